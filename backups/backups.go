@@ -0,0 +1,136 @@
+// Database backups kept in a directory under timestamped names, pruned down to the newest few,
+// and restoring one in place of the database.
+package backups
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	namePrefix = "bookmarks-"
+	nameSuffix = ".db"
+	// sorts in time order, and has nothing that's awkward in a file name
+	timeFormat = "20060102T150405Z"
+)
+
+type Backup struct {
+	Path string
+	Time time.Time
+}
+
+// The file name for a backup taken at t, like bookmarks-20261019T083000Z.db
+func Name(t time.Time) string {
+	return namePrefix + t.UTC().Format(timeFormat) + nameSuffix
+}
+
+// The backups in dir, oldest first. Other files in it are left alone.
+func List(dir string) ([]Backup, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("listing backups: %w", err)
+	}
+	backups := make([]Backup, 0)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, namePrefix) || !strings.HasSuffix(name, nameSuffix) {
+			continue
+		}
+		t, err := time.Parse(timeFormat, strings.TrimSuffix(strings.TrimPrefix(name, namePrefix), nameSuffix))
+		if err != nil {
+			continue
+		}
+		backups = append(backups, Backup{Path: filepath.Join(dir, name), Time: t})
+	}
+	sort.Slice(backups, func(i, j int) bool { return backups[i].Time.Before(backups[j].Time) })
+	return backups, nil
+}
+
+// Deletes all but the newest keep backups in dir, and returns the ones it deleted
+func Prune(dir string, keep int) ([]string, error) {
+	backups, err := List(dir)
+	if err != nil {
+		return nil, err
+	}
+	removed := make([]string, 0)
+	for len(backups) > keep {
+		err = os.Remove(backups[0].Path)
+		if err != nil {
+			return removed, fmt.Errorf("removing old backup: %w", err)
+		}
+		removed = append(removed, backups[0].Path)
+		backups = backups[1:]
+	}
+	return removed, nil
+}
+
+// Puts a copy of backupFile in place of dbFile, once check has passed on the copy.
+// Anything already at dbFile is moved aside rather than deleted, and its new name is returned.
+// Nothing can have the database open, which is checked by looking for its write-ahead log:
+// sqlite removes that when the last connection closes. It's also left behind if the server crashed,
+// and then it holds changes that haven't made it into the database file yet.
+func Restore(dbFile, backupFile string, check func(file string) error) (string, error) {
+	if _, err := os.Stat(dbFile + "-wal"); err == nil {
+		return "", fmt.Errorf("%s-wal exists, so either the server is still running or it didn't shut down cleanly. "+
+			"Stop the server if it's running. If it isn't, don't delete the file, since it has the latest changes in it: "+
+			"start and stop the server once, or run sqlite3 %s \"pragma wal_checkpoint(truncate)\", to write them to the database, "+
+			"and then restore again", dbFile, dbFile)
+	}
+	restoring := dbFile + ".restoring"
+	// left over from a restore that was interrupted
+	os.Remove(restoring)
+	err := copyFile(backupFile, restoring)
+	if err != nil {
+		os.Remove(restoring)
+		return "", err
+	}
+	err = check(restoring)
+	if err != nil {
+		os.Remove(restoring)
+		return "", err
+	}
+
+	movedAside := ""
+	if _, err := os.Stat(dbFile); err == nil {
+		movedAside = dbFile + ".before-restore-" + time.Now().UTC().Format(timeFormat)
+		err = os.Rename(dbFile, movedAside)
+		if err != nil {
+			os.Remove(restoring)
+			return "", fmt.Errorf("moving the old database aside: %w", err)
+		}
+	}
+	// the shared memory index belongs to the old database
+	os.Remove(dbFile + "-shm")
+	err = os.Rename(restoring, dbFile)
+	if err != nil {
+		return movedAside, fmt.Errorf("moving the backup into place: %w", err)
+	}
+	return movedAside, nil
+}
+
+// Copies from to a new file at to, and makes sure it's on disk
+func copyFile(from, to string) error {
+	in, err := os.Open(from)
+	if err != nil {
+		return fmt.Errorf("opening backup: %w", err)
+	}
+	defer in.Close()
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", to, err)
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if err != nil {
+		out.Close()
+		return fmt.Errorf("copying backup: %w", err)
+	}
+	return out.Close()
+}
@@ -0,0 +1,240 @@
+package backups
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+var start = time.Date(2026, 10, 19, 8, 30, 0, 0, time.UTC)
+
+func writeFile(t *testing.T, file, content string) {
+	t.Helper()
+	err := os.WriteFile(file, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func readFile(t *testing.T, file string) string {
+	t.Helper()
+	content, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+// Backups in a new directory, taken a day apart, along with some files that aren't backups
+func backupDir(t *testing.T, count int) string {
+	t.Helper()
+	dir := t.TempDir()
+	for i := 0; i < count; i++ {
+		writeFile(t, filepath.Join(dir, Name(start.AddDate(0, 0, i))), "")
+	}
+	for _, name := range []string{"notes.txt", "bookmarks-latest.db", "bookmarks-20261019T083000Z.db.partial"} {
+		writeFile(t, filepath.Join(dir, name), "")
+	}
+	os.Mkdir(filepath.Join(dir, Name(start.AddDate(-1, 0, 0))), 0700)
+	return dir
+}
+
+func names(t *testing.T, dir string) []string {
+	t.Helper()
+	backups, err := List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	result := make([]string, len(backups))
+	for i, backup := range backups {
+		result[i] = filepath.Base(backup.Path)
+	}
+	return result
+}
+
+func TestName(t *testing.T) {
+	local := time.Date(2026, 10, 19, 10, 30, 5, 0, time.FixedZone("CEST", 2*60*60))
+	if got := Name(local); got != "bookmarks-20261019T083005Z.db" {
+		t.Errorf("got %s", got)
+	}
+}
+
+func TestListSortsOldestFirst(t *testing.T) {
+	dir := t.TempDir()
+	for _, days := range []int{2, 0, 1} {
+		writeFile(t, filepath.Join(dir, Name(start.AddDate(0, 0, days))), "")
+	}
+	writeFile(t, filepath.Join(dir, "notes.txt"), "")
+	backups, err := List(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(backups) != 3 {
+		t.Fatalf("got %v", backups)
+	}
+	for i, backup := range backups {
+		if !backup.Time.Equal(start.AddDate(0, 0, i)) {
+			t.Errorf("backup %d is from %s", i, backup.Time)
+		}
+	}
+}
+
+func TestListMissingDir(t *testing.T) {
+	if _, err := List(filepath.Join(t.TempDir(), "missing")); err == nil {
+		t.Error("no error")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	tests := []struct {
+		count, keep int
+		removed     int
+	}{
+		{count: 10, keep: 7, removed: 3},
+		{count: 7, keep: 7, removed: 0},
+		{count: 3, keep: 7, removed: 0},
+		{count: 3, keep: 1, removed: 2},
+		{count: 0, keep: 7, removed: 0},
+	}
+	for _, test := range tests {
+		dir := backupDir(t, test.count)
+		removed, err := Prune(dir, test.keep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(removed) != test.removed {
+			t.Errorf("pruning %d down to %d removed %v", test.count, test.keep, removed)
+		}
+		want := make([]string, 0)
+		for i := test.removed; i < test.count; i++ {
+			want = append(want, Name(start.AddDate(0, 0, i)))
+		}
+		if got := names(t, dir); !reflect.DeepEqual(got, want) {
+			t.Errorf("pruning %d down to %d left %v, want %v", test.count, test.keep, got, want)
+		}
+		// only backups are pruned
+		entries, _ := os.ReadDir(dir)
+		if len(entries) != len(want)+4 {
+			t.Errorf("pruning %d down to %d left %d files", test.count, test.keep, len(entries))
+		}
+	}
+}
+
+func TestPruneKeepsRotating(t *testing.T) {
+	dir := t.TempDir()
+	for i := 0; i < 10; i++ {
+		writeFile(t, filepath.Join(dir, Name(start.AddDate(0, 0, i))), "")
+		if _, err := Prune(dir, 3); err != nil {
+			t.Fatal(err)
+		}
+	}
+	want := []string{Name(start.AddDate(0, 0, 7)), Name(start.AddDate(0, 0, 8)), Name(start.AddDate(0, 0, 9))}
+	if got := names(t, dir); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func accept(file string) error {
+	return nil
+}
+
+func TestRestore(t *testing.T) {
+	dir := t.TempDir()
+	dbFile := filepath.Join(dir, "bookmarks.db")
+	backupFile := filepath.Join(dir, Name(start))
+	writeFile(t, dbFile, "current")
+	writeFile(t, dbFile+"-shm", "index")
+	writeFile(t, backupFile, "backup")
+
+	movedAside, err := Restore(dbFile, backupFile, accept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, dbFile); got != "backup" {
+		t.Errorf("database has %q", got)
+	}
+	if got := readFile(t, backupFile); got != "backup" {
+		t.Errorf("backup has %q", got)
+	}
+	if !strings.HasPrefix(movedAside, dbFile+".before-restore-") || readFile(t, movedAside) != "current" {
+		t.Errorf("old database moved to %s", movedAside)
+	}
+	if _, err := os.Stat(dbFile + "-shm"); err == nil {
+		t.Error("the old shared memory index is still there")
+	}
+	if _, err := os.Stat(dbFile + ".restoring"); err == nil {
+		t.Error("the copy is still there")
+	}
+}
+
+func TestRestoreWithoutDatabase(t *testing.T) {
+	dir := t.TempDir()
+	dbFile := filepath.Join(dir, "bookmarks.db")
+	backupFile := filepath.Join(dir, Name(start))
+	writeFile(t, backupFile, "backup")
+	movedAside, err := Restore(dbFile, backupFile, accept)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if movedAside != "" || readFile(t, dbFile) != "backup" {
+		t.Errorf("moved aside %q", movedAside)
+	}
+}
+
+func TestRestoreChecksTheCopy(t *testing.T) {
+	dir := t.TempDir()
+	dbFile := filepath.Join(dir, "bookmarks.db")
+	backupFile := filepath.Join(dir, Name(start))
+	writeFile(t, dbFile, "current")
+	writeFile(t, backupFile, "backup")
+	var checked string
+	_, err := Restore(dbFile, backupFile, func(file string) error {
+		checked = file
+		return errors.New("corrupt")
+	})
+	if err == nil || err.Error() != "corrupt" {
+		t.Errorf("got %v", err)
+	}
+	if checked != dbFile+".restoring" {
+		t.Errorf("checked %s", checked)
+	}
+	if readFile(t, dbFile) != "current" {
+		t.Error("database was replaced")
+	}
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 2 {
+		t.Errorf("left %d files behind", len(entries))
+	}
+}
+
+func TestRestoreRefusesWithWriteAheadLog(t *testing.T) {
+	dir := t.TempDir()
+	dbFile := filepath.Join(dir, "bookmarks.db")
+	backupFile := filepath.Join(dir, Name(start))
+	writeFile(t, dbFile, "current")
+	writeFile(t, dbFile+"-wal", "changes")
+	writeFile(t, backupFile, "backup")
+	_, err := Restore(dbFile, backupFile, accept)
+	if err == nil || !strings.Contains(err.Error(), "didn't shut down cleanly") {
+		t.Errorf("got %v", err)
+	}
+	if readFile(t, dbFile) != "current" || readFile(t, dbFile+"-wal") != "changes" {
+		t.Error("database was changed")
+	}
+}
+
+func TestRestoreMissingBackup(t *testing.T) {
+	dir := t.TempDir()
+	dbFile := filepath.Join(dir, "bookmarks.db")
+	writeFile(t, dbFile, "current")
+	if _, err := Restore(dbFile, filepath.Join(dir, "missing.db"), accept); err == nil {
+		t.Error("no error")
+	}
+	if readFile(t, dbFile) != "current" {
+		t.Error("database was replaced")
+	}
+}
@@ -0,0 +1,167 @@
+// Serving TLS certificates from files that can be replaced while the server is running,
+// and making self-signed ones for trying things out.
+package certs
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"local/bookmarks/logging"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// Holds the certificate loaded from a pair of files, and loads it again when asked to or when the files change
+type Reloader struct {
+	certFile string
+	keyFile  string
+
+	mutex       sync.RWMutex
+	certificate *tls.Certificate
+	// modification times of the files the certificate was loaded from
+	certModified time.Time
+	keyModified  time.Time
+}
+
+func NewReloader(certFile, keyFile string) (*Reloader, error) {
+	r := &Reloader{certFile: certFile, keyFile: keyFile}
+	err := r.Reload()
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Loads the certificate from the files again. If they don't hold a valid certificate, the old one stays in use.
+func (r *Reloader) Reload() error {
+	certModified, keyModified, err := r.modTimes()
+	if err != nil {
+		return err
+	}
+	certificate, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("loading certificate: %w", err)
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.certificate = &certificate
+	r.certModified = certModified
+	r.keyModified = keyModified
+	return nil
+}
+
+func (r *Reloader) modTimes() (time.Time, time.Time, error) {
+	certInfo, err := os.Stat(r.certFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("reading certificate: %w", err)
+	}
+	keyInfo, err := os.Stat(r.keyFile)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("reading key: %w", err)
+	}
+	return certInfo.ModTime(), keyInfo.ModTime(), nil
+}
+
+// For tls.Config.GetCertificate
+func (r *Reloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.certificate, nil
+}
+
+// Checks the files every interval until ctx is done, and reloads the certificate when either of them changes.
+// Renewal tools usually replace the two files one after the other, so a failed reload is tried again next time.
+func (r *Reloader) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		certModified, keyModified, err := r.modTimes()
+		if err != nil {
+			logging.Errorf("checking certificate files: %s", err)
+			continue
+		}
+		r.mutex.RLock()
+		changed := !certModified.Equal(r.certModified) || !keyModified.Equal(r.keyModified)
+		r.mutex.RUnlock()
+		if !changed {
+			continue
+		}
+		err = r.Reload()
+		if err != nil {
+			logging.Errorf("reloading changed certificate: %s", err)
+			continue
+		}
+		logging.Infof("Reloaded certificate from %s", r.certFile)
+	}
+}
+
+// Writes a new self-signed certificate for the given host names and ips, and its private key, as PEM files.
+// Browsers will warn about it, so it's only good for development and trying things out.
+func GenerateSelfSigned(hosts []string, validFor time.Duration, certFile, keyFile string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generating key: %w", err)
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return fmt.Errorf("generating serial number: %w", err)
+	}
+	now := time.Now()
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: hosts[0]},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validFor),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else {
+			template.DNSNames = append(template.DNSNames, host)
+		}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return fmt.Errorf("creating certificate: %w", err)
+	}
+	keyDer, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return fmt.Errorf("encoding key: %w", err)
+	}
+
+	err = writePem(keyFile, "PRIVATE KEY", keyDer, 0600)
+	if err != nil {
+		return err
+	}
+	return writePem(certFile, "CERTIFICATE", der, 0644)
+}
+
+func writePem(file, blockType string, der []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return fmt.Errorf("creating %s: %w", file, err)
+	}
+	err = pem.Encode(f, &pem.Block{Type: blockType, Bytes: der})
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("writing %s: %w", file, err)
+	}
+	return f.Close()
+}
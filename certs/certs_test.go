@@ -0,0 +1,156 @@
+package certs
+
+import (
+	"context"
+	"crypto/x509"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Makes a self-signed certificate for host in dir, returning the certificate and key files
+func generate(t *testing.T, dir, host string) (string, string) {
+	t.Helper()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	err := GenerateSelfSigned([]string{host}, time.Hour, certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return certFile, keyFile
+}
+
+// The host name the reloader's certificate is for
+func servedHost(t *testing.T, r *Reloader) string {
+	t.Helper()
+	certificate, err := r.GetCertificate(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed.Subject.CommonName
+}
+
+func TestGenerateSelfSigned(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	err := GenerateSelfSigned([]string{"localhost", "127.0.0.1", "::1"}, 24*time.Hour, certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certificate, _ := r.GetCertificate(nil)
+	parsed, err := x509.ParseCertificate(certificate.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, host := range []string{"localhost", "127.0.0.1", "::1"} {
+		if err := parsed.VerifyHostname(host); err != nil {
+			t.Errorf("not valid for %s: %s", host, err)
+		}
+	}
+	if err := parsed.VerifyHostname("example.com"); err == nil {
+		t.Error("valid for example.com")
+	}
+	if until := time.Until(parsed.NotAfter); until > 24*time.Hour || until < 23*time.Hour {
+		t.Errorf("valid for another %s", until)
+	}
+
+	info, err := os.Stat(keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("key file has mode %s", info.Mode().Perm())
+	}
+}
+
+func TestNewReloaderNeedsACertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := generate(t, dir, "old.example.com")
+	if _, err := NewReloader(certFile, filepath.Join(dir, "missing.pem")); err == nil {
+		t.Error("loaded without a key")
+	}
+	// a key that doesn't go with the certificate
+	otherDir := t.TempDir()
+	_, otherKey := generate(t, otherDir, "other.example.com")
+	if _, err := NewReloader(certFile, otherKey); err == nil {
+		t.Error("loaded with the wrong key")
+	}
+	if _, err := NewReloader(certFile, keyFile); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := generate(t, dir, "old.example.com")
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	generate(t, dir, "new.example.com")
+	if host := servedHost(t, r); host != "old.example.com" {
+		t.Errorf("serving %s before reloading", host)
+	}
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if host := servedHost(t, r); host != "new.example.com" {
+		t.Errorf("serving %s after reloading", host)
+	}
+
+	// half way through a renewal, the old certificate stays in use
+	err = os.WriteFile(certFile, []byte("not a certificate"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Error("reloaded a broken certificate")
+	}
+	if host := servedHost(t, r); host != "new.example.com" {
+		t.Errorf("serving %s after a failed reload", host)
+	}
+}
+
+func TestWatchReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := generate(t, dir, "old.example.com")
+	r, err := NewReloader(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		r.Watch(ctx, 10*time.Millisecond)
+		close(stopped)
+	}()
+
+	generate(t, dir, "new.example.com")
+	// file systems can keep modification times to the second, so make sure the new files look changed
+	later := time.Now().Add(time.Minute)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+	deadline := time.Now().Add(5 * time.Second)
+	for servedHost(t, r) != "new.example.com" {
+		if time.Now().After(deadline) {
+			t.Fatal("changed certificate wasn't reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Error("watching didn't stop")
+	}
+}
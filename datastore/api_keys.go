@@ -2,65 +2,256 @@ package datastore
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
 	"encoding/hex"
 	"fmt"
+	"strings"
 	"time"
 )
 
 const apiKeySize = 32
 
+// How many characters of a key are kept in plaintext so that people can tell their keys apart
+const apiKeyPrefixSize = 8
+
+// Permissions that can be granted to an api key
+const (
+	ScopeBookmarkRead  = "bookmark:read"
+	ScopeBookmarkWrite = "bookmark:write"
+	ScopeExport        = "export"
+)
+
+var AllScopes = []string{ScopeBookmarkRead, ScopeBookmarkWrite, ScopeExport}
+
+// Only a hash of the key itself is stored, so the full key is never available after it's created
 type ApiKey struct {
-	Id   int64
-	Name string
-	Key  string
+	Id            int64
+	Name          string
+	Prefix        string
+	Scopes        []string
+	Expires       sql.NullTime
+	Disabled      bool
+	LastUsed      sql.NullTime
+	LastIp        string
+	LastUserAgent string
+	// Requests per day over the last keyUsageDays days, most recent first
+	Usage []KeyUsage
+}
+
+// Who is making a request, as shown on the api keys and sessions pages
+type Client struct {
+	Ip        string
+	UserAgent string
+}
+
+type KeyUsage struct {
+	Day   time.Time
+	Count int64
+}
+
+// How many days of usage ListKeys reports
+const keyUsageDays = 7
+
+// The format of api_key_usage.day
+const usageDayFormat = "2006-01-02"
+
+func (k ApiKey) HasScope(scope string) bool {
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
 }
 
-func (ds *Datastore) CreateKey(name string) error {
+func (k ApiKey) Expired() bool {
+	return k.Expires.Valid && time.Now().UTC().After(k.Expires.Time)
+}
+
+func IsScope(scope string) bool {
+	for _, s := range AllScopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// Keys are long random strings rather than passwords, so a fast hash is enough
+func hashKey(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// Creates a key with the given scopes, and returns it. This is the only time the key is available.
+// If expires is the zero time, the key never expires.
+func (ds *Datastore) CreateKey(name string, scopes []string, expires time.Time) (string, error) {
+	for _, scope := range scopes {
+		if !IsScope(scope) {
+			return "", fmt.Errorf("unknown scope %s", scope)
+		}
+	}
 	keyBytes := make([]byte, apiKeySize)
 	_, err := rand.Read(keyBytes)
 	if err != nil {
-		return fmt.Errorf("generating cookie: %w", err)
+		return "", fmt.Errorf("generating key: %w", err)
 	}
 	key := hex.EncodeToString(keyBytes)
 	timestamp := time.Now().UTC()
-	_, err = ds.db.Exec(`insert into api_key (name, key, timestamp) values (?, ?, ?)`, name, key, timestamp)
+	expiry := sql.NullTime{Time: expires.UTC(), Valid: !expires.IsZero()}
+	_, err = ds.db.Exec(`insert into api_key (name, key_hash, prefix, timestamp, scopes, expires) values (?, ?, ?, ?, ?, ?)`,
+		name, hashKey(key), key[:apiKeyPrefixSize], timestamp, strings.Join(scopes, " "), expiry)
 	if err != nil {
-		return fmt.Errorf("inserting key: %w", err)
+		return "", fmt.Errorf("inserting key: %w", err)
+	}
+	return key, nil
+}
+
+// Hashes the keys that were stored in plaintext before keys were hashed, and forgets the plaintext.
+// This runs in the same transaction as the migration that moves them into legacy_key, so they're never left there.
+func hashLegacyKeys(tx timedTx) error {
+	rows, err := tx.Query(`select id, legacy_key from api_key where legacy_key is not null`)
+	if err != nil {
+		return fmt.Errorf("finding legacy keys: %w", err)
+	}
+	legacyKeys := make(map[int64]string)
+	for rows.Next() {
+		var id int64
+		var key string
+		err = rows.Scan(&id, &key)
+		if err != nil {
+			rows.Close()
+			return fmt.Errorf("scanning row: %w", err)
+		}
+		legacyKeys[id] = key
+	}
+	rows.Close()
+
+	for id, key := range legacyKeys {
+		_, err = tx.Exec(`update api_key set key_hash = ?, legacy_key = null where id = ?`, hashKey(key), id)
+		if err != nil {
+			return fmt.Errorf("hashing key %d: %w", id, err)
+		}
 	}
 	return nil
 }
 
 func (ds *Datastore) ListKeys() ([]ApiKey, error) {
-	rows, err := ds.db.Query(`select id, name, key from api_key order by timestamp desc`)
+	rows, err := ds.db.Query(`select id, name, prefix, scopes, expires, disabled, last_used, last_ip, last_user_agent
+		from api_key order by timestamp desc`)
 	if err != nil {
 		return nil, fmt.Errorf("getting rows: %w", err)
 	}
+	defer rows.Close()
 	keys := make([]ApiKey, 0)
 	for rows.Next() {
 		var key ApiKey
-		err = rows.Scan(&key.Id, &key.Name, &key.Key)
+		var scopes string
+		err = rows.Scan(&key.Id, &key.Name, &key.Prefix, &scopes, &key.Expires,
+			&key.Disabled, &key.LastUsed, &key.LastIp, &key.LastUserAgent)
 		if err != nil {
 			return nil, fmt.Errorf("scanning row: %w", err)
 		}
+		key.Scopes = strings.Fields(scopes)
 		keys = append(keys, key)
 	}
+	rows.Close()
+
+	for i := range keys {
+		keys[i].Usage, err = ds.getKeyUsage(keys[i].Id)
+		if err != nil {
+			return nil, fmt.Errorf("getting usage of key %d: %w", keys[i].Id, err)
+		}
+	}
 	return keys, nil
 }
 
+func (ds *Datastore) getKeyUsage(keyId int64) ([]KeyUsage, error) {
+	since := time.Now().UTC().AddDate(0, 0, -keyUsageDays).Format(usageDayFormat)
+	rows, err := ds.db.Query(`select day, count from api_key_usage where key = ? and day > ? order by day desc`,
+		keyId, since)
+	if err != nil {
+		return nil, fmt.Errorf("getting rows: %w", err)
+	}
+	defer rows.Close()
+	usage := make([]KeyUsage, 0)
+	for rows.Next() {
+		var day string
+		var u KeyUsage
+		err = rows.Scan(&day, &u.Count)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		u.Day, err = time.Parse(usageDayFormat, day)
+		if err != nil {
+			return nil, fmt.Errorf("parsing day: %w", err)
+		}
+		usage = append(usage, u)
+	}
+	return usage, nil
+}
+
+func (ds *Datastore) SetKeyDisabled(key int64, disabled bool) error {
+	_, err := ds.db.Exec(`update api_key set disabled = ? where id = ?`, disabled, key)
+	return err
+}
+
+// Disables keys that haven't been used within maxIdle of now.
+// Keys that have never been used count as idle from when they were created.
+func (ds *Datastore) DisableIdleKeys(maxIdle time.Duration) (int64, error) {
+	cutoff := time.Now().UTC().Add(-maxIdle)
+	result, err := ds.db.Exec(`update api_key set disabled = 1
+		where not disabled and coalesce(last_used, timestamp) < ?`, cutoff)
+	if err != nil {
+		return 0, fmt.Errorf("disabling keys: %w", err)
+	}
+	return result.RowsAffected()
+}
+
 func (ds *Datastore) DeleteKey(key int64) error {
 	_, err := ds.db.Exec(`delete from api_key where id = ?`, key)
 	return err
 }
 
-func (ds *Datastore) CheckKey(key string) (string, bool, error) {
-	var name string
-	err := ds.db.QueryRow(`select name from api_key where key = ?`, key).Scan(&name)
+// Checks that the key exists, is enabled, hasn't expired, and has been granted the scope.
+// The first bool says whether the key exists at all, and the second whether it can be used for this scope.
+// If it can, the request is recorded against the key.
+func (ds *Datastore) CheckKey(key, scope string, client Client) (string, bool, bool, error) {
+	var apiKey ApiKey
+	var scopes string
+	err := ds.db.QueryRow(`select id, name, scopes, expires, disabled from api_key where key_hash = ?`, hashKey(key)).
+		Scan(&apiKey.Id, &apiKey.Name, &scopes, &apiKey.Expires, &apiKey.Disabled)
 	if err == sql.ErrNoRows {
-		return "", false, nil
+		return "", false, false, nil
 	}
 	if err != nil {
-		return "", false, fmt.Errorf("inserting key: %w", err)
+		return "", false, false, fmt.Errorf("finding key: %w", err)
+	}
+	apiKey.Scopes = strings.Fields(scopes)
+	if apiKey.Disabled || apiKey.Expired() || !apiKey.HasScope(scope) {
+		return apiKey.Name, true, false, nil
 	}
-	return name, true, nil
+
+	err = ds.recordKeyUse(apiKey.Id, client)
+	if err != nil {
+		return "", false, false, fmt.Errorf("recording key use: %w", err)
+	}
+	return apiKey.Name, true, true, nil
+}
+
+func (ds *Datastore) recordKeyUse(keyId int64, client Client) error {
+	now := time.Now().UTC()
+	_, err := ds.db.Exec(`update api_key set last_used = ?, last_ip = ?, last_user_agent = ? where id = ?`,
+		now, client.Ip, client.UserAgent, keyId)
+	if err != nil {
+		return fmt.Errorf("updating key: %w", err)
+	}
+	_, err = ds.db.Exec(`insert into api_key_usage (key, day, count) values (?, ?, 1)
+		on conflict (key, day) do update set count = count + 1`,
+		keyId, now.Format(usageDayFormat))
+	if err != nil {
+		return fmt.Errorf("counting request: %w", err)
+	}
+	return nil
 }
@@ -0,0 +1,178 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckKey(t *testing.T) {
+	ds := newTestDatastore(t)
+	write, err := ds.CreateKey("writer", []string{ScopeBookmarkWrite}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expired, err := ds.CreateKey("expired", []string{ScopeBookmarkWrite}, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	disabled, err := ds.CreateKey("disabled", []string{ScopeBookmarkWrite}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ds.ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if key.Name == "disabled" {
+			if err := ds.SetKeyDisabled(key.Id, true); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	tests := []struct {
+		name, key, scope string
+		known, allowed   bool
+	}{
+		{"allowed", write, ScopeBookmarkWrite, true, true},
+		{"wrong scope", write, ScopeExport, true, false},
+		{"expired", expired, ScopeBookmarkWrite, true, false},
+		{"disabled", disabled, ScopeBookmarkWrite, true, false},
+		{"unknown", "0123456789abcdef", ScopeBookmarkWrite, false, false},
+		{"empty", "", ScopeBookmarkWrite, false, false},
+	}
+	for _, test := range tests {
+		name, known, allowed, err := ds.CheckKey(test.key, test.scope, Client{Ip: "192.0.2.1", UserAgent: "test"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if known != test.known || allowed != test.allowed {
+			t.Errorf("%s: got known %t, allowed %t", test.name, known, allowed)
+		}
+		if known && name == "" {
+			t.Errorf("%s: no name", test.name)
+		}
+	}
+
+	// only the allowed call counts as a use
+	keys, err = ds.ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		used := key.Name == "writer"
+		if key.LastUsed.Valid != used || (len(key.Usage) == 1) != used {
+			t.Errorf("%s: last used %v, usage %+v", key.Name, key.LastUsed, key.Usage)
+		}
+		if used && (key.LastIp != "192.0.2.1" || key.LastUserAgent != "test" || key.Usage[0].Count != 1) {
+			t.Errorf("%s: got %+v", key.Name, key)
+		}
+	}
+}
+
+func TestCreateKeyRejectsUnknownScope(t *testing.T) {
+	ds := newTestDatastore(t)
+	if _, err := ds.CreateKey("key", []string{"everything"}, time.Time{}); err == nil {
+		t.Error("no error")
+	}
+}
+
+func keyNamed(t *testing.T, ds *Datastore, name string) ApiKey {
+	t.Helper()
+	keys, err := ds.ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range keys {
+		if key.Name == name {
+			return key
+		}
+	}
+	t.Fatalf("no key called %s", name)
+	return ApiKey{}
+}
+
+func TestKeyUsage(t *testing.T) {
+	ds := newTestDatastore(t)
+	key, err := ds.CreateKey("key", []string{ScopeExport}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := keyNamed(t, ds, "key").Id
+	// earlier days, one of them too long ago to be listed
+	now := time.Now().UTC()
+	for days, count := range map[int]int{2: 5, keyUsageDays + 1: 9} {
+		_, err = ds.db.Exec(`insert into api_key_usage (key, day, count) values (?, ?, ?)`,
+			id, now.AddDate(0, 0, -days).Format(usageDayFormat), count)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, client := range []Client{{"192.0.2.1", "first"}, {"192.0.2.2", "second"}, {"192.0.2.3", "third"}} {
+		if _, _, _, err := ds.CheckKey(key, ScopeExport, client); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	listed := keyNamed(t, ds, "key")
+	if listed.LastIp != "192.0.2.3" || listed.LastUserAgent != "third" || !listed.LastUsed.Valid {
+		t.Errorf("got last use %+v", listed)
+	}
+	if len(listed.Usage) != 2 || listed.Usage[0].Count != 3 || listed.Usage[1].Count != 5 {
+		t.Fatalf("got usage %+v", listed.Usage)
+	}
+	if listed.Usage[0].Day.Format(usageDayFormat) != now.Format(usageDayFormat) {
+		t.Errorf("got day %s", listed.Usage[0].Day)
+	}
+
+	if err := ds.DeleteKey(id); err != nil {
+		t.Fatal(err)
+	}
+	var rows int
+	if err := ds.db.QueryRow(`select count(*) from api_key_usage`).Scan(&rows); err != nil || rows != 0 {
+		t.Errorf("%d usage rows left after deleting the key, %v", rows, err)
+	}
+}
+
+func TestDisableIdleKeys(t *testing.T) {
+	ds := newTestDatastore(t)
+	names := []string{"used recently", "used long ago", "never used, new", "never used, old"}
+	keys := make(map[string]string)
+	for _, name := range names {
+		key, err := ds.CreateKey(name, []string{ScopeExport}, time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys[name] = key
+	}
+	for _, name := range []string{"used recently", "used long ago"} {
+		if _, _, _, err := ds.CheckKey(keys[name], ScopeExport, Client{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	longAgo := time.Now().UTC().AddDate(0, 0, -60)
+	_, err := ds.db.Exec(`update api_key set last_used = ? where name = 'used long ago'`, longAgo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.db.Exec(`update api_key set timestamp = ? where name in ('used long ago', 'never used, old')`, longAgo)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	disabled, err := ds.DisableIdleKeys(30 * 24 * time.Hour)
+	if err != nil || disabled != 2 {
+		t.Fatalf("disabled %d, %v", disabled, err)
+	}
+	for _, name := range names {
+		wantDisabled := name == "used long ago" || name == "never used, old"
+		if key := keyNamed(t, ds, name); key.Disabled != wantDisabled {
+			t.Errorf("%s: disabled is %t", name, key.Disabled)
+		}
+	}
+	// disabled keys aren't counted again
+	if disabled, err := ds.DisableIdleKeys(30 * 24 * time.Hour); err != nil || disabled != 0 {
+		t.Errorf("disabled %d more, %v", disabled, err)
+	}
+}
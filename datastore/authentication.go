@@ -7,44 +7,55 @@ import (
 	"fmt"
 	"net/http"
 	"time"
-
-	"golang.org/x/crypto/argon2"
 )
 
-const AuthCookieName = "bookmark_auth"
-const AuthCookieTtl = 30 * 24 * time.Hour // 30 days
+const authCookieName = "bookmark_auth"
+
+// Browsers only accept cookies with this prefix if they're secure, for the whole site, and not shared with subdomains
+const hostCookiePrefix = "__Host-"
+
+// Browsers only accept cookies with this prefix if they're secure, but they can be for part of the site
+const secureCookiePrefix = "__Secure-"
 const authCookieSize = 32
 const saltSize = 16
 const csrfTokenSize = 32
 
-func (ds *Datastore) AddUser(username, password string) error {
-	saltBytes, err := randomBytes(saltSize)
+func (ds *Datastore) AddUser(username, password string) (int64, error) {
+	hash, err := ds.newPasswordHash(password)
 	if err != nil {
-		return fmt.Errorf("creating salt: %w", err)
+		return 0, err
 	}
-	salt := base64.URLEncoding.EncodeToString(saltBytes)
-	hash := hashPassword(password, saltBytes)
+	result, err := ds.db.Exec(`insert into user (username, password_hash) values (?, ?)`, username, hash)
 	if err != nil {
-		return fmt.Errorf("hashing password: %w", err)
+		return 0, fmt.Errorf("inserting new user: %w", err)
 	}
-	_, err = ds.db.Exec(`insert into user (username, password_hash, salt) values (?, ?, ?)`, username, hash, salt)
+	userId, err := result.LastInsertId()
 	if err != nil {
-		return fmt.Errorf("inserting new user: %w", err)
+		return 0, fmt.Errorf("getting user id: %w", err)
 	}
-	return nil
+	return userId, nil
 }
 
-func (ds *Datastore) ChangeUserPassword(username, password string) error {
-	saltBytes, err := randomBytes(saltSize)
+// Adds a user who logs in some other way, like single sign-on. They have no password,
+// so they can't log in with the password form unless one is set for them later.
+func (ds *Datastore) AddExternalUser(username string) (int64, error) {
+	result, err := ds.db.Exec(`insert into user (username) values (?)`, username)
 	if err != nil {
-		return fmt.Errorf("creating salt: %w", err)
+		return 0, fmt.Errorf("inserting new user: %w", err)
 	}
-	salt := base64.URLEncoding.EncodeToString(saltBytes)
-	hash := hashPassword(password, saltBytes)
+	userId, err := result.LastInsertId()
 	if err != nil {
-		return fmt.Errorf("hashing password: %w", err)
+		return 0, fmt.Errorf("getting user id: %w", err)
 	}
-	_, err = ds.db.Exec(`update user set password_hash = ?, salt = ? where username = ?`, hash, salt, username)
+	return userId, nil
+}
+
+func (ds *Datastore) ChangeUserPassword(username, password string) error {
+	hash, err := ds.newPasswordHash(password)
+	if err != nil {
+		return err
+	}
+	_, err = ds.db.Exec(`update user set password_hash = ?, salt = null where username = ?`, hash, username)
 	if err != nil {
 		return fmt.Errorf("updating user: %w", err)
 	}
@@ -60,12 +71,6 @@ func randomBytes(bytes int) ([]byte, error) {
 	return output, nil
 }
 
-func hashPassword(password string, salt []byte) string {
-	dk := argon2.Key([]byte(password), salt, 3, 32*1024, 4, 32)
-	hash := base64.URLEncoding.EncodeToString(dk)
-	return hash
-}
-
 func (ds *Datastore) ListUsers() ([]string, error) {
 	rows, err := ds.db.Query(`select username from user`)
 	if err != nil {
@@ -92,33 +97,38 @@ func (ds *Datastore) UserExists(username string) (int64, bool, error) {
 	return userId, true, nil
 }
 
+// Checks a username and password. If the password is right but its hash was made with
+// other parameters than new ones are, it's rehashed while the password is at hand.
 func (ds *Datastore) AuthenticateUser(username, password string) (int64, bool, error) {
 	var userId int64
-	var stored_hash string
-	var salt string
-	err := ds.db.QueryRow(`select id, password_hash, salt from user where username = ?`, username).
-		Scan(&userId, &stored_hash, &salt)
+	var storedHash sql.NullString
+	err := ds.db.QueryRow(`select id, password_hash from user where username = ? and not disabled`, username).
+		Scan(&userId, &storedHash)
 	if err == sql.ErrNoRows {
 		return 0, false, nil
 	}
 	if err != nil {
 		return 0, false, fmt.Errorf("finding user: %w", err)
 	}
-
-	saltBytes, err := base64.URLEncoding.DecodeString(salt)
-	if err != nil {
-		return 0, false, fmt.Errorf("decoding salt: %w", err)
+	// users added by single sign-on don't have a password
+	if !storedHash.Valid {
+		return 0, false, nil
 	}
-	new_hash := hashPassword(password, saltBytes)
+
+	correct, outdated, err := ds.checkPassword(storedHash.String, password)
 	if err != nil {
-		return 0, false, fmt.Errorf("hashing password: %w", err)
+		return 0, false, fmt.Errorf("checking password: %w", err)
 	}
-
-	if stored_hash == new_hash {
-		return userId, true, nil
-	} else {
+	if !correct {
 		return 0, false, nil
 	}
+	if outdated {
+		err = ds.rehashPassword(userId, storedHash.String, password)
+		if err != nil {
+			return 0, false, fmt.Errorf("rehashing password: %w", err)
+		}
+	}
+	return userId, true, nil
 }
 
 func (ds *Datastore) RemoveUser(username string) error {
@@ -126,7 +136,86 @@ func (ds *Datastore) RemoveUser(username string) error {
 	return err
 }
 
-func (ds *Datastore) CreateSession(user int64) (http.Cookie, error) {
+// How long sessions last, and how their cookies are sent
+type SessionPolicy struct {
+	// How long a session lasts after logging in, however much it's used
+	MaxAge time.Duration
+	// How long a session lasts without being used. Zero means sessions only end after MaxAge.
+	IdleTimeout time.Duration
+	// Whether cookies are only sent over https. Turning this off is only meant for local development.
+	Secure bool
+	// The path cookies are sent for, like /bookmarks-app when serving under a base path. Empty means the whole site.
+	Path string
+}
+
+var DefaultSessionPolicy = SessionPolicy{MaxAge: 30 * 24 * time.Hour, Secure: true}
+
+func (ds *Datastore) SetSessionPolicy(policy SessionPolicy) {
+	ds.sessionPolicy = policy
+}
+
+func (ds *Datastore) SessionPolicy() SessionPolicy {
+	return ds.sessionPolicy
+}
+
+// The session cookie gets the __Host- prefix whenever it's secure, so it can't be planted by a subdomain.
+// That prefix needs the cookie to be for the whole site, so under a base path it gets __Secure- instead.
+func (ds *Datastore) SessionCookieName() string {
+	if !ds.sessionPolicy.Secure {
+		return authCookieName
+	}
+	if ds.sessionCookiePath() != "/" {
+		return secureCookiePrefix + authCookieName
+	}
+	return hostCookiePrefix + authCookieName
+}
+
+func (ds *Datastore) sessionCookiePath() string {
+	if ds.sessionPolicy.Path == "" {
+		return "/"
+	}
+	return ds.sessionPolicy.Path
+}
+
+func (ds *Datastore) sessionCookie(value string, expires time.Time) http.Cookie {
+	return http.Cookie{
+		Name:     ds.SessionCookieName(),
+		Value:    value,
+		Path:     ds.sessionCookiePath(),
+		Expires:  expires,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   ds.sessionPolicy.Secure,
+	}
+}
+
+// A cookie that deletes the session cookie from the browser
+func (ds *Datastore) ExpiredSessionCookie() http.Cookie {
+	cookie := ds.sessionCookie("", time.Time{})
+	cookie.MaxAge = -1
+	return cookie
+}
+
+// When a session ends if it isn't used again: MaxAge after it was created, or sooner if it goes idle
+func (ds *Datastore) sessionExpiry(created, lastSeen time.Time) time.Time {
+	expires := created.Add(ds.sessionPolicy.MaxAge)
+	if ds.sessionPolicy.IdleTimeout > 0 && lastSeen.Add(ds.sessionPolicy.IdleTimeout).Before(expires) {
+		expires = lastSeen.Add(ds.sessionPolicy.IdleTimeout)
+	}
+	return expires
+}
+
+// Sessions created before the first cutoff, or last seen before the second, have expired
+func (ds *Datastore) sessionCutoffs() (time.Time, time.Time) {
+	now := time.Now().UTC()
+	var idleCutoff time.Time
+	if ds.sessionPolicy.IdleTimeout > 0 {
+		idleCutoff = now.Add(-ds.sessionPolicy.IdleTimeout)
+	}
+	return now.Add(-ds.sessionPolicy.MaxAge), idleCutoff
+}
+
+func (ds *Datastore) CreateSession(user int64, client Client) (http.Cookie, error) {
 	cookieBytes, err := randomBytes(authCookieSize)
 	if err != nil {
 		return http.Cookie{}, fmt.Errorf("generating cookie: %w", err)
@@ -138,56 +227,149 @@ func (ds *Datastore) CreateSession(user int64) (http.Cookie, error) {
 	}
 	csrf := base64.URLEncoding.EncodeToString(csrfBytes)
 	timestamp := time.Now().UTC()
-	_, err = ds.db.Exec(`insert into session (user, timestamp, cookie, csrf) values (?, ?, ?, ?)`,
-		user, timestamp, cookie, csrf)
+	_, err = ds.db.Exec(`insert into session (user, timestamp, cookie, csrf, last_seen, ip, user_agent)
+		values (?, ?, ?, ?, ?, ?, ?)`,
+		user, timestamp, cookie, csrf, timestamp, client.Ip, client.UserAgent)
 	if err != nil {
 		return http.Cookie{}, fmt.Errorf("inserting session: %w", err)
 	}
-	return http.Cookie{
-		Name:     AuthCookieName,
-		Value:    cookie,
-		Expires:  timestamp.Add(AuthCookieTtl),
-		SameSite: http.SameSiteLaxMode,
-		Secure:   true,
-	}, nil
+	return ds.sessionCookie(cookie, ds.sessionExpiry(timestamp, timestamp)), nil
 }
 
 type Session struct {
+	Id        int64
 	UserId    int64
 	Username  string
+	Admin     bool
 	CsrfToken string
+	Created   time.Time
+	LastSeen  time.Time
+	cookie    string
 }
 
+// Finds the session for a cookie. Sessions that have expired are deleted, and aren't valid.
 func (ds *Datastore) GetSession(cookie string) (Session, bool, error) {
-	var user int64
-	var timestamp time.Time
-	var csrf string
-	err := ds.db.QueryRow(`select user, timestamp, csrf from session where cookie = ?`, cookie).Scan(&user, &timestamp, &csrf)
+	session := Session{cookie: cookie}
+	var lastSeen sql.NullTime
+	err := ds.db.QueryRow(`select id, user, timestamp, last_seen, csrf from session where cookie = ?`, cookie).
+		Scan(&session.Id, &session.UserId, &session.Created, &lastSeen, &session.CsrfToken)
 	if err == sql.ErrNoRows {
 		return Session{}, false, nil
 	}
 	if err != nil {
 		return Session{}, false, fmt.Errorf("getting session: %w", err)
 	}
+	session.LastSeen = session.Created
+	if lastSeen.Valid {
+		session.LastSeen = lastSeen.Time
+	}
 
-	if time.Now().UTC().Sub(timestamp) > AuthCookieTtl {
-		_, err := ds.db.Exec(`delete from session where cookie = ?`, cookie)
+	if time.Now().UTC().After(ds.sessionExpiry(session.Created, session.LastSeen)) {
+		_, err := ds.db.Exec(`delete from session where id = ?`, session.Id)
 		if err != nil {
-			return Session{}, false, fmt.Errorf("deleting expired cookie: %w", err)
+			return Session{}, false, fmt.Errorf("deleting expired session: %w", err)
 		}
-		return Session{}, false, fmt.Errorf("expired cookie")
+		return Session{}, false, nil
 	}
 
-	var username string
-	err = ds.db.QueryRow(`select username from user where id = ?`, user).Scan(&username)
+	var disabled bool
+	err = ds.db.QueryRow(`select username, admin, disabled from user where id = ?`, session.UserId).
+		Scan(&session.Username, &session.Admin, &disabled)
 	if err != nil {
 		return Session{}, false, fmt.Errorf("getting username: %w", err)
 	}
-	return Session{user, username, csrf}, true, nil
+	if disabled {
+		return Session{}, false, nil
+	}
+	return session, true, nil
+}
+
+// How often a session's last seen time is updated, so that every request doesn't have to write to the database
+const sessionTouchInterval = time.Minute
+
+// Records that a session has just been used, and where from. When sessions time out while idle,
+// this returns a renewed cookie that lasts until the new idle timeout, or nil if it hasn't changed.
+func (ds *Datastore) TouchSession(session Session, client Client) (*http.Cookie, error) {
+	now := time.Now().UTC()
+	result, err := ds.db.Exec(`update session set last_seen = ?, ip = ?, user_agent = ?
+		where id = ? and (last_seen is null or last_seen < ? or ip != ? or user_agent != ?)`,
+		now, client.Ip, client.UserAgent, session.Id, now.Add(-sessionTouchInterval), client.Ip, client.UserAgent)
+	if err != nil {
+		return nil, fmt.Errorf("updating session: %w", err)
+	}
+	touched, err := result.RowsAffected()
+	if err != nil {
+		return nil, fmt.Errorf("updating session: %w", err)
+	}
+	if touched == 0 || ds.sessionPolicy.IdleTimeout == 0 {
+		return nil, nil
+	}
+	cookie := ds.sessionCookie(session.cookie, ds.sessionExpiry(session.Created, now))
+	return &cookie, nil
+}
+
+// A session as shown on the sessions page
+type SessionInfo struct {
+	Id        int64
+	Created   time.Time
+	LastSeen  sql.NullTime
+	Ip        string
+	UserAgent string
+}
+
+// Lists the user's sessions, most recently used first
+func (ds *Datastore) ListSessions(user int64) ([]SessionInfo, error) {
+	createdCutoff, idleCutoff := ds.sessionCutoffs()
+	rows, err := ds.db.Query(`select id, timestamp, last_seen, ip, user_agent from session
+		where user = ? and timestamp >= ? and coalesce(last_seen, timestamp) >= ?
+		order by coalesce(last_seen, timestamp) desc`, user, createdCutoff, idleCutoff)
+	if err != nil {
+		return nil, fmt.Errorf("listing sessions: %w", err)
+	}
+	defer rows.Close()
+	sessions := make([]SessionInfo, 0)
+	for rows.Next() {
+		var session SessionInfo
+		err = rows.Scan(&session.Id, &session.Created, &session.LastSeen, &session.Ip, &session.UserAgent)
+		if err != nil {
+			return nil, fmt.Errorf("scanning session: %w", err)
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// Logs out the session with this cookie
+func (ds *Datastore) DeleteSession(cookie string) error {
+	_, err := ds.db.Exec(`delete from session where cookie = ?`, cookie)
+	if err != nil {
+		return fmt.Errorf("deleting session: %w", err)
+	}
+	return nil
+}
+
+// Logs out one of the user's sessions
+func (ds *Datastore) RevokeSession(user, id int64) error {
+	_, err := ds.db.Exec(`delete from session where user = ? and id = ?`, user, id)
+	if err != nil {
+		return fmt.Errorf("deleting session: %w", err)
+	}
+	return nil
+}
+
+// Logs the user out everywhere
+func (ds *Datastore) RevokeAllSessions(user int64) error {
+	_, err := ds.db.Exec(`delete from session where user = ?`, user)
+	if err != nil {
+		return fmt.Errorf("deleting sessions: %w", err)
+	}
+	return nil
 }
 
-func (ds *Datastore) CleanUpSessions(ttl time.Duration) error {
-	oldestAllowed := time.Now().UTC().Add(-ttl)
-	_, err := ds.db.Exec(`delete from session where timestamp < ?`, oldestAllowed)
+// Deletes every session that has expired under the session policy
+func (ds *Datastore) CleanUpSessions() error {
+	createdCutoff, idleCutoff := ds.sessionCutoffs()
+	_, err := ds.db.Exec(`delete from session where timestamp < ? or coalesce(last_seen, timestamp) < ?`,
+		createdCutoff, idleCutoff)
 	return err
 }
@@ -0,0 +1,182 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionCookieScope(t *testing.T) {
+	tests := []struct {
+		name     string
+		secure   bool
+		path     string
+		wantName string
+		wantPath string
+	}{
+		{"secure at the root", true, "", "__Host-bookmark_auth", "/"},
+		{"secure under a base path", true, "/bookmarks-app", "__Secure-bookmark_auth", "/bookmarks-app"},
+		{"insecure at the root", false, "", "bookmark_auth", "/"},
+		{"insecure under a base path", false, "/bookmarks-app", "bookmark_auth", "/bookmarks-app"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ds := newTestDatastore(t)
+			ds.SetSessionPolicy(SessionPolicy{MaxAge: time.Hour, Secure: test.secure, Path: test.path})
+			user := addTestUser(t, ds, "someone")
+			cookie, err := ds.CreateSession(user, Client{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			expired := ds.ExpiredSessionCookie()
+			for _, c := range []struct{ Name, Path string }{{cookie.Name, cookie.Path}, {expired.Name, expired.Path}} {
+				if c.Name != test.wantName || c.Path != test.wantPath {
+					t.Errorf("got cookie %s for %s, want %s for %s", c.Name, c.Path, test.wantName, test.wantPath)
+				}
+			}
+			if ds.SessionCookieName() != test.wantName {
+				t.Errorf("looking for cookie %s, want %s", ds.SessionCookieName(), test.wantName)
+			}
+			if cookie.Secure != test.secure {
+				t.Errorf("secure is %t", cookie.Secure)
+			}
+		})
+	}
+}
+
+// Moves a session's creation and last use back in time
+func ageSession(t *testing.T, ds *Datastore, cookie string, created, lastSeen time.Duration) {
+	t.Helper()
+	now := time.Now().UTC()
+	_, err := ds.db.Exec(`update session set timestamp = ?, last_seen = ? where cookie = ?`,
+		now.Add(-created), now.Add(-lastSeen), cookie)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSessionExpiry(t *testing.T) {
+	tests := []struct {
+		name        string
+		idleTimeout time.Duration
+		created     time.Duration
+		lastSeen    time.Duration
+		valid       bool
+	}{
+		{"new", 10 * time.Minute, 0, 0, true},
+		{"in use", 10 * time.Minute, 50 * time.Minute, 5 * time.Minute, true},
+		{"idle", 10 * time.Minute, 50 * time.Minute, 11 * time.Minute, false},
+		{"too old, however recently used", 10 * time.Minute, 61 * time.Minute, 0, false},
+		{"no idle timeout", 0, 50 * time.Minute, 50 * time.Minute, true},
+		{"too old with no idle timeout", 0, 61 * time.Minute, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ds := newTestDatastore(t)
+			ds.SetSessionPolicy(SessionPolicy{MaxAge: time.Hour, IdleTimeout: test.idleTimeout})
+			user := addTestUser(t, ds, "someone")
+			cookie, err := ds.CreateSession(user, Client{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			ageSession(t, ds, cookie.Value, test.created, test.lastSeen)
+
+			_, valid, err := ds.GetSession(cookie.Value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if valid != test.valid {
+				t.Errorf("got valid %t", valid)
+			}
+			var rows int
+			ds.db.QueryRow(`select count(*) from session`).Scan(&rows)
+			if valid && rows != 1 || !valid && rows != 0 {
+				t.Errorf("%d sessions left after looking one up", rows)
+			}
+		})
+	}
+}
+
+func TestNewSessionCookieExpiry(t *testing.T) {
+	ds := newTestDatastore(t)
+	user := addTestUser(t, ds, "someone")
+	for _, policy := range []struct {
+		idleTimeout time.Duration
+		want        time.Duration
+	}{{0, time.Hour}, {10 * time.Minute, 10 * time.Minute}} {
+		ds.SetSessionPolicy(SessionPolicy{MaxAge: time.Hour, IdleTimeout: policy.idleTimeout})
+		cookie, err := ds.CreateSession(user, Client{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !near(cookie.Expires, time.Now().Add(policy.want)) {
+			t.Errorf("idle timeout %s: cookie expires %s", policy.idleTimeout, cookie.Expires)
+		}
+		if !cookie.HttpOnly {
+			t.Error("cookie can be read by scripts")
+		}
+	}
+}
+
+func TestTouchSessionRenewsIdleSessions(t *testing.T) {
+	ds := newTestDatastore(t)
+	ds.SetSessionPolicy(SessionPolicy{MaxAge: time.Hour, IdleTimeout: 10 * time.Minute})
+	user := addTestUser(t, ds, "someone")
+	cookie, err := ds.CreateSession(user, Client{Ip: "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ageSession(t, ds, cookie.Value, 30*time.Minute, 5*time.Minute)
+	session, _, err := ds.GetSession(cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	renewed, err := ds.TouchSession(session, Client{Ip: "192.0.2.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed == nil || renewed.Value != cookie.Value || !near(renewed.Expires, time.Now().Add(10*time.Minute)) {
+		t.Fatalf("got renewed cookie %v", renewed)
+	}
+	// now it's used again, so it's good for another ten minutes, even though it was last seen five minutes ago
+	session, _, _ = ds.GetSession(cookie.Value)
+	if !near(session.LastSeen, time.Now()) {
+		t.Errorf("last seen %s", session.LastSeen)
+	}
+
+	// it isn't written again straight away, unless it's used from somewhere else
+	renewed, err = ds.TouchSession(session, Client{Ip: "192.0.2.1"})
+	if err != nil || renewed != nil {
+		t.Errorf("touched again straight away: %v, %v", renewed, err)
+	}
+	renewed, err = ds.TouchSession(session, Client{Ip: "198.51.100.1"})
+	if err != nil || renewed == nil {
+		t.Errorf("not touched from a new ip: %v, %v", renewed, err)
+	}
+	sessions, _ := ds.ListSessions(user)
+	if len(sessions) != 1 || sessions[0].Ip != "198.51.100.1" {
+		t.Errorf("got sessions %+v", sessions)
+	}
+}
+
+func TestTouchSessionWithoutIdleTimeout(t *testing.T) {
+	ds := newTestDatastore(t)
+	ds.SetSessionPolicy(SessionPolicy{MaxAge: time.Hour})
+	user := addTestUser(t, ds, "someone")
+	cookie, err := ds.CreateSession(user, Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ageSession(t, ds, cookie.Value, 30*time.Minute, 30*time.Minute)
+	session, _, _ := ds.GetSession(cookie.Value)
+
+	// the cookie already lasts as long as the session can
+	renewed, err := ds.TouchSession(session, Client{})
+	if err != nil || renewed != nil {
+		t.Errorf("got renewed cookie %v, %v", renewed, err)
+	}
+	session, _, _ = ds.GetSession(cookie.Value)
+	if !near(session.LastSeen, time.Now()) {
+		t.Errorf("last seen %s", session.LastSeen)
+	}
+}
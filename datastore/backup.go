@@ -0,0 +1,76 @@
+package datastore
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Writes a consistent snapshot of the database to file, which mustn't exist yet, while other connections carry on.
+// The snapshot is written under a temporary name first, so a file with the final name is always complete.
+func (ds *Datastore) Backup(file string) error {
+	if _, err := os.Stat(file); err == nil {
+		return fmt.Errorf("%s already exists", file)
+	}
+	partial := file + ".partial"
+	// left over from a backup that was interrupted
+	os.Remove(partial)
+	_, err := ds.db.Exec(`vacuum into ?`, partial)
+	if err != nil {
+		os.Remove(partial)
+		return fmt.Errorf("writing backup: %w", err)
+	}
+	err = os.Rename(partial, file)
+	if err != nil {
+		os.Remove(partial)
+		return fmt.Errorf("renaming backup: %w", err)
+	}
+	return nil
+}
+
+// Checks that file is an intact sqlite database that's been set up by this app, without changing it
+func CheckIntegrity(file string) error {
+	if _, err := os.Stat(file); err != nil {
+		return err
+	}
+	dsn, err := fileUri(file, "mode=ro")
+	if err != nil {
+		return err
+	}
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return fmt.Errorf("opening %s: %w", file, err)
+	}
+	defer db.Close()
+
+	rows, err := db.Query(`pragma integrity_check`)
+	if err != nil {
+		return fmt.Errorf("checking integrity of %s: %w", file, err)
+	}
+	defer rows.Close()
+	problems := make([]string, 0)
+	for rows.Next() {
+		var problem string
+		err = rows.Scan(&problem)
+		if err != nil {
+			return fmt.Errorf("checking integrity of %s: %w", file, err)
+		}
+		if problem != "ok" {
+			problems = append(problems, problem)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return fmt.Errorf("checking integrity of %s: %w", file, err)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("%s is corrupt: %s", file, strings.Join(problems, "; "))
+	}
+
+	var migrations int
+	err = db.QueryRow(`select count(*) from _migration`).Scan(&migrations)
+	if err != nil || migrations == 0 {
+		return fmt.Errorf("%s isn't a bookmarks database", file)
+	}
+	return nil
+}
@@ -0,0 +1,77 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestBackup(t *testing.T) {
+	ds := newTestDatastore(t)
+	addTestUser(t, ds, "someone")
+	// characters that mean something in a uri
+	file := filepath.Join(t.TempDir(), "a?b#c%20d.db")
+	err := ds.Backup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(file + ".partial"); err == nil {
+		t.Error("partial backup left behind")
+	}
+	err = CheckIntegrity(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backup, err := Connect(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backup.Close()
+	var username string
+	err = backup.db.QueryRow(`select username from user`).Scan(&username)
+	if err != nil || username != "someone" {
+		t.Errorf("got %q, %v", username, err)
+	}
+}
+
+func TestBackupWontOverwrite(t *testing.T) {
+	ds := newTestDatastore(t)
+	file := filepath.Join(t.TempDir(), "backup.db")
+	err := os.WriteFile(file, []byte("something else"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.Backup(file); err == nil {
+		t.Error("no error")
+	}
+	if content, _ := os.ReadFile(file); string(content) != "something else" {
+		t.Error("overwritten")
+	}
+}
+
+func TestCheckIntegrityRejects(t *testing.T) {
+	dir := t.TempDir()
+	garbage := filepath.Join(dir, "garbage.db")
+	err := os.WriteFile(garbage, []byte("not a database at all, just some text that's long enough"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := Connect(filepath.Join(dir, "other.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = other.db.Exec(`create table thing (id integer)`)
+	other.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range []string{garbage, filepath.Join(dir, "other.db"), filepath.Join(dir, "missing.db")} {
+		if err := CheckIntegrity(file); err == nil {
+			t.Errorf("%s passed", filepath.Base(file))
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing.db")); err == nil {
+		t.Error("checking created the missing file")
+	}
+}
@@ -5,12 +5,18 @@ import (
 	"database/sql"
 	"encoding/json"
 	"fmt"
+	"net/url"
+	"path/filepath"
 	"strings"
 	"time"
 )
 
 type Datastore struct {
-	db *sql.DB
+	db             timedDB
+	passwordParams PasswordParams
+	sessionPolicy  SessionPolicy
+	// set once RunMigrations has brought the schema up to date
+	migrated bool
 }
 
 type Bookmark struct {
@@ -20,6 +26,9 @@ type Bookmark struct {
 	Url         string    `json:"url"`
 	Description string    `json:"description"`
 	Tags        []string  `json:"tags"`
+	Favorite    bool      `json:"favorite"`
+	// Only filled in by GetBookmark and Export
+	Highlights []Highlight `json:"highlights"`
 }
 
 type QueryInfo struct {
@@ -30,6 +39,9 @@ type QueryInfo struct {
 	Tags    []string
 }
 
+// Columns to select when scanning a row into a Bookmark with scanBookmark
+const bookmarkColumns = `bookmark.id, bookmark.name, url, date, description, favorite`
+
 func NewQueryInfo(pageSize int64) QueryInfo {
 	return QueryInfo{
 		Reverse: false,
@@ -40,19 +52,54 @@ func NewQueryInfo(pageSize int64) QueryInfo {
 	}
 }
 
+// How long queries wait for another connection's write lock before giving up
+const busyTimeout = 30 * time.Second
+
 func Connect(file string) (Datastore, error) {
-	address := fmt.Sprintf("file:%s?_foreign_keys=ON&_journal_mode=WAL&_busy_timeout=30000", file)
+	address, err := fileUri(file, fmt.Sprintf("_foreign_keys=ON&_journal_mode=WAL&_busy_timeout=%d", busyTimeout.Milliseconds()))
+	if err != nil {
+		return Datastore{}, err
+	}
 	db, err := sql.Open("sqlite3", address)
 	if err != nil {
 		return Datastore{}, fmt.Errorf("unable to open sqlite3 connection: %w", err)
 	}
-	return Datastore{db}, nil
+	return Datastore{
+		db:             timedDB{db},
+		passwordParams: DefaultPasswordParams,
+		sessionPolicy:  DefaultSessionPolicy,
+	}, nil
+}
+
+// A uri for opening file with the given query parameters. The path is escaped, so characters
+// like ? # and % in it are taken literally.
+func fileUri(file, query string) (string, error) {
+	path, err := filepath.Abs(file)
+	if err != nil {
+		return "", fmt.Errorf("finding %s: %w", file, err)
+	}
+	path = filepath.ToSlash(path)
+	// windows paths start with a drive letter, which sqlite wants after a slash, like file:///C:/bookmarks.db
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return (&url.URL{Scheme: "file", Path: path, RawQuery: query}).String(), nil
+}
+
+// Moves everything in the write-ahead log into the database file, then closes the database
+func (ds *Datastore) Close() error {
+	_, err := ds.db.Exec(`pragma wal_checkpoint(TRUNCATE)`)
+	if err != nil {
+		ds.db.Close()
+		return fmt.Errorf("checkpointing wal: %w", err)
+	}
+	return ds.db.Close()
 }
 
 func (ds *Datastore) GetBookmark(id int64) (Bookmark, error) {
 	var result Bookmark
-	err := ds.db.QueryRow(`select * from bookmark where id=?`, id).
-		Scan(&result.Id, &result.Name, &result.Url, &result.Date, &result.Description)
+	err := ds.db.QueryRow(`select `+bookmarkColumns+` from bookmark where id=?`, id).
+		Scan(&result.Id, &result.Name, &result.Url, &result.Date, &result.Description, &result.Favorite)
 	if err != nil {
 		return result, fmt.Errorf("retrieving bookmark: %w", err)
 	}
@@ -60,16 +107,20 @@ func (ds *Datastore) GetBookmark(id int64) (Bookmark, error) {
 	if err != nil {
 		return result, fmt.Errorf("retrieving tags: %w", err)
 	}
+	result.Highlights, err = ds.getBookmarkHighlights(id)
+	if err != nil {
+		return result, fmt.Errorf("retrieving highlights: %w", err)
+	}
 	return result, nil
 }
 
-func (ds *Datastore) CreateBookmark(name, url, description string, tags []string) error {
+func (ds *Datastore) CreateBookmark(name, url, description string, tags []string) (int64, error) {
 	date := time.Now().UTC()
 	ctx, stop := context.WithCancel(context.Background())
 	tx, err := ds.db.BeginTx(ctx, nil)
 	if err != nil {
 		stop()
-		return fmt.Errorf("beginning transaction: %w", err)
+		return 0, fmt.Errorf("beginning transaction: %w", err)
 	}
 
 	result, err := tx.Exec(
@@ -77,27 +128,27 @@ func (ds *Datastore) CreateBookmark(name, url, description string, tags []string
 		name, date, url, description)
 	if err != nil {
 		stop()
-		return fmt.Errorf("inserting bookmark: %w", err)
+		return 0, fmt.Errorf("inserting bookmark: %w", err)
 	}
 
 	bookmarkId, err := result.LastInsertId()
 	if err != nil {
 		stop()
-		return fmt.Errorf("getting bookmark id: %w", err)
+		return 0, fmt.Errorf("getting bookmark id: %w", err)
 	}
 
 	err = setBookmarkTags(bookmarkId, tags, tx)
 	if err != nil {
 		stop()
-		return fmt.Errorf("setting tags: %w", err)
+		return 0, fmt.Errorf("setting tags: %w", err)
 	}
 
 	err = tx.Commit()
 	stop()
 	if err != nil {
-		return fmt.Errorf("committing transaction: %w", err)
+		return 0, fmt.Errorf("committing transaction: %w", err)
 	}
-	return err
+	return bookmarkId, nil
 }
 
 func (ds *Datastore) UpdateBookmark(id int64, name, url, description string, tags []string) error {
@@ -155,16 +206,16 @@ func (ds *Datastore) GetBookmarks(info QueryInfo) ([]Bookmark, error) {
 	var err error
 	if len(tags) == 0 {
 		if info.Search == "" {
-			query := fmt.Sprintf(`select * from bookmark order by date %s limit ? offset ?`, order)
+			query := fmt.Sprintf(`select %s from bookmark order by date %s limit ? offset ?`, bookmarkColumns, order)
 			rows, err = ds.db.Query(query, info.Number, info.Offset)
 		} else {
-			query := fmt.Sprintf(`select * from bookmark
+			query := fmt.Sprintf(`select %s from bookmark
 				where bookmark.name like $1 or url like $1 or description like $1
-				order by date %s limit $2 offset $3`, order)
+				order by date %s limit $2 offset $3`, bookmarkColumns, order)
 			rows, err = ds.db.Query(query, "%"+info.Search+"%", info.Number, info.Offset)
 		}
 	} else {
-		query := fmt.Sprintf(`select bookmark.id, bookmark.name, url, date, description from bookmark
+		query := fmt.Sprintf(`select %s from bookmark
 			join (
 				select * from tag_bookmark
 				join tag on tag.id = tag_bookmark.tag
@@ -174,7 +225,7 @@ func (ds *Datastore) GetBookmarks(info QueryInfo) ([]Bookmark, error) {
 			) as t on bookmark.id = t.bookmark
 			where bookmark.name like $1 or url like $1 or description like $1
 			order by date %s limit $2 offset $3`,
-			quoteStrings(tags), len(tags), order)
+			bookmarkColumns, quoteStrings(tags), len(tags), order)
 		pattern := "%" + info.Search + "%"
 		rows, err = ds.db.Query(query, pattern, info.Number, info.Offset)
 	}
@@ -184,9 +235,16 @@ func (ds *Datastore) GetBookmarks(info QueryInfo) ([]Bookmark, error) {
 	if err != nil {
 		return result, fmt.Errorf("fetching bookmarks: %w", err)
 	}
+	return ds.scanBookmarks(rows)
+}
+
+// Reads bookmarkColumns out of every row, along with each bookmark's tags
+func (ds *Datastore) scanBookmarks(rows *sql.Rows) ([]Bookmark, error) {
+	defer rows.Close()
+	result := make([]Bookmark, 0)
 	for rows.Next() {
 		var b Bookmark
-		err = rows.Scan(&b.Id, &b.Name, &b.Url, &b.Date, &b.Description)
+		err := rows.Scan(&b.Id, &b.Name, &b.Url, &b.Date, &b.Description, &b.Favorite)
 		if err != nil {
 			return result, fmt.Errorf("scanning bookmark: %w", err)
 		}
@@ -201,6 +259,23 @@ func (ds *Datastore) GetBookmarks(info QueryInfo) ([]Bookmark, error) {
 	return result, nil
 }
 
+// Gets every bookmark that has been pinned as a favorite, most recent first
+func (ds *Datastore) GetFavoriteBookmarks() ([]Bookmark, error) {
+	rows, err := ds.db.Query(`select ` + bookmarkColumns + ` from bookmark where favorite order by date desc`)
+	if err != nil {
+		return nil, fmt.Errorf("fetching favorites: %w", err)
+	}
+	return ds.scanBookmarks(rows)
+}
+
+func (ds *Datastore) SetFavorite(id int64, favorite bool) error {
+	_, err := ds.db.Exec(`update bookmark set favorite=? where id=?`, favorite, id)
+	if err != nil {
+		return fmt.Errorf("updating bookmark: %w", err)
+	}
+	return nil
+}
+
 func (ds *Datastore) GetNumBookmarks(info QueryInfo) (int64, error) {
 	tags := stringsToLower(info.Tags)
 
@@ -247,6 +322,12 @@ func (ds *Datastore) Export() ([]byte, error) {
 	if err != nil {
 		return nil, fmt.Errorf("retrieving bookmarks: %w", err)
 	}
+	for i := range bookmarks {
+		bookmarks[i].Highlights, err = ds.getBookmarkHighlights(bookmarks[i].Id)
+		if err != nil {
+			return nil, fmt.Errorf("retrieving highlights for bookmark %d: %w", bookmarks[i].Id, err)
+		}
+	}
 	data, err := json.Marshal(bookmarks)
 	if err != nil {
 		return nil, fmt.Errorf("marshalling json: %w", err)
@@ -0,0 +1,52 @@
+package datastore
+
+import "testing"
+
+func addTestBookmark(t *testing.T, ds *Datastore, name string, tags ...string) int64 {
+	t.Helper()
+	id, err := ds.CreateBookmark(name, "https://example.com/"+name, "", tags)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func TestFavorites(t *testing.T) {
+	ds := newTestDatastore(t)
+	first := addTestBookmark(t, ds, "first")
+	addTestBookmark(t, ds, "second")
+	third := addTestBookmark(t, ds, "third")
+	for _, id := range []int64{first, third} {
+		if err := ds.SetFavorite(id, true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	favorites, err := ds.GetFavoriteBookmarks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(favorites) != 2 || favorites[0].Id != third || favorites[1].Id != first || !favorites[0].Favorite {
+		t.Errorf("got %+v", favorites)
+	}
+
+	if err := ds.SetFavorite(third, false); err != nil {
+		t.Fatal(err)
+	}
+	bookmark, err := ds.GetBookmark(third)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bookmark.Favorite {
+		t.Error("still a favorite")
+	}
+	all, err := ds.GetBookmarks(NewQueryInfo(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, b := range all {
+		if b.Favorite != (b.Id == first) {
+			t.Errorf("%s has favorite %t", b.Name, b.Favorite)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package datastore
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A migrated database in a temporary directory, with cheap password hashing, which is closed when the test ends
+func newTestDatastore(t *testing.T) *Datastore {
+	t.Helper()
+	ds, err := Connect(filepath.Join(t.TempDir(), "bookmarks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.SetPasswordParams(PasswordParams{Time: 1, Memory: 64, Threads: 1})
+	_, err = ds.RunMigrations(os.DirFS("../schema"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ds.Close() })
+	return &ds
+}
+
+func addTestUser(t *testing.T, ds *Datastore, username string) int64 {
+	t.Helper()
+	id, err := ds.AddUser(username, "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
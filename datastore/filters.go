@@ -0,0 +1,46 @@
+package datastore
+
+import (
+	"fmt"
+	"time"
+)
+
+// A search that a user has saved so that it can be shown on the dashboard.
+// Query holds the url-encoded search parameters.
+type SavedFilter struct {
+	Id    int64
+	Name  string
+	Query string
+}
+
+func (ds *Datastore) CreateSavedFilter(name, query string) error {
+	timestamp := time.Now().UTC()
+	_, err := ds.db.Exec(`insert into saved_filter (name, query, timestamp) values (?, ?, ?)`, name, query, timestamp)
+	if err != nil {
+		return fmt.Errorf("inserting saved filter: %w", err)
+	}
+	return nil
+}
+
+func (ds *Datastore) ListSavedFilters() ([]SavedFilter, error) {
+	rows, err := ds.db.Query(`select id, name, query from saved_filter order by name asc`)
+	if err != nil {
+		return nil, fmt.Errorf("getting rows: %w", err)
+	}
+	defer rows.Close()
+	filters := make([]SavedFilter, 0)
+	for rows.Next() {
+		var filter SavedFilter
+		err = rows.Scan(&filter.Id, &filter.Name, &filter.Query)
+		if err != nil {
+			return nil, fmt.Errorf("scanning row: %w", err)
+		}
+		filters = append(filters, filter)
+	}
+	return filters, nil
+}
+
+func (ds *Datastore) DeleteSavedFilter(id int64) error {
+	_, err := ds.db.Exec(`delete from saved_filter where id = ?`, id)
+	return err
+}
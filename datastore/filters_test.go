@@ -0,0 +1,35 @@
+package datastore
+
+import "testing"
+
+func TestSavedFilters(t *testing.T) {
+	ds := newTestDatastore(t)
+	for _, name := range []string{"Recipes", "Go", "Papers"} {
+		err := ds.CreateSavedFilter(name, "searchTag="+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	filters, err := ds.ListSavedFilters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 3 || filters[0].Name != "Go" || filters[1].Name != "Papers" || filters[2].Name != "Recipes" {
+		t.Fatalf("got %+v", filters)
+	}
+	if filters[0].Query != "searchTag=Go" {
+		t.Errorf("got query %q", filters[0].Query)
+	}
+
+	err = ds.DeleteSavedFilter(filters[1].Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	filters, err = ds.ListSavedFilters()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(filters) != 2 || filters[0].Name != "Go" || filters[1].Name != "Recipes" {
+		t.Errorf("after deleting: got %+v", filters)
+	}
+}
@@ -0,0 +1,35 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// Whether RunMigrations has finished bringing the schema up to date
+func (ds *Datastore) Migrated() bool {
+	return ds.migrated
+}
+
+// Checks that the database can be written to. Waiting for a lock gives up at ctx's deadline,
+// which sqlite's busy timeout wouldn't otherwise notice.
+func (ds *Datastore) CheckWritable(ctx context.Context) error {
+	conn, err := ds.db.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("connecting: %w", err)
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		_, err = conn.ExecContext(ctx, fmt.Sprintf(`pragma busy_timeout = %d`, time.Until(deadline).Milliseconds()))
+		if err != nil {
+			return fmt.Errorf("setting busy timeout: %w", err)
+		}
+		// the connection goes back in the pool, so it has to wait as long as the others again
+		defer conn.ExecContext(context.Background(), fmt.Sprintf(`pragma busy_timeout = %d`, busyTimeout.Milliseconds()))
+	}
+	_, err = conn.ExecContext(ctx, `insert or replace into health_check (id, checked) values (1, ?)`, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("writing health check: %w", err)
+	}
+	return nil
+}
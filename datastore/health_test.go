@@ -0,0 +1,80 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMigrated(t *testing.T) {
+	ds, err := Connect(filepath.Join(t.TempDir(), "bookmarks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	if ds.Migrated() {
+		t.Error("migrated before running migrations")
+	}
+	if err := ds.CheckWritable(context.Background()); err == nil {
+		t.Error("writable without a schema")
+	}
+	_, err = ds.RunMigrations(schemaUpTo(t, "9999-12-31.0.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ds.Migrated() {
+		t.Error("not migrated after running migrations")
+	}
+	if err := ds.CheckWritable(context.Background()); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckWritableGivesUpAtTheDeadline(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "bookmarks.db")
+	ds, err := Connect(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	_, err = ds.RunMigrations(schemaUpTo(t, "9999-12-31.0.sql"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// someone else holding the write lock
+	other, err := sql.Open("sqlite3", file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer other.Close()
+	conn, err := other.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, err = conn.ExecContext(context.Background(), `begin immediate`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	started := time.Now()
+	if err := ds.CheckWritable(ctx); err == nil {
+		t.Error("writable while locked")
+	}
+	if took := time.Since(started); took > 2*time.Second {
+		t.Errorf("took %s to give up", took)
+	}
+
+	_, err = conn.ExecContext(context.Background(), `rollback`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.CheckWritable(context.Background()); err != nil {
+		t.Errorf("still not writable once unlocked: %s", err)
+	}
+}
@@ -0,0 +1,71 @@
+package datastore
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// A passage of text quoted from a bookmarked page
+type Highlight struct {
+	Id   int64     `json:"id"`
+	Text string    `json:"text"`
+	Date time.Time `json:"date"`
+}
+
+func (ds *Datastore) AddHighlight(bookmarkId int64, text string) error {
+	timestamp := time.Now().UTC()
+	_, err := ds.db.Exec(`insert into highlight (bookmark, text, timestamp) values (?, ?, ?)`,
+		bookmarkId, text, timestamp)
+	if err != nil {
+		return fmt.Errorf("inserting highlight: %w", err)
+	}
+	return nil
+}
+
+// Deletes a highlight, returning the id of the bookmark it belonged to
+func (ds *Datastore) DeleteHighlight(id int64) (int64, error) {
+	var bookmarkId int64
+	err := ds.db.QueryRow(`select bookmark from highlight where id = ?`, id).Scan(&bookmarkId)
+	if err != nil {
+		return 0, fmt.Errorf("finding highlight: %w", err)
+	}
+	_, err = ds.db.Exec(`delete from highlight where id = ?`, id)
+	if err != nil {
+		return 0, fmt.Errorf("deleting highlight: %w", err)
+	}
+	return bookmarkId, nil
+}
+
+func (ds *Datastore) getBookmarkHighlights(bookmarkId int64) ([]Highlight, error) {
+	rows, err := ds.db.Query(`select id, text, timestamp from highlight where bookmark = ? order by timestamp asc`,
+		bookmarkId)
+	if err != nil {
+		return nil, fmt.Errorf("getting highlights: %w", err)
+	}
+	defer rows.Close()
+
+	highlights := make([]Highlight, 0)
+	for rows.Next() {
+		var highlight Highlight
+		err = rows.Scan(&highlight.Id, &highlight.Text, &highlight.Date)
+		if err != nil {
+			return highlights, fmt.Errorf("scanning highlight: %w", err)
+		}
+		highlights = append(highlights, highlight)
+	}
+	return highlights, nil
+}
+
+// Finds the bookmark with exactly this url
+func (ds *Datastore) GetBookmarkIdByUrl(url string) (int64, bool, error) {
+	var id int64
+	err := ds.db.QueryRow(`select id from bookmark where url = ?`, url).Scan(&id)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("finding bookmark: %w", err)
+	}
+	return id, true, nil
+}
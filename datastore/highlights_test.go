@@ -0,0 +1,86 @@
+package datastore
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestHighlights(t *testing.T) {
+	ds := newTestDatastore(t)
+	id := addTestBookmark(t, ds, "article")
+	other := addTestBookmark(t, ds, "other")
+	for _, text := range []string{"first quote", "second quote"} {
+		if err := ds.AddHighlight(id, text); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	bookmark, err := ds.GetBookmark(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(bookmark.Highlights) != 2 || bookmark.Highlights[0].Text != "first quote" || bookmark.Highlights[1].Text != "second quote" {
+		t.Fatalf("got %+v", bookmark.Highlights)
+	}
+	if bookmark, _ := ds.GetBookmark(other); len(bookmark.Highlights) != 0 {
+		t.Errorf("other bookmark has %+v", bookmark.Highlights)
+	}
+
+	belongedTo, err := ds.DeleteHighlight(bookmark.Highlights[0].Id)
+	if err != nil || belongedTo != id {
+		t.Errorf("deleting: got %d, %v", belongedTo, err)
+	}
+	if _, err := ds.DeleteHighlight(bookmark.Highlights[0].Id); err == nil {
+		t.Error("deleted the same highlight twice")
+	}
+	bookmark, _ = ds.GetBookmark(id)
+	if len(bookmark.Highlights) != 1 || bookmark.Highlights[0].Text != "second quote" {
+		t.Errorf("after deleting: got %+v", bookmark.Highlights)
+	}
+}
+
+func TestHighlightsAreExported(t *testing.T) {
+	ds := newTestDatastore(t)
+	id := addTestBookmark(t, ds, "article")
+	if err := ds.AddHighlight(id, "a quote"); err != nil {
+		t.Fatal(err)
+	}
+	exported, err := ds.Export()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var bookmarks []Bookmark
+	if err := json.Unmarshal(exported, &bookmarks); err != nil {
+		t.Fatalf("parsing %s: %s", exported, err)
+	}
+	if len(bookmarks) != 1 || len(bookmarks[0].Highlights) != 1 || bookmarks[0].Highlights[0].Text != "a quote" {
+		t.Errorf("exported %s", exported)
+	}
+}
+
+func TestDeletingBookmarkDeletesHighlights(t *testing.T) {
+	ds := newTestDatastore(t)
+	id := addTestBookmark(t, ds, "article")
+	if err := ds.AddHighlight(id, "a quote"); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.DeleteBookmark(id); err != nil {
+		t.Fatal(err)
+	}
+	var count int
+	if err := ds.db.QueryRow(`select count(*) from highlight`).Scan(&count); err != nil || count != 0 {
+		t.Errorf("%d highlights left, %v", count, err)
+	}
+}
+
+func TestGetBookmarkIdByUrl(t *testing.T) {
+	ds := newTestDatastore(t)
+	id := addTestBookmark(t, ds, "article")
+	found, exists, err := ds.GetBookmarkIdByUrl("https://example.com/article")
+	if err != nil || !exists || found != id {
+		t.Errorf("got %d, %t, %v", found, exists, err)
+	}
+	if _, exists, err := ds.GetBookmarkIdByUrl("https://example.com/article/"); err != nil || exists {
+		t.Errorf("a different url matched: %t, %v", exists, err)
+	}
+}
@@ -0,0 +1,195 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+const DefaultInviteTtl = 7 * 24 * time.Hour
+const DefaultPasswordResetTtl = 24 * time.Hour
+const linkTokenSize = 32
+
+type Invite struct {
+	Id        int64
+	CreatedBy string
+	Created   time.Time
+	Expires   time.Time
+}
+
+func newLinkToken() (string, error) {
+	tokenBytes, err := randomBytes(linkTokenSize)
+	if err != nil {
+		return "", fmt.Errorf("generating token: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(tokenBytes), nil
+}
+
+// Creates an invite and returns its token, which can't be looked up again afterwards
+func (ds *Datastore) CreateInvite(createdBy string, ttl time.Duration) (string, error) {
+	token, err := newLinkToken()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now().UTC()
+	_, err = ds.db.Exec(`insert into invite (token_hash, created_by, timestamp, expires) values (?, ?, ?, ?)`,
+		hashKey(token), createdBy, now, now.Add(ttl))
+	if err != nil {
+		return "", fmt.Errorf("inserting invite: %w", err)
+	}
+	return token, nil
+}
+
+// Lists the invites that haven't been used or expired yet
+func (ds *Datastore) ListInvites() ([]Invite, error) {
+	rows, err := ds.db.Query(`select id, created_by, timestamp, expires from invite where expires > ? order by timestamp`,
+		time.Now().UTC())
+	if err != nil {
+		return nil, fmt.Errorf("listing invites: %w", err)
+	}
+	defer rows.Close()
+	invites := make([]Invite, 0)
+	for rows.Next() {
+		var invite Invite
+		err = rows.Scan(&invite.Id, &invite.CreatedBy, &invite.Created, &invite.Expires)
+		if err != nil {
+			return nil, fmt.Errorf("scanning invite: %w", err)
+		}
+		invites = append(invites, invite)
+	}
+	return invites, nil
+}
+
+func (ds *Datastore) DeleteInvite(id int64) error {
+	_, err := ds.db.Exec(`delete from invite where id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("deleting invite: %w", err)
+	}
+	return nil
+}
+
+func (ds *Datastore) CheckInvite(token string) (bool, error) {
+	var id int64
+	err := ds.db.QueryRow(`select id from invite where token_hash = ? and expires > ?`, hashKey(token), time.Now().UTC()).
+		Scan(&id)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("finding invite: %w", err)
+	}
+	return true, nil
+}
+
+// Uses up an invite to add a new user, all at once, so that the invite is only used up if the user is added.
+// Returns whether the invite was good, and whether the username was free; the user is only added if both were.
+// Expired invites are cleaned up at the same time.
+func (ds *Datastore) AddInvitedUser(token, username, password string) (int64, bool, bool, error) {
+	// hashing is slow, so do it before taking the write lock
+	hash, err := ds.newPasswordHash(password)
+	if err != nil {
+		return 0, false, false, err
+	}
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+	tx, err := ds.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, false, fmt.Errorf("beginning transaction: %w", err)
+	}
+	now := time.Now().UTC()
+	result, err := tx.Exec(`delete from invite where token_hash = ? and expires > ?`, hashKey(token), now)
+	if err != nil {
+		return 0, false, false, fmt.Errorf("using invite: %w", err)
+	}
+	used, err := result.RowsAffected()
+	if err != nil {
+		return 0, false, false, fmt.Errorf("using invite: %w", err)
+	}
+	if used == 0 {
+		return 0, false, false, nil
+	}
+	// nothing else can add a user between this and the insert, since the delete has taken the write lock
+	var taken bool
+	err = tx.QueryRow(`select exists (select 1 from user where username = ?)`, username).Scan(&taken)
+	if err != nil {
+		return 0, false, false, fmt.Errorf("checking whether user exists: %w", err)
+	}
+	if taken {
+		return 0, true, false, nil
+	}
+	result, err = tx.Exec(`insert into user (username, password_hash) values (?, ?)`, username, hash)
+	if err != nil {
+		return 0, false, false, fmt.Errorf("inserting new user: %w", err)
+	}
+	userId, err := result.LastInsertId()
+	if err != nil {
+		return 0, false, false, fmt.Errorf("getting user id: %w", err)
+	}
+	_, err = tx.Exec(`delete from invite where expires <= ?`, now)
+	if err != nil {
+		return 0, false, false, fmt.Errorf("deleting expired invites: %w", err)
+	}
+	err = tx.Commit()
+	if err != nil {
+		return 0, false, false, fmt.Errorf("committing transaction: %w", err)
+	}
+	return userId, true, true, nil
+}
+
+func (ds *Datastore) useLinkToken(table, token string) (bool, error) {
+	now := time.Now().UTC()
+	result, err := ds.db.Exec(`delete from `+table+` where token_hash = ? and expires > ?`, hashKey(token), now)
+	if err != nil {
+		return false, fmt.Errorf("using token: %w", err)
+	}
+	used, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("using token: %w", err)
+	}
+	_, err = ds.db.Exec(`delete from `+table+` where expires <= ?`, now)
+	if err != nil {
+		return false, fmt.Errorf("deleting expired tokens: %w", err)
+	}
+	return used > 0, nil
+}
+
+// Creates a link for the user to choose a new password with. Any older links for them stop working.
+func (ds *Datastore) CreatePasswordReset(user int64, ttl time.Duration) (string, error) {
+	token, err := newLinkToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = ds.db.Exec(`delete from password_reset where user = ?`, user)
+	if err != nil {
+		return "", fmt.Errorf("deleting old password resets: %w", err)
+	}
+	now := time.Now().UTC()
+	_, err = ds.db.Exec(`insert into password_reset (user, token_hash, timestamp, expires) values (?, ?, ?, ?)`,
+		user, hashKey(token), now, now.Add(ttl))
+	if err != nil {
+		return "", fmt.Errorf("inserting password reset: %w", err)
+	}
+	return token, nil
+}
+
+// Finds who a password reset link is for, if it's still valid
+func (ds *Datastore) CheckPasswordReset(token string) (int64, string, bool, error) {
+	var user int64
+	var username string
+	err := ds.db.QueryRow(`select user.id, user.username from password_reset join user on user.id = password_reset.user
+		where token_hash = ? and expires > ?`, hashKey(token), time.Now().UTC()).Scan(&user, &username)
+	if err == sql.ErrNoRows {
+		return 0, "", false, nil
+	}
+	if err != nil {
+		return 0, "", false, fmt.Errorf("finding password reset: %w", err)
+	}
+	return user, username, true, nil
+}
+
+// Uses up a password reset link, returning false if it was already used or has expired
+func (ds *Datastore) UsePasswordReset(token string) (bool, error) {
+	return ds.useLinkToken(`password_reset`, token)
+}
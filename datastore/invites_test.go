@@ -0,0 +1,51 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAddInvitedUser(t *testing.T) {
+	ds := newTestDatastore(t)
+	addTestUser(t, ds, "alice")
+	token, err := ds.CreateInvite("alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, valid, free, err := ds.AddInvitedUser(token, "alice", "password"); err != nil || !valid || free {
+		t.Fatalf("taken username: got valid %v, free %v, %v", valid, free, err)
+	}
+	if valid, _ := ds.CheckInvite(token); !valid {
+		t.Fatal("invite was used up by a username that was taken")
+	}
+
+	bob, valid, free, err := ds.AddInvitedUser(token, "bob", "password")
+	if err != nil || !valid || !free {
+		t.Fatalf("got valid %v, free %v, %v", valid, free, err)
+	}
+	if id, ok, err := ds.AuthenticateUser("bob", "password"); err != nil || !ok || id != bob {
+		t.Errorf("can't log in as the new user: %v, %v", ok, err)
+	}
+
+	if _, valid, _, err := ds.AddInvitedUser(token, "carol", "password"); err != nil || valid {
+		t.Errorf("used invite: got valid %v, %v", valid, err)
+	}
+	if _, exists, _ := ds.UserExists("carol"); exists {
+		t.Error("user was added with a used invite")
+	}
+}
+
+func TestAddInvitedUserRejectsExpiredInvites(t *testing.T) {
+	ds := newTestDatastore(t)
+	token, err := ds.CreateInvite("alice", -time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, valid, _, err := ds.AddInvitedUser(token, "bob", "password"); err != nil || valid {
+		t.Errorf("got valid %v, %v", valid, err)
+	}
+	if _, exists, _ := ds.UserExists("bob"); exists {
+		t.Error("user was added with an expired invite")
+	}
+}
@@ -0,0 +1,140 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"local/bookmarks/metrics"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+var queryDuration = metrics.NewHistogram("bookmarks_datastore_query_duration_seconds",
+	"How long database queries take, by the datastore function that made them. Queries are timed until their first row is ready.",
+	metrics.DurationBuckets, "operation")
+var queryErrors = metrics.NewCounter("bookmarks_datastore_query_errors_total",
+	"Database queries that failed, by the datastore function that made them.", "operation")
+
+// A database connection that times each query
+type timedDB struct {
+	*sql.DB
+}
+
+func (db timedDB) Exec(query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := db.DB.Exec(query, args...)
+	observeQuery(start, err)
+	return result, err
+}
+
+func (db timedDB) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := db.DB.Query(query, args...)
+	observeQuery(start, err)
+	return rows, err
+}
+
+func (db timedDB) QueryRow(query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := db.DB.QueryRow(query, args...)
+	observeQuery(start, row.Err())
+	return row
+}
+
+func (db timedDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (timedTx, error) {
+	tx, err := db.DB.BeginTx(ctx, opts)
+	return timedTx{tx}, err
+}
+
+// A transaction that times each query
+type timedTx struct {
+	*sql.Tx
+}
+
+func (tx timedTx) Exec(query string, args ...interface{}) (sql.Result, error) {
+	start := time.Now()
+	result, err := tx.Tx.Exec(query, args...)
+	observeQuery(start, err)
+	return result, err
+}
+
+func (tx timedTx) Query(query string, args ...interface{}) (*sql.Rows, error) {
+	start := time.Now()
+	rows, err := tx.Tx.Query(query, args...)
+	observeQuery(start, err)
+	return rows, err
+}
+
+func (tx timedTx) QueryRow(query string, args ...interface{}) *sql.Row {
+	start := time.Now()
+	row := tx.Tx.QueryRow(query, args...)
+	observeQuery(start, row.Err())
+	return row
+}
+
+// Records a query that started at start, under the name of the function that called Exec, Query or QueryRow
+func observeQuery(start time.Time, err error) {
+	operation := callerName(3)
+	queryDuration.Observe(time.Since(start).Seconds(), operation)
+	if err != nil && err != sql.ErrNoRows {
+		queryErrors.Inc(operation)
+	}
+}
+
+var callerNames sync.Map
+
+// The name of the function skip frames up, like GetBookmark, without its package or receiver.
+// Closures are put down to the function they're in.
+func callerName(skip int) string {
+	pc, _, _, ok := runtime.Caller(skip)
+	if !ok {
+		return "unknown"
+	}
+	if name, ok := callerNames.Load(pc); ok {
+		return name.(string)
+	}
+	name := "unknown"
+	if f := runtime.FuncForPC(pc); f != nil {
+		name = f.Name()
+		name = name[strings.LastIndex(name, "/")+1:]
+		parts := strings.Split(name, ".")
+		for len(parts) > 1 && (strings.HasPrefix(parts[len(parts)-1], "func") || parts[len(parts)-1] == "") {
+			parts = parts[:len(parts)-1]
+		}
+		name = parts[len(parts)-1]
+	}
+	callerNames.Store(pc, name)
+	return name
+}
+
+// How many of each thing are stored, for monitoring
+type Totals struct {
+	Bookmarks int64
+	// tags that are on at least one bookmark, like GetTags lists
+	Tags  int64
+	Users int64
+	// keys that can still be used: not disabled or expired
+	ApiKeys int64
+	// sessions that haven't expired
+	Sessions int64
+}
+
+func (ds *Datastore) Totals() (Totals, error) {
+	var totals Totals
+	now := time.Now().UTC()
+	createdCutoff, idleCutoff := ds.sessionCutoffs()
+	err := ds.db.QueryRow(`select
+		(select count(*) from bookmark),
+		(select count(distinct tag) from tag_bookmark),
+		(select count(*) from user),
+		(select count(*) from api_key where not disabled and (expires is null or expires > ?)),
+		(select count(*) from session where timestamp >= ? and coalesce(last_seen, timestamp) >= ?)`,
+		now, createdCutoff, idleCutoff).
+		Scan(&totals.Bookmarks, &totals.Tags, &totals.Users, &totals.ApiKeys, &totals.Sessions)
+	if err != nil {
+		return totals, fmt.Errorf("counting totals: %w", err)
+	}
+	return totals, nil
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 
@@ -18,6 +19,16 @@ type migration struct {
 	number int
 }
 
+type migrationFile struct {
+	migration migration
+	path      string
+}
+
+// Steps that can't be written in sql, which run after the sql of their migration, in the same transaction
+var migrationSteps = map[migration]func(tx timedTx) error{
+	{"2026-10-19", 4}: hashLegacyKeys,
+}
+
 func (m1 migration) before(m2 migration) bool {
 	return m1.date < m2.date || (m1.date == m2.date && m1.number < m2.number)
 }
@@ -60,9 +71,10 @@ func (ds *Datastore) RunMigrations(migrations fs.FS) (uint, error) {
 
 	var migrationsPerformed uint = 0
 
-	// Execute only migrations which are more recent than the latest migration
-	// Because walkdir traverses the directory in lexicographical order, we don't need
-	// to worry about the migrations being performed in the wrong order
+	// Execute only migrations which are more recent than the latest migration.
+	// Walkdir traverses the directory in lexicographical order, which puts 10 before 9,
+	// so sort the migrations by date & number before running them
+	var files []migrationFile
 	err = fs.WalkDir(migrations, ".", func(filepath string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return fmt.Errorf("walking dir: %s", err)
@@ -77,26 +89,36 @@ func (ds *Datastore) RunMigrations(migrations fs.FS) (uint, error) {
 		if err != nil {
 			return fmt.Errorf("parsing migration name: %w", err)
 		}
+		files = append(files, migrationFile{newMigration, filepath})
+		return nil
+	})
+	if err != nil {
+		return migrationsPerformed, err
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].migration.before(files[j].migration) })
+
+	for _, f := range files {
+		newMigration, filepath := f.migration, f.path
 
 		// if migration is already in db
 		isRun, exists := migrationSet[newMigration]
 		if exists {
 			if isRun {
-				return fmt.Errorf("duplicate migration: %s.%d has already been visited", newMigration.date, newMigration.number)
+				return migrationsPerformed, fmt.Errorf("duplicate migration: %s.%d has already been visited", newMigration.date, newMigration.number)
 			}
 			if latestMigration.before(newMigration) {
 				// this migration is somehow out of order
-				return fmt.Errorf("migrations are out of order: old migration %s.%d is newer than latest migration %s.%d",
+				return migrationsPerformed, fmt.Errorf("migrations are out of order: old migration %s.%d is newer than latest migration %s.%d",
 					newMigration.date, newMigration.number, latestMigration.date, latestMigration.number)
 			}
 			// skip old migration
 			migrationSet[newMigration] = true
-			return nil
+			continue
 
 		} else {
 			// this is a new migration
 			if !latestMigration.before(newMigration) {
-				return fmt.Errorf("migrations are out of order: new migration %s.%d is no newer than than latest migration %s.%d",
+				return migrationsPerformed, fmt.Errorf("migrations are out of order: new migration %s.%d is no newer than than latest migration %s.%d",
 					newMigration.date, newMigration.number, latestMigration.date, latestMigration.number)
 			}
 			// this is our new latest migration; continue as normal
@@ -107,22 +129,21 @@ func (ds *Datastore) RunMigrations(migrations fs.FS) (uint, error) {
 		// do migration
 		file, err := fs.ReadFile(migrations, filepath)
 		if err != nil {
-			return fmt.Errorf("reading migration file %s: %s", filepath, err)
+			return migrationsPerformed, fmt.Errorf("reading migration file %s: %s", filepath, err)
 		}
 		err = ds.runMigration(newMigration, string(file))
 		if err != nil {
-			return fmt.Errorf("running migration %s.%d: %s", newMigration.date, newMigration.number, err)
+			return migrationsPerformed, fmt.Errorf("running migration %s.%d: %s", newMigration.date, newMigration.number, err)
 		}
 		migrationsPerformed += 1
-
-		return nil
-	})
+	}
 
 	for m, done := range migrationSet {
 		if !done {
 			return migrationsPerformed, fmt.Errorf("missing migration: migration %s.%d was never visited", m.date, m.number)
 		}
 	}
+	ds.migrated = true
 	return migrationsPerformed, err
 }
 
@@ -159,6 +180,13 @@ func (ds *Datastore) runMigration(name migration, contents string) error {
 		stop()
 		return fmt.Errorf("executing migration: %s", err)
 	}
+	if step, ok := migrationSteps[name]; ok {
+		err = step(tx)
+		if err != nil {
+			stop()
+			return fmt.Errorf("executing migration: %s", err)
+		}
+	}
 	_, err = tx.Exec(`insert into _migration values (?, ?)`, name.date, name.number)
 	if err != nil {
 		stop()
@@ -0,0 +1,166 @@
+package datastore
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+)
+
+// The migrations in ../schema up to and including the one called last
+func schemaUpTo(t *testing.T, last string) fs.FS {
+	t.Helper()
+	lastMigration, err := parseMigrationName(last)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries, err := os.ReadDir("../schema")
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema := fstest.MapFS{}
+	for _, entry := range entries {
+		m, err := parseMigrationName(entry.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lastMigration.before(m) {
+			continue
+		}
+		contents, err := os.ReadFile(filepath.Join("../schema", entry.Name()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		schema[entry.Name()] = &fstest.MapFile{Data: contents}
+	}
+	return schema
+}
+
+// A database that's only been migrated up to last
+func newOldTestDatastore(t *testing.T, last string) *Datastore {
+	t.Helper()
+	ds, err := Connect(filepath.Join(t.TempDir(), "bookmarks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = ds.RunMigrations(schemaUpTo(t, last))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ds.Close() })
+	return &ds
+}
+
+func TestMigratingPlaintextKeys(t *testing.T) {
+	ds := newOldTestDatastore(t, "2026-10-19.3.sql")
+	const oldKey = "0123456789abcdef0123456789abcdef0123456789abcdef0123456789abcdef"
+	// the way keys were stored before they were hashed
+	_, err := ds.db.Exec(`insert into api_key (name, key, timestamp, scopes) values (?, ?, ?, ?)`,
+		"old key", oldKey, "2021-04-12", ScopeExport)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = ds.RunMigrations(os.DirFS("../schema"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keyHash, prefix string
+	var plaintext int
+	err = ds.db.QueryRow(`select key_hash, prefix from api_key where name = 'old key'`).Scan(&keyHash, &prefix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if keyHash != hashKey(oldKey) || prefix != oldKey[:apiKeyPrefixSize] {
+		t.Errorf("got hash %s, prefix %s", keyHash, prefix)
+	}
+	err = ds.db.QueryRow(`select count(*) from api_key where legacy_key is not null`).Scan(&plaintext)
+	if err != nil || plaintext != 0 {
+		t.Errorf("%d keys are still in plaintext, %v", plaintext, err)
+	}
+
+	name, known, allowed, err := ds.CheckKey(oldKey, ScopeExport, Client{})
+	if err != nil || name != "old key" || !known || !allowed {
+		t.Errorf("got %q, %t, %t, %v", name, known, allowed, err)
+	}
+	if _, _, allowed, _ := ds.CheckKey(oldKey, ScopeBookmarkWrite, Client{}); allowed {
+		t.Error("the old key got a scope it didn't have")
+	}
+}
+
+// If hashing fails, the migration is rolled back, so keys can't be left in plaintext under the new schema
+func TestMigrationStepsRunInTheMigrationsTransaction(t *testing.T) {
+	ds := newOldTestDatastore(t, "2026-10-19.3.sql")
+	_, err := ds.db.Exec(`insert into api_key (name, key, timestamp) values ('old key', 'abc', '2021-04-12')`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hashKeys := migrationSteps[migration{"2026-10-19", 4}]
+	migrationSteps[migration{"2026-10-19", 4}] = func(tx timedTx) error {
+		if err := hashKeys(tx); err != nil {
+			return err
+		}
+		return fs.ErrInvalid
+	}
+	defer func() { migrationSteps[migration{"2026-10-19", 4}] = hashKeys }()
+
+	if _, err := ds.RunMigrations(os.DirFS("../schema")); err == nil {
+		t.Fatal("no error")
+	}
+	var key string
+	err = ds.db.QueryRow(`select key from api_key`).Scan(&key)
+	if err != nil || key != "abc" {
+		t.Errorf("got %q, %v", key, err)
+	}
+}
+
+// Migrations numbered 1 to count on one day, each of which records its number
+func numberedMigrations(count int) fstest.MapFS {
+	migrations := fstest.MapFS{
+		"2030-01-01.1.sql": &fstest.MapFile{Data: []byte(`create table ran (number integer); insert into ran values (1);`)},
+	}
+	for i := 2; i <= count; i++ {
+		migrations[fmt.Sprintf("2030-01-01.%d.sql", i)] = &fstest.MapFile{Data: []byte(fmt.Sprintf(`insert into ran values (%d);`, i))}
+	}
+	return migrations
+}
+
+func TestMigrationsAreSortedByNumber(t *testing.T) {
+	ds, err := Connect(filepath.Join(t.TempDir(), "bookmarks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+
+	// 10 sorts before 2 as a string, which would run it second
+	performed, err := ds.RunMigrations(numberedMigrations(12))
+	if err != nil || performed != 12 {
+		t.Fatalf("ran %d migrations, %v", performed, err)
+	}
+	performed, err = ds.RunMigrations(numberedMigrations(13))
+	if err != nil || performed != 1 {
+		t.Fatalf("ran %d more migrations, %v", performed, err)
+	}
+
+	rows, err := ds.db.Query(`select number from ran order by rowid`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	var order []int
+	for rows.Next() {
+		var number int
+		rows.Scan(&number)
+		order = append(order, number)
+	}
+	for i, number := range order {
+		if number != i+1 {
+			t.Fatalf("migrations ran in the order %v", order)
+		}
+	}
+	if len(order) != 13 {
+		t.Errorf("ran %d migrations, want 13", len(order))
+	}
+}
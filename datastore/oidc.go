@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+const OidcStateCookieName = "bookmark_oidc_state"
+
+// How long the user has to log in with the single sign-on provider
+const OidcLoginTtl = 10 * time.Minute
+
+// What we need to remember while the user is away at the single sign-on provider
+type OidcLogin struct {
+	Nonce        string
+	CodeVerifier string
+	RedirectTo   string
+}
+
+func (ds *Datastore) CreateOidcLogin(state string, login OidcLogin) error {
+	_, err := ds.db.Exec(`insert into oidc_login (state_hash, nonce, code_verifier, redirect_to, timestamp)
+		values (?, ?, ?, ?, ?)`,
+		hashKey(state), login.Nonce, login.CodeVerifier, login.RedirectTo, time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("inserting login: %w", err)
+	}
+	return nil
+}
+
+// Looks up a login by its state when the user comes back. Each one can only be used once.
+func (ds *Datastore) ConsumeOidcLogin(state string) (OidcLogin, bool, error) {
+	oldestAllowed := time.Now().UTC().Add(-OidcLoginTtl)
+	var login OidcLogin
+	err := ds.db.QueryRow(`select nonce, code_verifier, redirect_to from oidc_login where state_hash = ? and timestamp > ?`,
+		hashKey(state), oldestAllowed).Scan(&login.Nonce, &login.CodeVerifier, &login.RedirectTo)
+	if err != nil && err != sql.ErrNoRows {
+		return OidcLogin{}, false, fmt.Errorf("finding login: %w", err)
+	}
+	found := err == nil
+
+	_, err = ds.db.Exec(`delete from oidc_login where state_hash = ? or timestamp < ?`, hashKey(state), oldestAllowed)
+	if err != nil {
+		return OidcLogin{}, false, fmt.Errorf("deleting login: %w", err)
+	}
+	return login, found, nil
+}
+
+// Finds the user who logs in with the single sign-on account that issuer knows as subject
+func (ds *Datastore) GetOidcUser(issuer, subject string) (int64, bool, error) {
+	var user int64
+	err := ds.db.QueryRow(`select id from user where oidc_issuer = ? and oidc_subject = ?`, issuer, subject).Scan(&user)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("finding user: %w", err)
+	}
+	return user, true, nil
+}
+
+// Adds a user who logs in with a single sign-on account. Like AddExternalUser, they have no password.
+func (ds *Datastore) AddOidcUser(username, issuer, subject string) (int64, error) {
+	result, err := ds.db.Exec(`insert into user (username, oidc_issuer, oidc_subject) values (?, ?, ?)`,
+		username, issuer, subject)
+	if err != nil {
+		return 0, fmt.Errorf("inserting new user: %w", err)
+	}
+	userId, err := result.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("getting user id: %w", err)
+	}
+	return userId, nil
+}
+
+// Lets an existing user log in with a single sign-on account from now on.
+// Returns false if they already log in with another one, which is never replaced.
+func (ds *Datastore) LinkOidcUser(user int64, issuer, subject string) (bool, error) {
+	result, err := ds.db.Exec(`update user set oidc_issuer = ?, oidc_subject = ? where id = ? and oidc_subject is null`,
+		issuer, subject, user)
+	if err != nil {
+		return false, fmt.Errorf("linking user: %w", err)
+	}
+	linked, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("linking user: %w", err)
+	}
+	return linked == 1, nil
+}
@@ -0,0 +1,166 @@
+package datastore
+
+import (
+	"database/sql"
+	"fmt"
+	"local/bookmarks/webauthn"
+	"time"
+)
+
+// How long the browser has to answer a passkey challenge
+const PasskeyChallengeTtl = 5 * time.Minute
+
+// The most challenges that can be waiting for an answer at once for each user, or for logins,
+// so that asking for them over and over can't fill up the database
+const maxPendingPasskeyChallenges = 1000
+
+type Passkey struct {
+	Id       int64
+	Name     string
+	Created  time.Time
+	LastUsed sql.NullTime
+}
+
+// What's needed to check a login with a passkey
+type PasskeyCredential struct {
+	Id        int64
+	User      int64
+	PublicKey []byte
+	SignCount uint32
+}
+
+// Hands out a challenge for the browser to sign. Registration challenges belong to a user;
+// login challenges are created with user 0, since we don't know who's logging in until they answer.
+// Returns false if there are already too many waiting to be answered.
+func (ds *Datastore) CreatePasskeyChallenge(user int64) (string, bool, error) {
+	err := ds.deleteExpiredPasskeyChallenges()
+	if err != nil {
+		return "", false, err
+	}
+	challenge, err := webauthn.NewChallenge()
+	if err != nil {
+		return "", false, err
+	}
+	owner := sql.NullInt64{Int64: user, Valid: user != 0}
+	result, err := ds.db.Exec(`insert into passkey_challenge (user, challenge, timestamp)
+		select ?, ?, ? where (select count(*) from passkey_challenge where user is ?) < ?`,
+		owner, challenge, time.Now().UTC(), owner, maxPendingPasskeyChallenges)
+	if err != nil {
+		return "", false, fmt.Errorf("inserting challenge: %w", err)
+	}
+	inserted, err := result.RowsAffected()
+	if err != nil {
+		return "", false, fmt.Errorf("inserting challenge: %w", err)
+	}
+	if inserted == 0 {
+		return "", false, nil
+	}
+	return challenge, true, nil
+}
+
+func (ds *Datastore) deleteExpiredPasskeyChallenges() error {
+	_, err := ds.db.Exec(`delete from passkey_challenge where timestamp < ?`,
+		time.Now().UTC().Add(-PasskeyChallengeTtl))
+	if err != nil {
+		return fmt.Errorf("deleting expired challenges: %w", err)
+	}
+	return nil
+}
+
+// Checks that a challenge was handed out to this user (or 0 for logins) and hasn't expired.
+// Each challenge can only be used once, whether or not the answer turns out to be right.
+func (ds *Datastore) ConsumePasskeyChallenge(challenge string, user int64) (bool, error) {
+	err := ds.deleteExpiredPasskeyChallenges()
+	if err != nil {
+		return false, err
+	}
+	result, err := ds.db.Exec(`delete from passkey_challenge where challenge = ? and user is ?`,
+		challenge, sql.NullInt64{Int64: user, Valid: user != 0})
+	if err != nil {
+		return false, fmt.Errorf("deleting challenge: %w", err)
+	}
+	deleted, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("deleting challenge: %w", err)
+	}
+	return deleted > 0, nil
+}
+
+func (ds *Datastore) AddPasskey(user int64, name string, credential webauthn.Credential) error {
+	_, err := ds.db.Exec(`insert into passkey (user, name, credential_id, public_key, sign_count, timestamp)
+		values (?, ?, ?, ?, ?, ?)`,
+		user, name, webauthn.Encoding.EncodeToString(credential.Id), credential.PublicKey, credential.SignCount,
+		time.Now().UTC())
+	if err != nil {
+		return fmt.Errorf("inserting passkey: %w", err)
+	}
+	return nil
+}
+
+func (ds *Datastore) ListPasskeys(user int64) ([]Passkey, error) {
+	rows, err := ds.db.Query(`select id, name, timestamp, last_used from passkey where user = ? order by timestamp`, user)
+	if err != nil {
+		return nil, fmt.Errorf("listing passkeys: %w", err)
+	}
+	defer rows.Close()
+	passkeys := make([]Passkey, 0)
+	for rows.Next() {
+		var passkey Passkey
+		err = rows.Scan(&passkey.Id, &passkey.Name, &passkey.Created, &passkey.LastUsed)
+		if err != nil {
+			return nil, fmt.Errorf("scanning passkey: %w", err)
+		}
+		passkeys = append(passkeys, passkey)
+	}
+	return passkeys, nil
+}
+
+// The base64url ids of the user's credentials, so the browser doesn't register the same authenticator twice
+func (ds *Datastore) PasskeyCredentialIds(user int64) ([]string, error) {
+	rows, err := ds.db.Query(`select credential_id from passkey where user = ?`, user)
+	if err != nil {
+		return nil, fmt.Errorf("listing passkeys: %w", err)
+	}
+	defer rows.Close()
+	ids := make([]string, 0)
+	for rows.Next() {
+		var id string
+		err = rows.Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("scanning passkey: %w", err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+func (ds *Datastore) DeletePasskey(user, id int64) error {
+	_, err := ds.db.Exec(`delete from passkey where id = ? and user = ?`, id, user)
+	if err != nil {
+		return fmt.Errorf("deleting passkey: %w", err)
+	}
+	return nil
+}
+
+// Finds a passkey by the base64url credential id the browser sends
+func (ds *Datastore) GetPasskeyCredential(credentialId string) (PasskeyCredential, bool, error) {
+	var credential PasskeyCredential
+	err := ds.db.QueryRow(`select id, user, public_key, sign_count from passkey where credential_id = ?`, credentialId).
+		Scan(&credential.Id, &credential.User, &credential.PublicKey, &credential.SignCount)
+	if err == sql.ErrNoRows {
+		return PasskeyCredential{}, false, nil
+	}
+	if err != nil {
+		return PasskeyCredential{}, false, fmt.Errorf("finding passkey: %w", err)
+	}
+	return credential, true, nil
+}
+
+func (ds *Datastore) RecordPasskeyUse(id int64, signCount uint32) error {
+	_, err := ds.db.Exec(`update passkey set sign_count = ?, last_used = ? where id = ?`,
+		signCount, time.Now().UTC(), id)
+	if err != nil {
+		return fmt.Errorf("updating passkey: %w", err)
+	}
+	return nil
+}
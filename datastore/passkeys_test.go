@@ -0,0 +1,46 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPasskeyChallengesAreLimited(t *testing.T) {
+	ds := newTestDatastore(t)
+	user := addTestUser(t, ds, "alice")
+	for i := 0; i < maxPendingPasskeyChallenges; i++ {
+		if _, created, err := ds.CreatePasskeyChallenge(0); err != nil || !created {
+			t.Fatalf("challenge %d: got %v, %v", i, created, err)
+		}
+	}
+	if _, created, err := ds.CreatePasskeyChallenge(0); err != nil || created {
+		t.Errorf("one too many: got %v, %v", created, err)
+	}
+	// registering is counted separately for each user
+	if _, created, err := ds.CreatePasskeyChallenge(user); err != nil || !created {
+		t.Errorf("registration challenge: got %v, %v", created, err)
+	}
+
+	_, err := ds.db.Exec(`update passkey_challenge set timestamp = ?`, time.Now().UTC().Add(-PasskeyChallengeTtl-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	challenge, created, err := ds.CreatePasskeyChallenge(0)
+	if err != nil || !created {
+		t.Fatalf("after the others expired: got %v, %v", created, err)
+	}
+	var left int
+	ds.db.QueryRow(`select count(*) from passkey_challenge`).Scan(&left)
+	if left != 1 {
+		t.Errorf("%d challenges left, want just the new one", left)
+	}
+	if valid, err := ds.ConsumePasskeyChallenge(challenge, user); err != nil || valid {
+		t.Errorf("login challenge was accepted for registering: %v, %v", valid, err)
+	}
+	if valid, err := ds.ConsumePasskeyChallenge(challenge, 0); err != nil || !valid {
+		t.Errorf("login challenge: %v, %v", valid, err)
+	}
+	if valid, err := ds.ConsumePasskeyChallenge(challenge, 0); err != nil || valid {
+		t.Errorf("login challenge was accepted twice: %v, %v", valid, err)
+	}
+}
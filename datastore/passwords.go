@@ -0,0 +1,198 @@
+package datastore
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+)
+
+// Password hashes are stored as PHC strings, like $argon2id$v=19$m=32768,t=3,p=4$<salt>$<hash>,
+// so that each one records how it was made and the cost can be raised without breaking old ones.
+const (
+	algorithmArgon2i  = "argon2i"
+	algorithmArgon2id = "argon2id"
+)
+
+const passwordKeySize = 32
+
+// How hard new password hashes are to compute
+type PasswordParams struct {
+	// Passes over the memory
+	Time uint32
+	// Memory in KiB
+	Memory  uint32
+	Threads uint8
+}
+
+var DefaultPasswordParams = PasswordParams{Time: 3, Memory: 32 * 1024, Threads: 4}
+
+// What every password was hashed with before the parameters were stored alongside the hash
+var legacyPasswordParams = PasswordParams{Time: 3, Memory: 32 * 1024, Threads: 4}
+
+// Sets the cost of new password hashes. Existing hashes with other parameters are rehashed the next time their user logs in.
+func (ds *Datastore) SetPasswordParams(params PasswordParams) {
+	ds.passwordParams = params
+}
+
+type passwordHash struct {
+	algorithm string
+	params    PasswordParams
+	salt      []byte
+	key       []byte
+}
+
+var phcEncoding = base64.RawStdEncoding
+
+func (h passwordHash) String() string {
+	return fmt.Sprintf("$%s$v=%d$m=%d,t=%d,p=%d$%s$%s", h.algorithm, argon2.Version,
+		h.params.Memory, h.params.Time, h.params.Threads, phcEncoding.EncodeToString(h.salt), phcEncoding.EncodeToString(h.key))
+}
+
+func parsePasswordHash(encoded string) (passwordHash, error) {
+	var hash passwordHash
+	fields := strings.Split(encoded, "$")
+	if len(fields) != 6 || fields[0] != "" {
+		return hash, fmt.Errorf("not a PHC string")
+	}
+	hash.algorithm = fields[1]
+	if hash.algorithm != algorithmArgon2i && hash.algorithm != algorithmArgon2id {
+		return hash, fmt.Errorf("unknown algorithm %s", hash.algorithm)
+	}
+	if fields[2] != fmt.Sprintf("v=%d", argon2.Version) {
+		return hash, fmt.Errorf("unsupported version %s", fields[2])
+	}
+	for _, param := range strings.Split(fields[3], ",") {
+		nameValue := strings.SplitN(param, "=", 2)
+		if len(nameValue) != 2 {
+			return hash, fmt.Errorf("bad parameter %s", param)
+		}
+		name := nameValue[0]
+		n, err := strconv.ParseUint(nameValue[1], 10, 32)
+		if err != nil {
+			return hash, fmt.Errorf("parsing %s: %w", name, err)
+		}
+		switch name {
+		case "m":
+			hash.params.Memory = uint32(n)
+		case "t":
+			hash.params.Time = uint32(n)
+		case "p":
+			if n > 255 {
+				return hash, fmt.Errorf("too many threads: %d", n)
+			}
+			hash.params.Threads = uint8(n)
+		default:
+			return hash, fmt.Errorf("unknown parameter %s", name)
+		}
+	}
+	if hash.params.Memory == 0 || hash.params.Time == 0 || hash.params.Threads == 0 {
+		return hash, fmt.Errorf("missing parameters")
+	}
+	var err error
+	hash.salt, err = phcEncoding.DecodeString(fields[4])
+	if err != nil {
+		return hash, fmt.Errorf("decoding salt: %w", err)
+	}
+	hash.key, err = phcEncoding.DecodeString(fields[5])
+	if err != nil {
+		return hash, fmt.Errorf("decoding hash: %w", err)
+	}
+	return hash, nil
+}
+
+func deriveKey(algorithm string, params PasswordParams, password string, salt []byte, size uint32) []byte {
+	if algorithm == algorithmArgon2i {
+		return argon2.Key([]byte(password), salt, params.Time, params.Memory, params.Threads, size)
+	}
+	return argon2.IDKey([]byte(password), salt, params.Time, params.Memory, params.Threads, size)
+}
+
+// Hashes a new password with a fresh salt
+func (ds *Datastore) newPasswordHash(password string) (string, error) {
+	salt, err := randomBytes(saltSize)
+	if err != nil {
+		return "", fmt.Errorf("creating salt: %w", err)
+	}
+	params := ds.passwordParams
+	return passwordHash{
+		algorithm: algorithmArgon2id,
+		params:    params,
+		salt:      salt,
+		key:       deriveKey(algorithmArgon2id, params, password, salt, passwordKeySize),
+	}.String(), nil
+}
+
+// Checks a password against a stored hash, and reports whether the hash was made
+// differently from how new ones are, so should be replaced.
+func (ds *Datastore) checkPassword(encoded, password string) (bool, bool, error) {
+	hash, err := parsePasswordHash(encoded)
+	if err != nil {
+		return false, false, err
+	}
+	key := deriveKey(hash.algorithm, hash.params, password, hash.salt, uint32(len(hash.key)))
+	if subtle.ConstantTimeCompare(key, hash.key) != 1 {
+		return false, false, nil
+	}
+	outdated := hash.algorithm != algorithmArgon2id || hash.params != ds.passwordParams || len(hash.key) != passwordKeySize
+	return true, outdated, nil
+}
+
+// Rewrites password hashes from before they were stored as PHC strings, when the salt had its own column
+// and the parameters were fixed. Returns the number of hashes rewritten.
+func (ds *Datastore) UpgradeLegacyPasswordHashes() (int, error) {
+	rows, err := ds.db.Query(`select id, password_hash, salt from user where password_hash is not null and salt is not null`)
+	if err != nil {
+		return 0, fmt.Errorf("finding legacy password hashes: %w", err)
+	}
+	legacyHashes := make(map[int64]passwordHash)
+	for rows.Next() {
+		var id int64
+		var key, salt string
+		err = rows.Scan(&id, &key, &salt)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("scanning row: %w", err)
+		}
+		hash := passwordHash{
+			algorithm: algorithmArgon2i,
+			params:    legacyPasswordParams,
+		}
+		hash.salt, err = base64.URLEncoding.DecodeString(salt)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("decoding salt of user %d: %w", id, err)
+		}
+		hash.key, err = base64.URLEncoding.DecodeString(key)
+		if err != nil {
+			rows.Close()
+			return 0, fmt.Errorf("decoding password hash of user %d: %w", id, err)
+		}
+		legacyHashes[id] = hash
+	}
+	rows.Close()
+
+	for id, hash := range legacyHashes {
+		_, err = ds.db.Exec(`update user set password_hash = ?, salt = null where id = ?`, hash.String(), id)
+		if err != nil {
+			return 0, fmt.Errorf("rewriting password hash of user %d: %w", id, err)
+		}
+	}
+	return len(legacyHashes), nil
+}
+
+// Replaces a hash after a successful login, unless the password was changed in the meantime
+func (ds *Datastore) rehashPassword(userId int64, oldHash, password string) error {
+	hash, err := ds.newPasswordHash(password)
+	if err != nil {
+		return err
+	}
+	_, err = ds.db.Exec(`update user set password_hash = ? where id = ? and password_hash = ?`, hash, userId, oldHash)
+	if err != nil {
+		return fmt.Errorf("updating password hash: %w", err)
+	}
+	return nil
+}
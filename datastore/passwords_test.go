@@ -0,0 +1,128 @@
+package datastore
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+)
+
+// The example from the argon2 reference implementation's readme, made with
+// echo -n "password" | argon2 somesalt -t 2 -m 16 -p 4 -l 24
+const referenceHash = "$argon2i$v=19$m=65536,t=2,p=4$c29tZXNhbHQ$RdescudvJCsgt3ub+b+dWRWJTmaaJObG"
+
+func TestParsePasswordHash(t *testing.T) {
+	hash, err := parsePasswordHash(referenceHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hash.algorithm != algorithmArgon2i || hash.params != (PasswordParams{Time: 2, Memory: 65536, Threads: 4}) ||
+		string(hash.salt) != "somesalt" || len(hash.key) != 24 {
+		t.Errorf("got %+v", hash)
+	}
+	if hash.String() != referenceHash {
+		t.Errorf("got %s back", hash.String())
+	}
+}
+
+func TestCheckPasswordAgainstReference(t *testing.T) {
+	ds := Datastore{passwordParams: DefaultPasswordParams}
+	correct, outdated, err := ds.checkPassword(referenceHash, "password")
+	if err != nil || !correct {
+		t.Fatalf("got %v, %v", correct, err)
+	}
+	// argon2i, other parameters and a shorter key all need replacing
+	if !outdated {
+		t.Error("not outdated")
+	}
+	if correct, _, _ := ds.checkPassword(referenceHash, "Password"); correct {
+		t.Error("wrong password was accepted")
+	}
+}
+
+func TestParsePasswordHashErrors(t *testing.T) {
+	tests := map[string]string{
+		"empty":              "",
+		"no leading $":       "argon2id$v=19$m=64,t=1,p=1$c2FsdA$a2V5",
+		"too few fields":     "$argon2id$v=19$m=64,t=1,p=1$c2FsdA",
+		"too many fields":    "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$a2V5$",
+		"other algorithm":    "$argon2d$v=19$m=64,t=1,p=1$c2FsdA$a2V5",
+		"bcrypt":             "$2b$10$abcdefghijklmnopqrstuu5YkBNSQ6kQk0p0kq6aBKe3gXGXgN5Ge",
+		"old version":        "$argon2id$v=16$m=64,t=1,p=1$c2FsdA$a2V5",
+		"no version":         "$argon2id$m=64,t=1,p=1$c2FsdA$a2V5$",
+		"parameter no value": "$argon2id$v=19$m,t=1,p=1$c2FsdA$a2V5",
+		"negative memory":    "$argon2id$v=19$m=-64,t=1,p=1$c2FsdA$a2V5",
+		"huge memory":        "$argon2id$v=19$m=4294967296,t=1,p=1$c2FsdA$a2V5",
+		"too many threads":   "$argon2id$v=19$m=64,t=1,p=256$c2FsdA$a2V5",
+		"unknown parameter":  "$argon2id$v=19$m=64,t=1,p=1,x=1$c2FsdA$a2V5",
+		"missing time":       "$argon2id$v=19$m=64,p=1$c2FsdA$a2V5",
+		"zero threads":       "$argon2id$v=19$m=64,t=1,p=0$c2FsdA$a2V5",
+		"padded salt":        "$argon2id$v=19$m=64,t=1,p=1$c2FsdA==$a2V5",
+		"url-safe key":       "$argon2id$v=19$m=64,t=1,p=1$c2FsdA$a2V5-_",
+	}
+	for name, encoded := range tests {
+		if _, err := parsePasswordHash(encoded); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestPasswordHashRoundTrip(t *testing.T) {
+	ds := Datastore{passwordParams: PasswordParams{Time: 1, Memory: 64, Threads: 2}}
+	encoded, err := ds.newPasswordHash("correct horse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(encoded, "$argon2id$v=19$m=64,t=1,p=2$") {
+		t.Errorf("got %s", encoded)
+	}
+	correct, outdated, err := ds.checkPassword(encoded, "correct horse")
+	if err != nil || !correct || outdated {
+		t.Errorf("got correct %v, outdated %v, %v", correct, outdated, err)
+	}
+
+	ds.SetPasswordParams(PasswordParams{Time: 2, Memory: 64, Threads: 2})
+	if correct, outdated, _ := ds.checkPassword(encoded, "correct horse"); !correct || !outdated {
+		t.Errorf("after changing parameters: got correct %v, outdated %v", correct, outdated)
+	}
+}
+
+func TestAuthenticateUserRehashesOutdatedPasswords(t *testing.T) {
+	ds := newTestDatastore(t)
+	user := addTestUser(t, ds, "alice")
+	ds.SetPasswordParams(PasswordParams{Time: 2, Memory: 128, Threads: 1})
+	if id, ok, err := ds.AuthenticateUser("alice", "password"); err != nil || !ok || id != user {
+		t.Fatalf("got %v, %v", ok, err)
+	}
+	var stored string
+	ds.db.QueryRow(`select password_hash from user where id = ?`, user).Scan(&stored)
+	if !strings.HasPrefix(stored, "$argon2id$v=19$m=128,t=2,p=1$") {
+		t.Errorf("got %s after logging in", stored)
+	}
+	if _, ok, _ := ds.AuthenticateUser("alice", "wrong"); ok {
+		t.Error("wrong password was accepted")
+	}
+}
+
+func TestUpgradeLegacyPasswordHashes(t *testing.T) {
+	ds := newTestDatastore(t)
+	user := addTestUser(t, ds, "alice")
+	// how passwords were stored before the PHC format, with the salt in its own column
+	salt := []byte("0123456789abcdef")
+	key := deriveKey(algorithmArgon2i, legacyPasswordParams, "old password", salt, passwordKeySize)
+	_, err := ds.db.Exec(`update user set password_hash = ?, salt = ? where id = ?`,
+		base64.URLEncoding.EncodeToString(key), base64.URLEncoding.EncodeToString(salt), user)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := ds.UpgradeLegacyPasswordHashes()
+	if err != nil || n != 1 {
+		t.Fatalf("got %d, %v", n, err)
+	}
+	if _, ok, err := ds.AuthenticateUser("alice", "old password"); err != nil || !ok {
+		t.Errorf("can't log in after upgrading: %v, %v", ok, err)
+	}
+	if n, _ := ds.UpgradeLegacyPasswordHashes(); n != 0 {
+		t.Errorf("upgraded %d hashes the second time", n)
+	}
+}
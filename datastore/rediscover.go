@@ -0,0 +1,172 @@
+package datastore
+
+import (
+	"database/sql"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+const (
+	// Pick any old bookmark, favouring older and less-viewed ones
+	RediscoverRandom = "random"
+	// Pick whichever old bookmark has been waiting the longest to come back around
+	RediscoverScheduled = "scheduled"
+)
+
+// Bookmarks younger than this are never resurfaced
+const RediscoverMinAge = 7 * 24 * time.Hour
+const day = 24 * time.Hour
+
+// The longest a bookmark is put off for. Longer than ten years isn't useful, and much longer would overflow the due date.
+const MaxRediscoverDays = 3650
+
+type rediscoverCandidate struct {
+	id    int64
+	date  time.Time
+	views int64
+	due   sql.NullTime
+}
+
+// How strongly a random pick should favour this bookmark
+func (c rediscoverCandidate) weight(now time.Time) float64 {
+	age := now.Sub(c.date).Hours() / 24
+	return age / float64(1+c.views)
+}
+
+// Notes that a bookmark has been looked at
+func (ds *Datastore) RecordView(bookmarkId int64) error {
+	timestamp := time.Now().UTC()
+	_, err := ds.db.Exec(`insert into rediscovery (bookmark, views, last_seen) values (?, 1, ?)
+		on conflict (bookmark) do update set views = views + 1, last_seen = excluded.last_seen`,
+		bookmarkId, timestamp)
+	if err != nil {
+		return fmt.Errorf("recording view: %w", err)
+	}
+	return nil
+}
+
+// Picks an old bookmark to show again. Returns false if no bookmark is eligible.
+func (ds *Datastore) Rediscover(mode string) (Bookmark, bool, error) {
+	now := time.Now().UTC()
+	rows, err := ds.db.Query(`select bookmark.id, bookmark.date, coalesce(r.views, 0), r.due from bookmark
+		left join rediscovery as r on r.bookmark = bookmark.id
+		where bookmark.date < ? and not coalesce(r.dismissed, 0) and (r.due is null or r.due <= ?)`,
+		now.Add(-RediscoverMinAge), now)
+	if err != nil {
+		return Bookmark{}, false, fmt.Errorf("finding candidates: %w", err)
+	}
+	defer rows.Close()
+
+	candidates := make([]rediscoverCandidate, 0)
+	for rows.Next() {
+		var c rediscoverCandidate
+		err = rows.Scan(&c.id, &c.date, &c.views, &c.due)
+		if err != nil {
+			return Bookmark{}, false, fmt.Errorf("scanning candidate: %w", err)
+		}
+		candidates = append(candidates, c)
+	}
+	rows.Close()
+	if len(candidates) == 0 {
+		return Bookmark{}, false, nil
+	}
+
+	var picked rediscoverCandidate
+	switch mode {
+	case RediscoverRandom:
+		picked = pickWeighted(candidates, now)
+	case RediscoverScheduled:
+		picked = pickScheduled(candidates, now)
+	default:
+		return Bookmark{}, false, fmt.Errorf("unknown mode %s", mode)
+	}
+
+	bookmark, err := ds.GetBookmark(picked.id)
+	if err != nil {
+		return Bookmark{}, false, fmt.Errorf("getting bookmark %d: %w", picked.id, err)
+	}
+	return bookmark, true, nil
+}
+
+func pickWeighted(candidates []rediscoverCandidate, now time.Time) rediscoverCandidate {
+	var total float64
+	for _, c := range candidates {
+		total += c.weight(now)
+	}
+	target := rand.Float64() * total
+	for _, c := range candidates {
+		target -= c.weight(now)
+		if target <= 0 {
+			return c
+		}
+	}
+	return candidates[len(candidates)-1]
+}
+
+// Bookmarks that have never been scheduled count as due from the moment they became old enough
+func pickScheduled(candidates []rediscoverCandidate, now time.Time) rediscoverCandidate {
+	dueDate := func(c rediscoverCandidate) time.Time {
+		if c.due.Valid {
+			return c.due.Time
+		}
+		return c.date.Add(RediscoverMinAge)
+	}
+	picked := candidates[0]
+	for _, c := range candidates[1:] {
+		if dueDate(c).Before(dueDate(picked)) ||
+			(dueDate(c).Equal(dueDate(picked)) && c.weight(now) > picked.weight(now)) {
+			picked = c
+		}
+	}
+	return picked
+}
+
+// Marks a resurfaced bookmark as reviewed, so that it comes back after twice as long as last time,
+// up to MaxRediscoverDays
+func (ds *Datastore) KeepRediscovered(bookmarkId int64) error {
+	now := time.Now().UTC()
+	var interval int64
+	err := ds.db.QueryRow(`select interval from rediscovery where bookmark = ?`, bookmarkId).Scan(&interval)
+	if err != nil && err != sql.ErrNoRows {
+		return fmt.Errorf("getting interval: %w", err)
+	}
+	switch {
+	case interval < 1:
+		interval = 1
+	case interval > MaxRediscoverDays/2:
+		interval = MaxRediscoverDays
+	default:
+		interval *= 2
+	}
+	_, err = ds.db.Exec(`insert into rediscovery (bookmark, interval, due) values (?, ?, ?)
+		on conflict (bookmark) do update set interval = excluded.interval, due = excluded.due`,
+		bookmarkId, interval, now.Add(time.Duration(interval)*day))
+	if err != nil {
+		return fmt.Errorf("rescheduling bookmark: %w", err)
+	}
+	return nil
+}
+
+// Hides a bookmark from rediscovery for the given number of days, without changing its schedule
+func (ds *Datastore) SnoozeRediscovered(bookmarkId int64, days int) error {
+	due := time.Now().UTC().Add(time.Duration(days) * day)
+	_, err := ds.db.Exec(`insert into rediscovery (bookmark, due) values (?, ?)
+		on conflict (bookmark) do update set due = excluded.due`,
+		bookmarkId, due)
+	if err != nil {
+		return fmt.Errorf("snoozing bookmark: %w", err)
+	}
+	return nil
+}
+
+// Stops a bookmark from ever being resurfaced again
+func (ds *Datastore) DismissRediscovered(bookmarkId int64) error {
+	_, err := ds.db.Exec(`insert into rediscovery (bookmark, dismissed) values (?, 1)
+		on conflict (bookmark) do update set dismissed = 1`,
+		bookmarkId)
+	if err != nil {
+		return fmt.Errorf("dismissing bookmark: %w", err)
+	}
+	return nil
+}
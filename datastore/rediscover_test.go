@@ -0,0 +1,117 @@
+package datastore
+
+import (
+	"testing"
+	"time"
+)
+
+// Makes a bookmark that's old enough to be rediscovered
+func addOldBookmark(t *testing.T, ds *Datastore, name string, age time.Duration) int64 {
+	t.Helper()
+	id := addTestBookmark(t, ds, name)
+	_, err := ds.db.Exec(`update bookmark set date = ? where id = ?`, time.Now().UTC().Add(-age), id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+func rediscoverySchedule(t *testing.T, ds *Datastore, id int64) (int64, time.Time) {
+	t.Helper()
+	var interval int64
+	var due time.Time
+	err := ds.db.QueryRow(`select interval, due from rediscovery where bookmark = ?`, id).Scan(&interval, &due)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return interval, due
+}
+
+func near(a, b time.Time) bool {
+	difference := a.Sub(b)
+	return difference < time.Minute && difference > -time.Minute
+}
+
+func TestKeepRediscoveredDoubles(t *testing.T) {
+	ds := newTestDatastore(t)
+	id := addOldBookmark(t, ds, "old", 30*day)
+	for _, want := range []int64{1, 2, 4, 8} {
+		if err := ds.KeepRediscovered(id); err != nil {
+			t.Fatal(err)
+		}
+		interval, due := rediscoverySchedule(t, ds, id)
+		wantDue := time.Now().UTC().Add(time.Duration(want) * day)
+		if interval != want || !near(due, wantDue) {
+			t.Errorf("got interval %d due %s, want %d due %s", interval, due, want, wantDue)
+		}
+	}
+}
+
+func TestKeepRediscoveredIsCapped(t *testing.T) {
+	ds := newTestDatastore(t)
+	id := addOldBookmark(t, ds, "old", 30*day)
+	// enough doublings to overflow an int64 many times over
+	for i := 0; i < 100; i++ {
+		if err := ds.KeepRediscovered(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+	interval, due := rediscoverySchedule(t, ds, id)
+	wantDue := time.Now().UTC().Add(MaxRediscoverDays * day)
+	if interval != MaxRediscoverDays || !near(due, wantDue) {
+		t.Errorf("got interval %d due %s", interval, due)
+	}
+
+	// intervals saved before there was a cap are brought back down
+	_, err := ds.db.Exec(`update rediscovery set interval = ? where bookmark = ?`, int64(1)<<62, id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.KeepRediscovered(id); err != nil {
+		t.Fatal(err)
+	}
+	if interval, _ := rediscoverySchedule(t, ds, id); interval != MaxRediscoverDays {
+		t.Errorf("got interval %d", interval)
+	}
+}
+
+func TestRediscover(t *testing.T) {
+	ds := newTestDatastore(t)
+	addTestBookmark(t, ds, "new")
+	if _, found, err := ds.Rediscover(RediscoverRandom); err != nil || found {
+		t.Fatalf("found a bookmark that's too new: %t, %v", found, err)
+	}
+
+	older := addOldBookmark(t, ds, "older", 60*day)
+	old := addOldBookmark(t, ds, "old", 30*day)
+	for _, mode := range []string{RediscoverRandom, RediscoverScheduled} {
+		bookmark, found, err := ds.Rediscover(mode)
+		if err != nil || !found || (bookmark.Id != old && bookmark.Id != older) {
+			t.Errorf("%s: got %+v, %t, %v", mode, bookmark, found, err)
+		}
+	}
+	// the one that became old enough first has been due for longest
+	if bookmark, _, _ := ds.Rediscover(RediscoverScheduled); bookmark.Id != older {
+		t.Errorf("scheduled picked %s", bookmark.Name)
+	}
+
+	if err := ds.KeepRediscovered(older); err != nil {
+		t.Fatal(err)
+	}
+	if err := ds.DismissRediscovered(old); err != nil {
+		t.Fatal(err)
+	}
+	if bookmark, found, err := ds.Rediscover(RediscoverRandom); err != nil || found {
+		t.Errorf("kept and dismissed bookmarks came back: %+v, %v", bookmark, err)
+	}
+
+	if err := ds.SnoozeRediscovered(older, 0); err != nil {
+		t.Fatal(err)
+	}
+	if bookmark, found, err := ds.Rediscover(RediscoverScheduled); err != nil || !found || bookmark.Id != older {
+		t.Errorf("got %+v, %t, %v", bookmark, found, err)
+	}
+	if _, _, err := ds.Rediscover("sideways"); err == nil {
+		t.Error("unknown mode was accepted")
+	}
+}
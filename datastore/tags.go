@@ -1,7 +1,6 @@
 package datastore
 
 import (
-	"database/sql"
 	"fmt"
 )
 
@@ -51,7 +50,7 @@ func (ds *Datastore) getBookmarkTags(bookmarkId int64) ([]string, error) {
 	return tags, nil
 }
 
-func setBookmarkTags(bookmarkId int64, tags []string, tx *sql.Tx) error {
+func setBookmarkTags(bookmarkId int64, tags []string, tx timedTx) error {
 	lowerTags := stringsToLower(tags)
 	for _, tag := range lowerTags {
 		var exists int
@@ -0,0 +1,223 @@
+package datastore
+
+import (
+	"context"
+	"database/sql"
+	"encoding/base32"
+	"fmt"
+	"local/bookmarks/totp"
+	"strings"
+	"time"
+)
+
+const LoginChallengeCookieName = "bookmark_login_challenge"
+
+// How long a user has to enter their second factor after entering their password
+const LoginChallengeTtl = 5 * time.Minute
+const loginChallengeSize = 32
+
+const recoveryCodeCount = 10
+const recoveryCodeSize = 10
+
+// Whether the user has to enter a one-time code to log in
+func (ds *Datastore) TotpEnabled(user int64) (bool, error) {
+	var enabled bool
+	err := ds.db.QueryRow(`select totp_enabled from user where id = ?`, user).Scan(&enabled)
+	if err != nil {
+		return false, fmt.Errorf("getting user: %w", err)
+	}
+	return enabled, nil
+}
+
+// Returns the secret of an enrollment that has been started but not confirmed, if there is one
+func (ds *Datastore) PendingTotpSecret(user int64) (string, bool, error) {
+	var secret sql.NullString
+	var enabled bool
+	err := ds.db.QueryRow(`select totp_secret, totp_enabled from user where id = ?`, user).Scan(&secret, &enabled)
+	if err != nil {
+		return "", false, fmt.Errorf("getting user: %w", err)
+	}
+	if enabled || !secret.Valid {
+		return "", false, nil
+	}
+	return secret.String, true, nil
+}
+
+// Generates a new secret for the user. It isn't used for logins until ConfirmTotp succeeds.
+func (ds *Datastore) StartTotpEnrollment(user int64) error {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		return fmt.Errorf("generating secret: %w", err)
+	}
+	_, err = ds.db.Exec(`update user set totp_secret = ?, totp_last_step = 0 where id = ? and not totp_enabled`,
+		secret, user)
+	if err != nil {
+		return fmt.Errorf("updating user: %w", err)
+	}
+	return nil
+}
+
+// Turns on two-factor authentication if the code matches the pending secret.
+// Returns a fresh set of recovery codes, which are only ever available here.
+func (ds *Datastore) ConfirmTotp(user int64, code string) ([]string, bool, error) {
+	secret, pending, err := ds.PendingTotpSecret(user)
+	if err != nil {
+		return nil, false, err
+	}
+	if !pending {
+		return nil, false, nil
+	}
+	step, valid, err := totp.Validate(secret, code, time.Now())
+	if err != nil {
+		return nil, false, fmt.Errorf("validating code: %w", err)
+	}
+	if !valid {
+		return nil, false, nil
+	}
+
+	codes := make([]string, 0, recoveryCodeCount)
+	for i := 0; i < recoveryCodeCount; i += 1 {
+		codeBytes, err := randomBytes(recoveryCodeSize)
+		if err != nil {
+			return nil, false, fmt.Errorf("generating recovery code: %w", err)
+		}
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(codeBytes))[:recoveryCodeSize]
+		codes = append(codes, code[:5]+"-"+code[5:])
+	}
+
+	ctx, stop := context.WithCancel(context.Background())
+	tx, err := ds.db.BeginTx(ctx, nil)
+	if err != nil {
+		stop()
+		return nil, false, fmt.Errorf("beginning transaction: %w", err)
+	}
+	_, err = tx.Exec(`update user set totp_enabled = 1, totp_last_step = ? where id = ?`, step, user)
+	if err != nil {
+		stop()
+		return nil, false, fmt.Errorf("enabling totp: %w", err)
+	}
+	_, err = tx.Exec(`delete from totp_recovery_code where user = ?`, user)
+	if err != nil {
+		stop()
+		return nil, false, fmt.Errorf("deleting old recovery codes: %w", err)
+	}
+	for _, code := range codes {
+		_, err = tx.Exec(`insert into totp_recovery_code (user, code_hash) values (?, ?)`,
+			user, hashKey(normalizeRecoveryCode(code)))
+		if err != nil {
+			stop()
+			return nil, false, fmt.Errorf("inserting recovery code: %w", err)
+		}
+	}
+	err = tx.Commit()
+	stop()
+	if err != nil {
+		return nil, false, fmt.Errorf("committing transaction: %w", err)
+	}
+	return codes, true, nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+}
+
+// Checks a one-time code or an unused recovery code. Each code only works once.
+func (ds *Datastore) CheckTotp(user int64, code string) (bool, error) {
+	var secret sql.NullString
+	var enabled bool
+	err := ds.db.QueryRow(`select totp_secret, totp_enabled from user where id = ?`, user).
+		Scan(&secret, &enabled)
+	if err != nil {
+		return false, fmt.Errorf("getting user: %w", err)
+	}
+	if !enabled || !secret.Valid {
+		return false, nil
+	}
+
+	step, valid, err := totp.Validate(secret.String, code, time.Now())
+	if err != nil {
+		return false, fmt.Errorf("validating code: %w", err)
+	}
+	if valid {
+		// only one of two requests racing with the same code gets to move the last step forward
+		result, err := ds.db.Exec(`update user set totp_last_step = ? where id = ? and totp_last_step < ?`,
+			step, user, step)
+		if err != nil {
+			return false, fmt.Errorf("updating last step: %w", err)
+		}
+		updated, err := result.RowsAffected()
+		if err != nil {
+			return false, fmt.Errorf("updating last step: %w", err)
+		}
+		return updated == 1, nil
+	}
+
+	result, err := ds.db.Exec(`update totp_recovery_code set used = 1 where user = ? and code_hash = ? and not used`,
+		user, hashKey(normalizeRecoveryCode(code)))
+	if err != nil {
+		return false, fmt.Errorf("using recovery code: %w", err)
+	}
+	used, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("using recovery code: %w", err)
+	}
+	return used > 0, nil
+}
+
+func (ds *Datastore) RemainingRecoveryCodes(user int64) (int64, error) {
+	var n int64
+	err := ds.db.QueryRow(`select count(*) from totp_recovery_code where user = ? and not used`, user).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("counting recovery codes: %w", err)
+	}
+	return n, nil
+}
+
+// Turns off two-factor authentication and forgets the secret and recovery codes
+func (ds *Datastore) DisableTotp(user int64) error {
+	_, err := ds.db.Exec(`update user set totp_secret = null, totp_enabled = 0, totp_last_step = 0 where id = ?`, user)
+	if err != nil {
+		return fmt.Errorf("updating user: %w", err)
+	}
+	_, err = ds.db.Exec(`delete from totp_recovery_code where user = ?`, user)
+	if err != nil {
+		return fmt.Errorf("deleting recovery codes: %w", err)
+	}
+	return nil
+}
+
+// Records that the user has entered their password, and returns a token to send back with their second factor
+func (ds *Datastore) CreateLoginChallenge(user int64) (string, error) {
+	tokenBytes, err := randomBytes(loginChallengeSize)
+	if err != nil {
+		return "", fmt.Errorf("generating token: %w", err)
+	}
+	token := base32.StdEncoding.EncodeToString(tokenBytes)
+	_, err = ds.db.Exec(`insert into login_challenge (user, token_hash, timestamp) values (?, ?, ?)`,
+		user, hashKey(token), time.Now().UTC())
+	if err != nil {
+		return "", fmt.Errorf("inserting challenge: %w", err)
+	}
+	return token, nil
+}
+
+// Finds the user who a login challenge was issued to, if it hasn't expired
+func (ds *Datastore) GetLoginChallenge(token string) (int64, bool, error) {
+	var user int64
+	err := ds.db.QueryRow(`select user from login_challenge where token_hash = ? and timestamp > ?`,
+		hashKey(token), time.Now().UTC().Add(-LoginChallengeTtl)).Scan(&user)
+	if err == sql.ErrNoRows {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("finding challenge: %w", err)
+	}
+	return user, true, nil
+}
+
+// Deletes the challenge once it's been answered, along with any that have expired
+func (ds *Datastore) DeleteLoginChallenge(token string) error {
+	_, err := ds.db.Exec(`delete from login_challenge where token_hash = ? or timestamp < ?`,
+		hashKey(token), time.Now().UTC().Add(-LoginChallengeTtl))
+	return err
+}
@@ -0,0 +1,117 @@
+package datastore
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"local/bookmarks/totp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// The code an authenticator app would show for secret right now
+func currentCode(t *testing.T, secret string) string {
+	t.Helper()
+	key, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var counter [8]byte
+	binary.BigEndian.PutUint64(counter[:], uint64(totp.Step(time.Now())))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(counter[:])
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0xf
+	return fmt.Sprintf("%06d", binary.BigEndian.Uint32(sum[offset:offset+4])&0x7fffffff%1000000)
+}
+
+// Enrolls a new user in two-factor authentication, and returns them with their secret
+func addTotpUser(t *testing.T, ds *Datastore) (int64, string) {
+	t.Helper()
+	user := addTestUser(t, ds, "alice")
+	err := ds.StartTotpEnrollment(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _, err := ds.PendingTotpSecret(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// confirm as if it were the step before, so the current code hasn't been used yet
+	_, err = ds.db.Exec(`update user set totp_enabled = 1, totp_last_step = ? where id = ?`,
+		totp.Step(time.Now())-2, user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return user, secret
+}
+
+func TestCheckTotpRejectsReplay(t *testing.T) {
+	ds := newTestDatastore(t)
+	user, secret := addTotpUser(t, ds)
+	code := currentCode(t, secret)
+	if ok, err := ds.CheckTotp(user, code); err != nil || !ok {
+		t.Fatalf("first use: got %v, %v", ok, err)
+	}
+	if ok, err := ds.CheckTotp(user, code); err != nil || ok {
+		t.Errorf("second use: got %v, %v", ok, err)
+	}
+}
+
+func TestCheckTotpConcurrentUseSucceedsOnce(t *testing.T) {
+	ds := newTestDatastore(t)
+	user, secret := addTotpUser(t, ds)
+	code := currentCode(t, secret)
+
+	var wg sync.WaitGroup
+	var mutex sync.Mutex
+	successes := 0
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ok, err := ds.CheckTotp(user, code)
+			if err != nil {
+				t.Error(err)
+			}
+			if ok {
+				mutex.Lock()
+				successes++
+				mutex.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if successes != 1 {
+		t.Errorf("code was accepted %d times", successes)
+	}
+}
+
+func TestCheckTotpRecoveryCodeWorksOnce(t *testing.T) {
+	ds := newTestDatastore(t)
+	user := addTestUser(t, ds, "alice")
+	err := ds.StartTotpEnrollment(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _, err := ds.PendingTotpSecret(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codes, ok, err := ds.ConfirmTotp(user, currentCode(t, secret))
+	if err != nil || !ok {
+		t.Fatalf("confirming: got %v, %v", ok, err)
+	}
+	if ok, err := ds.CheckTotp(user, " "+codes[0]+" "); err != nil || !ok {
+		t.Fatalf("first use: got %v, %v", ok, err)
+	}
+	if ok, err := ds.CheckTotp(user, codes[0]); err != nil || ok {
+		t.Errorf("second use: got %v, %v", ok, err)
+	}
+	if n, _ := ds.RemainingRecoveryCodes(user); n != recoveryCodeCount-1 {
+		t.Errorf("got %d recovery codes left", n)
+	}
+}
@@ -0,0 +1,101 @@
+package datastore
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// A user as shown on the admin page
+type User struct {
+	Id          int64
+	Username    string
+	Admin       bool
+	Disabled    bool
+	HasPassword bool
+	TotpEnabled bool
+}
+
+const userColumns = "id, username, admin, disabled, password_hash is not null, totp_enabled"
+
+func scanUser(row interface{ Scan(...interface{}) error }) (User, error) {
+	var user User
+	err := row.Scan(&user.Id, &user.Username, &user.Admin, &user.Disabled, &user.HasPassword, &user.TotpEnabled)
+	return user, err
+}
+
+func (ds *Datastore) GetUsers() ([]User, error) {
+	rows, err := ds.db.Query(`select ` + userColumns + ` from user order by username`)
+	if err != nil {
+		return nil, fmt.Errorf("listing users: %w", err)
+	}
+	defer rows.Close()
+	users := make([]User, 0)
+	for rows.Next() {
+		user, err := scanUser(rows)
+		if err != nil {
+			return nil, fmt.Errorf("scanning user: %w", err)
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
+
+func (ds *Datastore) GetUser(id int64) (User, bool, error) {
+	user, err := scanUser(ds.db.QueryRow(`select `+userColumns+` from user where id = ?`, id))
+	if err == sql.ErrNoRows {
+		return User{}, false, nil
+	}
+	if err != nil {
+		return User{}, false, fmt.Errorf("getting user: %w", err)
+	}
+	return user, true, nil
+}
+
+func (ds *Datastore) SetUserPassword(id int64, password string) error {
+	hash, err := ds.newPasswordHash(password)
+	if err != nil {
+		return err
+	}
+	_, err = ds.db.Exec(`update user set password_hash = ?, salt = null where id = ?`, hash, id)
+	if err != nil {
+		return fmt.Errorf("updating user: %w", err)
+	}
+	return nil
+}
+
+func (ds *Datastore) SetUserAdmin(id int64, admin bool) error {
+	_, err := ds.db.Exec(`update user set admin = ? where id = ?`, admin, id)
+	if err != nil {
+		return fmt.Errorf("updating user: %w", err)
+	}
+	return nil
+}
+
+// Stops a user from logging in. Disabling a user also logs them out everywhere.
+func (ds *Datastore) SetUserDisabled(id int64, disabled bool) error {
+	_, err := ds.db.Exec(`update user set disabled = ? where id = ?`, disabled, id)
+	if err != nil {
+		return fmt.Errorf("updating user: %w", err)
+	}
+	if disabled {
+		return ds.RevokeAllSessions(id)
+	}
+	return nil
+}
+
+func (ds *Datastore) DeleteUser(id int64) error {
+	_, err := ds.db.Exec(`delete from user where id = ?`, id)
+	if err != nil {
+		return fmt.Errorf("deleting user: %w", err)
+	}
+	return nil
+}
+
+// Logs the user out everywhere except the session they're using, like after they change their password
+func (ds *Datastore) RevokeOtherSessions(user, keepSession int64) error {
+	_, err := ds.db.Exec(`delete from session where user = ? and id != ?`, user, keepSession)
+	if err != nil {
+		return fmt.Errorf("deleting sessions: %w", err)
+	}
+	return nil
+}
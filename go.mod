@@ -5,5 +5,8 @@ go 1.16
 require (
 	github.com/julienschmidt/httprouter v1.3.0
 	github.com/mattn/go-sqlite3 v1.14.6
-	golang.org/x/crypto v0.0.0-20210415154028-4f45737414dc
+	github.com/microcosm-cc/bluemonday v1.0.27
+	github.com/skip2/go-qrcode v0.0.0-20200617195104-da1b6568686e
+	github.com/yuin/goldmark v1.4.13
+	golang.org/x/crypto v0.24.0
 )
@@ -0,0 +1,169 @@
+// Structured logs, written as logfmt or JSON lines with a level on each message.
+// Anything written with the standard log package comes out as info messages in the same format.
+package logging
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return "level" + strconv.Itoa(int(l))
+	}
+	return levelNames[l]
+}
+
+func ParseLevel(name string) (Level, error) {
+	for i, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q (use one of %s)", name, strings.Join(levelNames, ", "))
+}
+
+const (
+	FormatText = "text"
+	FormatJson = "json"
+)
+
+type logger struct {
+	mutex sync.Mutex
+	out   io.Writer
+	json  bool
+	level Level
+}
+
+var defaultLogger = &logger{out: os.Stderr, level: LevelInfo}
+
+// Sends every log message to stderr in the given format, leaving out messages below level
+func Setup(format string, level Level) error {
+	if format != FormatText && format != FormatJson {
+		return fmt.Errorf("unknown log format %q (use %s or %s)", format, FormatText, FormatJson)
+	}
+	defaultLogger.mutex.Lock()
+	defaultLogger.json = format == FormatJson
+	defaultLogger.level = level
+	defaultLogger.mutex.Unlock()
+	log.SetFlags(0)
+	log.SetOutput(stdLogWriter{})
+	return nil
+}
+
+// Logs a message, followed by fields given as pairs of keys and values
+func Log(level Level, msg string, fields ...interface{}) {
+	defaultLogger.log(level, msg, fields)
+}
+
+func Debugf(format string, args ...interface{}) {
+	defaultLogger.log(LevelDebug, fmt.Sprintf(format, args...), nil)
+}
+
+func Infof(format string, args ...interface{}) {
+	defaultLogger.log(LevelInfo, fmt.Sprintf(format, args...), nil)
+}
+
+func Warnf(format string, args ...interface{}) {
+	defaultLogger.log(LevelWarn, fmt.Sprintf(format, args...), nil)
+}
+
+func Errorf(format string, args ...interface{}) {
+	defaultLogger.log(LevelError, fmt.Sprintf(format, args...), nil)
+}
+
+// Logs an error and exits
+func Fatalf(format string, args ...interface{}) {
+	defaultLogger.log(LevelError, fmt.Sprintf(format, args...), nil)
+	os.Exit(1)
+}
+
+// Turns lines from the standard log package into info messages
+type stdLogWriter struct{}
+
+func (stdLogWriter) Write(line []byte) (int, error) {
+	defaultLogger.log(LevelInfo, strings.TrimSuffix(string(line), "\n"), nil)
+	return len(line), nil
+}
+
+func (l *logger) log(level Level, msg string, fields []interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if level < l.level {
+		return
+	}
+	all := append([]interface{}{"time", time.Now().UTC().Format("2006-01-02T15:04:05.000Z"), "level", level.String(), "msg", msg}, fields...)
+	var line bytes.Buffer
+	if l.json {
+		line.WriteByte('{')
+	}
+	for i := 0; i+1 < len(all); i += 2 {
+		key := fmt.Sprint(all[i])
+		if l.json {
+			if i > 0 {
+				line.WriteByte(',')
+			}
+			writeJson(&line, key)
+			line.WriteByte(':')
+			writeJson(&line, all[i+1])
+		} else {
+			if i > 0 {
+				line.WriteByte(' ')
+			}
+			line.WriteString(key)
+			line.WriteByte('=')
+			line.WriteString(logfmtValue(all[i+1]))
+		}
+	}
+	if l.json {
+		line.WriteByte('}')
+	}
+	line.WriteByte('\n')
+	l.out.Write(line.Bytes())
+}
+
+func writeJson(line *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case fmt.Stringer:
+		value = v.String()
+	}
+	var encoded bytes.Buffer
+	encoder := json.NewEncoder(&encoded)
+	// urls are logged as they are, rather than with & and < escaped for html
+	encoder.SetEscapeHTML(false)
+	if encoder.Encode(value) != nil {
+		encoded.Reset()
+		encoder.Encode(fmt.Sprint(value))
+	}
+	line.Write(bytes.TrimSuffix(encoded.Bytes(), []byte("\n")))
+}
+
+// Values are quoted if they're empty or have anything in them that would make the line ambiguous
+func logfmtValue(value interface{}) string {
+	s := fmt.Sprint(value)
+	if s == "" || strings.ContainsAny(s, " =\"\\") || strings.IndexFunc(s, func(r rune) bool { return r < ' ' || r == 0x7f }) >= 0 {
+		return strconv.Quote(s)
+	}
+	return s
+}
@@ -1,18 +1,31 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"embed"
 	"flag"
 	"fmt"
 	"io/fs"
+	"local/bookmarks/backups"
+	"local/bookmarks/certs"
 	"local/bookmarks/datastore"
+	"local/bookmarks/logging"
+	"local/bookmarks/oidc"
 	"local/bookmarks/server"
+	"local/bookmarks/settings"
 	"local/bookmarks/templates"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -36,6 +49,11 @@ func main() {
 	commandList = []command{
 		serverCommand(),
 		manageUserCommand(),
+		inviteCommand(),
+		configCommand(),
+		certCommand(),
+		backupCommand(),
+		restoreCommand(),
 		helpCommand(),
 	}
 	if len(os.Args) < 2 {
@@ -54,28 +72,250 @@ func main() {
 }
 
 type serveConfig struct {
-	port            uint
-	dbFile          string
-	sessionAgeHours uint
+	configFile             string
+	listen                 string
+	port                   uint
+	basePath               string
+	dbFile                 string
+	tlsCert                string
+	tlsKey                 string
+	redirectHttp           string
+	shutdownTimeoutSeconds uint
+	metrics                bool
+	metricsListen          string
+	logFormat              string
+	logLevel               string
+	sessionAgeHours        uint
+	sessionIdleHours       uint
+	insecureCookies        bool
+	keyIdleDays            uint
+	trustedProxies         string
+	passkeyOrigin          string
+	password               passwordConfig
+	backup                 backupConfig
+	oidc                   oidcConfig
+	proxyAuth              proxyAuthConfig
 }
 
-func serverCommand() command {
-	config := serveConfig{}
-	flags := flag.NewFlagSet("serve", flag.ContinueOnError)
+type passwordConfig struct {
+	time      uint
+	memoryMiB uint
+	threads   uint
+}
+
+type backupConfig struct {
+	dir           string
+	intervalHours uint
+	keep          uint
+}
+
+type proxyAuthConfig struct {
+	header         string
+	trustedProxies string
+	autoCreate     bool
+}
+
+type oidcConfig struct {
+	issuer        string
+	clientId      string
+	clientSecret  string
+	redirectUrl   string
+	usernameClaim string
+	autoCreate    bool
+	linkExisting  bool
+}
+
+// Environment variables that set serve's flags start with this, like BOOKMARKS_DB for -db
+const envPrefix = "BOOKMARKS_"
+
+func serveFlags(name string, config *serveConfig) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.StringVar(&config.configFile, "config", "", "TOML file to read settings from, named like these flags (flags and "+envPrefix+"* environment variables take precedence)")
+	flags.StringVar(&config.listen, "listen", "", "address to listen on, like 127.0.0.1:8080 (overrides -port)")
 	flags.UintVar(&config.port, "port", 8080, "port to serve on")
+	flags.StringVar(&config.basePath, "base-path", "", "path to serve everything under, like /bookmarks-app, when sharing a host behind a reverse proxy")
 	flags.StringVar(&config.dbFile, "db", "./bookmarks.db", "location of the bookmarks database")
-	flags.UintVar(&config.sessionAgeHours, "session-age", 24*30, "max number of hours that a session should stay alive")
+	flags.StringVar(&config.tlsCert, "tls-cert", "", "PEM certificate file to serve https with; it's reloaded when it changes, or on SIGHUP")
+	flags.StringVar(&config.tlsKey, "tls-key", "", "PEM private key file for -tls-cert")
+	flags.StringVar(&config.redirectHttp, "redirect-http", "", "also listen for plain http on this address, like :80, and redirect it to https")
+	flags.UintVar(&config.shutdownTimeoutSeconds, "shutdown-timeout", 30, "seconds to wait for requests to finish when shutting down")
+	flags.BoolVar(&config.metrics, "metrics", false, "serve Prometheus metrics at /metrics, without logging in")
+	flags.StringVar(&config.metricsListen, "metrics-listen", "", "serve Prometheus metrics on this address instead, like 127.0.0.1:9100, so they can be kept off the public listener")
+	flags.StringVar(&config.logFormat, "log-format", logging.FormatText, "log as logfmt "+logging.FormatText+" or as "+logging.FormatJson+" lines")
+	flags.StringVar(&config.logLevel, "log-level", logging.LevelInfo.String(), "least important messages to log: debug, info, warn or error")
+	flags.UintVar(&config.sessionAgeHours, "session-age", uint(datastore.DefaultSessionPolicy.MaxAge/time.Hour), "max number of hours that a session should stay alive")
+	flags.UintVar(&config.sessionIdleHours, "session-idle", 0, "log sessions out after this many hours without being used (0 to only use -session-age)")
+	flags.BoolVar(&config.insecureCookies, "insecure-cookies", false, "send cookies over plain http too, for local development")
+	flags.UintVar(&config.keyIdleDays, "disable-idle-keys", 0, "disable api keys that haven't been used in this many days (0 to never disable them)")
+	flags.UintVar(&config.password.time, "password-time", uint(datastore.DefaultPasswordParams.Time), "argon2 passes when hashing passwords")
+	flags.UintVar(&config.password.memoryMiB, "password-memory", uint(datastore.DefaultPasswordParams.Memory/1024), "MiB of memory argon2 uses when hashing passwords")
+	flags.UintVar(&config.password.threads, "password-threads", uint(datastore.DefaultPasswordParams.Threads), "argon2 threads when hashing passwords")
+	flags.StringVar(&config.backup.dir, "backup-dir", "", "directory to back the database up to while serving (leave empty to not take backups)")
+	flags.UintVar(&config.backup.intervalHours, "backup-interval", 24, "hours between backups in -backup-dir")
+	flags.UintVar(&config.backup.keep, "backup-keep", 7, "number of backups to keep in -backup-dir; older ones are deleted")
+	flags.StringVar(&config.oidc.issuer, "oidc-issuer", "", "issuer url of an OpenID Connect provider to offer single sign-on with (leave empty to turn it off)")
+	flags.StringVar(&config.oidc.clientId, "oidc-client-id", "", "client id registered with the OpenID Connect provider")
+	flags.StringVar(&config.oidc.clientSecret, "oidc-client-secret", "", "client secret registered with the OpenID Connect provider, if it gave you one")
+	flags.StringVar(&config.oidc.redirectUrl, "oidc-redirect-url", "", "public url of /login/oidc/callback, as registered with the OpenID Connect provider")
+	flags.StringVar(&config.oidc.usernameClaim, "oidc-username-claim", "preferred_username", "id token claim that holds the username")
+	flags.BoolVar(&config.oidc.autoCreate, "oidc-auto-create", false, "add users the first time they log in with single sign-on")
+	flags.BoolVar(&config.oidc.linkExisting, "oidc-link-existing", false, "let people log in as an existing user with the same -oidc-username-claim the first time they use single sign-on; only set this if nobody can pick their own username at the provider")
+	flags.StringVar(&config.passkeyOrigin, "passkey-origin", "", "scheme and host the site is reached at, like https://bookmarks.example.com, which passkeys are tied to (leave empty to use the Host header of each request)")
+	flags.StringVar(&config.trustedProxies, "trusted-proxies", "", "comma-separated ips or cidr ranges of reverse proxies whose X-Forwarded-For header says who the client is, for logs and rate limits")
+	flags.StringVar(&config.proxyAuth.header, "proxy-auth-header", "", "trust this header (like X-Forwarded-User) to name the logged-in user, when it comes from a trusted proxy")
+	flags.StringVar(&config.proxyAuth.trustedProxies, "proxy-auth-trusted", "", "comma-separated ips or cidr ranges of the proxies allowed to set -proxy-auth-header")
+	flags.BoolVar(&config.proxyAuth.autoCreate, "proxy-auth-auto-create", false, "add users the first time the proxy sends them")
+	return flags
+}
+
+// Settings that are printed as <redacted> by config check
+var secretSettings = map[string]bool{
+	"oidc-client-secret": true,
+}
+
+func serverCommand() command {
+	config := serveConfig{}
+	flags := serveFlags("serve", &config)
 	return command{
 		flags: flags,
 		run: func() {
-			flags.Parse(os.Args[2:])
+			_, err := settings.Load(flags, os.Args[2:], envPrefix, "config")
+			if err == nil {
+				err = config.check()
+			}
+			if err != nil {
+				fmt.Printf("%s\n", err)
+				os.Exit(1)
+			}
 			serve(config)
 		},
 	}
 }
 
+// Checks settings that can't be right, so that serve doesn't start with them
+func (config serveConfig) check() error {
+	if _, _, err := net.SplitHostPort(config.listenAddress()); err != nil {
+		return fmt.Errorf("bad -listen address: %w", err)
+	}
+	if base := config.normalizedBasePath(); base != "" && (!strings.HasPrefix(base, "/") || strings.ContainsAny(base, "?#")) {
+		return fmt.Errorf("-base-path has to be a path starting with /, like /bookmarks-app")
+	}
+	if config.logFormat != logging.FormatText && config.logFormat != logging.FormatJson {
+		return fmt.Errorf("-log-format has to be %s or %s", logging.FormatText, logging.FormatJson)
+	}
+	if _, err := logging.ParseLevel(config.logLevel); err != nil {
+		return fmt.Errorf("bad -log-level: %w", err)
+	}
+	if config.metrics && config.metricsListen != "" {
+		return fmt.Errorf("-metrics and -metrics-listen can't be used together")
+	}
+	if config.metricsListen != "" {
+		if _, _, err := net.SplitHostPort(config.metricsListen); err != nil {
+			return fmt.Errorf("bad -metrics-listen address: %w", err)
+		}
+	}
+	if config.backup.dir != "" && (config.backup.intervalHours == 0 || config.backup.keep == 0) {
+		return fmt.Errorf("-backup-interval and -backup-keep have to be at least 1")
+	}
+	if (config.tlsCert == "") != (config.tlsKey == "") {
+		return fmt.Errorf("-tls-cert and -tls-key go together")
+	}
+	if config.tlsCert != "" {
+		_, err := tls.LoadX509KeyPair(config.tlsCert, config.tlsKey)
+		if err != nil {
+			return fmt.Errorf("loading -tls-cert and -tls-key: %w", err)
+		}
+	}
+	if config.redirectHttp != "" {
+		if config.tlsCert == "" {
+			return fmt.Errorf("-redirect-http needs -tls-cert and -tls-key")
+		}
+		if _, _, err := net.SplitHostPort(config.redirectHttp); err != nil {
+			return fmt.Errorf("bad -redirect-http address: %w", err)
+		}
+	}
+	if config.password.time == 0 || config.password.memoryMiB == 0 || config.password.threads == 0 || config.password.threads > 255 {
+		return fmt.Errorf("-password-time, -password-memory and -password-threads must be positive, with at most 255 threads")
+	}
+	if config.sessionAgeHours == 0 {
+		return fmt.Errorf("-session-age must be positive")
+	}
+	if config.oidc.issuer != "" && (config.oidc.clientId == "" || config.oidc.redirectUrl == "") {
+		return fmt.Errorf("-oidc-client-id and -oidc-redirect-url are needed for single sign-on")
+	}
+	if config.passkeyOrigin != "" {
+		u, err := url.Parse(config.passkeyOrigin)
+		if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" || strings.Trim(u.Path, "/") != "" || u.RawQuery != "" {
+			return fmt.Errorf("-passkey-origin has to be a scheme and host, like https://bookmarks.example.com")
+		}
+	}
+	if _, err := parseCidrs(config.trustedProxies); err != nil {
+		return fmt.Errorf("parsing -trusted-proxies: %w", err)
+	}
+	if config.proxyAuth.header != "" {
+		proxies, err := parseCidrs(config.proxyAuth.trustedProxies)
+		if err != nil {
+			return fmt.Errorf("parsing -proxy-auth-trusted: %w", err)
+		}
+		if len(proxies) == 0 {
+			return fmt.Errorf("-proxy-auth-trusted is needed to trust -proxy-auth-header")
+		}
+	}
+	return nil
+}
+
+// The base path without any trailing slash, so it can go in front of paths starting with one
+func (config serveConfig) normalizedBasePath() string {
+	return strings.TrimRight(config.basePath, "/")
+}
+
+func (config serveConfig) listenAddress() string {
+	if config.listen != "" {
+		return config.listen
+	}
+	return ":" + strconv.Itoa(int(config.port))
+}
+
+// Prints the settings serve would run with, and whether they're valid
+func configCommand() command {
+	flags := flag.NewFlagSet("config", flag.ContinueOnError)
+	return command{
+		flags: flags,
+		run: func() {
+			if len(os.Args) < 3 || os.Args[2] != "check" {
+				fmt.Printf("Usage: %s config check [ SERVE FLAGS ]\n", os.Args[0])
+				os.Exit(1)
+			}
+			config := serveConfig{}
+			serveFlags := serveFlags("config check", &config)
+			sources, err := settings.Load(serveFlags, os.Args[3:], envPrefix, "config")
+			if err != nil {
+				fmt.Printf("%s\n", err)
+				os.Exit(1)
+			}
+			err = settings.Write(os.Stdout, serveFlags, sources, func(name string) bool { return secretSettings[name] })
+			if err != nil {
+				fmt.Printf("writing config: %s\n", err)
+				os.Exit(1)
+			}
+			err = config.check()
+			if err != nil {
+				fmt.Printf("\nInvalid config: %s\n", err)
+				os.Exit(1)
+			}
+			fmt.Printf("\nConfig is valid\n")
+		},
+	}
+}
+
 func serve(config serveConfig) {
-	templates := templates.CreateTemplates(templateFS)
+	logLevel, _ := logging.ParseLevel(config.logLevel)
+	err := logging.Setup(config.logFormat, logLevel)
+	if err != nil {
+		logging.Fatalf("%s", err)
+	}
+
+	templates := templates.CreateTemplates(templateFS, config.normalizedBasePath())
 
 	static, err := fs.Sub(staticFS, "static")
 	if err != nil {
@@ -84,28 +324,326 @@ func serve(config serveConfig) {
 
 	ds, err := openDatabase(config.dbFile)
 	if err != nil {
-		log.Fatalf("opening database file %s: %s", config.dbFile, err)
+		logging.Fatalf("opening database file %s: %s", config.dbFile, err)
 	}
+	ds.SetSessionPolicy(datastore.SessionPolicy{
+		MaxAge:      time.Hour * time.Duration(config.sessionAgeHours),
+		IdleTimeout: time.Hour * time.Duration(config.sessionIdleHours),
+		Secure:      !config.insecureCookies,
+		Path:        config.normalizedBasePath(),
+	})
+	if config.insecureCookies {
+		logging.Warnf("Sending cookies over plain http, which is only safe for local development")
+	}
+	// Passwords hashed differently are rehashed with these the next time their user logs in
+	ds.SetPasswordParams(datastore.PasswordParams{
+		Time:    uint32(config.password.time),
+		Memory:  uint32(config.password.memoryMiB * 1024),
+		Threads: uint8(config.password.threads),
+	})
 
+	// Ctrl-C or SIGTERM starts a clean shutdown. Once it's started, another one kills the server straight away.
+	ctx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stopSignals()
+	var workers sync.WaitGroup
+	workers.Add(1)
 	go func() {
-		// clean up cookies every hour
-		for {
-			ds.CleanUpSessions(time.Hour * time.Duration(config.sessionAgeHours))
-			time.Sleep(time.Hour)
-		}
+		defer workers.Done()
+		cleanUpPeriodically(ctx, ds, config.keyIdleDays)
 	}()
 
-	router := server.MakeRouter(&templates, static, ds)
-	log.Printf("Serving HTTP on port %d\n", config.port)
-	log.Fatal(http.ListenAndServe(":"+strconv.Itoa(int(config.port)), router))
+	if config.backup.dir != "" {
+		err = os.MkdirAll(config.backup.dir, 0700)
+		if err != nil {
+			logging.Fatalf("creating backup directory: %s", err)
+		}
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			backUpPeriodically(ctx, ds, config.backup)
+		}()
+		logging.Infof("Backing up every %d hours to %s, keeping %d backups", config.backup.intervalHours, config.backup.dir, config.backup.keep)
+	}
+
+	options := server.Options{BasePath: config.normalizedBasePath()}
+	if config.oidc.issuer != "" {
+		options.Oidc = &server.OidcOptions{
+			Provider: oidc.New(oidc.Config{
+				Issuer:       config.oidc.issuer,
+				ClientId:     config.oidc.clientId,
+				ClientSecret: config.oidc.clientSecret,
+				RedirectUrl:  config.oidc.redirectUrl,
+			}),
+			UsernameClaim: config.oidc.usernameClaim,
+			AutoCreate:    config.oidc.autoCreate,
+			LinkExisting:  config.oidc.linkExisting,
+		}
+		logging.Infof("Offering single sign-on with %s", config.oidc.issuer)
+	}
+
+	options.PasskeyOrigin = config.passkeyOrigin
+
+	options.TrustedProxies, err = parseCidrs(config.trustedProxies)
+	if err != nil {
+		logging.Fatalf("parsing -trusted-proxies: %s", err)
+	}
+	if len(options.TrustedProxies) > 0 {
+		logging.Infof("Trusting X-Forwarded-For from %s", config.trustedProxies)
+	}
+
+	if config.proxyAuth.header != "" {
+		proxies, err := parseCidrs(config.proxyAuth.trustedProxies)
+		if err != nil {
+			logging.Fatalf("parsing -proxy-auth-trusted: %s", err)
+		}
+		options.ProxyAuth = &server.ProxyAuthOptions{
+			Header:         config.proxyAuth.header,
+			TrustedProxies: proxies,
+			AutoCreate:     config.proxyAuth.autoCreate,
+		}
+		logging.Infof("Trusting %s header from %s", config.proxyAuth.header, config.proxyAuth.trustedProxies)
+	}
+
+	if config.metrics {
+		options.Metrics = server.MetricsHandler(ds)
+	}
+
+	router := server.MakeRouter(&templates, static, ds, options)
+	httpServer := &http.Server{Addr: config.listenAddress(), Handler: router}
+	servers := []*http.Server{httpServer}
+	serverErrors := make(chan error, 3)
+	if config.metricsListen != "" {
+		metricsMux := http.NewServeMux()
+		metricsMux.Handle("/metrics", server.MetricsHandler(ds))
+		metricsServer := &http.Server{Addr: config.metricsListen, Handler: metricsMux}
+		servers = append(servers, metricsServer)
+		logging.Infof("Serving metrics on %s", config.metricsListen)
+		go func() {
+			serverErrors <- metricsServer.ListenAndServe()
+		}()
+	}
+	if config.tlsCert == "" {
+		logging.Infof("Serving HTTP on %s", config.listenAddress())
+		go func() {
+			serverErrors <- httpServer.ListenAndServe()
+		}()
+	} else {
+		reloader, err := certs.NewReloader(config.tlsCert, config.tlsKey)
+		if err != nil {
+			logging.Fatalf("%s", err)
+		}
+		httpServer.TLSConfig = &tls.Config{
+			GetCertificate: reloader.GetCertificate,
+			MinVersion:     tls.VersionTLS12,
+		}
+		workers.Add(2)
+		go func() {
+			defer workers.Done()
+			worker := server.StartWorker("certificate_watch", 0)
+			defer worker.Stop()
+			reloader.Watch(ctx, certCheckInterval)
+		}()
+		go func() {
+			defer workers.Done()
+			reloadOnHangup(ctx, reloader, config.tlsCert)
+		}()
+
+		if config.redirectHttp != "" {
+			_, httpsPort, _ := net.SplitHostPort(config.listenAddress())
+			redirectServer := &http.Server{Addr: config.redirectHttp, Handler: server.RedirectToHttps(httpsPort)}
+			servers = append(servers, redirectServer)
+			logging.Infof("Redirecting HTTP on %s to HTTPS", config.redirectHttp)
+			go func() {
+				serverErrors <- redirectServer.ListenAndServe()
+			}()
+		}
+		logging.Infof("Serving HTTPS on %s", config.listenAddress())
+		go func() {
+			serverErrors <- httpServer.ListenAndServeTLS("", "")
+		}()
+	}
+
+	failed := false
+	select {
+	case err := <-serverErrors:
+		logging.Errorf("serving: %s", err)
+		failed = true
+	case <-ctx.Done():
+		logging.Infof("Shutting down, waiting up to %d seconds for requests to finish", config.shutdownTimeoutSeconds)
+	}
+	// this also tells the background loops to stop
+	stopSignals()
+
+	if !shutDown(servers, &workers, ds, time.Second*time.Duration(config.shutdownTimeoutSeconds)) || failed {
+		os.Exit(1)
+	}
+	logging.Infof("Shut down cleanly")
+}
+
+// Waits up to timeout for the servers' requests to finish, then for the background loops to stop,
+// and closes the database. Returns false if any of that went wrong.
+func shutDown(servers []*http.Server, workers *sync.WaitGroup, ds *datastore.Datastore, timeout time.Duration) bool {
+	clean := true
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, s := range servers {
+		err := s.Shutdown(ctx)
+		if err != nil {
+			logging.Errorf("waiting for requests to finish: %s", err)
+			clean = false
+		}
+	}
+	workers.Wait()
+	err := ds.Close()
+	if err != nil {
+		logging.Errorf("closing database: %s", err)
+		clean = false
+	}
+	return clean
+}
+
+// Cleans up expired sessions, and idle keys if keyIdleDays isn't 0, every hour until ctx is done
+func cleanUpPeriodically(ctx context.Context, ds *datastore.Datastore, keyIdleDays uint) {
+	worker := server.StartWorker("cleanup", time.Hour)
+	defer worker.Stop()
+	ticker := time.NewTicker(time.Hour)
+	defer ticker.Stop()
+	for {
+		worker.Beat()
+		started := time.Now()
+		err := ds.CleanUpSessions()
+		server.RecordJob("session_cleanup", started, err)
+		if err != nil {
+			logging.Errorf("cleaning up sessions: %s", err)
+		}
+		if keyIdleDays > 0 {
+			started = time.Now()
+			n, err := ds.DisableIdleKeys(24 * time.Hour * time.Duration(keyIdleDays))
+			server.RecordJob("idle_key_cleanup", started, err)
+			if err != nil {
+				logging.Errorf("disabling idle api keys: %s", err)
+			} else if n > 0 {
+				logging.Infof("Disabled %d idle api keys", n)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Backs the database up to config.dir every config.intervalHours, deleting all but the newest config.keep backups,
+// until ctx is done. The first backup is taken straight away if the newest one is already that old.
+func backUpPeriodically(ctx context.Context, ds *datastore.Datastore, config backupConfig) {
+	interval := time.Hour * time.Duration(config.intervalHours)
+	worker := server.StartWorker("backup", interval)
+	defer worker.Stop()
+	next := time.Now()
+	existing, err := backups.List(config.dir)
+	if err != nil {
+		logging.Errorf("%s", err)
+	} else if len(existing) > 0 {
+		next = existing[len(existing)-1].Time.Add(interval)
+	}
+	for {
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+		worker.Beat()
+		next = time.Now().Add(interval)
+
+		started := time.Now()
+		file := filepath.Join(config.dir, backups.Name(started))
+		err := ds.Backup(file)
+		if err == nil {
+			err = datastore.CheckIntegrity(file)
+		}
+		server.RecordJob("backup", started, err)
+		if err != nil {
+			logging.Errorf("backing up: %s", err)
+			continue
+		}
+		logging.Infof("Backed up to %s", file)
+		removed, err := backups.Prune(config.dir, int(config.keep))
+		if err != nil {
+			logging.Errorf("pruning backups: %s", err)
+		}
+		for _, file := range removed {
+			logging.Infof("Deleted old backup %s", file)
+		}
+	}
+}
+
+// Reloads the certificate whenever the server gets a SIGHUP, until ctx is done
+func reloadOnHangup(ctx context.Context, reloader *certs.Reloader, certFile string) {
+	hangups := make(chan os.Signal, 1)
+	signal.Notify(hangups, syscall.SIGHUP)
+	defer signal.Stop(hangups)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangups:
+		}
+		err := reloader.Reload()
+		if err != nil {
+			logging.Errorf("reloading certificate: %s", err)
+		} else {
+			logging.Infof("Reloaded certificate from %s", certFile)
+		}
+	}
+}
+
+// How often the certificate files are checked for changes
+const certCheckInterval = 30 * time.Second
+
+// Parses a comma-separated list of cidr ranges. Plain ips are taken as ranges of one address.
+func parseCidrs(list string) ([]*net.IPNet, error) {
+	cidrs := make([]*net.IPNet, 0)
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return nil, fmt.Errorf("bad ip %q", entry)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			cidrs = append(cidrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(entry)
+		if err != nil {
+			return nil, err
+		}
+		cidrs = append(cidrs, cidr)
+	}
+	return cidrs, nil
 }
 
 type manageUserConfig struct {
-	username  string
-	password  string
-	delete    bool
-	listUsers bool
-	dbFile    string
+	username    string
+	password    string
+	delete      bool
+	reset2fa    bool
+	makeAdmin   bool
+	removeAdmin bool
+	resetLink   bool
+	siteUrl     string
+	listUsers   bool
+	dbFile      string
 }
 
 func manageUserCommand() command {
@@ -114,6 +652,11 @@ func manageUserCommand() command {
 	flags.StringVar(&config.username, "username", "", "Username to update")
 	flags.StringVar(&config.password, "password", "", "Password to set")
 	flags.BoolVar(&config.delete, "delete", false, "Delete this user instead of updating it")
+	flags.BoolVar(&config.reset2fa, "reset-2fa", false, "Turn off this user's two-factor authentication, for when they've lost their authenticator")
+	flags.BoolVar(&config.makeAdmin, "make-admin", false, "Let this user manage other users from the web")
+	flags.BoolVar(&config.removeAdmin, "remove-admin", false, "Stop this user from managing other users")
+	flags.BoolVar(&config.resetLink, "reset-link", false, "Print a one-time link for this user to choose a new password with")
+	flags.StringVar(&config.siteUrl, "url", "", "public url of the site, like https://bookmarks.example.com, for printing links")
 	flags.BoolVar(&config.listUsers, "list", false, "List all users, then exit")
 	flags.StringVar(&config.dbFile, "db", "./bookmarks.db", "location of the bookmarks database")
 	return command{
@@ -131,59 +674,300 @@ func manageUser(config manageUserConfig) {
 		fmt.Printf("opening database file %s: %s\n", config.dbFile, err)
 		os.Exit(1)
 	}
+	err = changeUsers(ds, config)
+	// closed before exiting, because deferred calls don't run after os.Exit
+	ds.Close()
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(1)
+	}
+}
 
+// Does what the user command's flags ask for, to the users in ds
+func changeUsers(ds *datastore.Datastore, config manageUserConfig) error {
 	if config.listUsers {
 		list, err := ds.ListUsers()
 		if err != nil {
-			fmt.Printf("getting users: %s\n", err)
-			os.Exit(1)
+			return fmt.Errorf("getting users: %w", err)
 		}
 		fmt.Println("All users:")
 		for _, user := range list {
 			fmt.Printf(" %s\n", user)
 		}
-		return
+		return nil
 	}
 
 	if config.username != "" {
 		if config.delete {
-			err = ds.RemoveUser(config.username)
+			err := ds.RemoveUser(config.username)
 			if err != nil {
-				fmt.Printf("removing user %s: %s\n", config.username, err)
-				os.Exit(1)
+				return fmt.Errorf("removing user %s: %w", config.username, err)
 			}
 			fmt.Printf("Removed user %s\n", config.username)
+		} else if config.resetLink {
+			userId, exists, err := ds.UserExists(config.username)
+			if err != nil {
+				return fmt.Errorf("checking whether user exists: %w", err)
+			}
+			if !exists {
+				return fmt.Errorf("User %s does not exist", config.username)
+			}
+			token, err := ds.CreatePasswordReset(userId, datastore.DefaultPasswordResetTtl)
+			if err != nil {
+				return fmt.Errorf("creating password reset link: %w", err)
+			}
+			fmt.Printf("Send this link to %s. It works once, for the next %d hours:\n%s\n",
+				config.username, int(datastore.DefaultPasswordResetTtl.Hours()), linkUrl(config.siteUrl, "/reset", token))
+		} else if config.reset2fa {
+			userId, exists, err := ds.UserExists(config.username)
+			if err != nil {
+				return fmt.Errorf("checking whether user exists: %w", err)
+			}
+			if !exists {
+				return fmt.Errorf("User %s does not exist", config.username)
+			}
+			err = ds.DisableTotp(userId)
+			if err != nil {
+				return fmt.Errorf("resetting two-factor authentication for %s: %w", config.username, err)
+			}
+			fmt.Printf("Turned off two-factor authentication for %s\n", config.username)
 		} else {
+			if config.password == "" && !config.makeAdmin && !config.removeAdmin {
+				return fmt.Errorf("To create a user or change a user's password, password must be non-empty")
+			}
+			userId, exists, err := ds.UserExists(config.username)
+			if err != nil {
+				return fmt.Errorf("checking whether user exists: %w", err)
+			}
 			if config.password != "" {
-				_, exists, err := ds.UserExists(config.username)
-				if err != nil {
-					fmt.Printf("checking whether user exists: %s\n", err)
-					os.Exit(1)
-				}
 				if exists {
 					err = ds.ChangeUserPassword(config.username, config.password)
 					if err != nil {
-						fmt.Printf("changing user %s's password: %s\n", config.username, err)
-						os.Exit(1)
+						return fmt.Errorf("changing user %s's password: %w", config.username, err)
 					}
 					fmt.Printf("Changed %s's password\n", config.username)
 				} else {
-					err = ds.AddUser(config.username, config.password)
+					userId, err = ds.AddUser(config.username, config.password)
 					if err != nil {
-						fmt.Printf("adding user %s: %s\n", config.username, err)
-						os.Exit(1)
+						return fmt.Errorf("adding user %s: %w", config.username, err)
 					}
 					fmt.Printf("Added user %s\n", config.username)
 				}
-			} else {
-				fmt.Printf("To create a user or change a user's password, password must be non-empty\n")
-				os.Exit(1)
+			} else if !exists {
+				return fmt.Errorf("User %s does not exist", config.username)
+			}
+			if config.makeAdmin || config.removeAdmin {
+				err = ds.SetUserAdmin(userId, config.makeAdmin)
+				if err != nil {
+					return fmt.Errorf("updating user %s: %w", config.username, err)
+				}
+				if config.makeAdmin {
+					fmt.Printf("Made %s an admin\n", config.username)
+				} else {
+					fmt.Printf("%s is no longer an admin\n", config.username)
+				}
 			}
 		}
-	} else {
-		fmt.Printf("Username must be non-empty\n")
+		return nil
+	}
+	return fmt.Errorf("Username must be non-empty")
+}
+
+type inviteConfig struct {
+	days    uint
+	siteUrl string
+	dbFile  string
+}
+
+func inviteCommand() command {
+	config := inviteConfig{}
+	flags := flag.NewFlagSet("invite", flag.ContinueOnError)
+	flags.UintVar(&config.days, "days", uint(datastore.DefaultInviteTtl/(24*time.Hour)), "number of days the invite works for")
+	flags.StringVar(&config.siteUrl, "url", "", "public url of the site, like https://bookmarks.example.com, for printing links")
+	flags.StringVar(&config.dbFile, "db", "./bookmarks.db", "location of the bookmarks database")
+	return command{
+		flags: flags,
+		run: func() {
+			flags.Parse(os.Args[2:])
+			invite(config)
+		},
+	}
+}
+
+// Prints a one-time link for someone to sign up with
+func invite(config inviteConfig) {
+	if config.days == 0 {
+		fmt.Printf("Invites have to work for at least a day\n")
+		os.Exit(1)
+	}
+	ds, err := openDatabase(config.dbFile)
+	if err != nil {
+		fmt.Printf("opening database file %s: %s\n", config.dbFile, err)
+		os.Exit(1)
+	}
+	token, err := ds.CreateInvite("command line", 24*time.Hour*time.Duration(config.days))
+	// closed before exiting, because deferred calls don't run after os.Exit
+	ds.Close()
+	if err != nil {
+		fmt.Printf("creating invite: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Send this link to the new user. It works once, for the next %d days:\n%s\n",
+		config.days, linkUrl(config.siteUrl, "/register", token))
+}
+
+func linkUrl(siteUrl, path, token string) string {
+	return strings.TrimSuffix(siteUrl, "/") + path + "?token=" + url.QueryEscape(token)
+}
+
+type certConfig struct {
+	hosts    string
+	certFile string
+	keyFile  string
+	days     uint
+}
+
+// Makes a self-signed certificate for trying out https
+func certCommand() command {
+	config := certConfig{}
+	flags := flag.NewFlagSet("cert", flag.ContinueOnError)
+	flags.StringVar(&config.hosts, "host", "localhost,127.0.0.1,::1", "comma-separated host names and ips the certificate is for")
+	flags.StringVar(&config.certFile, "cert", "./cert.pem", "where to write the certificate")
+	flags.StringVar(&config.keyFile, "key", "./key.pem", "where to write the private key")
+	flags.UintVar(&config.days, "days", 365, "days the certificate is valid for")
+	return command{
+		flags: flags,
+		run: func() {
+			flags.Parse(os.Args[2:])
+			makeCert(config)
+		},
+	}
+}
+
+func makeCert(config certConfig) {
+	hosts := make([]string, 0)
+	for _, host := range strings.Split(config.hosts, ",") {
+		if host = strings.TrimSpace(host); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 || config.days == 0 {
+		fmt.Printf("The certificate needs at least one host, and to be valid for at least a day\n")
+		os.Exit(1)
+	}
+	for _, file := range []string{config.certFile, config.keyFile} {
+		if _, err := os.Stat(file); err == nil {
+			fmt.Printf("%s already exists, so not overwriting it\n", file)
+			os.Exit(1)
+		}
+	}
+	err := certs.GenerateSelfSigned(hosts, 24*time.Hour*time.Duration(config.days), config.certFile, config.keyFile)
+	if err != nil {
+		fmt.Printf("%s\n", err)
 		os.Exit(1)
 	}
+	fmt.Printf("Wrote a self-signed certificate for %s to %s, and its key to %s\n",
+		strings.Join(hosts, ", "), config.certFile, config.keyFile)
+	fmt.Printf("Serve with it using -tls-cert %s -tls-key %s\n", config.certFile, config.keyFile)
+}
+
+type backupCommandConfig struct {
+	dbFile string
+	out    string
+}
+
+// Takes a snapshot of the database, which is safe while the server is running
+func backupCommand() command {
+	config := backupCommandConfig{}
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	flags.StringVar(&config.dbFile, "db", "./bookmarks.db", "location of the bookmarks database")
+	flags.StringVar(&config.out, "out", "", "file to write the backup to (defaults to a timestamped name like "+backups.Name(time.Now())+")")
+	return command{
+		flags: flags,
+		run: func() {
+			flags.Parse(os.Args[2:])
+			backUp(config)
+		},
+	}
+}
+
+func backUp(config backupCommandConfig) {
+	if _, err := os.Stat(config.dbFile); err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(1)
+	}
+	if config.out == "" {
+		config.out = backups.Name(time.Now())
+	}
+	ds, err := datastore.Connect(config.dbFile)
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(1)
+	}
+	err = ds.Backup(config.out)
+	// closed before exiting, because deferred calls don't run after os.Exit
+	ds.Close()
+	if err == nil {
+		err = datastore.CheckIntegrity(config.out)
+	}
+	if err != nil {
+		fmt.Printf("%s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Backed up %s to %s\n", config.dbFile, config.out)
+}
+
+type restoreConfig struct {
+	dbFile     string
+	backupFile string
+}
+
+// Puts a backup in place of the database, once the server's been stopped
+func restoreCommand() command {
+	config := restoreConfig{}
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	flags.StringVar(&config.dbFile, "db", "./bookmarks.db", "location of the bookmarks database to replace")
+	flags.StringVar(&config.backupFile, "from", "", "backup file to restore")
+	return command{
+		flags: flags,
+		run: func() {
+			flags.Parse(os.Args[2:])
+			restore(config)
+		},
+	}
+}
+
+func restore(config restoreConfig) {
+	if config.backupFile == "" {
+		fmt.Printf("Pass the backup to restore with -from\n")
+		os.Exit(1)
+	}
+	err := datastore.CheckIntegrity(config.backupFile)
+	if err != nil {
+		fmt.Printf("Not restoring: %s\n", err)
+		os.Exit(1)
+	}
+	if _, err := os.Stat(config.dbFile); err == nil {
+		// closing checkpoints the write-ahead log into the database file, so none of it is left behind when
+		// the file is moved aside. It's only removed if nothing else has the database open.
+		ds, err := datastore.Connect(config.dbFile)
+		if err == nil {
+			err = ds.Close()
+		}
+		if err != nil {
+			fmt.Printf("Not restoring: %s\n", err)
+			os.Exit(1)
+		}
+	}
+	movedAside, err := backups.Restore(config.dbFile, config.backupFile, datastore.CheckIntegrity)
+	if err != nil {
+		fmt.Printf("Not restoring: %s\n", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Restored %s from %s\n", config.dbFile, config.backupFile)
+	if movedAside != "" {
+		fmt.Printf("The database it replaced was moved to %s\n", movedAside)
+	}
 }
 
 func helpCommand() command {
@@ -202,13 +986,25 @@ func openDatabase(dbFile string) (*datastore.Datastore, error) {
 		return nil, fmt.Errorf("opening database: %w", err)
 	}
 
+	started := time.Now()
 	n, err := datastore.RunMigrations(schemaFS)
+	server.RecordJob("migrations", started, err)
 	if err != nil {
+		datastore.Close()
 		return nil, fmt.Errorf("running migrations: %w", err)
 	}
 	if n > 0 {
 		log.Printf("Ran %d migrations\n", n)
 	}
+
+	upgraded, err := datastore.UpgradeLegacyPasswordHashes()
+	if err != nil {
+		datastore.Close()
+		return nil, fmt.Errorf("upgrading password hashes: %w", err)
+	}
+	if upgraded > 0 {
+		log.Printf("Upgraded %d password hashes to the PHC format\n", upgraded)
+	}
 	return &datastore, nil
 }
 
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"context"
+	"local/bookmarks/certs"
+	"local/bookmarks/datastore"
+	"local/bookmarks/settings"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func setEnv(t *testing.T, name, value string) {
+	t.Helper()
+	os.Setenv(name, value)
+	t.Cleanup(func() { os.Unsetenv(name) })
+}
+
+// Loads serve's settings the way the serve command does
+func loadServeConfig(t *testing.T, args ...string) (serveConfig, map[string]settings.Source) {
+	t.Helper()
+	var config serveConfig
+	sources, err := settings.Load(serveFlags("serve", &config), args, envPrefix, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return config, sources
+}
+
+func TestTlsSettings(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	err := certs.GenerateSelfSigned([]string{"localhost"}, time.Hour, certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	configFile := filepath.Join(dir, "bookmarks.toml")
+	toml := "listen = \":8443\"\nredirect-http = \":80\"\n[tls]\ncert = \"" + certFile + "\"\nkey = \"wrong.pem\"\n"
+	err = os.WriteFile(configFile, []byte(toml), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setEnv(t, envPrefix+"TLS_KEY", keyFile)
+
+	config, sources := loadServeConfig(t, "-config", configFile, "-redirect-http", ":8080")
+	if config.tlsCert != certFile || config.tlsKey != keyFile || config.redirectHttp != ":8080" || config.listen != ":8443" {
+		t.Errorf("got cert %s, key %s, redirect %s, listen %s", config.tlsCert, config.tlsKey, config.redirectHttp, config.listen)
+	}
+	for name, want := range map[string]settings.Source{
+		"tls-cert":      settings.SourceFile,
+		"tls-key":       settings.SourceEnv,
+		"redirect-http": settings.SourceFlag,
+	} {
+		if sources[name] != want {
+			t.Errorf("%s came from %s, want %s", name, sources[name], want)
+		}
+	}
+	if err := config.check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCheckTlsSettings(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	err := certs.GenerateSelfSigned([]string{"localhost"}, time.Hour, certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		args    []string
+		wantErr string
+	}{
+		{"plain http", nil, ""},
+		{"tls", []string{"-tls-cert", certFile, "-tls-key", keyFile}, ""},
+		{"with a redirect", []string{"-tls-cert", certFile, "-tls-key", keyFile, "-redirect-http", ":8080"}, ""},
+		{"cert without key", []string{"-tls-cert", certFile}, "go together"},
+		{"key without cert", []string{"-tls-key", keyFile}, "go together"},
+		{"key for cert", []string{"-tls-cert", keyFile, "-tls-key", keyFile}, "loading -tls-cert"},
+		{"missing files", []string{"-tls-cert", filepath.Join(dir, "missing.pem"), "-tls-key", keyFile}, "loading -tls-cert"},
+		{"redirect without tls", []string{"-redirect-http", ":8080"}, "needs -tls-cert"},
+		{"bad redirect address", []string{"-tls-cert", certFile, "-tls-key", keyFile, "-redirect-http", "8080"}, "bad -redirect-http"},
+	}
+	for _, test := range tests {
+		config, _ := loadServeConfig(t, test.args...)
+		err := config.check()
+		if test.wantErr == "" && err != nil {
+			t.Errorf("%s: %s", test.name, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestShutdownTimeoutSetting(t *testing.T) {
+	config, _ := loadServeConfig(t)
+	if config.shutdownTimeoutSeconds != 30 {
+		t.Errorf("waits %d seconds by default", config.shutdownTimeoutSeconds)
+	}
+	setEnv(t, envPrefix+"SHUTDOWN_TIMEOUT", "5")
+	config, sources := loadServeConfig(t)
+	if config.shutdownTimeoutSeconds != 5 || sources["shutdown-timeout"] != settings.SourceEnv {
+		t.Errorf("got %d seconds from %s", config.shutdownTimeoutSeconds, sources["shutdown-timeout"])
+	}
+}
+
+// Serves handler on a local port until it's shut down
+func startServer(t *testing.T, handler http.HandlerFunc) (*http.Server, string) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &http.Server{Handler: handler}
+	go s.Serve(listener)
+	return s, "http://" + listener.Addr().String()
+}
+
+func TestShutDownFinishesRequestsBeforeClosingTheDatabase(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "bookmarks.db")
+	ds, err := openDatabase(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	s, url := startServer(t, func(resp http.ResponseWriter, req *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		if _, err := ds.AddUser("alice", "password"); err != nil {
+			http.Error(resp, err.Error(), http.StatusInternalServerError)
+		}
+	})
+	// a background loop that's still writing when the shutdown starts
+	var workers sync.WaitGroup
+	workers.Add(1)
+	go func() {
+		defer workers.Done()
+		<-started
+		time.Sleep(200 * time.Millisecond)
+		if _, err := ds.AddUser("bob", "password"); err != nil {
+			t.Error(err)
+		}
+	}()
+	responses := make(chan int, 1)
+	go func() {
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Error(err)
+			responses <- 0
+			return
+		}
+		resp.Body.Close()
+		responses <- resp.StatusCode
+	}()
+
+	<-started
+	if !shutDown([]*http.Server{s}, &workers, ds, 5*time.Second) {
+		t.Error("didn't shut down cleanly")
+	}
+	if code := <-responses; code != http.StatusOK {
+		t.Errorf("request in progress got %d", code)
+	}
+
+	// everything was checkpointed into the database file
+	if info, err := os.Stat(dbFile + "-wal"); err == nil && info.Size() > 0 {
+		t.Errorf("%d bytes left in the wal", info.Size())
+	}
+	reopened, err := datastore.Connect(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reopened.Close()
+	for _, user := range []string{"alice", "bob"} {
+		if _, exists, err := reopened.UserExists(user); err != nil || !exists {
+			t.Errorf("%s wasn't saved: %v", user, err)
+		}
+	}
+}
+
+func TestShutDownGivesUpOnSlowRequests(t *testing.T) {
+	ds, err := openDatabase(filepath.Join(t.TempDir(), "bookmarks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	started, release := make(chan struct{}), make(chan struct{})
+	defer close(release)
+	s, url := startServer(t, func(resp http.ResponseWriter, req *http.Request) {
+		close(started)
+		<-release
+	})
+	go func() {
+		resp, err := http.Get(url)
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+
+	<-started
+	begun := time.Now()
+	if shutDown([]*http.Server{s}, &sync.WaitGroup{}, ds, 50*time.Millisecond) {
+		t.Error("shut down cleanly with a request still running")
+	}
+	if took := time.Since(begun); took > 5*time.Second {
+		t.Errorf("took %s to give up", took)
+	}
+	if _, _, err := ds.UserExists("alice"); err == nil {
+		t.Error("database is still open")
+	}
+}
+
+func TestCleanUpStopsWhenDone(t *testing.T) {
+	ds, err := openDatabase(filepath.Join(t.TempDir(), "bookmarks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		cleanUpPeriodically(ctx, ds, 30)
+		close(stopped)
+	}()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Error("cleaning up didn't stop")
+	}
+}
+
+func TestManageUserClosesTheDatabase(t *testing.T) {
+	dbFile := filepath.Join(t.TempDir(), "bookmarks.db")
+	manageUser(manageUserConfig{dbFile: dbFile, username: "alice", password: "password", makeAdmin: true})
+
+	// closing checkpoints the wal, so everything's in the database file
+	if info, err := os.Stat(dbFile + "-wal"); err == nil && info.Size() > 0 {
+		t.Errorf("%d bytes left in the wal", info.Size())
+	}
+	ds, err := openDatabase(dbFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	if _, ok, _ := ds.AuthenticateUser("alice", "password"); !ok {
+		t.Error("alice wasn't added")
+	}
+}
+
+func TestChangeUsersErrors(t *testing.T) {
+	ds, err := openDatabase(filepath.Join(t.TempDir(), "bookmarks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	tests := []struct {
+		name    string
+		config  manageUserConfig
+		wantErr string
+	}{
+		{"no username", manageUserConfig{password: "password"}, "Username must be non-empty"},
+		{"no password", manageUserConfig{username: "alice"}, "password must be non-empty"},
+		{"unknown user", manageUserConfig{username: "bob", makeAdmin: true}, "User bob does not exist"},
+		{"reset link for unknown user", manageUserConfig{username: "bob", resetLink: true}, "User bob does not exist"},
+	}
+	for _, test := range tests {
+		err := changeUsers(ds, test.config)
+		if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+			t.Errorf("%s: got error %v, want %q", test.name, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package markdown
+
+import (
+	"bytes"
+	"html/template"
+	"log"
+
+	"github.com/microcosm-cc/bluemonday"
+	"github.com/yuin/goldmark"
+	"github.com/yuin/goldmark/extension"
+)
+
+var renderer = goldmark.New(goldmark.WithExtensions(extension.GFM))
+
+// Raw html in the source is already dropped by goldmark, but everything still goes through a
+// sanitizer in case a markdown construct ever turns into something we didn't expect
+var policy = bluemonday.UGCPolicy().
+	RequireNoReferrerOnLinks(true).
+	AddTargetBlankToFullyQualifiedLinks(true)
+
+// Renders user-supplied markdown to html that is safe to embed in a page
+func Render(source string) template.HTML {
+	var buf bytes.Buffer
+	err := renderer.Convert([]byte(source), &buf)
+	if err != nil {
+		log.Printf("rendering markdown: %s", err)
+		return template.HTML(template.HTMLEscapeString(source))
+	}
+	return template.HTML(policy.SanitizeBytes(buf.Bytes()))
+}
@@ -0,0 +1,54 @@
+package markdown
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRender(t *testing.T) {
+	tests := map[string]struct {
+		source string
+		want   string
+	}{
+		"formatting":          {"**bold** _em_ `code`", "<p><strong>bold</strong> <em>em</em> <code>code</code></p>\n"},
+		"table":               {"| a |\n|---|\n| b |", "<table>\n<thead>\n<tr>\n<th>a</th>\n</tr>\n</thead>\n<tbody>\n<tr>\n<td>b</td>\n</tr>\n</tbody>\n</table>\n"},
+		"script":              {"<script>alert(1)</script>", "\n"},
+		"raw html":            {"<b>bold</b> text", "<p>bold text</p>\n"},
+		"raw html block":      {"a\n\n<div onmouseover=\"alert(1)\">d</div>", "<p>a</p>\n\n"},
+		"event handler":       {"<a href=\"/x\" onclick=\"alert(1)\">hi</a>", "<p>hi</p>\n"},
+		"image event handler": {"<img src=x onerror=alert(1)>", "\n"},
+		"javascript link":     {"[x](javascript:alert(1))", "<p>x</p>\n"},
+		"mixed case scheme":   {"[x](JaVaScRiPt:alert(1))", "<p>x</p>\n"},
+		"data link":           {"[x](data:text/html;base64,PHNjcmlwdD4=)", "<p>x</p>\n"},
+		// goldmark makes checkboxes for task lists, which the policy doesn't allow
+		"task list": {"- [x] done", "<ul>\n<li> done</li>\n</ul>\n"},
+		// the policy adds these, so they show it was applied
+		"external link": {"[ex](https://example.com)", "<p><a href=\"https://example.com\" rel=\"nofollow noreferrer noopener\" target=\"_blank\">ex</a></p>\n"},
+		"relative link": {"[rel](/bookmarks)", "<p><a href=\"/bookmarks\" rel=\"nofollow noreferrer\">rel</a></p>\n"},
+		"autolink":      {"<https://example.com>", "<p><a href=\"https://example.com\" rel=\"nofollow noreferrer noopener\" target=\"_blank\">https://example.com</a></p>\n"},
+	}
+	for name, test := range tests {
+		if got := string(Render(test.source)); got != test.want {
+			t.Errorf("%s: %q rendered as %q, want %q", name, test.source, got, test.want)
+		}
+	}
+}
+
+// The sanitizer has to hold up even if goldmark ever lets raw html through
+func TestPolicy(t *testing.T) {
+	for _, html := range []string{
+		`<script>alert(1)</script>`,
+		`<a href="javascript:alert(1)">x</a>`,
+		`<img src="x" onerror="alert(1)">`,
+		`<p style="background: url(javascript:alert(1))" onmouseover="alert(1)">x</p>`,
+		`<iframe src="https://example.com"></iframe>`,
+		`<form action="/logout"><button>x</button></form>`,
+	} {
+		got := policy.Sanitize(html)
+		for _, bad := range []string{"<script", "javascript:", "onerror", "onmouseover", "style=", "<iframe", "<form"} {
+			if strings.Contains(strings.ToLower(got), bad) {
+				t.Errorf("%q sanitized to %q", html, got)
+			}
+		}
+	}
+}
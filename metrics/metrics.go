@@ -0,0 +1,263 @@
+// Counters, gauges and histograms, served in the Prometheus text format so the server can be scraped.
+// Metrics are registered once, when the packages that use them are initialised, and live for the whole process.
+package metrics
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Histogram buckets in seconds, from a millisecond to ten seconds, which suit request and query durations
+var DurationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(b *bytes.Buffer)
+}
+
+var (
+	registryMutex sync.Mutex
+	registry      []metric
+	names         = make(map[string]bool)
+	scrapeHooks   []func()
+)
+
+func register(name string, m metric) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	if names[name] {
+		panic("metric " + name + " registered twice")
+	}
+	names[name] = true
+	registry = append(registry, m)
+}
+
+// Runs f before each scrape, to update gauges that are cheaper to work out when they're asked for
+func OnScrape(f func()) {
+	registryMutex.Lock()
+	defer registryMutex.Unlock()
+	scrapeHooks = append(scrapeHooks, f)
+}
+
+// Serves every metric in the Prometheus text format
+func Handler() http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		registryMutex.Lock()
+		hooks := append([]func(){}, scrapeHooks...)
+		metrics := append([]metric{}, registry...)
+		registryMutex.Unlock()
+		for _, hook := range hooks {
+			hook()
+		}
+		var b bytes.Buffer
+		for _, m := range metrics {
+			m.write(&b)
+		}
+		resp.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		resp.Header().Set("Cache-Control", "no-store")
+		resp.Write(b.Bytes())
+	})
+}
+
+// The values of one metric, kept per combination of label values
+type family struct {
+	name       string
+	help       string
+	kind       string
+	labelNames []string
+
+	mutex  sync.Mutex
+	series map[string]*series
+}
+
+type series struct {
+	labelValues []string
+	value       float64
+	// only used by histograms: counts per bucket (not cumulative), and the number of observations
+	buckets []uint64
+	count   uint64
+}
+
+func newFamily(name, help, kind string, labelNames []string) *family {
+	return &family{name: name, help: help, kind: kind, labelNames: labelNames, series: make(map[string]*series)}
+}
+
+// Finds the series for some label values, adding it if it's new. The caller has to hold the mutex.
+func (f *family) get(labelValues []string) *series {
+	if len(labelValues) != len(f.labelNames) {
+		panic(fmt.Sprintf("metric %s takes %d labels, got %d", f.name, len(f.labelNames), len(labelValues)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	s, ok := f.series[key]
+	if !ok {
+		s = &series{labelValues: append([]string{}, labelValues...)}
+		f.series[key] = s
+	}
+	return s
+}
+
+// The series sorted by their label values, so scrapes come out in a stable order. The caller has to hold the mutex.
+func (f *family) sorted() []*series {
+	keys := make([]string, 0, len(f.series))
+	for key := range f.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	result := make([]*series, len(keys))
+	for i, key := range keys {
+		result[i] = f.series[key]
+	}
+	return result
+}
+
+func (f *family) writeHeader(b *bytes.Buffer) {
+	fmt.Fprintf(b, "# HELP %s %s\n", f.name, escapeHelp(f.help))
+	fmt.Fprintf(b, "# TYPE %s %s\n", f.name, f.kind)
+}
+
+func (f *family) write(b *bytes.Buffer) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.writeHeader(b)
+	for _, s := range f.sorted() {
+		writeSample(b, f.name, f.labelNames, s.labelValues, "", "", s.value)
+	}
+}
+
+// A value that only goes up, like a number of requests
+type Counter struct {
+	f *family
+}
+
+func NewCounter(name, help string, labelNames ...string) *Counter {
+	c := &Counter{newFamily(name, help, "counter", labelNames)}
+	register(name, c.f)
+	return c
+}
+
+func (c *Counter) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *Counter) Add(value float64, labelValues ...string) {
+	if value < 0 {
+		panic("counters can't go down")
+	}
+	c.f.mutex.Lock()
+	defer c.f.mutex.Unlock()
+	c.f.get(labelValues).value += value
+}
+
+// A value that can go up and down, like a number of users
+type Gauge struct {
+	f *family
+}
+
+func NewGauge(name, help string, labelNames ...string) *Gauge {
+	g := &Gauge{newFamily(name, help, "gauge", labelNames)}
+	register(name, g.f)
+	return g
+}
+
+func (g *Gauge) Set(value float64, labelValues ...string) {
+	g.f.mutex.Lock()
+	defer g.f.mutex.Unlock()
+	g.f.get(labelValues).value = value
+}
+
+// Counts observations, like durations, in buckets with the given upper bounds, and adds them up
+type Histogram struct {
+	f       *family
+	buckets []float64
+}
+
+func NewHistogram(name, help string, buckets []float64, labelNames ...string) *Histogram {
+	h := &Histogram{newFamily(name, help, "histogram", labelNames), append([]float64{}, buckets...)}
+	sort.Float64s(h.buckets)
+	register(name, h)
+	return h
+}
+
+func (h *Histogram) Observe(value float64, labelValues ...string) {
+	h.f.mutex.Lock()
+	defer h.f.mutex.Unlock()
+	s := h.f.get(labelValues)
+	if s.buckets == nil {
+		s.buckets = make([]uint64, len(h.buckets))
+	}
+	// values above the last bucket are only counted in +Inf, which is the total count
+	i := sort.SearchFloat64s(h.buckets, value)
+	if i < len(h.buckets) {
+		s.buckets[i]++
+	}
+	s.count++
+	s.value += value
+}
+
+func (h *Histogram) write(b *bytes.Buffer) {
+	h.f.mutex.Lock()
+	defer h.f.mutex.Unlock()
+	h.f.writeHeader(b)
+	for _, s := range h.f.sorted() {
+		var cumulative uint64
+		for i, upper := range h.buckets {
+			cumulative += s.buckets[i]
+			writeSample(b, h.f.name+"_bucket", h.f.labelNames, s.labelValues, "le", formatFloat(upper), float64(cumulative))
+		}
+		writeSample(b, h.f.name+"_bucket", h.f.labelNames, s.labelValues, "le", "+Inf", float64(s.count))
+		writeSample(b, h.f.name+"_sum", h.f.labelNames, s.labelValues, "", "", s.value)
+		writeSample(b, h.f.name+"_count", h.f.labelNames, s.labelValues, "", "", float64(s.count))
+	}
+}
+
+// Writes a line like name{label="value"} 1, with an extra label if extraName isn't empty
+func writeSample(b *bytes.Buffer, name string, labelNames, labelValues []string, extraName, extraValue string, value float64) {
+	b.WriteString(name)
+	if len(labelNames) > 0 || extraName != "" {
+		b.WriteByte('{')
+		for i, labelName := range labelNames {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", labelName, escapeLabel(labelValues[i]))
+		}
+		if extraName != "" {
+			if len(labelNames) > 0 {
+				b.WriteByte(',')
+			}
+			fmt.Fprintf(b, "%s=\"%s\"", extraName, escapeLabel(extraValue))
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(value))
+	b.WriteByte('\n')
+}
+
+func formatFloat(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`)
+var helpEscaper = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+func escapeHelp(help string) string {
+	return helpEscaper.Replace(help)
+}
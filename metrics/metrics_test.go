@@ -0,0 +1,157 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func written(m metric) string {
+	var b bytes.Buffer
+	m.write(&b)
+	return b.String()
+}
+
+func TestCounter(t *testing.T) {
+	c := NewCounter("test_requests_total", "Requests handled.", "route", "code")
+	c.Inc("/b", "200")
+	c.Add(2, "/a", "404")
+	c.Inc("/b", "200")
+	want := `# HELP test_requests_total Requests handled.
+# TYPE test_requests_total counter
+test_requests_total{route="/a",code="404"} 2
+test_requests_total{route="/b",code="200"} 2
+`
+	if got := written(c.f); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCounterCantGoDown(t *testing.T) {
+	c := NewCounter("test_down_total", "Goes down.")
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic")
+		}
+	}()
+	c.Add(-1)
+}
+
+func TestGauge(t *testing.T) {
+	g := NewGauge("test_users", "Users.")
+	g.Set(3)
+	g.Set(1.5)
+	want := "# HELP test_users Users.\n# TYPE test_users gauge\ntest_users 1.5\n"
+	if got := written(g.f); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogram(t *testing.T) {
+	h := NewHistogram("test_duration_seconds", "Durations.", []float64{1, 0.125, 0.5}, "route")
+	for _, value := range []float64{0.0625, 0.125, 0.25, 2, 0.75} {
+		h.Observe(value, "/")
+	}
+	want := `# HELP test_duration_seconds Durations.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{route="/",le="0.125"} 2
+test_duration_seconds_bucket{route="/",le="0.5"} 3
+test_duration_seconds_bucket{route="/",le="1"} 4
+test_duration_seconds_bucket{route="/",le="+Inf"} 5
+test_duration_seconds_sum{route="/"} 3.1875
+test_duration_seconds_count{route="/"} 5
+`
+	if got := written(h); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestEscaping(t *testing.T) {
+	c := NewCounter("test_escaped_total", "A \\ help\nline with \"quotes\".", "path")
+	c.Inc("a\\b\n\"c\"")
+	want := `# HELP test_escaped_total A \\ help\nline with "quotes".
+# TYPE test_escaped_total counter
+test_escaped_total{path="a\\b\n\"c\""} 1
+`
+	if got := written(c.f); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestFormatFloat(t *testing.T) {
+	tests := map[float64]string{
+		0:            "0",
+		1:            "1",
+		0.0025:       "0.0025",
+		1e6:          "1e+06",
+		math.Inf(1):  "+Inf",
+		math.Inf(-1): "-Inf",
+		math.NaN():   "NaN",
+	}
+	for value, want := range tests {
+		if got := formatFloat(value); got != want {
+			t.Errorf("%v came out as %s, want %s", value, got, want)
+		}
+	}
+}
+
+func TestWrongNumberOfLabels(t *testing.T) {
+	g := NewGauge("test_labelled", "Labelled.", "kind")
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic")
+		}
+	}()
+	g.Set(1)
+}
+
+func TestRegisteringTwice(t *testing.T) {
+	NewGauge("test_twice", "Once.")
+	defer func() {
+		if recover() == nil {
+			t.Error("no panic")
+		}
+	}()
+	NewCounter("test_twice", "Twice.")
+}
+
+func TestHandler(t *testing.T) {
+	g := NewGauge("test_scraped", "Set when scraped.")
+	scrapes := 0
+	OnScrape(func() {
+		scrapes++
+		g.Set(float64(scrapes))
+	})
+	resp := httptest.NewRecorder()
+	Handler().ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+	if scrapes != 1 {
+		t.Errorf("hook ran %d times", scrapes)
+	}
+	if got := resp.Header().Get("Content-Type"); got != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("content type %s", got)
+	}
+	body := resp.Body.String()
+	if !strings.Contains(body, "# TYPE test_scraped gauge\ntest_scraped 1\n") {
+		t.Errorf("scraped value missing from\n%s", body)
+	}
+	// every line is a comment or a sample, and each metric's samples follow its HELP and TYPE
+	var current string
+	for _, line := range strings.Split(strings.TrimSuffix(body, "\n"), "\n") {
+		if strings.HasPrefix(line, "# HELP ") {
+			current = strings.Fields(line)[2]
+			continue
+		}
+		if strings.HasPrefix(line, "# TYPE ") {
+			if strings.Fields(line)[2] != current {
+				t.Errorf("TYPE without HELP: %s", line)
+			}
+			continue
+		}
+		name := strings.FieldsFunc(line, func(r rune) bool { return r == '{' || r == ' ' })[0]
+		if !strings.HasPrefix(name, current) || len(strings.Fields(line[strings.LastIndex(line, " "):])) != 1 {
+			t.Errorf("sample %s doesn't belong to %s", line, current)
+		}
+	}
+}
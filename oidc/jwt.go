@@ -0,0 +1,117 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+)
+
+// One key from the provider's JSON Web Key Set
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+var encoding = base64.RawURLEncoding
+
+// Splits a compact JWT into its header, claims, the signed part and the signature
+func parseJwt(token string) (jwtHeader, map[string]interface{}, []byte, []byte, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return jwtHeader{}, nil, nil, nil, errors.New("malformed token")
+	}
+	headerJson, err := encoding.DecodeString(parts[0])
+	if err != nil {
+		return jwtHeader{}, nil, nil, nil, fmt.Errorf("decoding header: %w", err)
+	}
+	var header jwtHeader
+	err = json.Unmarshal(headerJson, &header)
+	if err != nil {
+		return jwtHeader{}, nil, nil, nil, fmt.Errorf("parsing header: %w", err)
+	}
+	claimsJson, err := encoding.DecodeString(parts[1])
+	if err != nil {
+		return jwtHeader{}, nil, nil, nil, fmt.Errorf("decoding claims: %w", err)
+	}
+	var claims map[string]interface{}
+	err = json.Unmarshal(claimsJson, &claims)
+	if err != nil {
+		return jwtHeader{}, nil, nil, nil, fmt.Errorf("parsing claims: %w", err)
+	}
+	signature, err := encoding.DecodeString(parts[2])
+	if err != nil {
+		return jwtHeader{}, nil, nil, nil, fmt.Errorf("decoding signature: %w", err)
+	}
+	return header, claims, []byte(parts[0] + "." + parts[1]), signature, nil
+}
+
+// Checks a JWT signature made with RS256 or ES256, the algorithms that providers actually use
+func verifyJwtSignature(key jsonWebKey, alg string, signed, signature []byte) error {
+	if key.Alg != "" && key.Alg != alg {
+		return fmt.Errorf("key is for %s, not %s", key.Alg, alg)
+	}
+	hash := sha256.Sum256(signed)
+	switch alg {
+	case "RS256":
+		if key.Kty != "RSA" {
+			return errors.New("wrong key type")
+		}
+		n, err := encoding.DecodeString(key.N)
+		if err != nil {
+			return fmt.Errorf("decoding key: %w", err)
+		}
+		e, err := encoding.DecodeString(key.E)
+		if err != nil || len(e) > 4 {
+			return errors.New("malformed key exponent")
+		}
+		publicKey := rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return rsa.VerifyPKCS1v15(&publicKey, crypto.SHA256, hash[:], signature)
+	case "ES256":
+		if key.Kty != "EC" || key.Crv != "P-256" {
+			return errors.New("wrong key type")
+		}
+		x, err := encoding.DecodeString(key.X)
+		if err != nil {
+			return fmt.Errorf("decoding key: %w", err)
+		}
+		y, err := encoding.DecodeString(key.Y)
+		if err != nil {
+			return fmt.Errorf("decoding key: %w", err)
+		}
+		publicKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return errors.New("public key is not on the curve")
+		}
+		// JWS signatures are the two 32-byte numbers side by side, not ASN.1
+		if len(signature) != 64 {
+			return errors.New("malformed signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(&publicKey, hash[:], r, s) {
+			return errors.New("bad signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported algorithm %q", alg)
+}
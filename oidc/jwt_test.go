@@ -0,0 +1,63 @@
+package oidc
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"math/big"
+	"testing"
+)
+
+func TestParseJwt(t *testing.T) {
+	// the example from RFC 7519 section 3.1
+	token := "eyJ0eXAiOiJKV1QiLA0KICJhbGciOiJIUzI1NiJ9." +
+		"eyJpc3MiOiJqb2UiLA0KICJleHAiOjEzMDA4MTkzODAsDQogImh0dHA6Ly9leGFtcGxlLmNvbS9pc19yb290Ijp0cnVlfQ." +
+		"dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	header, claims, signed, signature, err := parseJwt(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.Alg != "HS256" || claims["iss"] != "joe" || claims["exp"] != float64(1300819380) || claims["http://example.com/is_root"] != true {
+		t.Errorf("got header %+v, claims %v", header, claims)
+	}
+	if string(signed) != token[:len(token)-len(".dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")] || len(signature) != 32 {
+		t.Errorf("got signed part %q, %d byte signature", signed, len(signature))
+	}
+
+	for _, bad := range []string{"", "a.b", "a.b.c.d", "!!.e30.", "e30.!!.", "e30.e30.!!", "bm90IGpzb24.e30.", "e30.bm90IGpzb24."} {
+		if _, _, _, _, err := parseJwt(bad); err == nil {
+			t.Errorf("%q: no error", bad)
+		}
+	}
+}
+
+func TestVerifyJwtSignatureRs256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwk := jsonWebKey{Kty: "RSA", N: encoding.EncodeToString(key.N.Bytes()), E: encoding.EncodeToString(big.NewInt(int64(key.E)).Bytes())}
+	signed := []byte("header.claims")
+	hash := sha256.Sum256(signed)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verifyJwtSignature(jwk, "RS256", signed, signature); err != nil {
+		t.Errorf("good signature: %s", err)
+	}
+	if err := verifyJwtSignature(jwk, "RS256", []byte("header.other"), signature); err == nil {
+		t.Error("signature over something else was accepted")
+	}
+	// the header chooses the algorithm, so a key mustn't be used with one it isn't for
+	for _, alg := range []string{"ES256", "HS256", "none", ""} {
+		if err := verifyJwtSignature(jwk, alg, signed, signature); err == nil {
+			t.Errorf("%q was accepted with an rsa key", alg)
+		}
+	}
+	jwk.Alg = "RS384"
+	if err := verifyJwtSignature(jwk, "RS256", signed, signature); err == nil {
+		t.Error("key for another algorithm was accepted")
+	}
+}
@@ -0,0 +1,258 @@
+// A client for logging in with an OpenID Connect provider, using the authorization code flow with PKCE
+// (https://openid.net/specs/openid-connect-core-1_0.html, RFC 7636).
+package oidc
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const randomSize = 32
+
+// How far the provider's clock is allowed to be off from ours
+const clockSkew = 2 * time.Minute
+
+type Config struct {
+	// The provider's issuer url, which the discovery document is found under
+	Issuer       string
+	ClientId     string
+	ClientSecret string
+	// Where the provider sends the user back to, which must be registered with the provider
+	RedirectUrl string
+	Scopes      []string
+}
+
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+// A provider fetches its discovery document and keys the first time they're needed,
+// so that the app can still start while the provider is down.
+type Provider struct {
+	config Config
+	client *http.Client
+
+	lock      sync.Mutex
+	endpoints *discovery
+	keys      []jsonWebKey
+}
+
+func New(config Config) *Provider {
+	if len(config.Scopes) == 0 {
+		config.Scopes = []string{"openid", "profile", "email"}
+	}
+	return &Provider{config: config, client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Returns a random string for the state, nonce or code verifier
+func RandomString() (string, error) {
+	bytes := make([]byte, randomSize)
+	_, err := rand.Read(bytes)
+	if err != nil {
+		return "", fmt.Errorf("generating random bytes: %w", err)
+	}
+	return encoding.EncodeToString(bytes), nil
+}
+
+func (p *Provider) discover() (discovery, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if p.endpoints != nil {
+		return *p.endpoints, nil
+	}
+	var endpoints discovery
+	err := p.getJson(strings.TrimSuffix(p.config.Issuer, "/")+"/.well-known/openid-configuration", &endpoints)
+	if err != nil {
+		return discovery{}, fmt.Errorf("fetching discovery document: %w", err)
+	}
+	if endpoints.Issuer != p.config.Issuer {
+		return discovery{}, fmt.Errorf("provider says its issuer is %q, not %q", endpoints.Issuer, p.config.Issuer)
+	}
+	if endpoints.AuthorizationEndpoint == "" || endpoints.TokenEndpoint == "" || endpoints.JwksUri == "" {
+		return discovery{}, errors.New("discovery document is missing endpoints")
+	}
+	p.endpoints = &endpoints
+	return endpoints, nil
+}
+
+func (p *Provider) getJson(url string, value interface{}) error {
+	resp, err := p.client.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got status %s", resp.Status)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(value)
+}
+
+// Builds the url to send the user to. The state, nonce and code verifier have to be
+// remembered until the user comes back, and passed to Exchange.
+func (p *Provider) AuthUrl(state, nonce, codeVerifier string) (string, error) {
+	endpoints, err := p.discover()
+	if err != nil {
+		return "", err
+	}
+	authUrl, err := url.Parse(endpoints.AuthorizationEndpoint)
+	if err != nil {
+		return "", fmt.Errorf("parsing authorization endpoint: %w", err)
+	}
+	challenge := sha256.Sum256([]byte(codeVerifier))
+	q := authUrl.Query()
+	q.Set("response_type", "code")
+	q.Set("client_id", p.config.ClientId)
+	q.Set("redirect_uri", p.config.RedirectUrl)
+	q.Set("scope", strings.Join(p.config.Scopes, " "))
+	q.Set("state", state)
+	q.Set("nonce", nonce)
+	q.Set("code_challenge", encoding.EncodeToString(challenge[:]))
+	q.Set("code_challenge_method", "S256")
+	authUrl.RawQuery = q.Encode()
+	return authUrl.String(), nil
+}
+
+type tokenResponse struct {
+	IdToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// Trades the code the provider sent back for an id token, checks it, and returns its claims
+func (p *Provider) Exchange(code, codeVerifier, nonce string) (map[string]interface{}, error) {
+	endpoints, err := p.discover()
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", p.config.RedirectUrl)
+	form.Set("code_verifier", codeVerifier)
+	form.Set("client_id", p.config.ClientId)
+	req, err := http.NewRequest(http.MethodPost, endpoints.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("creating token request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.config.ClientId), url.QueryEscape(p.config.ClientSecret))
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("requesting token: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if err != nil {
+		return nil, fmt.Errorf("reading token response: %w", err)
+	}
+	var token tokenResponse
+	err = json.Unmarshal(body, &token)
+	if err != nil {
+		return nil, fmt.Errorf("parsing token response: %w", err)
+	}
+	if token.Error != "" {
+		return nil, fmt.Errorf("provider refused code: %s: %s", token.Error, token.ErrorDescription)
+	}
+	if resp.StatusCode != http.StatusOK || token.IdToken == "" {
+		return nil, fmt.Errorf("provider returned %s with no id token", resp.Status)
+	}
+	return p.verifyIdToken(endpoints, token.IdToken, nonce)
+}
+
+func (p *Provider) verifyIdToken(endpoints discovery, idToken, nonce string) (map[string]interface{}, error) {
+	header, claims, signed, signature, err := parseJwt(idToken)
+	if err != nil {
+		return nil, err
+	}
+	key, err := p.key(endpoints, header.Kid)
+	if err != nil {
+		return nil, err
+	}
+	err = verifyJwtSignature(key, header.Alg, signed, signature)
+	if err != nil {
+		return nil, fmt.Errorf("checking id token signature: %w", err)
+	}
+
+	if iss, _ := claims["iss"].(string); iss != endpoints.Issuer {
+		return nil, fmt.Errorf("id token is from %q", iss)
+	}
+	if !audienceContains(claims["aud"], p.config.ClientId) {
+		return nil, errors.New("id token is for another client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.config.ClientId {
+		return nil, errors.New("id token was issued to another client")
+	}
+	now := time.Now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(clockSkew)) {
+		return nil, errors.New("id token has expired")
+	}
+	if iat, ok := claims["iat"].(float64); ok && now.Add(clockSkew).Before(time.Unix(int64(iat), 0)) {
+		return nil, errors.New("id token was issued in the future")
+	}
+	if tokenNonce, _ := claims["nonce"].(string); tokenNonce != nonce {
+		return nil, errors.New("wrong nonce")
+	}
+	return claims, nil
+}
+
+func audienceContains(aud interface{}, clientId string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == clientId
+	case []interface{}:
+		for _, a := range aud {
+			if a == clientId {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Finds the key the token was signed with, fetching the key set again if
+// the provider has rotated its keys since we last looked
+func (p *Provider) key(endpoints discovery, kid string) (jsonWebKey, error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	for _, refresh := range []bool{false, true} {
+		if refresh || p.keys == nil {
+			var keySet struct {
+				Keys []jsonWebKey `json:"keys"`
+			}
+			err := p.getJson(endpoints.JwksUri, &keySet)
+			if err != nil {
+				return jsonWebKey{}, fmt.Errorf("fetching keys: %w", err)
+			}
+			p.keys = keySet.Keys
+		}
+		for _, key := range p.keys {
+			if (kid == "" || key.Kid == kid) && (key.Use == "" || key.Use == "sig") {
+				return key, nil
+			}
+		}
+	}
+	return jsonWebKey{}, fmt.Errorf("no key with id %q", kid)
+}
+
+// Reads a claim as a string, for mapping it to a username
+func StringClaim(claims map[string]interface{}, name string) (string, bool) {
+	value, ok := claims[name].(string)
+	return value, ok && value != ""
+}
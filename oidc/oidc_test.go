@@ -0,0 +1,120 @@
+package oidc
+
+import (
+	"local/bookmarks/oidc/oidctest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestIssuer(t *testing.T) (*oidctest.Issuer, *Provider) {
+	t.Helper()
+	issuer, err := oidctest.NewIssuer("bookmarks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(issuer.Close)
+	return issuer, New(Config{Issuer: issuer.Url, ClientId: "bookmarks", RedirectUrl: "https://bookmarks.example.com/login/oidc/callback"})
+}
+
+func TestAuthUrl(t *testing.T) {
+	issuer, provider := newTestIssuer(t)
+	authUrl, err := provider.AuthUrl("the-state", "the-nonce", "the-verifier")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(authUrl)
+	q := u.Query()
+	if !strings.HasPrefix(authUrl, issuer.Url+"/authorize?") || q.Get("state") != "the-state" || q.Get("nonce") != "the-nonce" ||
+		q.Get("client_id") != "bookmarks" || q.Get("code_challenge_method") != "S256" {
+		t.Errorf("got %s", authUrl)
+	}
+	// RFC 7636 Appendix B
+	authUrl, _ = provider.AuthUrl("", "", "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	u, _ = url.Parse(authUrl)
+	if challenge := u.Query().Get("code_challenge"); challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("got code challenge %s", challenge)
+	}
+}
+
+func TestExchange(t *testing.T) {
+	issuer, provider := newTestIssuer(t)
+	claims, err := provider.Exchange(issuer.Code("the-nonce", map[string]interface{}{"sub": "123", "preferred_username": "alice"}),
+		"the-verifier", "the-nonce")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sub, _ := StringClaim(claims, "sub"); sub != "123" {
+		t.Errorf("got sub %q", sub)
+	}
+	if username, _ := StringClaim(claims, "preferred_username"); username != "alice" {
+		t.Errorf("got username %q", username)
+	}
+}
+
+func TestExchangeRejects(t *testing.T) {
+	now := time.Now()
+	tests := map[string]map[string]interface{}{
+		"wrong issuer":          {"iss": "https://evil.example.com"},
+		"wrong audience":        {"aud": "someone-else"},
+		"audience list":         {"aud": []string{"someone-else", "another"}},
+		"issued to another app": {"aud": []string{"bookmarks", "someone-else"}, "azp": "someone-else"},
+		"expired":               {"exp": now.Add(-time.Hour).Unix()},
+		"no expiry":             {"exp": nil},
+		"issued in the future":  {"iat": now.Add(time.Hour).Unix()},
+		"wrong nonce":           {"nonce": "another-nonce"},
+	}
+	issuer, provider := newTestIssuer(t)
+	for name, claims := range tests {
+		if _, err := provider.Exchange(issuer.Code("the-nonce", claims), "the-verifier", "the-nonce"); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if _, err := provider.Exchange("made-up-code", "the-verifier", "the-nonce"); err == nil {
+		t.Error("made up code: no error")
+	}
+}
+
+func TestExchangeAcceptsAudienceList(t *testing.T) {
+	issuer, provider := newTestIssuer(t)
+	_, err := provider.Exchange(issuer.Code("the-nonce", map[string]interface{}{"aud": []string{"other", "bookmarks"}}),
+		"the-verifier", "the-nonce")
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestExchangeRejectsBadSignature(t *testing.T) {
+	issuer, provider := newTestIssuer(t)
+	err := issuer.SignWithUnknownKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = provider.Exchange(issuer.Code("the-nonce", nil), "the-verifier", "the-nonce")
+	if err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Errorf("got %v", err)
+	}
+}
+
+func TestExchangeFetchesRotatedKeys(t *testing.T) {
+	issuer, provider := newTestIssuer(t)
+	if _, err := provider.Exchange(issuer.Code("the-nonce", nil), "the-verifier", "the-nonce"); err != nil {
+		t.Fatal(err)
+	}
+	err := issuer.RotateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := provider.Exchange(issuer.Code("the-nonce", nil), "the-verifier", "the-nonce"); err != nil {
+		t.Errorf("after rotating keys: %s", err)
+	}
+}
+
+func TestDiscoveryChecksIssuer(t *testing.T) {
+	issuer, _ := newTestIssuer(t)
+	provider := New(Config{Issuer: issuer.Url + "/", ClientId: "bookmarks"})
+	if _, err := provider.AuthUrl("state", "nonce", "verifier"); err == nil {
+		t.Error("issuer with a different url was accepted")
+	}
+}
@@ -0,0 +1,170 @@
+// A fake OpenID Connect provider, serving discovery, keys and tokens from an httptest server,
+// for testing single sign-on without a real one.
+package oidctest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var encoding = base64.RawURLEncoding
+
+type grant struct {
+	nonce  string
+	claims map[string]interface{}
+}
+
+// Signs ES256 id tokens for one client
+type Issuer struct {
+	Url      string
+	ClientId string
+	server   *httptest.Server
+
+	lock   sync.Mutex
+	key    *ecdsa.PrivateKey
+	kid    int
+	grants map[string]grant
+	// set by SignWithUnknownKey
+	rogueKey *ecdsa.PrivateKey
+}
+
+func NewIssuer(clientId string) (*Issuer, error) {
+	i := &Issuer{ClientId: clientId, grants: make(map[string]grant)}
+	err := i.RotateKey()
+	if err != nil {
+		return nil, err
+	}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", i.discovery)
+	mux.HandleFunc("/jwks", i.jwks)
+	mux.HandleFunc("/token", i.token)
+	i.server = httptest.NewServer(mux)
+	i.Url = i.server.URL
+	return i, nil
+}
+
+func (i *Issuer) Close() {
+	i.server.Close()
+}
+
+// Starts signing with a new key, and drops the old one from the key set
+func (i *Issuer) RotateKey() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generating key: %w", err)
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.key = key
+	i.kid += 1
+	return nil
+}
+
+// Makes the following tokens be signed with a key that isn't in the key set, under the current key's id
+func (i *Issuer) SignWithUnknownKey() error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generating key: %w", err)
+	}
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.rogueKey = key
+	return nil
+}
+
+// Returns a code that the token endpoint exchanges for an id token with the nonce and these claims,
+// on top of iss, aud, iat and exp, which can be overridden
+func (i *Issuer) Code(nonce string, claims map[string]interface{}) string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	code := "code-" + strconv.Itoa(len(i.grants))
+	i.grants[code] = grant{nonce: nonce, claims: claims}
+	return code
+}
+
+// Signs a token with these claims, as they are
+func (i *Issuer) Sign(claims map[string]interface{}) string {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	key := i.key
+	if i.rogueKey != nil {
+		key = i.rogueKey
+	}
+	header, _ := json.Marshal(map[string]string{"alg": "ES256", "typ": "JWT", "kid": strconv.Itoa(i.kid)})
+	payload, _ := json.Marshal(claims)
+	signed := encoding.EncodeToString(header) + "." + encoding.EncodeToString(payload)
+	hash := sha256.Sum256([]byte(signed))
+	r, s, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	if err != nil {
+		panic(err)
+	}
+	signature := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return signed + "." + encoding.EncodeToString(signature)
+}
+
+func (i *Issuer) discovery(resp http.ResponseWriter, req *http.Request) {
+	writeJson(resp, http.StatusOK, map[string]string{
+		"issuer":                 i.Url,
+		"authorization_endpoint": i.Url + "/authorize",
+		"token_endpoint":         i.Url + "/token",
+		"jwks_uri":               i.Url + "/jwks",
+	})
+}
+
+func (i *Issuer) jwks(resp http.ResponseWriter, req *http.Request) {
+	i.lock.Lock()
+	key := i.key.PublicKey
+	kid := i.kid
+	i.lock.Unlock()
+	writeJson(resp, http.StatusOK, map[string]interface{}{
+		"keys": []map[string]string{{
+			"kty": "EC",
+			"crv": "P-256",
+			"use": "sig",
+			"alg": "ES256",
+			"kid": strconv.Itoa(kid),
+			"x":   encoding.EncodeToString(key.X.FillBytes(make([]byte, 32))),
+			"y":   encoding.EncodeToString(key.Y.FillBytes(make([]byte, 32))),
+		}},
+	})
+}
+
+func (i *Issuer) token(resp http.ResponseWriter, req *http.Request) {
+	req.ParseForm()
+	i.lock.Lock()
+	g, found := i.grants[req.Form.Get("code")]
+	delete(i.grants, req.Form.Get("code"))
+	i.lock.Unlock()
+	if !found || req.Form.Get("code_verifier") == "" || req.Form.Get("client_id") != i.ClientId {
+		writeJson(resp, http.StatusBadRequest, map[string]string{"error": "invalid_grant"})
+		return
+	}
+	now := time.Now()
+	claims := map[string]interface{}{
+		"iss":   i.Url,
+		"aud":   i.ClientId,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+		"nonce": g.nonce,
+	}
+	for name, value := range g.claims {
+		claims[name] = value
+	}
+	writeJson(resp, http.StatusOK, map[string]string{"id_token": i.Sign(claims), "token_type": "Bearer"})
+}
+
+func writeJson(resp http.ResponseWriter, status int, value interface{}) {
+	resp.Header().Set("Content-Type", "application/json")
+	resp.WriteHeader(status)
+	json.NewEncoder(resp).Encode(value)
+}
@@ -0,0 +1,217 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Controls how quickly a Limiter backs off after failures
+type Config struct {
+	// Failures allowed before any delay kicks in
+	FreeFailures int
+	// Delay after the first failure past FreeFailures; it doubles with every failure after that
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// After this many failures, the key is locked out for LockoutDuration
+	LockoutFailures int
+	LockoutDuration time.Duration
+	// Failures are forgotten once there hasn't been one for this long
+	ForgetAfter time.Duration
+}
+
+func DefaultConfig() Config {
+	return Config{
+		FreeFailures:    5,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutFailures: 20,
+		LockoutDuration: 15 * time.Minute,
+		ForgetAfter:     time.Hour,
+	}
+}
+
+type record struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+	// attempts started with Begin that haven't ended yet
+	pending int
+}
+
+// Counts failed attempts per key (for example per ip, or per ip and username),
+// and blocks keys that fail too often for an exponentially increasing time
+type Limiter struct {
+	config    Config
+	mu        sync.Mutex
+	records   map[string]*record
+	lastPrune time.Time
+	// replaced in tests
+	now func() time.Time
+}
+
+func New(config Config) *Limiter {
+	return &Limiter{
+		config:    config,
+		records:   make(map[string]*record),
+		lastPrune: time.Now(),
+		now:       time.Now,
+	}
+}
+
+// Checks whether any of the keys are currently blocked.
+// If they are, returns how long until all of them are allowed again.
+func (l *Limiter) Allow(keys ...string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var wait time.Duration
+	for _, key := range keys {
+		r, exists := l.records[key]
+		if exists && r.blockedUntil.After(now) && r.blockedUntil.Sub(now) > wait {
+			wait = r.blockedUntil.Sub(now)
+		}
+	}
+	return wait == 0, wait
+}
+
+// An attempt that's been let through by Begin. It has to be ended once its result is known.
+type Attempt struct {
+	l     *Limiter
+	keys  []string
+	ended bool
+}
+
+// Lets an attempt through if none of the keys are blocked, like Allow, and counts it as in progress until it ends.
+// In-progress attempts count against the free failures, and once those are used up, only one attempt per key
+// can be in progress at a time. Otherwise attempts that are all made at once would all be let through before
+// any of them had failed. If the attempt isn't let through, returns how long to wait before trying again.
+func (l *Limiter) Begin(keys ...string) (*Attempt, bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var wait time.Duration
+	for _, key := range keys {
+		r, exists := l.records[key]
+		if !exists {
+			continue
+		}
+		if r.blockedUntil.After(now) && r.blockedUntil.Sub(now) > wait {
+			wait = r.blockedUntil.Sub(now)
+		}
+		if r.pending > 0 && l.failures(r, now)+r.pending > l.config.FreeFailures && wait < l.config.BaseDelay {
+			wait = l.config.BaseDelay
+		}
+	}
+	if wait > 0 {
+		return nil, false, wait
+	}
+	for _, key := range keys {
+		l.record(key, now).pending += 1
+	}
+	return &Attempt{l: l, keys: keys}, true, 0
+}
+
+// Stops counting the attempt as in progress. Record how it went with Fail, FailWithoutLockout or Succeed as well;
+// it's fine to end it after doing that, and ending it more than once does nothing.
+func (a *Attempt) End() {
+	if a.ended {
+		return
+	}
+	a.ended = true
+	a.l.mu.Lock()
+	defer a.l.mu.Unlock()
+	for _, key := range a.keys {
+		if r, exists := a.l.records[key]; exists && r.pending > 0 {
+			r.pending -= 1
+		}
+	}
+}
+
+// The key's record, which is added if it doesn't exist. Failures are forgotten once they're ForgetAfter old. Must hold l.mu.
+func (l *Limiter) record(key string, now time.Time) *record {
+	r, exists := l.records[key]
+	if !exists {
+		r = &record{}
+		l.records[key] = r
+	}
+	r.failures = l.failures(r, now)
+	return r
+}
+
+// How many failures still count against a record. Must hold l.mu.
+func (l *Limiter) failures(r *record, now time.Time) int {
+	if now.Sub(r.lastFailure) > l.config.ForgetAfter {
+		return 0
+	}
+	return r.failures
+}
+
+// Records a failed attempt against each of the keys
+func (l *Limiter) Fail(keys ...string) {
+	l.fail(true, keys)
+}
+
+// Records a failed attempt against each of the keys, which only ever slows them down and never locks them out.
+// This is for keys that anyone can name, like usernames, so that nobody can lock someone else out of their account.
+func (l *Limiter) FailWithoutLockout(keys ...string) {
+	l.fail(false, keys)
+}
+
+func (l *Limiter) fail(lockout bool, keys []string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	if now.Sub(l.lastPrune) > l.config.ForgetAfter {
+		l.prune(now)
+	}
+	for _, key := range keys {
+		r := l.record(key, now)
+		r.failures += 1
+		r.lastFailure = now
+		if lockout && r.failures >= l.config.LockoutFailures {
+			r.blockedUntil = now.Add(l.config.LockoutDuration)
+		} else if r.failures > l.config.FreeFailures {
+			r.blockedUntil = now.Add(l.delay(r.failures - l.config.FreeFailures))
+		}
+	}
+}
+
+// Clears the failures recorded against each of the keys
+func (l *Limiter) Succeed(keys ...string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		r, exists := l.records[key]
+		if !exists {
+			continue
+		}
+		if r.pending > 0 {
+			// other attempts are still in progress, and have to be ended
+			*r = record{pending: r.pending}
+		} else {
+			delete(l.records, key)
+		}
+	}
+}
+
+// The delay after the nth failure past the free ones
+func (l *Limiter) delay(n int) time.Duration {
+	delay := l.config.BaseDelay
+	for i := 1; i < n && delay < l.config.MaxDelay; i += 1 {
+		delay *= 2
+	}
+	if delay > l.config.MaxDelay {
+		delay = l.config.MaxDelay
+	}
+	return delay
+}
+
+// Forgets keys that haven't failed in a while and aren't blocked. Must hold l.mu.
+func (l *Limiter) prune(now time.Time) {
+	for key, r := range l.records {
+		if now.Sub(r.lastFailure) > l.config.ForgetAfter && now.After(r.blockedUntil) && r.pending == 0 {
+			delete(l.records, key)
+		}
+	}
+	l.lastPrune = now
+}
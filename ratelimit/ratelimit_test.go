@@ -0,0 +1,160 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+// A limiter whose clock only moves when the test moves it
+func newTestLimiter(config Config) (*Limiter, *time.Time) {
+	l := New(config)
+	now := time.Date(2026, 10, 19, 12, 0, 0, 0, time.UTC)
+	l.lastPrune = now
+	l.now = func() time.Time { return now }
+	return l, &now
+}
+
+func TestBackoffCurve(t *testing.T) {
+	l, _ := newTestLimiter(DefaultConfig())
+	// 5 free failures, then 1s, 2s, 4s... capped at a minute, until the lockout at 20
+	expected := []time.Duration{0, 0, 0, 0, 0,
+		time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second,
+		time.Minute, time.Minute, time.Minute, time.Minute, time.Minute, time.Minute, time.Minute, time.Minute}
+	for i, want := range expected {
+		l.Fail("ip:1.2.3.4")
+		allowed, wait := l.Allow("ip:1.2.3.4")
+		if wait != want || allowed != (want == 0) {
+			t.Errorf("after failure %d: got allowed %v, wait %s; want wait %s", i+1, allowed, wait, want)
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	l, now := newTestLimiter(DefaultConfig())
+	for i := 0; i < 20; i++ {
+		l.Fail("ip:1.2.3.4")
+	}
+	if _, wait := l.Allow("ip:1.2.3.4"); wait != 15*time.Minute {
+		t.Errorf("got wait %s after 20 failures, want the 15 minute lockout", wait)
+	}
+	*now = now.Add(15*time.Minute + time.Second)
+	if allowed, _ := l.Allow("ip:1.2.3.4"); !allowed {
+		t.Errorf("still blocked after the lockout ended")
+	}
+}
+
+func TestFailWithoutLockout(t *testing.T) {
+	l, _ := newTestLimiter(DefaultConfig())
+	for i := 0; i < 100; i++ {
+		l.FailWithoutLockout("user:alice")
+	}
+	if _, wait := l.Allow("user:alice"); wait != time.Minute {
+		t.Errorf("got wait %s after 100 failures without lockout, want the max delay of a minute", wait)
+	}
+}
+
+func TestSucceedResets(t *testing.T) {
+	l, _ := newTestLimiter(DefaultConfig())
+	for i := 0; i < 10; i++ {
+		l.Fail("user:alice")
+	}
+	l.Succeed("user:alice")
+	if allowed, _ := l.Allow("user:alice"); !allowed {
+		t.Errorf("still blocked after succeeding")
+	}
+	// the count starts again from nothing, so the free failures are free again
+	for i := 0; i < 5; i++ {
+		l.Fail("user:alice")
+	}
+	if allowed, wait := l.Allow("user:alice"); !allowed {
+		t.Errorf("blocked for %s within the free failures after a success", wait)
+	}
+}
+
+func TestForgetsOldFailures(t *testing.T) {
+	l, now := newTestLimiter(DefaultConfig())
+	for i := 0; i < 6; i++ {
+		l.Fail("ip:1.2.3.4")
+	}
+	*now = now.Add(2 * time.Hour)
+	l.Fail("ip:1.2.3.4")
+	if allowed, _ := l.Allow("ip:1.2.3.4"); !allowed {
+		t.Errorf("failures from two hours ago still counted")
+	}
+}
+
+func TestAllowWaitsForSlowestKey(t *testing.T) {
+	l, _ := newTestLimiter(DefaultConfig())
+	for i := 0; i < 7; i++ {
+		l.Fail("ip:1.2.3.4")
+	}
+	l.Fail("user:alice")
+	if _, wait := l.Allow("user:alice", "ip:1.2.3.4"); wait != 2*time.Second {
+		t.Errorf("got wait %s, want the ip's 2s", wait)
+	}
+}
+
+func TestBeginCountsAttemptsInProgress(t *testing.T) {
+	l, _ := newTestLimiter(DefaultConfig())
+	// the free failures, plus the one after them that's let through before the backoff starts
+	attempts := make([]*Attempt, 0)
+	for i := 0; i < 6; i++ {
+		attempt, allowed, _ := l.Begin("ip:1.2.3.4")
+		if !allowed {
+			t.Fatalf("attempt %d wasn't let through", i+1)
+		}
+		attempts = append(attempts, attempt)
+	}
+	if _, allowed, wait := l.Begin("ip:1.2.3.4"); allowed || wait != time.Second {
+		t.Fatalf("too many attempts at once: got allowed %t, wait %s", allowed, wait)
+	}
+	if allowed, _ := l.Allow("ip:1.2.3.4"); !allowed {
+		t.Error("attempts in progress shouldn't count as failures")
+	}
+
+	// once they've all failed, the backoff has started
+	for _, attempt := range attempts {
+		l.Fail("ip:1.2.3.4")
+		attempt.End()
+	}
+	if _, allowed, wait := l.Begin("ip:1.2.3.4"); allowed || wait != time.Second {
+		t.Errorf("after the attempts failed: got allowed %t, wait %s", allowed, wait)
+	}
+}
+
+func TestEndingAttempts(t *testing.T) {
+	l, _ := newTestLimiter(DefaultConfig())
+	for i := 0; i < 100; i++ {
+		attempt, allowed, _ := l.Begin("ip:1.2.3.4", "ip+user:1.2.3.4 alice")
+		if !allowed {
+			t.Fatalf("attempt %d that ended without failing wasn't let through", i+1)
+		}
+		attempt.End()
+		attempt.End()
+	}
+	if r := l.records["ip:1.2.3.4"]; r.pending != 0 || r.failures != 0 {
+		t.Errorf("got %+v", r)
+	}
+
+	first, _, _ := l.Begin("user:alice")
+	second, _, _ := l.Begin("user:alice")
+	l.Succeed("user:alice")
+	first.End()
+	if r := l.records["user:alice"]; r == nil || r.pending != 1 {
+		t.Errorf("succeeding lost track of the other attempt: %+v", r)
+	}
+	second.End()
+}
+
+func TestBeginForgetsOldFailures(t *testing.T) {
+	l, now := newTestLimiter(DefaultConfig())
+	for i := 0; i < 5; i++ {
+		l.Fail("ip:1.2.3.4")
+	}
+	*now = now.Add(2 * time.Hour)
+	for i := 0; i < 6; i++ {
+		if _, allowed, _ := l.Begin("ip:1.2.3.4"); !allowed {
+			t.Fatalf("attempt %d wasn't let through", i+1)
+		}
+	}
+}
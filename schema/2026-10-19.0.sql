@@ -0,0 +1,8 @@
+ALTER TABLE bookmark ADD COLUMN favorite BOOLEAN NOT NULL DEFAULT 0;
+
+CREATE TABLE saved_filter (
+    id          INTEGER PRIMARY KEY,
+    name        TEXT NOT NULL UNIQUE,
+    query       TEXT NOT NULL,
+    timestamp   TIMESTAMP NOT NULL
+);
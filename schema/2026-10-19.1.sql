@@ -0,0 +1,9 @@
+CREATE TABLE highlight (
+    id          INTEGER PRIMARY KEY,
+    bookmark    INTEGER NOT NULL,
+    text        TEXT NOT NULL,
+    timestamp   TIMESTAMP NOT NULL,
+    FOREIGN KEY (bookmark) REFERENCES bookmark(id) ON DELETE CASCADE
+);
+
+CREATE INDEX highlight__bookmark ON highlight(bookmark);
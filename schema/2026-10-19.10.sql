@@ -0,0 +1,3 @@
+-- admins can manage other users from the web; disabled users can't log in
+ALTER TABLE user ADD COLUMN admin BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE user ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT 0;
@@ -0,0 +1,17 @@
+-- single-use links for new users to sign up with, and for existing users to reset their password
+CREATE TABLE invite (
+    id          INTEGER PRIMARY KEY,
+    token_hash  TEXT NOT NULL UNIQUE,
+    created_by  TEXT NOT NULL,
+    timestamp   TIMESTAMP NOT NULL,
+    expires     TIMESTAMP NOT NULL
+);
+
+CREATE TABLE password_reset (
+    id          INTEGER PRIMARY KEY,
+    user        INTEGER NOT NULL,
+    token_hash  TEXT NOT NULL UNIQUE,
+    timestamp   TIMESTAMP NOT NULL,
+    expires     TIMESTAMP NOT NULL,
+    FOREIGN KEY (user) REFERENCES user(id) ON DELETE CASCADE
+);
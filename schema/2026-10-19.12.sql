@@ -0,0 +1,5 @@
+-- a single row that readiness checks write to, to make sure the database can still be written
+CREATE TABLE health_check (
+    id          INTEGER PRIMARY KEY CHECK (id = 1),
+    checked     TIMESTAMP NOT NULL
+);
@@ -0,0 +1,6 @@
+-- the single sign-on account each user logs in with: the provider's issuer, and its id for them (the sub claim),
+-- which unlike usernames and emails can't be changed by the user at the provider
+ALTER TABLE user ADD COLUMN oidc_issuer TEXT;
+ALTER TABLE user ADD COLUMN oidc_subject TEXT;
+
+CREATE UNIQUE INDEX user__oidc ON user(oidc_issuer, oidc_subject);
@@ -0,0 +1,10 @@
+-- how often each bookmark has been looked at, and when it should be resurfaced
+CREATE TABLE rediscovery (
+    bookmark    INTEGER PRIMARY KEY,
+    views       INTEGER NOT NULL DEFAULT 0,
+    last_seen   TIMESTAMP,
+    due         TIMESTAMP,
+    interval    INTEGER NOT NULL DEFAULT 0,
+    dismissed   BOOLEAN NOT NULL DEFAULT 0,
+    FOREIGN KEY (bookmark) REFERENCES bookmark(id) ON DELETE CASCADE
+);
@@ -0,0 +1,3 @@
+-- keys made before scopes existed keep full access
+ALTER TABLE api_key ADD COLUMN scopes TEXT NOT NULL DEFAULT 'bookmark:read bookmark:write export';
+ALTER TABLE api_key ADD COLUMN expires TIMESTAMP;
@@ -0,0 +1,19 @@
+-- api keys are stored as a hash plus a short prefix for recognising them.
+-- existing keys are moved to legacy_key, and hashLegacyKeys hashes and clears them before this commits.
+ALTER TABLE api_key RENAME TO api_key_plaintext;
+
+CREATE TABLE api_key (
+    id          INTEGER PRIMARY KEY,
+    name        TEXT NOT NULL UNIQUE,
+    key_hash    TEXT UNIQUE,
+    prefix      TEXT NOT NULL,
+    legacy_key  TEXT,
+    timestamp   DATE NOT NULL,
+    scopes      TEXT NOT NULL,
+    expires     TIMESTAMP
+);
+
+INSERT INTO api_key (id, name, prefix, legacy_key, timestamp, scopes, expires)
+    SELECT id, name, substr(key, 1, 8), key, timestamp, scopes, expires FROM api_key_plaintext;
+
+DROP TABLE api_key_plaintext;
@@ -0,0 +1,13 @@
+ALTER TABLE api_key ADD COLUMN last_used TIMESTAMP;
+ALTER TABLE api_key ADD COLUMN last_ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE api_key ADD COLUMN last_user_agent TEXT NOT NULL DEFAULT '';
+ALTER TABLE api_key ADD COLUMN disabled BOOLEAN NOT NULL DEFAULT 0;
+
+-- number of successful requests made with each key, per day (in UTC)
+CREATE TABLE api_key_usage (
+    key     INTEGER NOT NULL,
+    day     TEXT NOT NULL,
+    count   INTEGER NOT NULL,
+    PRIMARY KEY (key, day),
+    FOREIGN KEY (key) REFERENCES api_key(id) ON DELETE CASCADE
+);
@@ -0,0 +1,22 @@
+-- optional totp two-factor authentication.
+-- totp_secret is set as soon as enrollment starts, but only checked once totp_enabled is set.
+ALTER TABLE user ADD COLUMN totp_secret TEXT;
+ALTER TABLE user ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT 0;
+ALTER TABLE user ADD COLUMN totp_last_step INTEGER NOT NULL DEFAULT 0;
+
+CREATE TABLE totp_recovery_code (
+    id          INTEGER PRIMARY KEY,
+    user        INTEGER NOT NULL,
+    code_hash   TEXT NOT NULL,
+    used        BOOLEAN NOT NULL DEFAULT 0,
+    FOREIGN KEY (user) REFERENCES user(id) ON DELETE CASCADE
+);
+
+-- users who have entered their password but not yet their second factor
+CREATE TABLE login_challenge (
+    id          INTEGER PRIMARY KEY,
+    user        INTEGER NOT NULL,
+    token_hash  TEXT NOT NULL UNIQUE,
+    timestamp   TIMESTAMP NOT NULL,
+    FOREIGN KEY (user) REFERENCES user(id) ON DELETE CASCADE
+);
@@ -0,0 +1,22 @@
+-- passkeys and security keys for logging in without a password.
+-- credential_id is the base64url id that the authenticator gave us, public_key the COSE key it signs with.
+CREATE TABLE passkey (
+    id              INTEGER PRIMARY KEY,
+    user            INTEGER NOT NULL,
+    name            TEXT NOT NULL,
+    credential_id   TEXT NOT NULL UNIQUE,
+    public_key      BLOB NOT NULL,
+    sign_count      INTEGER NOT NULL DEFAULT 0,
+    timestamp       TIMESTAMP NOT NULL,
+    last_used       TIMESTAMP,
+    FOREIGN KEY (user) REFERENCES user(id) ON DELETE CASCADE
+);
+
+-- challenges handed out for registering a passkey (user is set) or logging in with one (user is null)
+CREATE TABLE passkey_challenge (
+    id          INTEGER PRIMARY KEY,
+    user        INTEGER,
+    challenge   TEXT NOT NULL UNIQUE,
+    timestamp   TIMESTAMP NOT NULL,
+    FOREIGN KEY (user) REFERENCES user(id) ON DELETE CASCADE
+);
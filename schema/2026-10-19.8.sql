@@ -0,0 +1,10 @@
+-- logins that have been sent off to the single sign-on provider and not come back yet.
+-- the state is also kept in a cookie, so that only the browser that started the login can finish it.
+CREATE TABLE oidc_login (
+    id              INTEGER PRIMARY KEY,
+    state_hash      TEXT NOT NULL UNIQUE,
+    nonce           TEXT NOT NULL,
+    code_verifier   TEXT NOT NULL,
+    redirect_to     TEXT NOT NULL,
+    timestamp       TIMESTAMP NOT NULL
+);
@@ -0,0 +1,4 @@
+-- where each session was last used from, for the sessions page
+ALTER TABLE session ADD COLUMN last_seen TIMESTAMP;
+ALTER TABLE session ADD COLUMN ip TEXT NOT NULL DEFAULT '';
+ALTER TABLE session ADD COLUMN user_agent TEXT NOT NULL DEFAULT '';
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"encoding/base64"
+	"html/template"
+	"local/bookmarks/datastore"
+	"local/bookmarks/templates"
+	"local/bookmarks/totp"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+	"github.com/skip2/go-qrcode"
+)
+
+const totpIssuer = "Bookmarks"
+
+type accountData struct {
+	Username    string
+	Admin       bool
+	TotpEnabled bool
+	// Set while the user is setting up an authenticator app
+	PendingSecret string
+	QrCode        template.URL
+	// Only set straight after two-factor authentication is turned on
+	RecoveryCodes  []string
+	RemainingCodes int64
+	Message        string
+	Passkeys       []datastore.Passkey
+	PasskeyMessage string
+	CsrfToken      string
+}
+
+func account(templates *templates.Templates, ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		req.ParseForm()
+		data, err := getAccountData(ds, session)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "getting account details: %s", err)
+			return
+		}
+		switch req.Form.Get("failed") {
+		case "":
+		case "passkey":
+			data.PasskeyMessage = "Couldn't add that passkey. Try again."
+		default:
+			data.Message = "That code didn't work. Check your authenticator app and try again."
+		}
+		renderAccount(templates, resp, req, data)
+	}
+}
+
+func getAccountData(ds *datastore.Datastore, session datastore.Session) (accountData, error) {
+	data := accountData{Username: session.Username, Admin: session.Admin, CsrfToken: session.CsrfToken}
+	var err error
+	data.TotpEnabled, err = ds.TotpEnabled(session.UserId)
+	if err != nil {
+		return data, err
+	}
+	if data.TotpEnabled {
+		data.RemainingCodes, err = ds.RemainingRecoveryCodes(session.UserId)
+		if err != nil {
+			return data, err
+		}
+	}
+
+	data.Passkeys, err = ds.ListPasskeys(session.UserId)
+	if err != nil {
+		return data, err
+	}
+
+	secret, pending, err := ds.PendingTotpSecret(session.UserId)
+	if err != nil {
+		return data, err
+	}
+	if pending {
+		png, err := qrcode.Encode(totp.Url(totpIssuer, session.Username, secret), qrcode.Medium, 256)
+		if err != nil {
+			return data, err
+		}
+		data.PendingSecret = secret
+		data.QrCode = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(png))
+	}
+	return data, nil
+}
+
+func renderAccount(templates *templates.Templates, resp http.ResponseWriter, req *http.Request, data accountData) {
+	resp.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	resp.Header().Set("Cache-Control", "no-store")
+	err := templates.Account.ExecuteTemplate(resp, "base", data)
+	if err != nil {
+		ErrorPage(resp, http.StatusInternalServerError)
+		logError(req, "writing template: %v", err)
+		return
+	}
+}
+
+func startTotp(ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		err := ds.StartTotpEnrollment(session.UserId)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "starting totp enrollment: %s", err)
+			return
+		}
+		redirect(resp, req, accountPrefix, http.StatusSeeOther)
+	}
+}
+
+func confirmTotp(templates *templates.Templates, ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		codes, valid, err := ds.ConfirmTotp(session.UserId, req.Form.Get("code"))
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "confirming totp: %s", err)
+			return
+		}
+		if !valid {
+			redirect(resp, req, accountPrefix+"?failed=1", http.StatusSeeOther)
+			return
+		}
+		logInfo(req, "user %s turned on two-factor authentication", session.Username)
+
+		// Render the page directly instead of redirecting, since the recovery codes can't be looked up again
+		data, err := getAccountData(ds, session)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "getting account details: %s", err)
+			return
+		}
+		data.RecoveryCodes = codes
+		renderAccount(templates, resp, req, data)
+	}
+}
+
+// Turns off two-factor authentication, or cancels setting it up.
+// Once it's on, turning it off needs a current code.
+func disableTotp(ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		enabled, err := ds.TotpEnabled(session.UserId)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "checking totp: %s", err)
+			return
+		}
+		if enabled {
+			valid, err := ds.CheckTotp(session.UserId, req.Form.Get("code"))
+			if err != nil {
+				ErrorPage(resp, http.StatusInternalServerError)
+				logError(req, "checking totp: %s", err)
+				return
+			}
+			if !valid {
+				redirect(resp, req, accountPrefix+"?failed=1", http.StatusSeeOther)
+				return
+			}
+		}
+		err = ds.DisableTotp(session.UserId)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "disabling totp: %s", err)
+			return
+		}
+		if enabled {
+			logInfo(req, "user %s turned off two-factor authentication", session.Username)
+		}
+		redirect(resp, req, accountPrefix, http.StatusSeeOther)
+	}
+}
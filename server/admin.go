@@ -0,0 +1,173 @@
+package server
+
+import (
+	"local/bookmarks/datastore"
+	"local/bookmarks/templates"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type adminUsersData struct {
+	Users         []datastore.User
+	Invites       []datastore.Invite
+	CurrentUserId int64
+	Message       string
+	// An invite or password reset link that was just created, which is shown once and never again
+	NewLink      string
+	NewLinkLabel string
+	CsrfToken    string
+}
+
+// Only lets admins through
+func admin(h sessionHandler) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		if !session.Admin {
+			ErrorPage(resp, http.StatusForbidden)
+			return
+		}
+		h(session, resp, req, params)
+	}
+}
+
+func adminUsers(templates *templates.Templates, ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		req.ParseForm()
+		var data adminUsersData
+		switch req.Form.Get("failed") {
+		case "":
+		case "exists":
+			data.Message = "There's already a user with that name."
+		case "self":
+			data.Message = "You can't do that to your own account."
+		default:
+			data.Message = "Usernames and passwords can't be empty."
+		}
+		renderAdminUsers(templates, ds, session, resp, req, data)
+	}
+}
+
+// Fills in the users and invites, then renders the page
+func renderAdminUsers(templates *templates.Templates, ds *datastore.Datastore, session datastore.Session, resp http.ResponseWriter, req *http.Request, data adminUsersData) {
+	var err error
+	data.Users, err = ds.GetUsers()
+	if err != nil {
+		ErrorPage(resp, http.StatusInternalServerError)
+		logError(req, "listing users: %s", err)
+		return
+	}
+	data.Invites, err = ds.ListInvites()
+	if err != nil {
+		ErrorPage(resp, http.StatusInternalServerError)
+		logError(req, "listing invites: %s", err)
+		return
+	}
+	data.CurrentUserId = session.UserId
+	data.CsrfToken = session.CsrfToken
+	resp.Header().Set("Content-Type", "text/html; charset=UTF-8")
+	resp.Header().Set("Cache-Control", "no-store")
+	err = templates.AdminUsers.ExecuteTemplate(resp, "base", data)
+	if err != nil {
+		ErrorPage(resp, http.StatusInternalServerError)
+		logError(req, "writing template: %v", err)
+		return
+	}
+}
+
+func adminCreateUser(ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		username := req.Form.Get("username")
+		password := req.Form.Get("password")
+		if username == "" || password == "" {
+			redirect(resp, req, adminPrefix+"/users?failed=empty", http.StatusSeeOther)
+			return
+		}
+		_, exists, err := ds.UserExists(username)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "checking whether user exists: %s", err)
+			return
+		}
+		if exists {
+			redirect(resp, req, adminPrefix+"/users?failed=exists", http.StatusSeeOther)
+			return
+		}
+		userId, err := ds.AddUser(username, password)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "adding user: %s", err)
+			return
+		}
+		if req.Form.Get("admin") != "" {
+			err = ds.SetUserAdmin(userId, true)
+			if err != nil {
+				ErrorPage(resp, http.StatusInternalServerError)
+				logError(req, "making user an admin: %s", err)
+				return
+			}
+		}
+		logInfo(req, "%s added user %s", session.Username, username)
+		redirect(resp, req, adminPrefix+"/users", http.StatusSeeOther)
+	}
+}
+
+// Handles the buttons next to each user. Admins can reset their own password,
+// but can't lock themselves out by disabling, deleting or demoting themselves.
+func adminUserAction(ds *datastore.Datastore, action string) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		id, err := strconv.Atoi(params[0].Value)
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		userId := int64(id)
+		user, found, err := ds.GetUser(userId)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "getting user: %s", err)
+			return
+		}
+		if !found {
+			ErrorPage(resp, http.StatusNotFound)
+			return
+		}
+		if userId == session.UserId && action != "password" {
+			redirect(resp, req, adminPrefix+"/users?failed=self", http.StatusSeeOther)
+			return
+		}
+
+		switch action {
+		case "password":
+			password := req.Form.Get("password")
+			if password == "" {
+				redirect(resp, req, adminPrefix+"/users?failed=empty", http.StatusSeeOther)
+				return
+			}
+			err = ds.SetUserPassword(userId, password)
+			if err == nil && userId != session.UserId {
+				err = ds.RevokeAllSessions(userId)
+			}
+		case "disable":
+			err = ds.SetUserDisabled(userId, true)
+		case "enable":
+			err = ds.SetUserDisabled(userId, false)
+		case "promote":
+			err = ds.SetUserAdmin(userId, true)
+		case "demote":
+			err = ds.SetUserAdmin(userId, false)
+		case "delete":
+			err = ds.DeleteUser(userId)
+		default:
+			log.Panicf("unknown user action %s", action)
+		}
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "%s user %d: %s", action, userId, err)
+			return
+		}
+		logInfo(req, "%s: %s user %s", session.Username, action, user.Username)
+		redirect(resp, req, adminPrefix+"/users", http.StatusSeeOther)
+	}
+}
@@ -2,22 +2,33 @@ package server
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"local/bookmarks/datastore"
+	"local/bookmarks/logging"
+	"local/bookmarks/ratelimit"
 	"local/bookmarks/templates"
-	"log"
+	"math"
 	"net/http"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 const tokenType = "Bearer "
 
+// The format that <input type="date"> submits
+const dateInputFormat = "2006-01-02"
+
 type keysData struct {
-	Keys      []datastore.ApiKey
-	CsrfToken string
+	Keys   []datastore.ApiKey
+	Scopes []string
+	// A key that was just created, which is shown once and never again
+	NewKey     string
+	NewKeyName string
+	CsrfToken  string
 }
 
 func keys(templates *templates.Templates, ds *datastore.Datastore) sessionHandler {
@@ -26,14 +37,18 @@ func keys(templates *templates.Templates, ds *datastore.Datastore) sessionHandle
 		keys, err := ds.ListKeys()
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("retrieving keys: %s", err)
+			logError(req, "retrieving keys: %s", err)
 			return
 		}
 
-		err = templates.ApiKeys.ExecuteTemplate(resp, "base", keysData{keys, session.CsrfToken})
+		err = templates.ApiKeys.ExecuteTemplate(resp, "base", keysData{
+			Keys:      keys,
+			Scopes:    datastore.AllScopes,
+			CsrfToken: session.CsrfToken,
+		})
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("writing template: %v", err)
+			logError(req, "writing template: %v", err)
 			return
 		}
 	}
@@ -43,18 +58,55 @@ func createKey(templates *templates.Templates, ds *datastore.Datastore) sessionH
 	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
 		req.ParseForm()
 		name := req.Form.Get("name")
-		if name == "" {
+		scopes := req.Form["scope"]
+		if name == "" || len(scopes) == 0 {
 			ErrorPage(resp, http.StatusBadRequest)
 			return
 		}
-		err := ds.CreateKey(name)
+		for _, scope := range scopes {
+			if !datastore.IsScope(scope) {
+				ErrorPage(resp, http.StatusBadRequest)
+				return
+			}
+		}
+		// the key stays valid until the end of its expiry date
+		var expires time.Time
+		if expiresParam := req.Form.Get("expires"); expiresParam != "" {
+			expiryDate, err := time.Parse(dateInputFormat, expiresParam)
+			if err != nil {
+				ErrorPage(resp, http.StatusBadRequest)
+				return
+			}
+			expires = expiryDate.Add(24 * time.Hour)
+		}
+		newKey, err := ds.CreateKey(name, scopes, expires)
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("creating key: %s", err)
+			logError(req, "creating key: %s", err)
 			return
 		}
 
-		http.Redirect(resp, req, keysPrefix, http.StatusSeeOther)
+		// Render the page directly instead of redirecting, since the key can't be looked up again afterwards
+		keys, err := ds.ListKeys()
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "retrieving keys: %s", err)
+			return
+		}
+		resp.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		resp.Header().Set("Cache-Control", "no-store")
+		err = templates.ApiKeys.ExecuteTemplate(resp, "base", keysData{
+			Keys:       keys,
+			Scopes:     datastore.AllScopes,
+			NewKey:     newKey,
+			NewKeyName: name,
+			CsrfToken:  session.CsrfToken,
+		})
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "writing template: %v", err)
+			return
+		}
 	}
 }
 
@@ -69,12 +121,90 @@ func deleteKey(templates *templates.Templates, ds *datastore.Datastore) sessionH
 		err = ds.DeleteKey(int64(id))
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("creating key: %s", err)
+			logError(req, "creating key: %s", err)
+			return
+		}
+
+		redirect(resp, req, keysPrefix, http.StatusSeeOther)
+	}
+}
+
+func setKeyDisabled(ds *datastore.Datastore, disabled bool) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		id, err := strconv.Atoi(params[0].Value)
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		err = ds.SetKeyDisabled(int64(id), disabled)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "updating key: %s", err)
 			return
 		}
 
-		http.Redirect(resp, req, keysPrefix, http.StatusSeeOther)
+		redirect(resp, req, keysPrefix, http.StatusSeeOther)
+	}
+}
+
+// Describes who is making a request, for the api keys and sessions pages
+func requestClient(req *http.Request) datastore.Client {
+	return datastore.Client{Ip: remoteIp(req), UserAgent: req.UserAgent()}
+}
+
+// The client's ip, which is the one a trusted proxy forwarded the request for, if it came through one
+func remoteIp(req *http.Request) string {
+	if ip := requestInfoOf(req).ip; ip != "" {
+		return ip
 	}
+	return peerIp(req)
+}
+
+// Reads the api key out of the Authorization header.
+// If there isn't one, this writes the error response and returns false.
+func bearerToken(resp http.ResponseWriter, req *http.Request) (string, bool) {
+	authHeader := req.Header.Get("Authorization")
+	if !strings.HasPrefix(authHeader, tokenType) {
+		ErrorPage(resp, http.StatusBadRequest)
+		return "", false
+	}
+	return authHeader[len(tokenType):], true
+}
+
+// Checks that an api key is allowed to make this call. Clients that keep sending keys that don't exist have to
+// back off, but a real key that isn't allowed to make this call isn't a guess, so it's just refused.
+// If the call isn't allowed, this writes the error response and returns false.
+func checkApiKey(ds *datastore.Datastore, limiter *ratelimit.Limiter, resp http.ResponseWriter, req *http.Request, key, scope string) bool {
+	ip := remoteIp(req)
+	if allowed, wait := limiter.Allow(ip); !allowed {
+		logWarn(req, "throttling api call from %s", ip)
+		tooManyRequests(resp, wait)
+		return false
+	}
+	name, known, allowed, err := ds.CheckKey(key, scope, requestClient(req))
+	if err != nil {
+		resultJson(resp, http.StatusInternalServerError)
+		logError(req, "authenticating api call: %s", err)
+		return false
+	}
+	if !known {
+		limiter.Fail(ip)
+		logWarn(req, "rejected unknown api key from %s for %s", ip, req.URL.Path)
+		resultJson(resp, http.StatusForbidden)
+		return false
+	}
+	if !allowed {
+		logWarn(req, "api key %s from %s isn't allowed to call %s", name, ip, req.URL.Path)
+		resultJson(resp, http.StatusForbidden)
+		return false
+	}
+	setRequestUser(req, "api key "+name)
+	return true
+}
+
+func tooManyRequests(resp http.ResponseWriter, wait time.Duration) {
+	resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	resultJson(resp, http.StatusTooManyRequests)
 }
 
 type apiNewBookmarkData struct {
@@ -82,6 +212,37 @@ type apiNewBookmarkData struct {
 	Url         string   `json:"url"`
 	Description string   `json:"description"`
 	Tags        []string `json:"tags"`
+	// A quote from the page, which is appended to the bookmark if the url is already bookmarked
+	Highlight string `json:"highlight"`
+}
+
+// Adds a new bookmark. With a highlight, the highlight is attached to the existing bookmark with the same url
+// if there is one, rather than making another bookmark; without one, it's added like before highlights existed,
+// which fails if the url is already bookmarked.
+func saveApiBookmark(ds *datastore.Datastore, data apiNewBookmarkData) error {
+	url := ensureProtocol(data.Url)
+	if data.Highlight == "" {
+		_, err := ds.CreateBookmark(data.Name, url, data.Description, data.Tags)
+		if err != nil {
+			return fmt.Errorf("creating bookmark: %w", err)
+		}
+		return nil
+	}
+	bookmarkId, exists, err := ds.GetBookmarkIdByUrl(url)
+	if err != nil {
+		return fmt.Errorf("finding existing bookmark: %w", err)
+	}
+	if !exists {
+		bookmarkId, err = ds.CreateBookmark(data.Name, url, data.Description, data.Tags)
+		if err != nil {
+			return fmt.Errorf("creating bookmark: %w", err)
+		}
+	}
+	err = ds.AddHighlight(bookmarkId, data.Highlight)
+	if err != nil {
+		return fmt.Errorf("adding highlight: %w", err)
+	}
+	return nil
 }
 
 // If you want to set up CORS for a particular route, do it like this.
@@ -98,7 +259,7 @@ type apiNewBookmarkData struct {
 	}
 }*/
 
-func addFromBookmarklet(ds *datastore.Datastore) sessionHandler {
+func addFromBookmarklet(ds *datastore.Datastore, limiter *ratelimit.Limiter) sessionHandler {
 	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
 		err := req.ParseForm()
 		if err != nil {
@@ -106,104 +267,82 @@ func addFromBookmarklet(ds *datastore.Datastore) sessionHandler {
 			return
 		}
 		authToken := req.Form.Get("auth")
-		_, allowed, err := ds.CheckKey(authToken)
-		if err != nil {
-			resultJson(resp, http.StatusInternalServerError)
-			log.Printf("authenticating api call: %s", err)
+		if !checkApiKey(ds, limiter, resp, req, authToken, datastore.ScopeBookmarkWrite) {
 			return
 		}
-		if allowed {
-			data := apiNewBookmarkData{
-				Name:        req.Form.Get("name"),
-				Url:         req.Form.Get("url"),
-				Description: req.Form.Get("description"),
-				Tags:        req.Form["tag"],
-			}
-			if data.Name == "" || data.Url == "" {
-				ErrorPage(resp, http.StatusBadRequest)
-				return
-			}
-			ds.CreateBookmark(data.Name, ensureProtocol(data.Url), data.Description, data.Tags)
-			http.Redirect(resp, req, "/", http.StatusSeeOther)
-		} else {
-			resultJson(resp, http.StatusForbidden)
+		data := apiNewBookmarkData{
+			Name:        req.Form.Get("name"),
+			Url:         req.Form.Get("url"),
+			Description: req.Form.Get("description"),
+			Tags:        req.Form["tag"],
+			Highlight:   req.Form.Get("highlight"),
+		}
+		if data.Name == "" || data.Url == "" {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		err = saveApiBookmark(ds, data)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "adding bookmark from bookmarklet: %s", err)
+			return
 		}
+		redirect(resp, req, "/", http.StatusSeeOther)
 	}
 }
 
-func apiNewBookmark(ds *datastore.Datastore) httprouter.Handle {
+func apiNewBookmark(ds *datastore.Datastore, limiter *ratelimit.Limiter) httprouter.Handle {
 	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
 		header := resp.Header()
 		header.Set("Access-Control-Allow-Origin", "*")
 		header.Set("Access-Control-Allow-Headers", "Authorization")
 		header.Set("Access-Control-Allow-Methods", req.Method)
 		header.Set("Content-Type", "application/json; charset=UTF-8")
-		authHeader := req.Header.Get("Authorization")
-		if !strings.HasPrefix(authHeader, tokenType) {
-			ErrorPage(resp, http.StatusBadRequest)
+		authHeader, ok := bearerToken(resp, req)
+		if !ok || !checkApiKey(ds, limiter, resp, req, authHeader, datastore.ScopeBookmarkWrite) {
 			return
-		} else {
-			authHeader = authHeader[len(tokenType):]
 		}
-		_, allowed, err := ds.CheckKey(authHeader)
+		jsonData, err := ioutil.ReadAll(req.Body)
 		if err != nil {
-			resultJson(resp, http.StatusInternalServerError)
-			log.Printf("authenticating api call: %s", err)
+			resultJson(resp, http.StatusBadRequest)
 			return
 		}
-		if allowed {
-			jsonData, err := ioutil.ReadAll(req.Body)
-			if err != nil {
-				resultJson(resp, http.StatusBadRequest)
-				return
-			}
-			var data apiNewBookmarkData
-			err = json.Unmarshal(jsonData, &data)
-			if err != nil {
-				resultJson(resp, http.StatusBadRequest)
-				return
-			}
-			if data.Name == "" || data.Url == "" {
-				resultJson(resp, http.StatusBadRequest)
-				return
-			}
-			ds.CreateBookmark(data.Name, ensureProtocol(data.Url), data.Description, data.Tags)
-			resultJson(resp, http.StatusOK)
-		} else {
-			resultJson(resp, http.StatusForbidden)
+		var data apiNewBookmarkData
+		err = json.Unmarshal(jsonData, &data)
+		if err != nil {
+			resultJson(resp, http.StatusBadRequest)
+			return
 		}
+		if data.Name == "" || data.Url == "" {
+			resultJson(resp, http.StatusBadRequest)
+			return
+		}
+		err = saveApiBookmark(ds, data)
+		if err != nil {
+			resultJson(resp, http.StatusInternalServerError)
+			logError(req, "adding bookmark from api: %s", err)
+			return
+		}
+		resultJson(resp, http.StatusOK)
 	}
 }
 
-func apiExport(ds *datastore.Datastore) httprouter.Handle {
+func apiExport(ds *datastore.Datastore, limiter *ratelimit.Limiter) httprouter.Handle {
 	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
 		resp.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		authHeader := req.Header.Get("Authorization")
-		if !strings.HasPrefix(authHeader, tokenType) {
-			ErrorPage(resp, http.StatusBadRequest)
+		authHeader, ok := bearerToken(resp, req)
+		if !ok || !checkApiKey(ds, limiter, resp, req, authHeader, datastore.ScopeExport) {
 			return
-		} else {
-			authHeader = authHeader[len(tokenType):]
 		}
-		_, allowed, err := ds.CheckKey(authHeader)
+		exported, err := ds.Export()
 		if err != nil {
 			resultJson(resp, http.StatusInternalServerError)
-			log.Printf("authenticating api call: %s", err)
+			logError(req, "exporting data: %s", err)
 			return
 		}
-		if allowed {
-			exported, err := ds.Export()
-			if err != nil {
-				resultJson(resp, http.StatusInternalServerError)
-				log.Printf("exporting data: %s", err)
-				return
-			}
-			_, err = resp.Write(exported)
-			if err != nil {
-				log.Printf("writing response: %s", err)
-			}
-		} else {
-			resultJson(resp, http.StatusForbidden)
+		_, err = resp.Write(exported)
+		if err != nil {
+			logError(req, "writing response: %s", err)
 		}
 	}
 }
@@ -218,10 +357,10 @@ func resultJson(resp http.ResponseWriter, code int) {
 	resp.Header().Set("Content-Type", "text/json; charset=UTF-8")
 	data, err := json.Marshal(resultData{code, http.StatusText(code)})
 	if err != nil {
-		log.Printf("marshaling json: %s", err)
+		logging.Errorf("marshaling json: %s", err)
 	}
 	_, err = resp.Write(data)
 	if err != nil {
-		log.Printf("writing response: %s", err)
+		logging.Errorf("writing response: %s", err)
 	}
 }
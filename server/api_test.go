@@ -0,0 +1,171 @@
+package server
+
+import (
+	"local/bookmarks/datastore"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func (s *testSite) newKey(scopes ...string) string {
+	s.t.Helper()
+	key, err := s.ds.CreateKey("test key", scopes, time.Time{})
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	return key
+}
+
+// Calls the api with a key, without a session
+func (s *testSite) api(method, path, key, body string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Authorization", tokenType+key)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	return resp
+}
+
+func (s *testSite) bookmarks() []datastore.Bookmark {
+	s.t.Helper()
+	bookmarks, err := s.ds.GetBookmarks(datastore.NewQueryInfo(100))
+	if err != nil {
+		s.t.Fatal(err)
+	}
+	for i := range bookmarks {
+		bookmarks[i], err = s.ds.GetBookmark(bookmarks[i].Id)
+		if err != nil {
+			s.t.Fatal(err)
+		}
+	}
+	return bookmarks
+}
+
+func TestApiHighlightsGoOnExistingBookmark(t *testing.T) {
+	s := newTestSite(t, Options{})
+	key := s.newKey(datastore.ScopeBookmarkWrite)
+	post := func(body string) {
+		t.Helper()
+		if resp := s.api("POST", apiPrefix+"/bookmark", key, body); resp.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", resp.Code, resp.Body)
+		}
+	}
+
+	post(`{"name": "Article", "url": "example.com/article", "highlight": "first quote"}`)
+	post(`{"name": "Article again", "url": "https://example.com/article", "highlight": "second quote"}`)
+	bookmarks := s.bookmarks()
+	if len(bookmarks) != 1 || bookmarks[0].Name != "Article" || len(bookmarks[0].Highlights) != 2 {
+		t.Fatalf("got %+v", bookmarks)
+	}
+	if bookmarks[0].Highlights[0].Text != "first quote" || bookmarks[0].Highlights[1].Text != "second quote" {
+		t.Errorf("got highlights %+v", bookmarks[0].Highlights)
+	}
+
+	// without a highlight, the bookmark isn't merged into the existing one, and urls are unique
+	resp := s.api("POST", apiPrefix+"/bookmark", key, `{"name": "Article once more", "url": "https://example.com/article"}`)
+	if resp.Code == http.StatusOK {
+		t.Error("bookmarked the same url twice")
+	}
+	if bookmarks := s.bookmarks(); len(bookmarks) != 1 || bookmarks[0].Name != "Article" {
+		t.Errorf("got %+v", bookmarks)
+	}
+}
+
+func TestBookmarkletHighlight(t *testing.T) {
+	s := newTestSite(t, Options{})
+	key := s.newKey(datastore.ScopeBookmarkWrite)
+	resp := s.get("/_bookmarklet?auth=" + key + "&name=Article&url=https://example.com/a&highlight=a+quote")
+	if resp.Code != http.StatusSeeOther {
+		t.Fatalf("got %d", resp.Code)
+	}
+	bookmarks := s.bookmarks()
+	if len(bookmarks) != 1 || len(bookmarks[0].Highlights) != 1 || bookmarks[0].Highlights[0].Text != "a quote" {
+		t.Fatalf("got %+v", bookmarks)
+	}
+
+	resp = s.post(bookmarksPrefix+"/highlight/delete/"+strconv.FormatInt(bookmarks[0].Highlights[0].Id, 10), nil)
+	if location := resp.Header().Get("Location"); resp.Code != http.StatusSeeOther || location != bookmarksPrefix+"/view/"+strconv.FormatInt(bookmarks[0].Id, 10) {
+		t.Errorf("deleting: got %d to %q", resp.Code, location)
+	}
+	if bookmarks := s.bookmarks(); len(bookmarks[0].Highlights) != 0 {
+		t.Errorf("still has %+v", bookmarks[0].Highlights)
+	}
+}
+
+func TestApiKeyOutsideItsScopeIsntThrottled(t *testing.T) {
+	s := newTestSite(t, Options{})
+	key := s.newKey(datastore.ScopeBookmarkWrite)
+	for i := 0; i < 30; i++ {
+		if resp := s.api("GET", apiPrefix+"/export", key, ""); resp.Code != http.StatusForbidden {
+			t.Fatalf("call %d outside the key's scope: got %d", i, resp.Code)
+		}
+	}
+	if resp := s.api("POST", apiPrefix+"/bookmark", key, `{"name": "Article", "url": "https://example.com/a"}`); resp.Code != http.StatusOK {
+		t.Errorf("call within the key's scope: got %d", resp.Code)
+	}
+}
+
+func TestUnknownApiKeysAreThrottled(t *testing.T) {
+	s := newTestSite(t, Options{})
+	key := s.newKey(datastore.ScopeExport)
+	throttled := false
+	for i := 0; i < 30 && !throttled; i++ {
+		resp := s.api("GET", apiPrefix+"/export", "guess"+strconv.Itoa(i), "")
+		throttled = resp.Code == http.StatusTooManyRequests
+		if !throttled && resp.Code != http.StatusForbidden {
+			t.Fatalf("guess %d: got %d", i, resp.Code)
+		}
+	}
+	if !throttled {
+		t.Fatal("never throttled")
+	}
+	// the throttling is by ip, so a real key from the same place has to wait too
+	if resp := s.api("GET", apiPrefix+"/export", key, ""); resp.Code != http.StatusTooManyRequests || resp.Header().Get("Retry-After") == "" {
+		t.Errorf("got %d", resp.Code)
+	}
+}
+
+func TestKeysPageShowsUsage(t *testing.T) {
+	s := newTestSite(t, Options{})
+	key := s.newKey(datastore.ScopeExport)
+	req := httptest.NewRequest("GET", apiPrefix+"/export", nil)
+	req.Header.Set("Authorization", tokenType+key)
+	req.Header.Set("User-Agent", "backup-script/1.0")
+	s.router.ServeHTTP(httptest.NewRecorder(), req)
+
+	body := s.get(keysPrefix).Body.String()
+	for _, want := range []string{"from 192.0.2.1 (backup-script/1.0)", ": 1.", key[:8] + "…"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("keys page is missing %q", want)
+		}
+	}
+	if strings.Contains(body, key) {
+		t.Error("keys page shows the whole key")
+	}
+}
+
+func TestDisablingKeys(t *testing.T) {
+	s := newTestSite(t, Options{})
+	key := s.newKey(datastore.ScopeExport)
+	keys, err := s.ds.ListKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := strconv.FormatInt(keys[0].Id, 10)
+
+	if resp := s.post(keysPrefix+"/disable/"+id, nil); resp.Code != http.StatusSeeOther {
+		t.Fatalf("disabling: got %d", resp.Code)
+	}
+	if resp := s.api("GET", apiPrefix+"/export", key, ""); resp.Code != http.StatusForbidden {
+		t.Errorf("disabled key: got %d", resp.Code)
+	}
+	if body := s.get(keysPrefix).Body.String(); !strings.Contains(body, "(disabled)") {
+		t.Error("keys page doesn't say the key is disabled")
+	}
+	s.post(keysPrefix+"/enable/"+id, nil)
+	if resp := s.api("GET", apiPrefix+"/export", key, ""); resp.Code != http.StatusOK {
+		t.Errorf("enabled key: got %d", resp.Code)
+	}
+}
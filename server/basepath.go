@@ -0,0 +1,46 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"strings"
+)
+
+type basePathKey struct{}
+
+// Serves the app under a path like /bookmarks-app, so it can share a host with other things behind a reverse proxy.
+// Handlers see paths without the base path, and put it back with basePath when they link to themselves.
+type BasePathMiddleware struct {
+	base string
+	h    http.Handler
+}
+
+func (m BasePathMiddleware) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == m.base {
+		target := m.base + "/"
+		if req.URL.RawQuery != "" {
+			target += "?" + req.URL.RawQuery
+		}
+		http.Redirect(resp, req, target, http.StatusMovedPermanently)
+		return
+	}
+	if !strings.HasPrefix(req.URL.Path, m.base+"/") {
+		http.NotFound(resp, req)
+		return
+	}
+	inner := req.Clone(context.WithValue(req.Context(), basePathKey{}, m.base))
+	inner.URL.Path = strings.TrimPrefix(req.URL.Path, m.base)
+	inner.URL.RawPath = strings.TrimPrefix(req.URL.RawPath, m.base)
+	m.h.ServeHTTP(resp, inner)
+}
+
+// The path the app is served under, or "" if it's at the root
+func basePath(req *http.Request) string {
+	base, _ := req.Context().Value(basePathKey{}).(string)
+	return base
+}
+
+// Like http.Redirect, for paths within the app
+func redirect(resp http.ResponseWriter, req *http.Request, path string, code int) {
+	http.Redirect(resp, req, basePath(req)+path, code)
+}
@@ -3,9 +3,9 @@ package server
 import (
 	"fmt"
 	"local/bookmarks/datastore"
+	"local/bookmarks/markdown"
 	"local/bookmarks/templates"
 	"local/bookmarks/urlparams"
-	"log"
 	"net/http"
 	"strconv"
 	"strings"
@@ -25,6 +25,8 @@ type bookmarkData struct {
 	Bookmark     datastore.Bookmark
 	SearchParams urlparams.SearchParams
 	CsrfToken    string
+	// Whether to render the description as markdown instead of as plain text
+	Expanded bool
 }
 
 func index(templates *templates.Templates, ds *datastore.Datastore) sessionHandler {
@@ -47,14 +49,14 @@ func index(templates *templates.Templates, ds *datastore.Datastore) sessionHandl
 		bookmarks, err := ds.GetBookmarks(query)
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("getting bookmarks: %v", err)
+			logError(req, "getting bookmarks: %v", err)
 			return
 		}
 
 		numBookmarks, err := ds.GetNumBookmarks(query)
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("getting number of bookmarks: %v", err)
+			logError(req, "getting number of bookmarks: %v", err)
 			return
 		}
 
@@ -63,7 +65,7 @@ func index(templates *templates.Templates, ds *datastore.Datastore) sessionHandl
 			indexData{bookmarks, pager, urlParams, numBookmarks, session.CsrfToken})
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("writing template: %v", err)
+			logError(req, "writing template: %v", err)
 			return
 		}
 	}
@@ -89,10 +91,14 @@ func viewBookmark(templates *templates.Templates, ds *datastore.Datastore) sessi
 			ErrorPage(resp, http.StatusNotFound)
 			return
 		}
-		err = templates.ViewBookmark.ExecuteTemplate(resp, "base", bookmarkData{bookmark, urlParams, session.CsrfToken})
+		err = ds.RecordView(bookmark.Id)
+		if err != nil {
+			logError(req, "recording view of bookmark %d: %v", bookmark.Id, err)
+		}
+		err = templates.ViewBookmark.ExecuteTemplate(resp, "base", bookmarkData{bookmark, urlParams, session.CsrfToken, true})
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("writing template: %v", err)
+			logError(req, "writing template: %v", err)
 			return
 		}
 	}
@@ -118,10 +124,10 @@ func editBookmark(templates *templates.Templates, ds *datastore.Datastore) sessi
 			ErrorPage(resp, http.StatusNotFound)
 			return
 		}
-		err = templates.EditBookmark.ExecuteTemplate(resp, "base", bookmarkData{bookmark, urlParams, session.CsrfToken})
+		err = templates.EditBookmark.ExecuteTemplate(resp, "base", bookmarkData{bookmark, urlParams, session.CsrfToken, false})
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("writing template: %v", err)
+			logError(req, "writing template: %v", err)
 			return
 		}
 	}
@@ -164,10 +170,10 @@ func submitEditedBookmark(ds *datastore.Datastore) sessionHandler {
 		err = ds.UpdateBookmark(int64(id), name, url, description, tags)
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("updating bookmark %d: %s", id, err)
+			logError(req, "updating bookmark %d: %s", id, err)
 			return
 		}
-		http.Redirect(resp, req, bookmarksPrefix+"/view/"+bookmarkIdParam, http.StatusSeeOther)
+		redirect(resp, req, bookmarksPrefix+"/view/"+bookmarkIdParam, http.StatusSeeOther)
 	}
 }
 
@@ -188,13 +194,30 @@ func submitNewBookmark(ds *datastore.Datastore) sessionHandler {
 		url = ensureProtocol(url)
 		tags := req.Form["tag"]
 
-		err = ds.CreateBookmark(name, url, description, tags)
+		_, err = ds.CreateBookmark(name, url, description, tags)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "adding new bookmark: %v", err)
+			return
+		}
+		redirect(resp, req, bookmarksPrefix, http.StatusSeeOther)
+	}
+}
+
+func deleteHighlight(ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		id, err := strconv.Atoi(params[0].Value)
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		bookmarkId, err := ds.DeleteHighlight(int64(id))
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("adding new bookmark: %v", err)
+			logError(req, "deleting highlight %d: %v", id, err)
 			return
 		}
-		http.Redirect(resp, req, bookmarksPrefix, http.StatusSeeOther)
+		redirect(resp, req, bookmarksPrefix+"/view/"+strconv.FormatInt(bookmarkId, 10), http.StatusSeeOther)
 	}
 }
 
@@ -209,10 +232,26 @@ func deleteBookmark(ds *datastore.Datastore) sessionHandler {
 		err = ds.DeleteBookmark(int64(id))
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("deleting bookmark %d: %v", id, err)
+			logError(req, "deleting bookmark %d: %v", id, err)
 			return
 		}
-		http.Redirect(resp, req, bookmarksPrefix, http.StatusSeeOther)
+		redirect(resp, req, bookmarksPrefix, http.StatusSeeOther)
+	}
+}
+
+// Renders the posted description so that the edit form can show a preview of it
+func previewDescription() sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		resp.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		err := req.ParseForm()
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		_, err = resp.Write([]byte(markdown.Render(req.Form.Get("description"))))
+		if err != nil {
+			logError(req, "writing response: %s", err)
+		}
 	}
 }
 
@@ -0,0 +1,57 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+)
+
+// The address of whatever is directly connected to us, which may be a proxy
+func peerIp(req *http.Request) string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return req.RemoteAddr
+	}
+	return ip
+}
+
+// Works out the client's ip. If the peer is a trusted proxy, X-Forwarded-For is followed from the right,
+// past any more trusted proxies, to the first address that isn't one. Addresses further left than that
+// could have been made up by the client, so they're never used.
+func clientIp(req *http.Request, trustedProxies []*net.IPNet) string {
+	ip := peerIp(req)
+	if len(trustedProxies) == 0 {
+		return ip
+	}
+	forwarded := make([]string, 0)
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		for _, hop := range strings.Split(header, ",") {
+			if hop = strings.TrimSpace(hop); hop != "" {
+				forwarded = append(forwarded, hop)
+			}
+		}
+	}
+	for len(forwarded) > 0 && trusted(ip, trustedProxies) {
+		next := forwarded[len(forwarded)-1]
+		forwarded = forwarded[:len(forwarded)-1]
+		if net.ParseIP(next) == nil {
+			// a proxy we trust wouldn't write this, so stop at the last address we know is real
+			break
+		}
+		ip = next
+	}
+	return ip
+}
+
+func trusted(ip string, proxies []*net.IPNet) bool {
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return false
+	}
+	for _, proxy := range proxies {
+		if proxy.Contains(parsed) {
+			return true
+		}
+	}
+	return false
+}
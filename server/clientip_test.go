@@ -0,0 +1,40 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"testing"
+)
+
+func TestClientIp(t *testing.T) {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	trustedProxies := []*net.IPNet{proxies}
+	tests := []struct {
+		name      string
+		peer      string
+		forwarded []string
+		trusted   []*net.IPNet
+		want      string
+	}{
+		{"no proxies configured", "10.0.0.1:1234", []string{"1.2.3.4"}, nil, "10.0.0.1"},
+		{"direct client", "5.6.7.8:1234", nil, trustedProxies, "5.6.7.8"},
+		{"untrusted peer can't forward", "5.6.7.8:1234", []string{"1.2.3.4"}, trustedProxies, "5.6.7.8"},
+		{"trusted proxy", "10.0.0.1:1234", []string{"1.2.3.4"}, trustedProxies, "1.2.3.4"},
+		{"chain of trusted proxies", "10.0.0.1:1234", []string{"1.2.3.4, 10.0.0.2"}, trustedProxies, "1.2.3.4"},
+		{"spoofed addresses on the left are ignored", "10.0.0.1:1234", []string{"9.9.9.9, 1.2.3.4"}, trustedProxies, "1.2.3.4"},
+		{"several headers", "10.0.0.1:1234", []string{"9.9.9.9", "1.2.3.4"}, trustedProxies, "1.2.3.4"},
+		{"only proxies", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, trustedProxies, "10.0.0.3"},
+		{"garbage", "10.0.0.1:1234", []string{"not an ip"}, trustedProxies, "10.0.0.1"},
+		{"ipv6", "10.0.0.1:1234", []string{"2001:db8::1"}, trustedProxies, "2001:db8::1"},
+	}
+	for _, test := range tests {
+		req, _ := http.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = test.peer
+		for _, header := range test.forwarded {
+			req.Header.Add("X-Forwarded-For", header)
+		}
+		if got := clientIp(req, test.trusted); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+	}
+}
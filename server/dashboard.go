@@ -0,0 +1,156 @@
+package server
+
+import (
+	"local/bookmarks/datastore"
+	"local/bookmarks/templates"
+	"local/bookmarks/urlparams"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const dashboardRecent = 10
+const dashboardTags = 20
+
+type dashboardData struct {
+	Favorites    []datastore.Bookmark
+	Recent       []datastore.Bookmark
+	Tags         []datastore.Tag
+	Filters      []savedFilterData
+	SearchParams urlparams.SearchParams
+	CsrfToken    string
+}
+
+type savedFilterData struct {
+	Id           int64
+	Name         string
+	SearchParams urlparams.SearchParams
+}
+
+func dashboard(templates *templates.Templates, ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		resp.Header().Set("Content-Type", "text/html; charset=UTF-8")
+
+		favorites, err := ds.GetFavoriteBookmarks()
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "getting favorites: %v", err)
+			return
+		}
+
+		recent, err := ds.GetBookmarks(datastore.NewQueryInfo(dashboardRecent))
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "getting recent bookmarks: %v", err)
+			return
+		}
+
+		tags, err := ds.GetTags()
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "getting tags: %v", err)
+			return
+		}
+		sort.SliceStable(tags, func(i, j int) bool {
+			return tags[i].Count > tags[j].Count
+		})
+		if len(tags) > dashboardTags {
+			tags = tags[:dashboardTags]
+		}
+
+		savedFilters, err := ds.ListSavedFilters()
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "getting saved filters: %v", err)
+			return
+		}
+		filters := make([]savedFilterData, 0, len(savedFilters))
+		for _, filter := range savedFilters {
+			filterParams, err := urlparams.ParseQuery(filter.Query)
+			if err != nil {
+				logError(req, "parsing saved filter %d: %v", filter.Id, err)
+				continue
+			}
+			filters = append(filters, savedFilterData{filter.Id, filter.Name, filterParams})
+		}
+
+		err = templates.Dashboard.ExecuteTemplate(resp, "base", dashboardData{
+			Favorites:    favorites,
+			Recent:       recent,
+			Tags:         tags,
+			Filters:      filters,
+			SearchParams: urlparams.DefaultUrlParams(),
+			CsrfToken:    session.CsrfToken,
+		})
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "writing template: %v", err)
+			return
+		}
+	}
+}
+
+func setFavorite(ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		bookmarkIdParam := params[0].Value
+		id, err := strconv.Atoi(bookmarkIdParam)
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		urlParams, err := urlparams.GetQueryParams(req)
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		favorite := req.Form.Get("favorite") == "true"
+		err = ds.SetFavorite(int64(id), favorite)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "setting favorite on bookmark %d: %v", id, err)
+			return
+		}
+		redirect(resp, req, bookmarksPrefix+"/view/"+bookmarkIdParam+string(urlParams.QueryString()), http.StatusSeeOther)
+	}
+}
+
+func createSavedFilter(ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		urlParams, err := urlparams.GetQueryParams(req)
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		name := req.Form.Get("name")
+		if name == "" {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		err = ds.CreateSavedFilter(name, urlParams.Encode())
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "saving filter: %v", err)
+			return
+		}
+		redirect(resp, req, "/", http.StatusSeeOther)
+	}
+}
+
+func deleteSavedFilter(ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		id, err := strconv.Atoi(params[0].Value)
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		err = ds.DeleteSavedFilter(int64(id))
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "deleting saved filter %d: %v", id, err)
+			return
+		}
+		redirect(resp, req, "/", http.StatusSeeOther)
+	}
+}
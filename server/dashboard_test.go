@@ -0,0 +1,66 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestDashboard(t *testing.T) {
+	s := newTestSite(t, Options{})
+	pinned, err := s.ds.CreateBookmark("Pinned one", "https://pinned.example.com", "", []string{"go"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = s.ds.CreateBookmark("Unpinned one", "https://unpinned.example.com", "", []string{"go", "sqlite"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := s.post(fmt.Sprintf("%s/favorite/%d", bookmarksPrefix, pinned), url.Values{"favorite": {"true"}})
+	if resp.Code != http.StatusSeeOther {
+		t.Fatalf("pinning: got %d", resp.Code)
+	}
+	resp = s.post(filtersPrefix+"/create", url.Values{"name": {"Go & databases"}, "searchTag": {"go", "sqlite"}, "order": {"reverse"}})
+	if location := resp.Header().Get("Location"); resp.Code != http.StatusSeeOther || location != "/" {
+		t.Fatalf("saving filter: got %d to %q", resp.Code, location)
+	}
+
+	resp = s.get("/")
+	if resp.Code != http.StatusOK {
+		t.Fatalf("got %d", resp.Code)
+	}
+	body := resp.Body.String()
+	pinnedSection := body[strings.Index(body, "<h2>Pinned</h2>"):strings.Index(body, "<h2>Saved filters</h2>")]
+	if !strings.Contains(pinnedSection, "Pinned one") || strings.Contains(pinnedSection, "Unpinned one") {
+		t.Errorf("pinned section is\n%s", pinnedSection)
+	}
+	for _, want := range []string{
+		"Go &amp; databases",
+		`href="/bookmarks?order=reverse&amp;searchTag=go&amp;searchTag=sqlite"`,
+		`<a href="/bookmarks?searchTag=go">go</a> (2)`,
+		"Unpinned one",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("dashboard is missing %s", want)
+		}
+	}
+
+	filters, err := s.ds.ListSavedFilters()
+	if err != nil || len(filters) != 1 {
+		t.Fatalf("got %v, %v", filters, err)
+	}
+	s.post(fmt.Sprintf("%s/delete/%d", filtersPrefix, filters[0].Id), nil)
+	if body := s.get("/").Body.String(); strings.Contains(body, "Saved filters") {
+		t.Error("filter is still shown after deleting it")
+	}
+}
+
+func TestSavedFilterNeedsName(t *testing.T) {
+	s := newTestSite(t, Options{})
+	if resp := s.post(filtersPrefix+"/create", url.Values{"search": {"go"}}); resp.Code != http.StatusBadRequest {
+		t.Errorf("got %d", resp.Code)
+	}
+}
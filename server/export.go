@@ -3,34 +3,38 @@ package server
 import (
 	"local/bookmarks/datastore"
 	"local/bookmarks/templates"
-	"log"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+type exportData struct {
+	Data      string
+	CsrfToken string
+}
+
 func export(templates *templates.Templates, ds *datastore.Datastore) sessionHandler {
 	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
 		resp.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		req.ParseForm()
 		really := req.Form.Get("really")
 
-		var exportData string
+		data := exportData{CsrfToken: session.CsrfToken}
 		var err error
 		if really == "yes" {
 			exportBytes, err := ds.Export()
 			if err != nil {
 				ErrorPage(resp, http.StatusInternalServerError)
 			}
-			exportData = string(exportBytes)
+			data.Data = string(exportBytes)
 		} else {
-			exportData = "Press \"Export Data\" to populate this field with your data."
+			data.Data = "Press \"Export Data\" to populate this field with your data."
 		}
 
-		err = templates.Export.ExecuteTemplate(resp, "base", exportData)
+		err = templates.Export.ExecuteTemplate(resp, "base", data)
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("writing template: %v", err)
+			logError(req, "writing template: %v", err)
 			return
 		}
 	}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"local/bookmarks/datastore"
+	"local/bookmarks/logging"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+// How long the readiness check waits for the database before reporting it as down
+const databaseCheckTimeout = 5 * time.Second
+
+// A background loop, like session cleanup, that readiness depends on
+type Worker struct {
+	name string
+	// how often the worker checks in with Beat, or 0 if it only has to be running
+	interval time.Duration
+
+	mutex    sync.Mutex
+	lastBeat time.Time
+	stopped  bool
+}
+
+var (
+	workersMutex sync.Mutex
+	workers      []*Worker
+)
+
+// Registers a worker that's just started. It has to call Beat at least every interval (unless that's 0) to count as alive,
+// and Stop when it exits.
+func StartWorker(name string, interval time.Duration) *Worker {
+	w := &Worker{name: name, interval: interval, lastBeat: time.Now()}
+	workersMutex.Lock()
+	defer workersMutex.Unlock()
+	workers = append(workers, w)
+	return w
+}
+
+func (w *Worker) Beat() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.lastBeat = time.Now()
+}
+
+func (w *Worker) Stop() {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.stopped = true
+}
+
+// Returns "" if the worker is alive, or why it isn't
+func (w *Worker) problem() string {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.stopped {
+		return "stopped"
+	}
+	// a run can take a while, so allow for one being late
+	if w.interval > 0 && time.Since(w.lastBeat) > 2*w.interval {
+		return "last checked in " + time.Since(w.lastBeat).Round(time.Second).String() + " ago"
+	}
+	return ""
+}
+
+type healthCheck struct {
+	Ok    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]healthCheck `json:"checks,omitempty"`
+}
+
+// Answers as long as the server is running, for liveness probes
+func healthz() httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		requestInfoOf(req).quiet = true
+		writeHealth(resp, http.StatusOK, healthReport{Status: "ok"})
+	}
+}
+
+// Checks that the database can be written, it's been migrated, and the background workers are alive,
+// for readiness probes. Responds with 503 and the failed checks if it isn't ready.
+func readyz(ds *datastore.Datastore) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+		requestInfoOf(req).quiet = true
+		report := healthReport{Status: "ok", Checks: make(map[string]healthCheck)}
+		problems := make([]string, 0)
+		check := func(name string, problem string) {
+			report.Checks[name] = healthCheck{Ok: problem == "", Error: problem}
+			if problem != "" {
+				report.Status = "unavailable"
+				problems = append(problems, name+": "+problem)
+			}
+		}
+
+		ctx, cancel := context.WithTimeout(req.Context(), databaseCheckTimeout)
+		defer cancel()
+		if err := ds.CheckWritable(ctx); err != nil {
+			check("database", err.Error())
+		} else {
+			check("database", "")
+		}
+		if ds.Migrated() {
+			check("migrations", "")
+		} else {
+			check("migrations", "migrations haven't finished")
+		}
+		workersMutex.Lock()
+		current := append([]*Worker{}, workers...)
+		workersMutex.Unlock()
+		sort.Slice(current, func(i, j int) bool { return current[i].name < current[j].name })
+		for _, w := range current {
+			check("worker "+w.name, w.problem())
+		}
+
+		if report.Status != "ok" {
+			logWarn(req, "not ready: %s", strings.Join(problems, "; "))
+			writeHealth(resp, http.StatusServiceUnavailable, report)
+			return
+		}
+		writeHealth(resp, http.StatusOK, report)
+	}
+}
+
+func writeHealth(resp http.ResponseWriter, code int, report healthReport) {
+	data, err := json.Marshal(report)
+	if err != nil {
+		resultJson(resp, http.StatusInternalServerError)
+		logging.Errorf("marshaling json: %s", err)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	resp.Header().Set("Cache-Control", "no-store")
+	resp.WriteHeader(code)
+	_, err = resp.Write(data)
+	if err != nil {
+		logging.Errorf("writing response: %s", err)
+	}
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"encoding/json"
+	"local/bookmarks/datastore"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Starts the test with no workers registered, and puts back the ones from before when it ends
+func clearWorkers(t *testing.T) {
+	workersMutex.Lock()
+	before := workers
+	workers = nil
+	workersMutex.Unlock()
+	t.Cleanup(func() {
+		workersMutex.Lock()
+		workers = before
+		workersMutex.Unlock()
+	})
+}
+
+// Makes an unauthenticated request for a health endpoint, and decodes the report
+func health(t *testing.T, handler http.Handler, path string) (int, healthReport) {
+	t.Helper()
+	resp := httptest.NewRecorder()
+	handler.ServeHTTP(resp, httptest.NewRequest("GET", path, nil))
+	var report healthReport
+	err := json.Unmarshal(resp.Body.Bytes(), &report)
+	if err != nil {
+		t.Fatalf("%s: %s in %q", path, err, resp.Body.String())
+	}
+	return resp.Code, report
+}
+
+func TestHealthz(t *testing.T) {
+	s := newTestSite(t, Options{})
+	code, report := health(t, s.router, "/healthz")
+	if code != http.StatusOK || report.Status != "ok" {
+		t.Errorf("got %d, %+v", code, report)
+	}
+}
+
+func TestReadyz(t *testing.T) {
+	clearWorkers(t)
+	s := newTestSite(t, Options{})
+	code, report := health(t, s.router, "/readyz")
+	if code != http.StatusOK || report.Status != "ok" {
+		t.Errorf("got %d, %+v", code, report)
+	}
+	for _, name := range []string{"database", "migrations"} {
+		if !report.Checks[name].Ok {
+			t.Errorf("%s: %+v", name, report.Checks[name])
+		}
+	}
+}
+
+func TestReadyzChecksWorkers(t *testing.T) {
+	clearWorkers(t)
+	s := newTestSite(t, Options{})
+	beating := StartWorker("beating", time.Hour)
+	StartWorker("running", 0)
+	code, report := health(t, s.router, "/readyz")
+	if code != http.StatusOK || !report.Checks["worker beating"].Ok || !report.Checks["worker running"].Ok {
+		t.Errorf("got %d, %+v", code, report)
+	}
+
+	// a worker that's missed more than one beat is stuck
+	beating.mutex.Lock()
+	beating.lastBeat = time.Now().Add(-3 * time.Hour)
+	beating.mutex.Unlock()
+	code, report = health(t, s.router, "/readyz")
+	if check := report.Checks["worker beating"]; code != http.StatusServiceUnavailable || report.Status != "unavailable" || check.Ok || check.Error != "last checked in 3h0m0s ago" {
+		t.Errorf("late worker: got %d, %+v", code, report)
+	}
+	beating.Beat()
+	if code, report = health(t, s.router, "/readyz"); code != http.StatusOK {
+		t.Errorf("after beating again: got %d, %+v", code, report)
+	}
+
+	beating.Stop()
+	code, report = health(t, s.router, "/readyz")
+	if check := report.Checks["worker beating"]; code != http.StatusServiceUnavailable || check.Ok || check.Error != "stopped" {
+		t.Errorf("stopped worker: got %d, %+v", code, report)
+	}
+	if !report.Checks["worker running"].Ok || !report.Checks["database"].Ok {
+		t.Errorf("other checks failed too: %+v", report)
+	}
+}
+
+func TestReadyzBeforeMigrating(t *testing.T) {
+	clearWorkers(t)
+	ds, err := datastore.Connect(filepath.Join(t.TempDir(), "bookmarks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ds.Close()
+	handler := http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		readyz(&ds)(resp, req, nil)
+	})
+	code, report := health(t, handler, "/readyz")
+	if code != http.StatusServiceUnavailable || report.Checks["migrations"].Ok || report.Checks["database"].Ok {
+		t.Errorf("got %d, %+v", code, report)
+	}
+}
@@ -0,0 +1,282 @@
+package server
+
+import (
+	"local/bookmarks/datastore"
+	"local/bookmarks/ratelimit"
+	"local/bookmarks/templates"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const registerPrefix = "/register"
+const resetPrefix = "/reset"
+
+type linkTokenData struct {
+	Token    string
+	Valid    bool
+	Username string
+	Message  string
+}
+
+// The absolute url of a page on this site, for links that get sent to people
+func siteUrl(req *http.Request, path, token string) string {
+	q := url.Values{}
+	q.Set("token", token)
+	return requestOrigin(req) + basePath(req) + path + "?" + q.Encode()
+}
+
+func linkTokenMessage(failed string) string {
+	switch failed {
+	case "":
+		return ""
+	case "throttled":
+		return "Too many failed attempts. Try again in a little while."
+	case "exists":
+		return "That username is taken. Pick another one."
+	case "mismatch":
+		return "The passwords didn't match."
+	default:
+		return "Usernames and passwords can't be empty."
+	}
+}
+
+func registerPage(templates *templates.Templates, ds *datastore.Datastore) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		resp.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		resp.Header().Set("Referrer-Policy", "no-referrer")
+		req.ParseForm()
+		data := linkTokenData{
+			Token:    req.Form.Get("token"),
+			Username: req.Form.Get("username"),
+			Message:  linkTokenMessage(req.Form.Get("failed")),
+		}
+		var err error
+		data.Valid, err = ds.CheckInvite(data.Token)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "checking invite: %s", err)
+			return
+		}
+		err = templates.Register.ExecuteTemplate(resp, "base", data)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "writing template: %v", err)
+			return
+		}
+	}
+}
+
+// Adds a new user with the username and password they chose, if their invite is still good
+func doRegister(ds *datastore.Datastore, limiter *ratelimit.Limiter) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		err := req.ParseForm()
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		token := req.Form.Get("token")
+		username := req.Form.Get("username")
+		password := req.Form.Get("password")
+		retry := func(failed string) {
+			q := url.Values{}
+			q.Set("token", token)
+			q.Set("username", username)
+			q.Set("failed", failed)
+			redirect(resp, req, registerPrefix+"?"+q.Encode(), http.StatusSeeOther)
+		}
+		ipKey := "ip:" + remoteIp(req)
+		if allowed, _ := limiter.Allow(ipKey); !allowed {
+			retry("throttled")
+			return
+		}
+		if username == "" || password == "" {
+			retry("empty")
+			return
+		}
+		if password != req.Form.Get("confirm") {
+			retry("mismatch")
+			return
+		}
+		// the invite is checked first, so that only people who have one can find out which usernames are taken
+		valid, err := ds.CheckInvite(token)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "checking invite: %s", err)
+			return
+		}
+		var userId int64
+		free := true
+		if valid {
+			userId, valid, free, err = ds.AddInvitedUser(token, username, password)
+			if err != nil {
+				ErrorPage(resp, http.StatusInternalServerError)
+				logError(req, "adding user: %s", err)
+				return
+			}
+		}
+		if !valid {
+			limiter.Fail(ipKey)
+			logWarn(req, "bad invite from %s", remoteIp(req))
+			retry("invalid")
+			return
+		}
+		if !free {
+			retry("exists")
+			return
+		}
+		logInfo(req, "user %s signed up with an invite", username)
+		completeLogin(ds, resp, req, userId, "/", false)
+	}
+}
+
+func resetPage(templates *templates.Templates, ds *datastore.Datastore) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		resp.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		resp.Header().Set("Referrer-Policy", "no-referrer")
+		req.ParseForm()
+		data := linkTokenData{
+			Token:   req.Form.Get("token"),
+			Message: linkTokenMessage(req.Form.Get("failed")),
+		}
+		var err error
+		_, data.Username, data.Valid, err = ds.CheckPasswordReset(data.Token)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "checking password reset: %s", err)
+			return
+		}
+		err = templates.ResetPassword.ExecuteTemplate(resp, "base", data)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "writing template: %v", err)
+			return
+		}
+	}
+}
+
+// Sets a new password from a reset link, and logs the user out everywhere else
+func doReset(ds *datastore.Datastore, limiter *ratelimit.Limiter) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		err := req.ParseForm()
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		token := req.Form.Get("token")
+		password := req.Form.Get("password")
+		retry := func(failed string) {
+			q := url.Values{}
+			q.Set("token", token)
+			q.Set("failed", failed)
+			redirect(resp, req, resetPrefix+"?"+q.Encode(), http.StatusSeeOther)
+		}
+		ipKey := "ip:" + remoteIp(req)
+		if allowed, _ := limiter.Allow(ipKey); !allowed {
+			retry("throttled")
+			return
+		}
+		if password == "" {
+			retry("empty")
+			return
+		}
+		if password != req.Form.Get("confirm") {
+			retry("mismatch")
+			return
+		}
+
+		userId, username, valid, err := ds.CheckPasswordReset(token)
+		if err == nil && valid {
+			valid, err = ds.UsePasswordReset(token)
+		}
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "using password reset: %s", err)
+			return
+		}
+		if !valid {
+			limiter.Fail(ipKey)
+			logWarn(req, "bad password reset link from %s", remoteIp(req))
+			retry("invalid")
+			return
+		}
+		err = ds.SetUserPassword(userId, password)
+		if err == nil {
+			err = ds.RevokeAllSessions(userId)
+		}
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "resetting password: %s", err)
+			return
+		}
+		logInfo(req, "user %s reset their password", username)
+		// they still need their second factor, if they have one
+		completeLogin(ds, resp, req, userId, "/", true)
+	}
+}
+
+func adminCreateInvite(templates *templates.Templates, ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		token, err := ds.CreateInvite(session.Username, datastore.DefaultInviteTtl)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "creating invite: %s", err)
+			return
+		}
+		logInfo(req, "%s created an invite", session.Username)
+		renderAdminUsers(templates, ds, session, resp, req, adminUsersData{
+			NewLink:      siteUrl(req, registerPrefix, token),
+			NewLinkLabel: "Invite link. It works once, for a week.",
+		})
+	}
+}
+
+func adminDeleteInvite(ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		id, err := strconv.Atoi(params[0].Value)
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		err = ds.DeleteInvite(int64(id))
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "deleting invite: %s", err)
+			return
+		}
+		redirect(resp, req, adminPrefix+"/users", http.StatusSeeOther)
+	}
+}
+
+func adminCreateResetLink(templates *templates.Templates, ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		id, err := strconv.Atoi(params[0].Value)
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		user, found, err := ds.GetUser(int64(id))
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "getting user: %s", err)
+			return
+		}
+		if !found {
+			ErrorPage(resp, http.StatusNotFound)
+			return
+		}
+		token, err := ds.CreatePasswordReset(user.Id, datastore.DefaultPasswordResetTtl)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "creating password reset: %s", err)
+			return
+		}
+		logInfo(req, "%s created a password reset link for %s", session.Username, user.Username)
+		renderAdminUsers(templates, ds, session, resp, req, adminUsersData{
+			NewLink:      siteUrl(req, resetPrefix, token),
+			NewLinkLabel: "Password reset link for " + user.Username + ". It works once, for a day.",
+		})
+	}
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"local/bookmarks/ratelimit"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRegisterChecksInviteBeforeUsername(t *testing.T) {
+	ds := newTestDatastore(t)
+	_, err := ds.AddUser("alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := ds.CreateInvite("alice", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	register := func(token, username string) string {
+		form := url.Values{"token": {token}, "username": {username}, "password": {"secret"}, "confirm": {"secret"}}
+		req := httptest.NewRequest("POST", registerPrefix, strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		resp := httptest.NewRecorder()
+		doRegister(ds, ratelimit.New(ratelimit.DefaultConfig()))(resp, req, nil)
+		location, _ := url.Parse(resp.Header().Get("Location"))
+		return location.Query().Get("failed")
+	}
+
+	if failed := register("made-up", "alice"); failed != "invalid" {
+		t.Errorf("taken username with a bad invite: got failed=%q", failed)
+	}
+	if failed := register(token, "alice"); failed != "exists" {
+		t.Errorf("taken username: got failed=%q", failed)
+	}
+	if failed := register(token, "bob"); failed != "" {
+		t.Errorf("new username: got failed=%q", failed)
+	}
+	if _, exists, _ := ds.UserExists("bob"); !exists {
+		t.Error("user wasn't added")
+	}
+	if failed := register(token, "carol"); failed != "invalid" {
+		t.Errorf("used invite: got failed=%q", failed)
+	}
+}
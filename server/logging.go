@@ -0,0 +1,205 @@
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"local/bookmarks/logging"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Query parameters that hold secrets, like the api key the bookmarklet passes as auth, which are redacted from logs
+var secretParams = map[string]bool{
+	"auth":       true,
+	"token":      true,
+	"code":       true,
+	"state":      true,
+	"password":   true,
+	"key":        true,
+	"secret":     true,
+	"csrf-token": true,
+}
+
+const requestIdHeader = "X-Request-Id"
+
+// Details of a request that handlers fill in for the access log
+type requestInfo struct {
+	id   string
+	user string
+	// the client's ip, see clientIp
+	ip string
+	// the pattern of the route that handled the request, like /bookmarks/edit/:id
+	route string
+	// requests that come often and aren't interesting, like health checks, are only logged at debug level
+	quiet bool
+}
+
+type requestInfoKey struct{}
+
+// Gives every request an id, which handlers include when they log, and logs each request once it's been handled.
+// A request id passed in by a proxy is kept, so the same request can be followed through both logs.
+type RequestLogger struct {
+	h http.Handler
+	// proxies whose X-Forwarded-For headers are believed, so their clients are logged and rate limited by their own ip
+	trustedProxies []*net.IPNet
+}
+
+func (rl RequestLogger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	start := time.Now()
+	info := &requestInfo{id: r.Header.Get(requestIdHeader), ip: clientIp(r, rl.trustedProxies)}
+	if !validRequestId(info.id) {
+		info.id = newRequestId()
+	}
+	w.Header().Set(requestIdHeader, info.id)
+	recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+	rl.h.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), requestInfoKey{}, info)))
+	duration := time.Since(start)
+	observeRequest(r, info.route, recorder.status, duration)
+
+	level := logging.LevelInfo
+	if info.quiet {
+		level = logging.LevelDebug
+	}
+	logging.Log(level, "request",
+		"request_id", info.id,
+		"method", r.Method,
+		"path", redactedUrl(r.URL),
+		"status", recorder.status,
+		"bytes", recorder.bytes,
+		"duration_ms", float64(duration.Microseconds())/1000,
+		"ip", info.ip,
+		"user", info.user,
+	)
+}
+
+// Records what a handler responded with
+type statusRecorder struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Write(data []byte) (int, error) {
+	r.wroteHeader = true
+	n, err := r.ResponseWriter.Write(data)
+	r.bytes += n
+	return n, err
+}
+
+func newRequestId() string {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(id)
+}
+
+// Ids from outside are only trusted to be short and plain, so they can't mess up the logs
+func validRequestId(id string) bool {
+	if id == "" || len(id) > 64 {
+		return false
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func requestInfoOf(req *http.Request) *requestInfo {
+	info, _ := req.Context().Value(requestInfoKey{}).(*requestInfo)
+	if info == nil {
+		return &requestInfo{}
+	}
+	return info
+}
+
+// Records who made the request, for the access log
+func setRequestUser(req *http.Request, user string) {
+	requestInfoOf(req).user = user
+}
+
+// The url with the values of secret query parameters replaced
+func redactedUrl(u *url.URL) string {
+	return u.Path + redactedQuery(u.RawQuery, 0)
+}
+
+// How many urls inside urls are looked into before giving up and hiding the rest
+const maxRedactDepth = 4
+
+// The query with a ? in front and the values of secret parameters replaced, or nothing if it's empty.
+// The page to go back to after logging in is in redirectTo, whose own query can have secrets in it too.
+func redactedQuery(rawQuery string, depth int) string {
+	if rawQuery == "" {
+		return ""
+	}
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil || depth > maxRedactDepth {
+		return "?REDACTED"
+	}
+	for name, values := range query {
+		if secretParams[name] {
+			query[name] = []string{"REDACTED"}
+		} else if name == "redirectTo" {
+			for i, value := range values {
+				values[i] = redactedLink(value, depth+1)
+			}
+		}
+	}
+	return "?" + query.Encode()
+}
+
+// A link within the site with the values of secret query parameters replaced. Links in redirectTo
+// are escaped once more than usual (see auth), so the query can be hidden in the path until they're unescaped.
+func redactedLink(link string, depth int) string {
+	for ; depth <= maxRedactDepth; depth++ {
+		u, err := url.Parse(link)
+		if err != nil {
+			return "REDACTED"
+		}
+		if u.RawQuery != "" || !strings.Contains(link, "%") {
+			return u.Path + redactedQuery(u.RawQuery, depth)
+		}
+		link, err = url.QueryUnescape(link)
+		if err != nil {
+			return "REDACTED"
+		}
+	}
+	return "REDACTED"
+}
+
+func logRequest(req *http.Request, level logging.Level, format string, args ...interface{}) {
+	logging.Log(level, fmt.Sprintf(format, args...), "request_id", requestInfoOf(req).id)
+}
+
+func logDebug(req *http.Request, format string, args ...interface{}) {
+	logRequest(req, logging.LevelDebug, format, args...)
+}
+
+func logInfo(req *http.Request, format string, args ...interface{}) {
+	logRequest(req, logging.LevelInfo, format, args...)
+}
+
+func logWarn(req *http.Request, format string, args ...interface{}) {
+	logRequest(req, logging.LevelWarn, format, args...)
+}
+
+func logError(req *http.Request, format string, args ...interface{}) {
+	logRequest(req, logging.LevelError, format, args...)
+}
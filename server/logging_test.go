@@ -0,0 +1,65 @@
+package server
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRedactedUrl(t *testing.T) {
+	// the way auth sends people to log in
+	loginFor := func(path string) string {
+		return "/login?redirectTo=" + url.QueryEscape(url.QueryEscape(path))
+	}
+	tests := []struct {
+		name string
+		url  string
+		want string
+	}{
+		{"no query", "/bookmarks", "/bookmarks"},
+		{"no secrets", "/bookmarks?tag=go&page=2", "/bookmarks?page=2&tag=go"},
+		{"top level", "/_bookmarklet?auth=SECRET&url=https://example.com", "/_bookmarklet?auth=REDACTED&url=https%3A%2F%2Fexample.com"},
+		{"every value", "/callback?code=SECRET&code=SECRET&state=SECRET", "/callback?code=REDACTED&state=REDACTED"},
+		{"nested", loginFor("/_bookmarklet?auth=SECRET&url=x"), "/login?redirectTo=%2F_bookmarklet%3Fauth%3DREDACTED%26url%3Dx"},
+		{"nested escaped once", "/login?redirectTo=%2F_bookmarklet%3Fauth%3DSECRET", "/login?redirectTo=%2F_bookmarklet%3Fauth%3DREDACTED"},
+		{"nested without secrets", loginFor("/tags"), "/login?redirectTo=%2Ftags"},
+		{"nested twice", "/login?redirectTo=" + url.QueryEscape(loginFor("/_bookmarklet?auth=SECRET")),
+			"/login?redirectTo=%2Flogin%3FredirectTo%3D%252F_bookmarklet%253Fauth%253DREDACTED"},
+		{"nested too deep", "/login?redirectTo=" + url.QueryEscape(url.QueryEscape(url.QueryEscape(url.QueryEscape(loginFor("/_bookmarklet?auth=SECRET"))))),
+			"/login?redirectTo=%2Flogin%3FredirectTo%3DREDACTED"},
+		{"unparseable", "/_bookmarklet?auth=SECRET&bad=%zz", "/_bookmarklet?REDACTED"},
+		{"nested unparseable", "/login?redirectTo=" + url.QueryEscape("%zz?auth=SECRET"), "/login?redirectTo=REDACTED"},
+	}
+	for _, test := range tests {
+		u, err := url.Parse(test.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := redactedUrl(u)
+		if got != test.want {
+			t.Errorf("%s: got %s, want %s", test.name, got, test.want)
+		}
+		if strings.Contains(got, "SECRET") {
+			t.Errorf("%s: leaked %s", test.name, got)
+		}
+	}
+}
+
+func TestRedactedLink(t *testing.T) {
+	tests := []struct {
+		link string
+		want string
+	}{
+		{"/", "/"},
+		{"/bookmarks?tag=go", "/bookmarks?tag=go"},
+		{"/_bookmarklet?auth=SECRET", "/_bookmarklet?auth=REDACTED"},
+		{"/_bookmarklet?url=https%3A%2F%2Fexample.com%2F%3Fkey%3Dnot-ours&key=SECRET", "/_bookmarklet?key=REDACTED&url=https%3A%2F%2Fexample.com%2F%3Fkey%3Dnot-ours"},
+		{"%2F_bookmarklet%3Fauth%3DSECRET", "/_bookmarklet?auth=REDACTED"},
+		{"/%zz?auth=SECRET", "REDACTED"},
+	}
+	for _, test := range tests {
+		if got := redactedLink(test.link, 0); got != test.want {
+			t.Errorf("%s: got %s, want %s", test.link, got, test.want)
+		}
+	}
+}
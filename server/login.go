@@ -3,27 +3,35 @@ package server
 import (
 	"fmt"
 	"local/bookmarks/datastore"
+	"local/bookmarks/ratelimit"
 	"local/bookmarks/templates"
 	"log"
 	"net/http"
 	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/julienschmidt/httprouter"
 )
 
 type loginData struct {
-	Message    string
-	RedirectTo string
+	Message      string
+	RedirectTo   string
+	SingleSignOn bool
 }
 
-func loginPage(templates *templates.Templates, ds *datastore.Datastore) httprouter.Handle {
+func loginPage(templates *templates.Templates, ds *datastore.Datastore, options Options) httprouter.Handle {
 	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
 		resp.Header().Set("Content-Type", "text/html; charset=UTF-8")
 		req.ParseForm()
 		failed := req.Form.Get("failed")
 		redirectTo := req.Form.Get("redirectTo")
-		var data loginData
-		if failed != "" {
+		data := loginData{SingleSignOn: options.Oidc != nil}
+		if failed == "throttled" {
+			data.Message = "Too many failed attempts. Try again in a little while."
+		} else if failed == "sso" {
+			data.Message = "Single sign-on failed"
+		} else if failed != "" {
 			data.Message = "Login failed"
 		}
 		var err error
@@ -32,30 +40,34 @@ func loginPage(templates *templates.Templates, ds *datastore.Datastore) httprout
 			ErrorPage(resp, http.StatusInternalServerError)
 			return
 		}
-		_, valid, err := authenticateSession(ds, req)
+		_, valid, err := currentSession(ds, options.ProxyAuth, resp, req)
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("finding session: %s", err)
+			logError(req, "finding session: %s", err)
 			return
 		}
 		if valid {
-			http.Redirect(resp, req, "/", http.StatusFound)
+			redirect(resp, req, "/", http.StatusFound)
 		} else {
 			err := templates.Login.ExecuteTemplate(resp, "base", data)
 			if err != nil {
 				ErrorPage(resp, http.StatusInternalServerError)
-				log.Printf("writing template: %s", err)
+				logError(req, "writing template: %s", err)
 				return
 			}
 		}
 	}
 }
 
-func doLogin(templates *templates.Templates, ds *datastore.Datastore) httprouter.Handle {
+func doLogin(templates *templates.Templates, ds *datastore.Datastore, limiter *ratelimit.Limiter) httprouter.Handle {
 	tryAgainUrl, err := url.Parse("/login?failed=1")
 	if err != nil {
 		log.Panicf("tried to parse a bad url path: %s", err)
 	}
+	throttledUrl, err := url.Parse("/login?failed=throttled")
+	if err != nil {
+		log.Panicf("tried to parse a bad url path: %s", err)
+	}
 	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
 		err := req.ParseForm()
 		if err != nil {
@@ -65,42 +77,221 @@ func doLogin(templates *templates.Templates, ds *datastore.Datastore) httprouter
 		username := req.Form.Get("username")
 		password := req.Form.Get("password")
 		redirectTo := req.Form.Get("redirectTo")
+
+		// check the limiter before hashing the password, so that guessing is slow and cheap for us.
+		// Failures against a username are only counted per ip, so that nobody else can slow its owner down.
+		ip := remoteIp(req)
+		ipKey, userKey := "ip:"+ip, "ip+user:"+ip+" "+username
+		attempt, allowed, wait := limiter.Begin(ipKey, userKey)
+		if !allowed {
+			logWarn(req, "throttling login for user %q from %s for %s", username, ip, wait.Round(time.Second))
+			redirectUrl := *throttledUrl
+			q := redirectUrl.Query()
+			q.Set("redirectTo", redirectTo)
+			redirectUrl.RawQuery = q.Encode()
+			redirect(resp, req, redirectUrl.String(), http.StatusSeeOther)
+			return
+		}
+		defer attempt.End()
+
 		userId, allowed, err := ds.AuthenticateUser(username, password)
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("authenticating user: %s", err)
+			logError(req, "authenticating user: %s", err)
 			return
 		}
 		if allowed {
-			cookie, err := ds.CreateSession(userId)
-			if err != nil {
-				ErrorPage(resp, http.StatusInternalServerError)
-				log.Printf("creating session: %s", err)
-				return
-			}
-			http.SetCookie(resp, &cookie)
-			log.Printf("redirecting to %s", redirectTo)
-			http.Redirect(resp, req, redirectTo, http.StatusSeeOther)
+			limiter.Succeed(userKey)
+			completeLogin(ds, resp, req, userId, redirectTo, true)
 		} else {
-			redirectUrl := tryAgainUrl
+			limiter.Fail(ipKey, userKey)
+			logWarn(req, "failed login for user %q from %s", username, ip)
+			redirectUrl := *tryAgainUrl
 			q := redirectUrl.Query()
 			q.Set("redirectTo", redirectTo)
 			redirectUrl.RawQuery = q.Encode()
-			http.Redirect(resp, req, redirectUrl.String(), http.StatusSeeOther)
+			redirect(resp, req, redirectUrl.String(), http.StatusSeeOther)
 		}
 	}
 }
 
-func logout(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
-	http.SetCookie(resp, &http.Cookie{Name: datastore.AuthCookieName})
-	http.Redirect(resp, req, "/", http.StatusSeeOther)
+// Starts a session for a user who has proven who they are, or sends them on to
+// the second factor if they have one and it's still needed
+func completeLogin(ds *datastore.Datastore, resp http.ResponseWriter, req *http.Request, userId int64, redirectTo string, needTotp bool) {
+	user, found, err := ds.GetUser(userId)
+	if err != nil {
+		ErrorPage(resp, http.StatusInternalServerError)
+		logError(req, "getting user: %s", err)
+		return
+	}
+	if !found || user.Disabled {
+		logWarn(req, "refusing login for disabled user %d", userId)
+		redirect(resp, req, loginPrefix+"?failed=1", http.StatusSeeOther)
+		return
+	}
+
+	if needTotp && user.TotpEnabled {
+		token, err := ds.CreateLoginChallenge(userId)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "creating login challenge: %s", err)
+			return
+		}
+		http.SetCookie(resp, loginChallengeCookie(ds, req, token, int(datastore.LoginChallengeTtl/time.Second)))
+		q := url.Values{}
+		q.Set("redirectTo", redirectTo)
+		redirect(resp, req, loginPrefix+"/2fa?"+q.Encode(), http.StatusSeeOther)
+		return
+	}
+
+	// a session that existed before logging in is never reused, in case someone else planted it
+	err = endCurrentSession(ds, req)
+	if err != nil {
+		ErrorPage(resp, http.StatusInternalServerError)
+		logError(req, "ending previous session: %s", err)
+		return
+	}
+	cookie, err := ds.CreateSession(userId, requestClient(req))
+	if err != nil {
+		ErrorPage(resp, http.StatusInternalServerError)
+		logError(req, "creating session: %s", err)
+		return
+	}
+	http.SetCookie(resp, &cookie)
+	logDebug(req, "redirecting to %s", redactedLink(redirectTo, 0))
+	redirect(resp, req, redirectTo, http.StatusSeeOther)
+}
+
+// Holds the login challenge between the password and the second factor. A negative maxAge deletes it.
+func loginChallengeCookie(ds *datastore.Datastore, req *http.Request, token string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     datastore.LoginChallengeCookieName,
+		Value:    token,
+		Path:     basePath(req) + loginPrefix,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   ds.SessionPolicy().Secure,
+	}
+}
+
+func loginTotpPage(templates *templates.Templates) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		resp.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		req.ParseForm()
+		var data loginData
+		data.RedirectTo = req.Form.Get("redirectTo")
+		switch req.Form.Get("failed") {
+		case "":
+		case "throttled":
+			data.Message = "Too many failed attempts. Try again in a little while."
+		default:
+			data.Message = "That code didn't work"
+		}
+		err := templates.LoginTotp.ExecuteTemplate(resp, "base", data)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "writing template: %s", err)
+			return
+		}
+	}
+}
+
+// The second step of logging in, for users with two-factor authentication turned on
+func doLoginTotp(ds *datastore.Datastore, limiter *ratelimit.Limiter) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		err := req.ParseForm()
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		redirectTo := req.Form.Get("redirectTo")
+		retry := func(failed string) {
+			q := url.Values{}
+			q.Set("failed", failed)
+			q.Set("redirectTo", redirectTo)
+			redirect(resp, req, loginPrefix+"/2fa?"+q.Encode(), http.StatusSeeOther)
+		}
+
+		challenge, err := req.Cookie(datastore.LoginChallengeCookieName)
+		if err != nil {
+			// the challenge has expired, so start again from the password
+			redirect(resp, req, loginPrefix, http.StatusSeeOther)
+			return
+		}
+		userId, valid, err := ds.GetLoginChallenge(challenge.Value)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "finding login challenge: %s", err)
+			return
+		}
+		if !valid {
+			http.SetCookie(resp, loginChallengeCookie(ds, req, "", -1))
+			redirect(resp, req, loginPrefix, http.StatusSeeOther)
+			return
+		}
+
+		ip := remoteIp(req)
+		ipKey, totpKey := "ip:"+ip, "totp:"+strconv.FormatInt(userId, 10)
+		attempt, allowed, _ := limiter.Begin(ipKey, totpKey)
+		if !allowed {
+			logWarn(req, "throttling second factor for user %d from %s", userId, ip)
+			retry("throttled")
+			return
+		}
+		defer attempt.End()
+		valid, err = ds.CheckTotp(userId, req.Form.Get("code"))
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "checking totp: %s", err)
+			return
+		}
+		if !valid {
+			limiter.Fail(ipKey, totpKey)
+			logWarn(req, "failed second factor for user %d from %s", userId, ip)
+			retry("1")
+			return
+		}
+		limiter.Succeed(totpKey)
+
+		err = ds.DeleteLoginChallenge(challenge.Value)
+		if err != nil {
+			logError(req, "deleting login challenge: %s", err)
+		}
+		http.SetCookie(resp, loginChallengeCookie(ds, req, "", -1))
+		completeLogin(ds, resp, req, userId, redirectTo, false)
+	}
+}
+
+// Ends the session on the server too, so the cookie is no use to anyone who has copied it
+func logout(ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		err := endCurrentSession(ds, req)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "logging out: %s", err)
+			return
+		}
+		expired := ds.ExpiredSessionCookie()
+		http.SetCookie(resp, &expired)
+		redirect(resp, req, "/", http.StatusSeeOther)
+	}
+}
+
+// Deletes the session the request was made with, if there is one
+func endCurrentSession(ds *datastore.Datastore, req *http.Request) error {
+	cookie, err := req.Cookie(ds.SessionCookieName())
+	if err != nil {
+		return nil
+	}
+	return ds.DeleteSession(cookie.Value)
 }
 
 func authenticateSession(ds *datastore.Datastore, req *http.Request) (datastore.Session, bool, error) {
 	cookies := req.Cookies()
 	var sessionCookie string
 	for _, cookie := range cookies {
-		if cookie.Name == datastore.AuthCookieName {
+		if cookie.Name == ds.SessionCookieName() {
 			sessionCookie = cookie.Value
 			break
 		}
@@ -0,0 +1,181 @@
+package server
+
+import (
+	"local/bookmarks/datastore"
+	"local/bookmarks/ratelimit"
+	"local/bookmarks/templates"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLogoutNeedsPostAndCsrfToken(t *testing.T) {
+	ds := newTestDatastore(t)
+	root := os.DirFS("..")
+	pages := templates.CreateTemplates(root, "")
+	router := MakeRouter(&pages, root, ds, Options{})
+	user, err := ds.AddUser("alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := ds.CreateSession(user, datastore.Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, _, err := ds.GetSession(cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logOut := func(method, csrfToken string) int {
+		form := url.Values{}
+		form.Set(templates.CsrfTokenName, csrfToken)
+		req := httptest.NewRequest(method, "/logout", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.AddCookie(&cookie)
+		resp := httptest.NewRecorder()
+		router.ServeHTTP(resp, req)
+		return resp.Code
+	}
+	stillLoggedIn := func() bool {
+		_, found, err := ds.GetSession(cookie.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return found
+	}
+
+	if code := logOut("GET", session.CsrfToken); code != http.StatusMethodNotAllowed || !stillLoggedIn() {
+		t.Errorf("get: got %d", code)
+	}
+	if code := logOut("POST", "wrong"); code != http.StatusForbidden || !stillLoggedIn() {
+		t.Errorf("wrong csrf token: got %d", code)
+	}
+	if code := logOut("POST", session.CsrfToken); code != http.StatusSeeOther || stillLoggedIn() {
+		t.Errorf("post: got %d", code)
+	}
+}
+
+func tryLogin(ds *datastore.Datastore, limiter *ratelimit.Limiter, ip, username, password string) *httptest.ResponseRecorder {
+	form := url.Values{"username": {username}, "password": {password}, "redirectTo": {"/"}}
+	req := httptest.NewRequest("POST", loginPrefix, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.RemoteAddr = ip + ":1234"
+	resp := httptest.NewRecorder()
+	doLogin(nil, ds, limiter)(resp, req, nil)
+	return resp
+}
+
+func loginFailure(resp *httptest.ResponseRecorder) string {
+	location, _ := url.Parse(resp.Header().Get("Location"))
+	return location.Query().Get("failed")
+}
+
+func TestConcurrentLoginGuessesAreTakenOneAtATime(t *testing.T) {
+	ds := newTestDatastore(t)
+	// slow enough that the guesses overlap
+	ds.SetPasswordParams(datastore.PasswordParams{Time: 1, Memory: 32 * 1024, Threads: 1})
+	if _, err := ds.AddUser("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+	limiter := ratelimit.New(ratelimit.DefaultConfig())
+
+	const guesses = 40
+	results := make(chan string, guesses)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < guesses; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			results <- loginFailure(tryLogin(ds, limiter, "192.0.2.1", "alice", "guess"+strconv.Itoa(i)))
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+	close(results)
+	checked := 0
+	for failed := range results {
+		switch failed {
+		case "1":
+			checked++
+		case "throttled":
+		default:
+			t.Errorf("got failed=%q", failed)
+		}
+	}
+	// the free failures, and the one after them
+	if checked < 1 || checked > ratelimit.DefaultConfig().FreeFailures+1 {
+		t.Errorf("%d of %d guesses at once were checked", checked, guesses)
+	}
+}
+
+func TestFailuresAgainstUsernameDontSlowDownOtherIps(t *testing.T) {
+	ds := newTestDatastore(t)
+	if _, err := ds.AddUser("alice", "password"); err != nil {
+		t.Fatal(err)
+	}
+	limiter := ratelimit.New(ratelimit.DefaultConfig())
+	for i := 0; i < 30; i++ {
+		tryLogin(ds, limiter, "198.51.100.1", "alice", "guess")
+	}
+	if failed := loginFailure(tryLogin(ds, limiter, "198.51.100.1", "alice", "password")); failed != "throttled" {
+		t.Errorf("guessing ip: got failed=%q", failed)
+	}
+
+	if failed := loginFailure(tryLogin(ds, limiter, "192.0.2.1", "alice", "typo")); failed != "1" {
+		t.Errorf("alice's own typo: got failed=%q", failed)
+	}
+	resp := tryLogin(ds, limiter, "192.0.2.1", "alice", "password")
+	if _, found := loggedIn(t, ds, resp); !found {
+		t.Errorf("alice couldn't log in: got %d to %q", resp.Code, resp.Header().Get("Location"))
+	}
+}
+
+func TestLoggingInStartsANewSession(t *testing.T) {
+	s := newTestSite(t, Options{})
+	form := url.Values{"username": {"alice"}, "password": {"password"}, "redirectTo": {"/"}}
+	req := httptest.NewRequest("POST", loginPrefix, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&s.cookie)
+	resp := httptest.NewRecorder()
+	doLogin(nil, s.ds, ratelimit.New(ratelimit.DefaultConfig()))(resp, req, nil)
+
+	session, found := loggedIn(t, s.ds, resp)
+	if !found {
+		t.Fatalf("not logged in: got %d to %q", resp.Code, resp.Header().Get("Location"))
+	}
+	if session.CsrfToken == s.session.CsrfToken {
+		t.Error("the session from before logging in was kept")
+	}
+	if _, valid, _ := s.ds.GetSession(s.cookie.Value); valid {
+		t.Error("the cookie from before logging in still works")
+	}
+}
+
+func TestRequestsRenewSessionsThatTimeOutWhenIdle(t *testing.T) {
+	s := newTestSite(t, Options{})
+	// alice's session was made without an ip, so the first request from one always updates it
+	if cookies := s.get("/").Result().Cookies(); len(cookies) != 0 {
+		t.Errorf("renewed a session with no idle timeout: %v", cookies)
+	}
+
+	policy := s.ds.SessionPolicy()
+	policy.IdleTimeout = 10 * time.Minute
+	s.ds.SetSessionPolicy(policy)
+	s.get("/") // within a minute of the last request, so not renewed
+	s.ds.TouchSession(s.session, datastore.Client{Ip: "198.51.100.1"})
+	cookies := s.get("/").Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != s.cookie.Value {
+		t.Fatalf("got cookies %v, want alice's renewed", cookies)
+	}
+	if until := time.Until(cookies[0].Expires); until < 9*time.Minute || until > 11*time.Minute {
+		t.Errorf("renewed cookie lasts %s", until)
+	}
+}
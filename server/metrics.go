@@ -0,0 +1,107 @@
+package server
+
+import (
+	"local/bookmarks/datastore"
+	"local/bookmarks/logging"
+	"local/bookmarks/metrics"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+var (
+	httpRequests = metrics.NewCounter("bookmarks_http_requests_total",
+		"HTTP requests handled, by method, route and status code.", "method", "route", "status")
+	httpDuration = metrics.NewHistogram("bookmarks_http_request_duration_seconds",
+		"How long HTTP requests take to handle, by method and route.", metrics.DurationBuckets, "method", "route")
+
+	storedBookmarks = metrics.NewGauge("bookmarks_bookmarks", "Bookmarks stored.")
+	storedTags      = metrics.NewGauge("bookmarks_tags", "Tags in use on at least one bookmark.")
+	storedUsers     = metrics.NewGauge("bookmarks_users", "Users, including disabled ones.")
+	storedKeys      = metrics.NewGauge("bookmarks_api_keys", "Api keys that can be used: not disabled or expired.")
+	activeSessions  = metrics.NewGauge("bookmarks_sessions", "Sessions that haven't expired.")
+
+	jobRuns = metrics.NewCounter("bookmarks_job_runs_total",
+		"Runs of background jobs like session cleanup and migrations, by whether they succeeded.", "job", "result")
+	jobLastSuccess = metrics.NewGauge("bookmarks_job_last_success_timestamp_seconds",
+		"Unix time that each background job last succeeded.", "job")
+	jobLastDuration = metrics.NewGauge("bookmarks_job_last_duration_seconds",
+		"How long each background job's last run took.", "job")
+)
+
+// Route label for requests that didn't match any route
+const unmatchedRoute = "unmatched"
+
+// Records a run of a background job that started at started, and failed if err isn't nil
+func RecordJob(job string, started time.Time, err error) {
+	jobLastDuration.Set(time.Since(started).Seconds(), job)
+	if err != nil {
+		jobRuns.Inc(job, "failure")
+		return
+	}
+	jobRuns.Inc(job, "success")
+	jobLastSuccess.Set(float64(time.Now().Unix()), job)
+}
+
+// Serves metrics in the Prometheus format, including the totals stored in ds, which are counted on each scrape
+func MetricsHandler(ds *datastore.Datastore) http.Handler {
+	metrics.OnScrape(func() {
+		totals, err := ds.Totals()
+		if err != nil {
+			logging.Errorf("counting totals for metrics: %s", err)
+			return
+		}
+		storedBookmarks.Set(float64(totals.Bookmarks))
+		storedTags.Set(float64(totals.Tags))
+		storedUsers.Set(float64(totals.Users))
+		storedKeys.Set(float64(totals.ApiKeys))
+		activeSessions.Set(float64(totals.Sessions))
+	})
+	return metrics.Handler()
+}
+
+func observeRequest(req *http.Request, route string, status int, duration time.Duration) {
+	if route == "" {
+		route = unmatchedRoute
+	}
+	method := req.Method
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete, http.MethodOptions:
+	default:
+		// anyone can send any method, so the rest are lumped together to keep the number of series down
+		method = "other"
+	}
+	httpRequests.Inc(method, route, strconv.Itoa(status))
+	httpDuration.Observe(duration.Seconds(), method, route)
+}
+
+// A router that notes which route handled each request, so metrics are grouped by route rather than by url
+type instrumentedRouter struct {
+	*httprouter.Router
+}
+
+func (r instrumentedRouter) GET(path string, handle httprouter.Handle) {
+	r.Router.GET(path, withRoute(path, handle))
+}
+
+func (r instrumentedRouter) POST(path string, handle httprouter.Handle) {
+	r.Router.POST(path, withRoute(path, handle))
+}
+
+// Like httprouter's ServeFiles, going through GET so the files get a route too
+func (r instrumentedRouter) ServeFiles(path string, root http.FileSystem) {
+	fileServer := http.FileServer(root)
+	r.GET(path, func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		req.URL.Path = params.ByName("filepath")
+		fileServer.ServeHTTP(resp, req)
+	})
+}
+
+func withRoute(path string, handle httprouter.Handle) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		requestInfoOf(req).route = path
+		handle(resp, req, params)
+	}
+}
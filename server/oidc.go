@@ -0,0 +1,181 @@
+package server
+
+import (
+	"crypto/subtle"
+	"local/bookmarks/datastore"
+	"local/bookmarks/oidc"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type OidcOptions struct {
+	Provider *oidc.Provider
+	// The id token claim that holds the local username, like preferred_username or email
+	UsernameClaim string
+	// Whether to add users the first time they log in, rather than turning away anyone without an account
+	AutoCreate bool
+	// Whether someone can log in as an existing user who hasn't used single sign-on before, just by having their username.
+	// Otherwise that's only allowed when the username is an email address that the provider has verified.
+	LinkExisting bool
+}
+
+// Holds the state between sending the user to the provider and them coming back. A negative maxAge deletes it.
+func oidcStateCookie(ds *datastore.Datastore, req *http.Request, state string, maxAge int) *http.Cookie {
+	return &http.Cookie{
+		Name:     datastore.OidcStateCookieName,
+		Value:    state,
+		Path:     basePath(req) + loginPrefix,
+		MaxAge:   maxAge,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Secure:   ds.SessionPolicy().Secure,
+	}
+}
+
+// Sends the user off to the single sign-on provider
+func startOidcLogin(ds *datastore.Datastore, options *OidcOptions) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		req.ParseForm()
+		var login datastore.OidcLogin
+		login.RedirectTo = req.Form.Get("redirectTo")
+		state, err := oidc.RandomString()
+		if err == nil {
+			login.Nonce, err = oidc.RandomString()
+		}
+		if err == nil {
+			login.CodeVerifier, err = oidc.RandomString()
+		}
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "starting single sign-on: %s", err)
+			return
+		}
+		authUrl, err := options.Provider.AuthUrl(state, login.Nonce, login.CodeVerifier)
+		if err != nil {
+			ErrorPage(resp, http.StatusBadGateway)
+			logError(req, "starting single sign-on: %s", err)
+			return
+		}
+		err = ds.CreateOidcLogin(state, login)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "saving single sign-on login: %s", err)
+			return
+		}
+		http.SetCookie(resp, oidcStateCookie(ds, req, state, int(datastore.OidcLoginTtl.Seconds())))
+		http.Redirect(resp, req, authUrl, http.StatusFound)
+	}
+}
+
+// Where the provider sends the user back to
+func oidcCallback(ds *datastore.Datastore, options *OidcOptions) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		req.ParseForm()
+		http.SetCookie(resp, oidcStateCookie(ds, req, "", -1))
+		failed := func(reason string, err error) {
+			if err != nil {
+				reason += ": " + err.Error()
+			}
+			logWarn(req, "failed single sign-on from %s: %s", remoteIp(req), reason)
+			redirect(resp, req, loginPrefix+"?failed=sso", http.StatusSeeOther)
+		}
+
+		if providerError := req.Form.Get("error"); providerError != "" {
+			failed("provider returned "+providerError+": "+req.Form.Get("error_description"), nil)
+			return
+		}
+		state := req.Form.Get("state")
+		cookie, err := req.Cookie(datastore.OidcStateCookieName)
+		if err != nil || state == "" || subtle.ConstantTimeCompare([]byte(cookie.Value), []byte(state)) != 1 {
+			failed("state doesn't match this browser", nil)
+			return
+		}
+		login, found, err := ds.ConsumeOidcLogin(state)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "finding single sign-on login: %s", err)
+			return
+		}
+		if !found {
+			failed("login has expired", nil)
+			return
+		}
+
+		claims, err := options.Provider.Exchange(req.Form.Get("code"), login.CodeVerifier, login.Nonce)
+		if err != nil {
+			failed("exchanging code", err)
+			return
+		}
+		// the verified token's issuer, and the provider's id for the account, which the user can't change
+		issuer, _ := oidc.StringClaim(claims, "iss")
+		subject, ok := oidc.StringClaim(claims, "sub")
+		if !ok {
+			failed("id token has no sub claim", nil)
+			return
+		}
+		userId, found, err := ds.GetOidcUser(issuer, subject)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "finding user: %s", err)
+			return
+		}
+		if found {
+			// accounts with a second factor of their own still need it
+			completeLogin(ds, resp, req, userId, login.RedirectTo, true)
+			return
+		}
+
+		username, ok := oidc.StringClaim(claims, options.UsernameClaim)
+		if !ok {
+			failed("id token has no "+options.UsernameClaim+" claim", nil)
+			return
+		}
+		// anyone can put any address in their profile, so only trust ones the provider has checked
+		emailVerified, _ := claims["email_verified"].(bool)
+		if options.UsernameClaim == "email" && !emailVerified {
+			failed("email "+username+" isn't verified", nil)
+			return
+		}
+
+		userId, exists, err := ds.UserExists(username)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "finding user: %s", err)
+			return
+		}
+		if exists {
+			// people can often pick their own username at the provider, so it only says who they are here
+			// if it's an address the provider has checked, or the admin has said the provider's usernames can be trusted
+			if options.UsernameClaim != "email" && !options.LinkExisting {
+				failed("user "+username+" has never logged in with single sign-on, and -oidc-link-existing isn't set", nil)
+				return
+			}
+			linked, err := ds.LinkOidcUser(userId, issuer, subject)
+			if err != nil {
+				ErrorPage(resp, http.StatusInternalServerError)
+				logError(req, "linking user: %s", err)
+				return
+			}
+			if !linked {
+				failed("user "+username+" logs in with another single sign-on account", nil)
+				return
+			}
+			logInfo(req, "linked user %s to single sign-on account %s", username, subject)
+		} else {
+			if !options.AutoCreate {
+				failed("no user called "+username, nil)
+				return
+			}
+			userId, err = ds.AddOidcUser(username, issuer, subject)
+			if err != nil {
+				ErrorPage(resp, http.StatusInternalServerError)
+				logError(req, "adding user: %s", err)
+				return
+			}
+			logInfo(req, "added user %s from single sign-on", username)
+		}
+
+		completeLogin(ds, resp, req, userId, login.RedirectTo, true)
+	}
+}
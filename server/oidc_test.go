@@ -0,0 +1,181 @@
+package server
+
+import (
+	"local/bookmarks/datastore"
+	"local/bookmarks/oidc"
+	"local/bookmarks/oidc/oidctest"
+	"local/bookmarks/totp"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+type oidcTest struct {
+	t       *testing.T
+	ds      *datastore.Datastore
+	issuer  *oidctest.Issuer
+	options *OidcOptions
+}
+
+func newOidcTest(t *testing.T) *oidcTest {
+	issuer, err := oidctest.NewIssuer("bookmarks")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(issuer.Close)
+	return &oidcTest{
+		t:      t,
+		ds:     newTestDatastore(t),
+		issuer: issuer,
+		options: &OidcOptions{
+			Provider: oidc.New(oidc.Config{
+				Issuer:      issuer.Url,
+				ClientId:    "bookmarks",
+				RedirectUrl: "https://bookmarks.example.com/login/oidc/callback",
+			}),
+			UsernameClaim: "preferred_username",
+		},
+	}
+}
+
+// Goes through single sign-on as whoever the provider says has these claims, and returns the callback's response
+func (ot *oidcTest) logIn(claims map[string]interface{}) *httptest.ResponseRecorder {
+	ot.t.Helper()
+	resp := httptest.NewRecorder()
+	startOidcLogin(ot.ds, ot.options)(resp, httptest.NewRequest("GET", loginPrefix+"/oidc?redirectTo=/bookmarks", nil), nil)
+	authUrl, err := url.Parse(resp.Header().Get("Location"))
+	if err != nil || resp.Code != http.StatusFound {
+		ot.t.Fatalf("starting login: got %d to %q", resp.Code, resp.Header().Get("Location"))
+	}
+	cookies := resp.Result().Cookies()
+
+	q := url.Values{}
+	q.Set("state", authUrl.Query().Get("state"))
+	q.Set("code", ot.issuer.Code(authUrl.Query().Get("nonce"), claims))
+	req := httptest.NewRequest("GET", loginPrefix+"/oidc/callback?"+q.Encode(), nil)
+	for _, cookie := range cookies {
+		req.AddCookie(cookie)
+	}
+	resp = httptest.NewRecorder()
+	oidcCallback(ot.ds, ot.options)(resp, req, nil)
+	return resp
+}
+
+func (ot *oidcTest) loggedInAs(resp *httptest.ResponseRecorder, user int64) {
+	ot.t.Helper()
+	session, found := loggedIn(ot.t, ot.ds, resp)
+	if !found || session.UserId != user {
+		ot.t.Errorf("got %d to %q, session %+v", resp.Code, resp.Header().Get("Location"), session)
+	}
+}
+
+func (ot *oidcTest) refused(resp *httptest.ResponseRecorder) {
+	ot.t.Helper()
+	if _, found := loggedIn(ot.t, ot.ds, resp); found {
+		ot.t.Error("logged in")
+	}
+	if location := resp.Header().Get("Location"); !strings.Contains(location, "failed=sso") {
+		ot.t.Errorf("got %d to %q", resp.Code, location)
+	}
+}
+
+func (ot *oidcTest) addUser(username string) int64 {
+	ot.t.Helper()
+	user, err := ot.ds.AddUser(username, "password")
+	if err != nil {
+		ot.t.Fatal(err)
+	}
+	return user
+}
+
+func TestOidcDoesNotTakeOverExistingUsers(t *testing.T) {
+	ot := newOidcTest(t)
+	ot.addUser("admin")
+	ot.options.AutoCreate = true
+	ot.refused(ot.logIn(map[string]interface{}{"sub": "attacker", "preferred_username": "admin"}))
+}
+
+func TestOidcLinksExistingUserWhenAllowed(t *testing.T) {
+	ot := newOidcTest(t)
+	alice := ot.addUser("alice")
+	ot.options.LinkExisting = true
+	ot.loggedInAs(ot.logIn(map[string]interface{}{"sub": "1", "preferred_username": "alice"}), alice)
+
+	// from now on the account is found by its subject, whatever it's called at the provider
+	ot.options.LinkExisting = false
+	ot.loggedInAs(ot.logIn(map[string]interface{}{"sub": "1", "preferred_username": "alice-renamed"}), alice)
+	// and nobody else can take the name over
+	ot.options.LinkExisting = true
+	ot.refused(ot.logIn(map[string]interface{}{"sub": "2", "preferred_username": "alice"}))
+}
+
+func TestOidcLinksExistingUserByVerifiedEmail(t *testing.T) {
+	ot := newOidcTest(t)
+	alice := ot.addUser("alice@example.com")
+	ot.options.UsernameClaim = "email"
+	ot.refused(ot.logIn(map[string]interface{}{"sub": "1", "email": "alice@example.com"}))
+	ot.refused(ot.logIn(map[string]interface{}{"sub": "1", "email": "alice@example.com", "email_verified": false}))
+	ot.loggedInAs(ot.logIn(map[string]interface{}{"sub": "1", "email": "alice@example.com", "email_verified": true}), alice)
+}
+
+func TestOidcAutoCreate(t *testing.T) {
+	ot := newOidcTest(t)
+	ot.refused(ot.logIn(map[string]interface{}{"sub": "1", "preferred_username": "bob"}))
+
+	ot.options.AutoCreate = true
+	resp := ot.logIn(map[string]interface{}{"sub": "1", "preferred_username": "bob"})
+	bob, exists, err := ot.ds.UserExists("bob")
+	if err != nil || !exists {
+		t.Fatalf("user wasn't added: %v", err)
+	}
+	ot.loggedInAs(resp, bob)
+	ot.loggedInAs(ot.logIn(map[string]interface{}{"sub": "1", "preferred_username": "bob"}), bob)
+
+	ot.refused(ot.logIn(map[string]interface{}{"preferred_username": "carol"}))
+}
+
+func TestOidcKeepsTotp(t *testing.T) {
+	ot := newOidcTest(t)
+	ot.options.AutoCreate = true
+	resp := ot.logIn(map[string]interface{}{"sub": "1", "preferred_username": "alice"})
+	session, _ := loggedIn(t, ot.ds, resp)
+	err := ot.ds.StartTotpEnrollment(session.UserId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret, _, err := ot.ds.PendingTotpSecret(session.UserId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := totp.Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, confirmed, err := ot.ds.ConfirmTotp(session.UserId, code); err != nil || !confirmed {
+		t.Fatalf("confirming totp: %v, %v", confirmed, err)
+	}
+
+	resp = ot.logIn(map[string]interface{}{"sub": "1", "preferred_username": "alice"})
+	if _, found := loggedIn(t, ot.ds, resp); found {
+		t.Error("logged in without a second factor")
+	}
+	if location := resp.Header().Get("Location"); !strings.HasPrefix(location, loginPrefix+"/2fa") {
+		t.Errorf("got %d to %q", resp.Code, location)
+	}
+}
+
+func TestOidcRejectsBadSignature(t *testing.T) {
+	ot := newOidcTest(t)
+	ot.options.AutoCreate = true
+	err := ot.issuer.SignWithUnknownKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ot.refused(ot.logIn(map[string]interface{}{"sub": "1", "preferred_username": "alice"}))
+	if _, exists, _ := ot.ds.UserExists("alice"); exists {
+		t.Error("user was added")
+	}
+}
@@ -0,0 +1,362 @@
+package server
+
+import (
+	"encoding/json"
+	"local/bookmarks/datastore"
+	"local/bookmarks/logging"
+	"local/bookmarks/ratelimit"
+	"local/bookmarks/webauthn"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const passkeyRpName = "Bookmarks"
+
+type passkeyCredentialParams struct {
+	Type string `json:"type"`
+	Alg  int    `json:"alg"`
+}
+
+type passkeyCredentialDescriptor struct {
+	Type string `json:"type"`
+	Id   string `json:"id"`
+}
+
+// The options for navigator.credentials.create(), with binary values as base64url
+type passkeyCreationOptions struct {
+	Challenge string `json:"challenge"`
+	Rp        struct {
+		Id   string `json:"id"`
+		Name string `json:"name"`
+	} `json:"rp"`
+	User struct {
+		Id          string `json:"id"`
+		Name        string `json:"name"`
+		DisplayName string `json:"displayName"`
+	} `json:"user"`
+	PubKeyCredParams       []passkeyCredentialParams     `json:"pubKeyCredParams"`
+	ExcludeCredentials     []passkeyCredentialDescriptor `json:"excludeCredentials"`
+	AuthenticatorSelection struct {
+		ResidentKey        string `json:"residentKey"`
+		RequireResidentKey bool   `json:"requireResidentKey"`
+		UserVerification   string `json:"userVerification"`
+	} `json:"authenticatorSelection"`
+	Attestation string `json:"attestation"`
+	Timeout     int64  `json:"timeout"`
+}
+
+// The options for navigator.credentials.get(). There's no allowCredentials list, since the
+// user hasn't told us who they are yet; the authenticator offers whichever passkeys it has for this site.
+type passkeyRequestOptions struct {
+	Challenge        string `json:"challenge"`
+	RpId             string `json:"rpId"`
+	UserVerification string `json:"userVerification"`
+	Timeout          int64  `json:"timeout"`
+}
+
+func requestHostname(req *http.Request) string {
+	if host, _, err := net.SplitHostPort(req.Host); err == nil {
+		return host
+	}
+	return req.Host
+}
+
+// The scheme and host the browser asked for. The site is always served over https
+// (perhaps by a proxy in front of us), except when testing on localhost.
+func requestOrigin(req *http.Request) string {
+	scheme := "https"
+	if req.TLS == nil && requestHostname(req) == "localhost" {
+		scheme = "http"
+	}
+	return scheme + "://" + req.Host
+}
+
+// The site that passkeys are tied to: origin, like https://bookmarks.example.com, if it's been set.
+// Otherwise it's worked out from the host the browser asked for, which is only right if the proxy in front of us
+// passes the Host header along unchanged, and passkeys registered under one name won't work under another.
+// Passkeys only work over https, except on localhost, which browsers treat as secure anyway.
+func relyingParty(req *http.Request, origin string) webauthn.RelyingParty {
+	if origin != "" {
+		if u, err := url.Parse(origin); err == nil {
+			return webauthn.RelyingParty{Id: u.Hostname(), Origin: u.Scheme + "://" + u.Host}
+		}
+	}
+	return webauthn.RelyingParty{Id: requestHostname(req), Origin: requestOrigin(req)}
+}
+
+// The user handle stored in each passkey, which comes back when logging in with it
+func passkeyUserHandle(userId int64) string {
+	return webauthn.Encoding.EncodeToString([]byte(strconv.FormatInt(userId, 10)))
+}
+
+func writeJson(resp http.ResponseWriter, value interface{}) {
+	data, err := json.Marshal(value)
+	if err != nil {
+		resultJson(resp, http.StatusInternalServerError)
+		logging.Errorf("marshaling json: %s", err)
+		return
+	}
+	resp.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	resp.Header().Set("Cache-Control", "no-store")
+	_, err = resp.Write(data)
+	if err != nil {
+		logging.Errorf("writing response: %s", err)
+	}
+}
+
+func passkeyRegistrationOptions(ds *datastore.Datastore, origin string) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		challenge, created, err := ds.CreatePasskeyChallenge(session.UserId)
+		if err != nil {
+			resultJson(resp, http.StatusInternalServerError)
+			logError(req, "creating passkey challenge: %s", err)
+			return
+		}
+		if !created {
+			tooManyRequests(resp, datastore.PasskeyChallengeTtl)
+			logWarn(req, "user %s has too many passkey challenges waiting", session.Username)
+			return
+		}
+		existing, err := ds.PasskeyCredentialIds(session.UserId)
+		if err != nil {
+			resultJson(resp, http.StatusInternalServerError)
+			logError(req, "listing passkeys: %s", err)
+			return
+		}
+
+		var options passkeyCreationOptions
+		options.Challenge = challenge
+		options.Rp.Id = relyingParty(req, origin).Id
+		options.Rp.Name = passkeyRpName
+		options.User.Id = passkeyUserHandle(session.UserId)
+		options.User.Name = session.Username
+		options.User.DisplayName = session.Username
+		options.PubKeyCredParams = []passkeyCredentialParams{
+			{Type: "public-key", Alg: webauthn.AlgorithmES256},
+			{Type: "public-key", Alg: webauthn.AlgorithmRS256},
+		}
+		options.ExcludeCredentials = make([]passkeyCredentialDescriptor, 0, len(existing))
+		for _, id := range existing {
+			options.ExcludeCredentials = append(options.ExcludeCredentials, passkeyCredentialDescriptor{"public-key", id})
+		}
+		// the passkey has to be discoverable, since logging in starts without a username
+		options.AuthenticatorSelection.ResidentKey = "required"
+		options.AuthenticatorSelection.RequireResidentKey = true
+		options.AuthenticatorSelection.UserVerification = "preferred"
+		options.Attestation = "none"
+		options.Timeout = datastore.PasskeyChallengeTtl.Milliseconds()
+		writeJson(resp, options)
+	}
+}
+
+func registerPasskey(ds *datastore.Datastore, origin string) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		failed := func(reason string, err error) {
+			if err != nil {
+				reason += ": " + err.Error()
+			}
+			logWarn(req, "user %s failed to register a passkey: %s", session.Username, reason)
+			redirect(resp, req, accountPrefix+"?failed=passkey", http.StatusSeeOther)
+		}
+		clientData, err := webauthn.Encoding.DecodeString(req.Form.Get("clientDataJSON"))
+		if err != nil {
+			failed("decoding client data", err)
+			return
+		}
+		attestation, err := webauthn.Encoding.DecodeString(req.Form.Get("attestationObject"))
+		if err != nil {
+			failed("decoding attestation", err)
+			return
+		}
+		challenge, err := webauthn.Challenge(clientData)
+		if err != nil {
+			failed("reading challenge", err)
+			return
+		}
+		valid, err := ds.ConsumePasskeyChallenge(challenge, session.UserId)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "checking passkey challenge: %s", err)
+			return
+		}
+		if !valid {
+			failed("checking challenge", nil)
+			return
+		}
+		credential, err := relyingParty(req, origin).VerifyRegistration(clientData, attestation, challenge)
+		if err != nil {
+			failed("verifying registration", err)
+			return
+		}
+
+		name := req.Form.Get("name")
+		if name == "" {
+			name = "Passkey"
+		}
+		err = ds.AddPasskey(session.UserId, name, credential)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "adding passkey: %s", err)
+			return
+		}
+		logInfo(req, "user %s added a passkey", session.Username)
+		redirect(resp, req, accountPrefix, http.StatusSeeOther)
+	}
+}
+
+func deletePasskey(ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		id, err := strconv.Atoi(params[0].Value)
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		err = ds.DeletePasskey(session.UserId, int64(id))
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "deleting passkey: %s", err)
+			return
+		}
+		redirect(resp, req, accountPrefix, http.StatusSeeOther)
+	}
+}
+
+// Counts requests for passkey login options per ip, which are forgotten once the challenges they made expire
+func newChallengeLimiter() *ratelimit.Limiter {
+	return ratelimit.New(ratelimit.Config{
+		FreeFailures: 20,
+		BaseDelay:    time.Second,
+		MaxDelay:     time.Minute,
+		ForgetAfter:  datastore.PasskeyChallengeTtl,
+	})
+}
+
+// Every request stores a challenge, so each one counts against the ip in challengeLimiter,
+// which slows down anyone asking for far more than they could use
+func passkeyLoginOptions(ds *datastore.Datastore, loginLimiter, challengeLimiter *ratelimit.Limiter, origin string) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		ipKey := "ip:" + remoteIp(req)
+		if allowed, wait := loginLimiter.Allow(ipKey); !allowed {
+			tooManyRequests(resp, wait)
+			return
+		}
+		if allowed, wait := challengeLimiter.Allow(ipKey); !allowed {
+			tooManyRequests(resp, wait)
+			return
+		}
+		challengeLimiter.FailWithoutLockout(ipKey)
+		challenge, created, err := ds.CreatePasskeyChallenge(0)
+		if err != nil {
+			resultJson(resp, http.StatusInternalServerError)
+			logError(req, "creating passkey challenge: %s", err)
+			return
+		}
+		if !created {
+			tooManyRequests(resp, datastore.PasskeyChallengeTtl)
+			logWarn(req, "too many passkey login challenges waiting to be answered")
+			return
+		}
+		writeJson(resp, passkeyRequestOptions{
+			Challenge:        challenge,
+			RpId:             relyingParty(req, origin).Id,
+			UserVerification: "preferred",
+			Timeout:          datastore.PasskeyChallengeTtl.Milliseconds(),
+		})
+	}
+}
+
+// Logs in with a passkey instead of a username and password
+func doLoginPasskey(ds *datastore.Datastore, limiter *ratelimit.Limiter, origin string) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		err := req.ParseForm()
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		redirectTo := req.Form.Get("redirectTo")
+		ip := remoteIp(req)
+		ipKey := "ip:" + ip
+		retry := func(failed string) {
+			q := url.Values{}
+			q.Set("failed", failed)
+			q.Set("redirectTo", redirectTo)
+			redirect(resp, req, loginPrefix+"?"+q.Encode(), http.StatusSeeOther)
+		}
+		if allowed, wait := limiter.Allow(ipKey); !allowed {
+			logWarn(req, "throttling passkey login from %s for %s", ip, wait.Round(time.Second))
+			retry("throttled")
+			return
+		}
+		reject := func(reason string, err error) {
+			if err != nil {
+				reason += ": " + err.Error()
+			}
+			limiter.Fail(ipKey)
+			logWarn(req, "failed passkey login from %s: %s", ip, reason)
+			retry("1")
+		}
+
+		var fields = make(map[string][]byte)
+		for _, field := range []string{"credentialId", "clientDataJSON", "authenticatorData", "signature", "userHandle"} {
+			fields[field], err = webauthn.Encoding.DecodeString(req.Form.Get(field))
+			if err != nil {
+				reject("decoding "+field, err)
+				return
+			}
+		}
+		challenge, err := webauthn.Challenge(fields["clientDataJSON"])
+		if err != nil {
+			reject("reading challenge", err)
+			return
+		}
+		valid, err := ds.ConsumePasskeyChallenge(challenge, 0)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "checking passkey challenge: %s", err)
+			return
+		}
+		if !valid {
+			reject("checking challenge", nil)
+			return
+		}
+		credential, found, err := ds.GetPasskeyCredential(webauthn.Encoding.EncodeToString(fields["credentialId"]))
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "finding passkey: %s", err)
+			return
+		}
+		if !found {
+			reject("finding passkey", nil)
+			return
+		}
+		if len(fields["userHandle"]) > 0 && webauthn.Encoding.EncodeToString(fields["userHandle"]) != passkeyUserHandle(credential.User) {
+			reject("checking user handle", nil)
+			return
+		}
+		assertion, err := relyingParty(req, origin).VerifyAssertion(fields["clientDataJSON"], fields["authenticatorData"],
+			fields["signature"], challenge, credential.PublicKey)
+		if err != nil {
+			reject("verifying assertion", err)
+			return
+		}
+		// authenticators that count signatures always count up, so going backwards means the key has been cloned
+		if (assertion.SignCount != 0 || credential.SignCount != 0) && assertion.SignCount <= credential.SignCount {
+			reject("checking signature counter", nil)
+			return
+		}
+		err = ds.RecordPasskeyUse(credential.Id, assertion.SignCount)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "recording passkey use: %s", err)
+			return
+		}
+
+		// a passkey that checked a pin or fingerprint counts as two factors on its own
+		completeLogin(ds, resp, req, credential.User, redirectTo, !assertion.UserVerified)
+	}
+}
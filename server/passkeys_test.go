@@ -0,0 +1,214 @@
+package server
+
+import (
+	"encoding/json"
+	"local/bookmarks/datastore"
+	"local/bookmarks/ratelimit"
+	"local/bookmarks/webauthn/webauthntest"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+const testOrigin = "https://bookmarks.example.com"
+
+// Serves the passkey endpoints for one user, without the rest of the router
+type passkeyTest struct {
+	t                *testing.T
+	ds               *datastore.Datastore
+	session          datastore.Session
+	loginLimiter     *ratelimit.Limiter
+	challengeLimiter *ratelimit.Limiter
+}
+
+func newPasskeyTest(t *testing.T) *passkeyTest {
+	ds := newTestDatastore(t)
+	user, err := ds.AddUser("alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &passkeyTest{
+		t:                t,
+		ds:               ds,
+		session:          datastore.Session{UserId: user, Username: "alice"},
+		loginLimiter:     ratelimit.New(ratelimit.DefaultConfig()),
+		challengeLimiter: newChallengeLimiter(),
+	}
+}
+
+// The Host header is a different name, which must not matter once the origin is set
+func (pt *passkeyTest) request(method, path string, form url.Values) *http.Request {
+	req := httptest.NewRequest(method, "http://internal:8080"+path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.ParseForm()
+	return req
+}
+
+func (pt *passkeyTest) register(a *webauthntest.Authenticator) *httptest.ResponseRecorder {
+	pt.t.Helper()
+	resp := httptest.NewRecorder()
+	passkeyRegistrationOptions(pt.ds, testOrigin)(pt.session, resp, pt.request("POST", accountPrefix+"/passkeys/options", nil), nil)
+	var options passkeyCreationOptions
+	err := json.Unmarshal(resp.Body.Bytes(), &options)
+	if err != nil {
+		pt.t.Fatalf("parsing registration options %q: %s", resp.Body.String(), err)
+	}
+	if options.Rp.Id != "bookmarks.example.com" {
+		pt.t.Errorf("got rp id %q", options.Rp.Id)
+	}
+
+	clientData, attestation := a.Create(options.Challenge)
+	resp = httptest.NewRecorder()
+	registerPasskey(pt.ds, testOrigin)(pt.session, resp, pt.request("POST", accountPrefix+"/passkeys/register", url.Values{
+		"name":              {"Laptop"},
+		"clientDataJSON":    {webauthntest.Encode(clientData)},
+		"attestationObject": {webauthntest.Encode(attestation)},
+	}), nil)
+	return resp
+}
+
+func (pt *passkeyTest) loginChallenge() string {
+	pt.t.Helper()
+	resp := httptest.NewRecorder()
+	passkeyLoginOptions(pt.ds, pt.loginLimiter, pt.challengeLimiter, testOrigin)(resp, pt.request("GET", loginPrefix+"/passkey/options", nil), nil)
+	var options passkeyRequestOptions
+	err := json.Unmarshal(resp.Body.Bytes(), &options)
+	if err != nil {
+		pt.t.Fatalf("parsing login options %q: %s", resp.Body.String(), err)
+	}
+	if options.RpId != "bookmarks.example.com" {
+		pt.t.Errorf("got rp id %q", options.RpId)
+	}
+	return options.Challenge
+}
+
+func (pt *passkeyTest) logIn(a *webauthntest.Authenticator, challenge string) *httptest.ResponseRecorder {
+	clientData, authData, signature := a.Get(challenge)
+	resp := httptest.NewRecorder()
+	doLoginPasskey(pt.ds, pt.loginLimiter, testOrigin)(resp, pt.request("POST", loginPrefix+"/passkey", url.Values{
+		"redirectTo":        {"/bookmarks"},
+		"credentialId":      {webauthntest.Encode(a.CredentialId)},
+		"clientDataJSON":    {webauthntest.Encode(clientData)},
+		"authenticatorData": {webauthntest.Encode(authData)},
+		"signature":         {webauthntest.Encode(signature)},
+		"userHandle":        {passkeyUserHandle(pt.session.UserId)},
+	}), nil)
+	return resp
+}
+
+func newAuthenticator(t *testing.T, rpId, origin string) *webauthntest.Authenticator {
+	t.Helper()
+	a, err := webauthntest.New(rpId, origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// Checks that a login response started a session, and returns its cookie
+func loggedIn(t *testing.T, ds *datastore.Datastore, resp *httptest.ResponseRecorder) (datastore.Session, bool) {
+	t.Helper()
+	for _, cookie := range resp.Result().Cookies() {
+		session, found, err := ds.GetSession(cookie.Value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if found {
+			return session, true
+		}
+	}
+	return datastore.Session{}, false
+}
+
+func TestPasskeyRegisterAndLogIn(t *testing.T) {
+	pt := newPasskeyTest(t)
+	a := newAuthenticator(t, "bookmarks.example.com", testOrigin)
+	resp := pt.register(a)
+	if location := resp.Header().Get("Location"); resp.Code != http.StatusSeeOther || location != accountPrefix {
+		t.Fatalf("registering: got %d to %q", resp.Code, location)
+	}
+	passkeys, err := pt.ds.ListPasskeys(pt.session.UserId)
+	if err != nil || len(passkeys) != 1 || passkeys[0].Name != "Laptop" {
+		t.Fatalf("got passkeys %+v, %v", passkeys, err)
+	}
+
+	resp = pt.logIn(a, pt.loginChallenge())
+	if location := resp.Header().Get("Location"); resp.Code != http.StatusSeeOther || location != "/bookmarks" {
+		t.Fatalf("logging in: got %d to %q", resp.Code, location)
+	}
+	session, found := loggedIn(t, pt.ds, resp)
+	if !found || session.UserId != pt.session.UserId {
+		t.Errorf("got session %+v, %v", session, found)
+	}
+}
+
+func TestPasskeyLoginRejects(t *testing.T) {
+	pt := newPasskeyTest(t)
+	a := newAuthenticator(t, "bookmarks.example.com", testOrigin)
+	pt.register(a)
+
+	failed := func(name string, resp *httptest.ResponseRecorder) {
+		t.Helper()
+		if location := resp.Header().Get("Location"); !strings.Contains(location, "failed=1") {
+			t.Errorf("%s: got %d to %q", name, resp.Code, location)
+		}
+		if _, found := loggedIn(t, pt.ds, resp); found {
+			t.Errorf("%s: logged in", name)
+		}
+	}
+
+	challenge := pt.loginChallenge()
+	pt.logIn(a, challenge)
+	failed("reused challenge", pt.logIn(a, challenge))
+	failed("made up challenge", pt.logIn(a, "made-up"))
+
+	a.Origin = "https://internal:8080"
+	failed("origin from the Host header", pt.logIn(a, pt.loginChallenge()))
+	a.Origin = testOrigin
+
+	a.SignCount = 1
+	failed("signature counter went backwards", pt.logIn(a, pt.loginChallenge()))
+
+	stranger := newAuthenticator(t, "bookmarks.example.com", testOrigin)
+	failed("unregistered passkey", pt.logIn(stranger, pt.loginChallenge()))
+}
+
+func TestPasskeyLoginOptionsAreRateLimited(t *testing.T) {
+	pt := newPasskeyTest(t)
+	limited := false
+	for i := 0; i < 25 && !limited; i++ {
+		resp := httptest.NewRecorder()
+		passkeyLoginOptions(pt.ds, pt.loginLimiter, pt.challengeLimiter, testOrigin)(resp, pt.request("GET", loginPrefix+"/passkey/options", nil), nil)
+		if resp.Code == http.StatusTooManyRequests {
+			limited = true
+			if i < 20 {
+				t.Errorf("limited after %d requests", i)
+			}
+			if resp.Header().Get("Retry-After") == "" {
+				t.Error("no Retry-After header")
+			}
+		}
+	}
+	if !limited {
+		t.Error("never limited")
+	}
+}
+
+func TestRelyingPartyFallsBackToHost(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://localhost:8080/login", nil)
+	rp := relyingParty(req, "")
+	if rp.Id != "localhost" || rp.Origin != "http://localhost:8080" {
+		t.Errorf("got %+v", rp)
+	}
+	req = httptest.NewRequest("GET", "http://bookmarks.example.com/login", nil)
+	rp = relyingParty(req, "")
+	if rp.Id != "bookmarks.example.com" || rp.Origin != "https://bookmarks.example.com" {
+		t.Errorf("got %+v", rp)
+	}
+	rp = relyingParty(req, "https://other.example.com:8443")
+	if rp.Id != "other.example.com" || rp.Origin != "https://other.example.com:8443" {
+		t.Errorf("got %+v", rp)
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"local/bookmarks/datastore"
+	"local/bookmarks/ratelimit"
+	"local/bookmarks/templates"
+	"net/http"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type passwordData struct {
+	Username    string
+	HasPassword bool
+	Message     string
+	Changed     bool
+	CsrfToken   string
+}
+
+func passwordPage(templates *templates.Templates, ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		resp.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		req.ParseForm()
+		user, _, err := ds.GetUser(session.UserId)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "getting user: %s", err)
+			return
+		}
+		data := passwordData{
+			Username:    session.Username,
+			HasPassword: user.HasPassword,
+			Changed:     req.Form.Get("changed") != "",
+			CsrfToken:   session.CsrfToken,
+		}
+		switch req.Form.Get("failed") {
+		case "":
+		case "wrong":
+			data.Message = "Your current password was wrong."
+		case "throttled":
+			data.Message = "Too many failed attempts. Try again in a little while."
+		case "mismatch":
+			data.Message = "The new passwords didn't match."
+		default:
+			data.Message = "Your new password can't be empty."
+		}
+		err = templates.Password.ExecuteTemplate(resp, "base", data)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "writing template: %v", err)
+			return
+		}
+	}
+}
+
+// Lets users change their own password. Users who log in with single sign-on and have
+// never had a password can set one without entering a current password.
+func changePassword(ds *datastore.Datastore, limiter *ratelimit.Limiter) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		retry := func(failed string) {
+			redirect(resp, req, accountPrefix+"/password?failed="+failed, http.StatusSeeOther)
+		}
+		newPassword := req.Form.Get("new")
+		if newPassword == "" {
+			retry("empty")
+			return
+		}
+		if newPassword != req.Form.Get("confirm") {
+			retry("mismatch")
+			return
+		}
+
+		user, _, err := ds.GetUser(session.UserId)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "getting user: %s", err)
+			return
+		}
+		if user.HasPassword {
+			userKey := "user:" + session.Username
+			attempt, allowed, _ := limiter.Begin(userKey)
+			if !allowed {
+				retry("throttled")
+				return
+			}
+			defer attempt.End()
+			_, valid, err := ds.AuthenticateUser(session.Username, req.Form.Get("current"))
+			if err != nil {
+				ErrorPage(resp, http.StatusInternalServerError)
+				logError(req, "authenticating user: %s", err)
+				return
+			}
+			if !valid {
+				limiter.FailWithoutLockout(userKey)
+				retry("wrong")
+				return
+			}
+			limiter.Succeed(userKey)
+		}
+
+		err = ds.SetUserPassword(session.UserId, newPassword)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "changing password: %s", err)
+			return
+		}
+		// anyone else who knew the old password shouldn't stay logged in
+		err = ds.RevokeOtherSessions(session.UserId, session.Id)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "revoking sessions: %s", err)
+			return
+		}
+		logInfo(req, "user %s changed their password", session.Username)
+		redirect(resp, req, accountPrefix+"/password?changed=1", http.StatusSeeOther)
+	}
+}
@@ -0,0 +1,82 @@
+package server
+
+import (
+	"fmt"
+	"local/bookmarks/datastore"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// For running behind a proxy that logs people in itself and passes their username along in a header
+type ProxyAuthOptions struct {
+	Header string
+	// The header is ignored on requests from anywhere else, since anyone could set it
+	TrustedProxies []*net.IPNet
+	// Whether to add users the first time the proxy sends them, rather than making them log in again
+	AutoCreate bool
+}
+
+// Returns the username the proxy vouches for, if the request came through a trusted proxy
+func proxyUser(options *ProxyAuthOptions, req *http.Request) (string, bool) {
+	if !trusted(peerIp(req), options.TrustedProxies) {
+		return "", false
+	}
+	username := strings.TrimSpace(req.Header.Get(options.Header))
+	return username, username != ""
+}
+
+// Finds the session for a request, logging the user in first if a trusted proxy says who they are.
+// The proxy's users get a normal session, so csrf tokens work just the same for them.
+func currentSession(ds *datastore.Datastore, proxy *ProxyAuthOptions, resp http.ResponseWriter, req *http.Request) (datastore.Session, bool, error) {
+	session, valid, err := authenticateSession(ds, req)
+	if err != nil || proxy == nil {
+		return session, valid, err
+	}
+	username, ok := proxyUser(proxy, req)
+	if !ok || (valid && session.Username == username) {
+		return session, valid, nil
+	}
+
+	userId, exists, err := ds.UserExists(username)
+	if err != nil {
+		return datastore.Session{}, false, fmt.Errorf("finding user: %w", err)
+	}
+	if !exists {
+		if !proxy.AutoCreate {
+			logWarn(req, "proxy sent unknown user %s", username)
+			return datastore.Session{}, false, nil
+		}
+		userId, err = ds.AddExternalUser(username)
+		if err != nil {
+			return datastore.Session{}, false, fmt.Errorf("adding user: %w", err)
+		}
+		logInfo(req, "added user %s from proxy", username)
+	} else {
+		// a disabled user's new session would be refused straight away, leaving it behind on every request
+		user, _, err := ds.GetUser(userId)
+		if err != nil {
+			return datastore.Session{}, false, fmt.Errorf("finding user: %w", err)
+		}
+		if user.Disabled {
+			logWarn(req, "proxy sent disabled user %s", username)
+			return datastore.Session{}, false, nil
+		}
+	}
+
+	// the proxy is in charge of any second factor, and the session of whoever it sent before ends here
+	err = endCurrentSession(ds, req)
+	if err != nil {
+		return datastore.Session{}, false, fmt.Errorf("ending previous session: %w", err)
+	}
+	cookie, err := ds.CreateSession(userId, requestClient(req))
+	if err != nil {
+		return datastore.Session{}, false, fmt.Errorf("creating session: %w", err)
+	}
+	http.SetCookie(resp, &cookie)
+	session, valid, err = ds.GetSession(cookie.Value)
+	if err != nil {
+		return datastore.Session{}, false, fmt.Errorf("finding new session: %w", err)
+	}
+	return session, valid, nil
+}
@@ -0,0 +1,193 @@
+package server
+
+import (
+	"local/bookmarks/datastore"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func testProxyAuth(autoCreate bool) *ProxyAuthOptions {
+	_, proxies, _ := net.ParseCIDR("10.0.0.0/8")
+	return &ProxyAuthOptions{Header: "X-Forwarded-User", TrustedProxies: []*net.IPNet{proxies}, AutoCreate: autoCreate}
+}
+
+// A request from peer, with the proxy's header set to user unless it's empty
+func proxiedRequest(peer, user string) *http.Request {
+	req := httptest.NewRequest("GET", "/", nil)
+	req.RemoteAddr = peer + ":1234"
+	if user != "" {
+		req.Header.Set("X-Forwarded-User", user)
+	}
+	return req
+}
+
+func sessionCount(t *testing.T, ds *datastore.Datastore, user int64) int {
+	t.Helper()
+	sessions, err := ds.ListSessions(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(sessions)
+}
+
+func TestProxyUser(t *testing.T) {
+	proxy := testProxyAuth(false)
+	tests := []struct {
+		name   string
+		peer   string
+		header string
+		want   string
+		ok     bool
+	}{
+		{"trusted proxy", "10.0.0.1", "alice", "alice", true},
+		{"untrusted peer", "192.0.2.1", "alice", "", false},
+		{"no header", "10.0.0.1", "", "", false},
+		{"blank header", "10.0.0.1", "   ", "", false},
+		{"spaces trimmed", "10.0.0.1", " alice ", "alice", true},
+	}
+	for _, test := range tests {
+		got, ok := proxyUser(proxy, proxiedRequest(test.peer, test.header))
+		if got != test.want || ok != test.ok {
+			t.Errorf("%s: got %q, %v, want %q, %v", test.name, got, ok, test.want, test.ok)
+		}
+	}
+}
+
+func TestProxyLogsInKnownUsers(t *testing.T) {
+	ds := newTestDatastore(t)
+	alice, err := ds.AddUser("alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	resp := httptest.NewRecorder()
+	session, valid, err := currentSession(ds, testProxyAuth(false), resp, proxiedRequest("10.0.0.1", "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid || session.Username != "alice" {
+		t.Fatalf("got session %+v, valid %v, want alice's", session, valid)
+	}
+	if len(resp.Result().Cookies()) != 1 {
+		t.Errorf("got cookies %v, want the new session's", resp.Result().Cookies())
+	}
+
+	// once logged in, the same user keeps the same session
+	req := proxiedRequest("10.0.0.1", "alice")
+	req.AddCookie(resp.Result().Cookies()[0])
+	_, valid, err = currentSession(ds, testProxyAuth(false), httptest.NewRecorder(), req)
+	if err != nil || !valid {
+		t.Fatalf("got valid %v, error %v with the session cookie", valid, err)
+	}
+	if count := sessionCount(t, ds, alice); count != 1 {
+		t.Errorf("got %d sessions, want 1", count)
+	}
+}
+
+func TestProxyHeaderIsIgnoredFromUntrustedPeers(t *testing.T) {
+	ds := newTestDatastore(t)
+	alice, err := ds.AddUser("alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, valid, err := currentSession(ds, testProxyAuth(true), httptest.NewRecorder(), proxiedRequest("192.0.2.1", "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if valid {
+		t.Error("untrusted peer logged in as alice")
+	}
+	_, valid, err = currentSession(ds, testProxyAuth(true), httptest.NewRecorder(), proxiedRequest("192.0.2.1", "mallory"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists, _ := ds.UserExists("mallory"); valid || exists {
+		t.Error("untrusted peer added a user")
+	}
+	if count := sessionCount(t, ds, alice); count != 0 {
+		t.Errorf("got %d sessions, want none", count)
+	}
+}
+
+func TestProxyAutoCreate(t *testing.T) {
+	ds := newTestDatastore(t)
+
+	_, valid, err := currentSession(ds, testProxyAuth(false), httptest.NewRecorder(), proxiedRequest("10.0.0.1", "bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, exists, _ := ds.UserExists("bob"); valid || exists {
+		t.Error("unknown user added without -proxy-auth-auto-create")
+	}
+
+	session, valid, err := currentSession(ds, testProxyAuth(true), httptest.NewRecorder(), proxiedRequest("10.0.0.1", "bob"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid || session.Username != "bob" {
+		t.Fatalf("got session %+v, valid %v, want bob's", session, valid)
+	}
+	// users from the proxy can't log in with a password
+	if _, ok, _ := ds.AuthenticateUser("bob", ""); ok {
+		t.Error("bob could log in without a password")
+	}
+}
+
+func TestProxySwitchingUsersEndsTheOldSession(t *testing.T) {
+	ds := newTestDatastore(t)
+	alice, _ := ds.AddUser("alice", "password")
+	bob, _ := ds.AddUser("bob", "password")
+
+	resp := httptest.NewRecorder()
+	_, _, err := currentSession(ds, testProxyAuth(false), resp, proxiedRequest("10.0.0.1", "alice"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := proxiedRequest("10.0.0.1", "bob")
+	req.AddCookie(resp.Result().Cookies()[0])
+	session, valid, err := currentSession(ds, testProxyAuth(false), httptest.NewRecorder(), req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !valid || session.Username != "bob" {
+		t.Fatalf("got session %+v, valid %v, want bob's", session, valid)
+	}
+	if count := sessionCount(t, ds, alice); count != 0 {
+		t.Errorf("alice still has %d sessions", count)
+	}
+	if count := sessionCount(t, ds, bob); count != 1 {
+		t.Errorf("got %d sessions for bob, want 1", count)
+	}
+}
+
+func TestProxyDoesntLogInDisabledUsers(t *testing.T) {
+	ds := newTestDatastore(t)
+	alice, err := ds.AddUser("alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ds.SetUserDisabled(alice, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		resp := httptest.NewRecorder()
+		_, valid, err := currentSession(ds, testProxyAuth(true), resp, proxiedRequest("10.0.0.1", "alice"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if valid {
+			t.Fatal("disabled user logged in")
+		}
+		if len(resp.Result().Cookies()) != 0 {
+			t.Errorf("got cookies %v for a disabled user", resp.Result().Cookies())
+		}
+	}
+	if count := sessionCount(t, ds, alice); count != 0 {
+		t.Errorf("got %d sessions for a disabled user, want none", count)
+	}
+}
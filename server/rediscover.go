@@ -0,0 +1,159 @@
+package server
+
+import (
+	"encoding/json"
+	"local/bookmarks/datastore"
+	"local/bookmarks/ratelimit"
+	"local/bookmarks/templates"
+	"local/bookmarks/urlparams"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+const defaultSnoozeDays = 7
+
+type rediscoverData struct {
+	Bookmark     datastore.Bookmark
+	Found        bool
+	Mode         string
+	SearchParams urlparams.SearchParams
+	CsrfToken    string
+}
+
+// Reads the rediscovery mode out of the request, defaulting to random
+func rediscoverMode(req *http.Request) (string, bool) {
+	mode := req.Form.Get("mode")
+	switch mode {
+	case "":
+		return datastore.RediscoverRandom, true
+	case datastore.RediscoverRandom, datastore.RediscoverScheduled:
+		return mode, true
+	default:
+		return "", false
+	}
+}
+
+func rediscover(templates *templates.Templates, ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		resp.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		err := req.ParseForm()
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		mode, ok := rediscoverMode(req)
+		if !ok {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+
+		bookmark, found, err := ds.Rediscover(mode)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "rediscovering bookmark: %v", err)
+			return
+		}
+
+		err = templates.Rediscover.ExecuteTemplate(resp, "base", rediscoverData{
+			Bookmark:     bookmark,
+			Found:        found,
+			Mode:         mode,
+			SearchParams: urlparams.DefaultUrlParams(),
+			CsrfToken:    session.CsrfToken,
+		})
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "writing template: %v", err)
+			return
+		}
+	}
+}
+
+// Handles the keep, snooze and dismiss buttons on the rediscover page
+func rediscoverAction(ds *datastore.Datastore, action string) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		id, err := strconv.Atoi(params[0].Value)
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		mode, ok := rediscoverMode(req)
+		if !ok {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+
+		switch action {
+		case "keep":
+			err = ds.KeepRediscovered(int64(id))
+		case "snooze":
+			days := defaultSnoozeDays
+			if daysParam := req.Form.Get("days"); daysParam != "" {
+				days, err = strconv.Atoi(daysParam)
+				if err != nil || days < 1 || days > datastore.MaxRediscoverDays {
+					ErrorPage(resp, http.StatusBadRequest)
+					return
+				}
+			}
+			err = ds.SnoozeRediscovered(int64(id), days)
+		case "dismiss":
+			err = ds.DismissRediscovered(int64(id))
+		default:
+			log.Panicf("unknown rediscover action %s", action)
+		}
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "%s rediscovered bookmark %d: %v", action, id, err)
+			return
+		}
+
+		q := url.Values{}
+		q.Set("mode", mode)
+		redirect(resp, req, rediscoverPrefix+"?"+q.Encode(), http.StatusSeeOther)
+	}
+}
+
+func apiRediscover(ds *datastore.Datastore, limiter *ratelimit.Limiter) httprouter.Handle {
+	return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		resp.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		authHeader, ok := bearerToken(resp, req)
+		if !ok || !checkApiKey(ds, limiter, resp, req, authHeader, datastore.ScopeBookmarkRead) {
+			return
+		}
+
+		err := req.ParseForm()
+		if err != nil {
+			resultJson(resp, http.StatusBadRequest)
+			return
+		}
+		mode, ok := rediscoverMode(req)
+		if !ok {
+			resultJson(resp, http.StatusBadRequest)
+			return
+		}
+		bookmark, found, err := ds.Rediscover(mode)
+		if err != nil {
+			resultJson(resp, http.StatusInternalServerError)
+			logError(req, "rediscovering bookmark: %s", err)
+			return
+		}
+		if !found {
+			resultJson(resp, http.StatusNotFound)
+			return
+		}
+		data, err := json.Marshal(bookmark)
+		if err != nil {
+			resultJson(resp, http.StatusInternalServerError)
+			logError(req, "marshaling json: %s", err)
+			return
+		}
+		_, err = resp.Write(data)
+		if err != nil {
+			logError(req, "writing response: %s", err)
+		}
+	}
+}
@@ -3,10 +3,13 @@ package server
 import (
 	"io/fs"
 	"local/bookmarks/datastore"
+	"local/bookmarks/ratelimit"
 	"local/bookmarks/templates"
 	"log"
+	"net"
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/julienschmidt/httprouter"
 )
@@ -15,32 +18,86 @@ const bookmarksPrefix = "/bookmarks"
 const keysPrefix = "/keys"
 const apiPrefix = "/api"
 const loginPrefix = "/login"
+const filtersPrefix = "/filters"
+const rediscoverPrefix = "/rediscover"
+const accountPrefix = "/account"
+const adminPrefix = "/admin"
 
 type sessionMiddleware = func(sessionHandler) httprouter.Handle
 type sessionHandler = func(datastore.Session, http.ResponseWriter, *http.Request, httprouter.Params)
 
-func MakeRouter(templates *templates.Templates, static fs.FS, ds *datastore.Datastore) http.Handler {
-	router := httprouter.New()
-	router.Handler(http.MethodGet, "/", http.RedirectHandler("/bookmarks/", http.StatusFound))
-	router.GET(loginPrefix, loginPage(templates, ds))
-	router.POST(loginPrefix, doLogin(templates, ds))
-	router.GET("/logout", logout)
+// Optional ways of logging in, which are set from flags
+type Options struct {
+	// Single sign-on is turned off if this is nil
+	Oidc *OidcOptions
+	// Logging in from proxy headers is turned off if this is nil
+	ProxyAuth *ProxyAuthOptions
+	// A path like /bookmarks-app to serve everything under, or "" to serve from the root.
+	// The templates have to be made with the same base path.
+	BasePath string
+	// Served at /metrics without logging in, if it isn't nil
+	Metrics http.Handler
+	// Reverse proxies whose X-Forwarded-For header says who the client is
+	TrustedProxies []*net.IPNet
+	// The scheme and host the site is reached at, like https://bookmarks.example.com, which passkeys are tied to.
+	// If it's "", it's taken from the Host header of each request.
+	PasskeyOrigin string
+}
+
+func MakeRouter(templates *templates.Templates, static fs.FS, ds *datastore.Datastore, options Options) http.Handler {
+	// failed logins are counted per ip and per username; failed api keys per ip
+	loginLimiter := ratelimit.New(ratelimit.DefaultConfig())
+	apiLimiter := ratelimit.New(ratelimit.DefaultConfig())
+	challengeLimiter := newChallengeLimiter()
+
+	router := instrumentedRouter{httprouter.New()}
+	router.GET(loginPrefix, loginPage(templates, ds, options))
+	router.POST(loginPrefix, doLogin(templates, ds, loginLimiter))
+	router.GET(loginPrefix+"/2fa", loginTotpPage(templates))
+	router.POST(loginPrefix+"/2fa", doLoginTotp(ds, loginLimiter))
+	router.GET(loginPrefix+"/passkey/options", passkeyLoginOptions(ds, loginLimiter, challengeLimiter, options.PasskeyOrigin))
+	router.POST(loginPrefix+"/passkey", doLoginPasskey(ds, loginLimiter, options.PasskeyOrigin))
+	if options.Oidc != nil {
+		router.GET(loginPrefix+"/oidc", startOidcLogin(ds, options.Oidc))
+		router.GET(loginPrefix+"/oidc/callback", oidcCallback(ds, options.Oidc))
+	}
+	router.GET(registerPrefix, registerPage(templates, ds))
+	router.POST(registerPrefix, doRegister(ds, loginLimiter))
+	router.GET(resetPrefix, resetPage(templates, ds))
+	router.POST(resetPrefix, doReset(ds, loginLimiter))
 
-	router.POST(apiPrefix+"/bookmark", apiNewBookmark(ds))
+	router.POST(apiPrefix+"/bookmark", apiNewBookmark(ds, apiLimiter))
 
-	router.GET(apiPrefix+"/export", apiExport(ds))
+	router.GET(apiPrefix+"/export", apiExport(ds, apiLimiter))
+
+	router.GET(apiPrefix+"/rediscover", apiRediscover(ds, apiLimiter))
 
 	router.ServeFiles("/static/*filepath", http.FS(static))
 
-	routeProtected(router, templates, ds)
+	// probes for orchestrators, which don't log in
+	router.GET("/healthz", healthz())
+	router.GET("/readyz", readyz(ds))
+
+	if options.Metrics != nil {
+		router.GET("/metrics", func(resp http.ResponseWriter, req *http.Request, _ httprouter.Params) {
+			options.Metrics.ServeHTTP(resp, req)
+		})
+	}
 
+	routeProtected(router, templates, ds, loginLimiter, apiLimiter, options)
+
+	var handler http.Handler = router
+	if options.BasePath != "" {
+		handler = BasePathMiddleware{options.BasePath, router}
+	}
 	return RequestLogger{
-		SecureHeadersMiddleware{router},
+		h:              SecureHeadersMiddleware{handler},
+		trustedProxies: options.TrustedProxies,
 	}
 }
 
-func routeProtected(router *httprouter.Router, templates *templates.Templates, ds *datastore.Datastore) {
-	auth := auth(ds, loginPrefix)
+func routeProtected(router instrumentedRouter, templates *templates.Templates, ds *datastore.Datastore, loginLimiter, apiLimiter *ratelimit.Limiter, options Options) {
+	auth := auth(ds, loginPrefix, options.ProxyAuth)
 
 	GET := func(path string, handler sessionHandler) {
 		router.GET(path, auth(handler))
@@ -52,7 +109,12 @@ func routeProtected(router *httprouter.Router, templates *templates.Templates, d
 	// Note: because we use same-site=lax cookies, dangerous endpoints have to be POSTs.
 	// This endpoint is an exception because it *also* requires an api key to be passed as a url parameter.
 	// (I know, I know, I'd rather pass it as a header too, but the bookmarklet can't do that. It's https-only)
-	GET("/_bookmarklet", addFromBookmarklet(ds))
+	GET("/_bookmarklet", addFromBookmarklet(ds, apiLimiter))
+
+	// a post, so that other sites can't log people out
+	POST("/logout", logout(ds))
+
+	GET("/", dashboard(templates, ds))
 
 	GET(bookmarksPrefix, index(templates, ds))
 	GET(bookmarksPrefix+"/edit/:id", editBookmark(templates, ds))
@@ -60,24 +122,53 @@ func routeProtected(router *httprouter.Router, templates *templates.Templates, d
 	POST(bookmarksPrefix+"/create", submitNewBookmark(ds))
 	POST(bookmarksPrefix+"/edit/:id", submitEditedBookmark(ds))
 	POST(bookmarksPrefix+"/delete/:id", deleteBookmark(ds))
+	POST(bookmarksPrefix+"/favorite/:id", setFavorite(ds))
+	POST(bookmarksPrefix+"/preview", previewDescription())
+	POST(bookmarksPrefix+"/highlight/delete/:id", deleteHighlight(ds))
+
+	POST(filtersPrefix+"/create", createSavedFilter(ds))
+	POST(filtersPrefix+"/delete/:id", deleteSavedFilter(ds))
+
+	GET(rediscoverPrefix, rediscover(templates, ds))
+	POST(rediscoverPrefix+"/keep/:id", rediscoverAction(ds, "keep"))
+	POST(rediscoverPrefix+"/snooze/:id", rediscoverAction(ds, "snooze"))
+	POST(rediscoverPrefix+"/dismiss/:id", rediscoverAction(ds, "dismiss"))
 
 	GET(keysPrefix, keys(templates, ds))
 	POST(keysPrefix+"/create", createKey(templates, ds))
 	POST(keysPrefix+"/delete/:id", deleteKey(templates, ds))
+	POST(keysPrefix+"/disable/:id", setKeyDisabled(ds, true))
+	POST(keysPrefix+"/enable/:id", setKeyDisabled(ds, false))
+
+	GET(accountPrefix, account(templates, ds))
+	POST(accountPrefix+"/2fa/start", startTotp(ds))
+	POST(accountPrefix+"/2fa/confirm", confirmTotp(templates, ds))
+	POST(accountPrefix+"/2fa/disable", disableTotp(ds))
+	POST(accountPrefix+"/passkeys/options", passkeyRegistrationOptions(ds, options.PasskeyOrigin))
+	POST(accountPrefix+"/passkeys/register", registerPasskey(ds, options.PasskeyOrigin))
+	POST(accountPrefix+"/passkeys/delete/:id", deletePasskey(ds))
+	GET(accountPrefix+"/sessions", sessions(templates, ds))
+	POST(accountPrefix+"/sessions/revoke/:id", revokeSession(ds))
+	POST(accountPrefix+"/sessions/revoke-all", revokeAllSessions(ds))
+	GET(accountPrefix+"/password", passwordPage(templates, ds))
+	POST(accountPrefix+"/password", changePassword(ds, loginLimiter))
+
+	GET(adminPrefix+"/users", admin(adminUsers(templates, ds)))
+	POST(adminPrefix+"/users/create", admin(adminCreateUser(ds)))
+	POST(adminPrefix+"/users/password/:id", admin(adminUserAction(ds, "password")))
+	POST(adminPrefix+"/users/disable/:id", admin(adminUserAction(ds, "disable")))
+	POST(adminPrefix+"/users/enable/:id", admin(adminUserAction(ds, "enable")))
+	POST(adminPrefix+"/users/promote/:id", admin(adminUserAction(ds, "promote")))
+	POST(adminPrefix+"/users/demote/:id", admin(adminUserAction(ds, "demote")))
+	POST(adminPrefix+"/users/delete/:id", admin(adminUserAction(ds, "delete")))
+	POST(adminPrefix+"/users/reset-link/:id", admin(adminCreateResetLink(templates, ds)))
+	POST(adminPrefix+"/invites/create", admin(adminCreateInvite(templates, ds)))
+	POST(adminPrefix+"/invites/delete/:id", admin(adminDeleteInvite(ds)))
 
 	GET("/export", export(templates, ds))
 	GET("/tags", tags(templates, ds))
 }
 
-type RequestLogger struct {
-	h http.Handler
-}
-
-func (rl RequestLogger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	log.Printf("%s %s", r.Method, r.URL)
-	rl.h.ServeHTTP(w, r)
-}
-
 type SecureHeadersMiddleware struct {
 	h http.Handler
 }
@@ -88,18 +179,45 @@ func (m SecureHeadersMiddleware) ServeHTTP(w http.ResponseWriter, r *http.Reques
 	m.h.ServeHTTP(w, r)
 }
 
-func auth(ds *datastore.Datastore, loginPath string) sessionMiddleware {
+// Sends plain http requests to the same place over https, on httpsPort (which is left out of urls when it's 443)
+func RedirectToHttps(httpsPort string) http.Handler {
+	return http.HandlerFunc(func(resp http.ResponseWriter, req *http.Request) {
+		host, _, err := net.SplitHostPort(req.Host)
+		if err != nil {
+			host = strings.Trim(req.Host, "[]")
+		}
+		if httpsPort != "443" {
+			host = net.JoinHostPort(host, httpsPort)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		target := url.URL{Scheme: "https", Host: host, Path: req.URL.Path, RawQuery: req.URL.RawQuery}
+		http.Redirect(resp, req, target.String(), http.StatusMovedPermanently)
+	})
+}
+
+func auth(ds *datastore.Datastore, loginPath string, proxy *ProxyAuthOptions) sessionMiddleware {
 	loginUrl, err := url.Parse(loginPath)
 	if err != nil {
 		log.Panicf("illegal login path %s passed to auth: %s", loginPath, err)
 	}
 	return func(h sessionHandler) httprouter.Handle {
 		return func(resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
-			session, valid, err := authenticateSession(ds, req)
+			session, valid, err := currentSession(ds, proxy, resp, req)
 			if err != nil {
 				ErrorPage(resp, http.StatusInternalServerError)
+				logError(req, "authenticating request: %s", err)
+				return
 			}
 			if valid {
+				setRequestUser(req, session.Username)
+				renewed, err := ds.TouchSession(session, requestClient(req))
+				if err != nil {
+					logError(req, "updating session: %s", err)
+				}
+				if renewed != nil {
+					http.SetCookie(resp, renewed)
+				}
 				h(session, resp, req, params)
 			} else {
 				escapedReturnPath := url.QueryEscape(req.URL.String())
@@ -107,7 +225,7 @@ func auth(ds *datastore.Datastore, loginPath string) sessionMiddleware {
 				q := redirectUrl.Query()
 				q.Set("redirectTo", escapedReturnPath)
 				redirectUrl.RawQuery = q.Encode()
-				http.Redirect(resp, req, redirectUrl.String(), http.StatusSeeOther)
+				redirect(resp, req, redirectUrl.String(), http.StatusSeeOther)
 			}
 		}
 	}
@@ -0,0 +1,32 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRedirectToHttps(t *testing.T) {
+	tests := []struct {
+		port string
+		host string
+		path string
+		want string
+	}{
+		{"443", "example.com", "/", "https://example.com/"},
+		{"443", "example.com:80", "/bookmarks?page=2", "https://example.com/bookmarks?page=2"},
+		{"8443", "example.com:8080", "/", "https://example.com:8443/"},
+		{"8443", "example.com", "/", "https://example.com:8443/"},
+		{"443", "[::1]:80", "/", "https://[::1]/"},
+		{"8443", "[::1]", "/", "https://[::1]:8443/"},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", test.path, nil)
+		req.Host = test.host
+		resp := httptest.NewRecorder()
+		RedirectToHttps(test.port).ServeHTTP(resp, req)
+		if resp.Code != http.StatusMovedPermanently || resp.Header().Get("Location") != test.want {
+			t.Errorf("%s%s to port %s: got %d to %s, want %s", test.host, test.path, test.port, resp.Code, resp.Header().Get("Location"), test.want)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"local/bookmarks/datastore"
+	"local/bookmarks/templates"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// A migrated database in a temporary directory, with cheap password hashing, which is closed when the test ends
+func newTestDatastore(t *testing.T) *datastore.Datastore {
+	t.Helper()
+	ds, err := datastore.Connect(filepath.Join(t.TempDir(), "bookmarks.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ds.SetPasswordParams(datastore.PasswordParams{Time: 1, Memory: 64, Threads: 1})
+	_, err = ds.RunMigrations(os.DirFS("../schema"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ds.Close() })
+	return &ds
+}
+
+// The whole router over a test database, with a user called alice who's logged in
+type testSite struct {
+	t       *testing.T
+	ds      *datastore.Datastore
+	router  http.Handler
+	cookie  http.Cookie
+	session datastore.Session
+}
+
+func newTestSite(t *testing.T, options Options) *testSite {
+	t.Helper()
+	ds := newTestDatastore(t)
+	root := os.DirFS("..")
+	pages := templates.CreateTemplates(root, options.BasePath)
+	user, err := ds.AddUser("alice", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie, err := ds.CreateSession(user, datastore.Client{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	session, _, err := ds.GetSession(cookie.Value)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testSite{t, ds, MakeRouter(&pages, root, ds, options), cookie, session}
+}
+
+// Makes a request as alice
+func (s *testSite) get(path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest("GET", path, nil)
+	req.AddCookie(&s.cookie)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	return resp
+}
+
+// Posts a form as alice, with her csrf token
+func (s *testSite) post(path string, form url.Values) *httptest.ResponseRecorder {
+	if form == nil {
+		form = url.Values{}
+	}
+	form.Set(templates.CsrfTokenName, s.session.CsrfToken)
+	req := httptest.NewRequest("POST", path, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.AddCookie(&s.cookie)
+	resp := httptest.NewRecorder()
+	s.router.ServeHTTP(resp, req)
+	return resp
+}
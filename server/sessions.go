@@ -0,0 +1,75 @@
+package server
+
+import (
+	"local/bookmarks/datastore"
+	"local/bookmarks/templates"
+	"net/http"
+	"strconv"
+
+	"github.com/julienschmidt/httprouter"
+)
+
+type sessionsData struct {
+	Sessions  []datastore.SessionInfo
+	CurrentId int64
+	CsrfToken string
+}
+
+func sessions(templates *templates.Templates, ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		resp.Header().Set("Content-Type", "text/html; charset=UTF-8")
+		sessions, err := ds.ListSessions(session.UserId)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "listing sessions: %s", err)
+			return
+		}
+		err = templates.Sessions.ExecuteTemplate(resp, "base", sessionsData{
+			Sessions:  sessions,
+			CurrentId: session.Id,
+			CsrfToken: session.CsrfToken,
+		})
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "writing template: %v", err)
+			return
+		}
+	}
+}
+
+func revokeSession(ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		id, err := strconv.Atoi(params[0].Value)
+		if err != nil {
+			ErrorPage(resp, http.StatusBadRequest)
+			return
+		}
+		err = ds.RevokeSession(session.UserId, int64(id))
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "revoking session: %s", err)
+			return
+		}
+		if int64(id) == session.Id {
+			redirect(resp, req, loginPrefix, http.StatusSeeOther)
+			return
+		}
+		redirect(resp, req, accountPrefix+"/sessions", http.StatusSeeOther)
+	}
+}
+
+// Logs out every session, including this one
+func revokeAllSessions(ds *datastore.Datastore) sessionHandler {
+	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
+		err := ds.RevokeAllSessions(session.UserId)
+		if err != nil {
+			ErrorPage(resp, http.StatusInternalServerError)
+			logError(req, "revoking sessions: %s", err)
+			return
+		}
+		logInfo(req, "user %s signed out everywhere", session.Username)
+		expired := ds.ExpiredSessionCookie()
+		http.SetCookie(resp, &expired)
+		redirect(resp, req, loginPrefix, http.StatusSeeOther)
+	}
+}
@@ -3,12 +3,16 @@ package server
 import (
 	"local/bookmarks/datastore"
 	"local/bookmarks/templates"
-	"log"
 	"net/http"
 
 	"github.com/julienschmidt/httprouter"
 )
 
+type tagsData struct {
+	Tags      []datastore.Tag
+	CsrfToken string
+}
+
 func tags(templates *templates.Templates, ds *datastore.Datastore) sessionHandler {
 	return func(session datastore.Session, resp http.ResponseWriter, req *http.Request, params httprouter.Params) {
 		resp.Header().Set("Content-Type", "text/html; charset=UTF-8")
@@ -16,14 +20,14 @@ func tags(templates *templates.Templates, ds *datastore.Datastore) sessionHandle
 		tags, err := ds.GetTags()
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("getting tags: %v", err)
+			logError(req, "getting tags: %v", err)
 			return
 		}
 
-		err = templates.Tags.ExecuteTemplate(resp, "base", tags)
+		err = templates.Tags.ExecuteTemplate(resp, "base", tagsData{tags, session.CsrfToken})
 		if err != nil {
 			ErrorPage(resp, http.StatusInternalServerError)
-			log.Printf("writing template: %v", err)
+			logError(req, "writing template: %v", err)
 			return
 		}
 	}
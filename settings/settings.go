@@ -0,0 +1,121 @@
+// Settings for a command, taken from its flags, then environment variables, then a TOML config file,
+// so the same options can be passed whichever way suits the deployment.
+package settings
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Where a setting's value came from
+type Source string
+
+const (
+	SourceDefault Source = "default"
+	SourceFile    Source = "file"
+	SourceEnv     Source = "env"
+	SourceFlag    Source = "flag"
+)
+
+// The environment variable that sets a flag, like BOOKMARKS_SESSION_AGE for -session-age
+func EnvName(prefix, flagName string) string {
+	return prefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Parses args into flags. Flags that weren't passed are then taken from environment variables starting with
+// envPrefix, and failing that from the TOML file named by the configFlag flag (or its environment variable).
+// Keys in the file are the flag names. Returns where each flag's value came from.
+func Load(flags *flag.FlagSet, args []string, envPrefix, configFlag string) (map[string]Source, error) {
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	if flags.NArg() > 0 {
+		return nil, fmt.Errorf("unexpected argument %s", flags.Arg(0))
+	}
+	sources := make(map[string]Source)
+	flags.Visit(func(f *flag.Flag) {
+		sources[f.Name] = SourceFlag
+	})
+
+	configPath := flags.Lookup(configFlag).Value.String()
+	if sources[configFlag] == "" {
+		if envPath, ok := os.LookupEnv(EnvName(envPrefix, configFlag)); ok {
+			configPath = envPath
+			sources[configFlag] = SourceEnv
+			if err = flags.Set(configFlag, envPath); err != nil {
+				return nil, err
+			}
+		}
+	}
+	fileValues := make(map[string]string)
+	if configPath != "" {
+		data, err := os.ReadFile(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("reading config file: %w", err)
+		}
+		fileValues, err = parseToml(string(data))
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s: %w", configPath, err)
+		}
+		for key := range fileValues {
+			if flags.Lookup(key) == nil || key == configFlag {
+				return nil, fmt.Errorf("%s: unknown setting %s", configPath, key)
+			}
+		}
+	}
+
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || sources[f.Name] != "" {
+			return
+		}
+		if value, ok := os.LookupEnv(EnvName(envPrefix, f.Name)); ok {
+			sources[f.Name] = SourceEnv
+			if err = flags.Set(f.Name, value); err != nil {
+				err = fmt.Errorf("%s: bad value %q: %w", EnvName(envPrefix, f.Name), value, err)
+			}
+		} else if value, ok := fileValues[f.Name]; ok {
+			sources[f.Name] = SourceFile
+			if err = flags.Set(f.Name, value); err != nil {
+				err = fmt.Errorf("%s: %s: bad value %q: %w", configPath, f.Name, value, err)
+			}
+		} else {
+			sources[f.Name] = SourceDefault
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sources, nil
+}
+
+// Writes the flags' values as a config file that Load would read back, noting where each came from.
+// The values of secret flags are left out.
+func Write(w io.Writer, flags *flag.FlagSet, sources map[string]Source, secret func(name string) bool) error {
+	names := make([]string, 0)
+	flags.VisitAll(func(f *flag.Flag) {
+		names = append(names, f.Name)
+	})
+	sort.Strings(names)
+	for _, name := range names {
+		f := flags.Lookup(name)
+		value := f.Value.String()
+		if getter, ok := f.Value.(flag.Getter); ok {
+			if _, isString := getter.Get().(string); isString {
+				value = fmt.Sprintf("%q", value)
+			}
+		}
+		if secret(name) && f.Value.String() != "" {
+			value = `"<redacted>"`
+		}
+		_, err := fmt.Fprintf(w, "%s = %s # %s\n", name, value, sources[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package settings
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+const testPrefix = "SETTINGS_TEST_"
+
+type testSettings struct {
+	config   string
+	listen   string
+	port     uint
+	db       string
+	insecure bool
+	secret   string
+}
+
+func newTestFlags(s *testSettings) *flag.FlagSet {
+	flags := flag.NewFlagSet("test", flag.ContinueOnError)
+	flags.SetOutput(new(bytes.Buffer))
+	flags.StringVar(&s.config, "config", "", "")
+	flags.StringVar(&s.listen, "listen", "", "")
+	flags.UintVar(&s.port, "port", 8080, "")
+	flags.StringVar(&s.db, "db", "default.db", "")
+	flags.BoolVar(&s.insecure, "insecure-cookies", false, "")
+	flags.StringVar(&s.secret, "oidc-client-secret", "", "")
+	return flags
+}
+
+func writeConfig(t *testing.T, toml string) string {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "config.toml")
+	err := os.WriteFile(file, []byte(toml), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func setEnv(t *testing.T, name, value string) {
+	t.Helper()
+	os.Setenv(name, value)
+	t.Cleanup(func() { os.Unsetenv(name) })
+}
+
+func TestLoadPrecedence(t *testing.T) {
+	file := writeConfig(t, "listen = \"file:1\"\nport = 1\ndb = \"file.db\"\n[oidc]\nclient-secret = \"from-file\"\n")
+	setEnv(t, testPrefix+"PORT", "2")
+	setEnv(t, testPrefix+"DB", "env.db")
+	setEnv(t, testPrefix+"INSECURE_COOKIES", "true")
+
+	var s testSettings
+	sources, err := Load(newTestFlags(&s), []string{"-config", file, "-db", "flag.db"}, testPrefix, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := testSettings{config: file, listen: "file:1", port: 2, db: "flag.db", insecure: true, secret: "from-file"}
+	if s != want {
+		t.Errorf("got %+v, want %+v", s, want)
+	}
+	wantSources := map[string]Source{
+		"config":             SourceFlag,
+		"listen":             SourceFile,
+		"port":               SourceEnv,
+		"db":                 SourceFlag,
+		"insecure-cookies":   SourceEnv,
+		"oidc-client-secret": SourceFile,
+	}
+	for name, source := range wantSources {
+		if sources[name] != source {
+			t.Errorf("%s came from %s, want %s", name, sources[name], source)
+		}
+	}
+}
+
+func TestLoadDefaults(t *testing.T) {
+	var s testSettings
+	sources, err := Load(newTestFlags(&s), nil, testPrefix, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.port != 8080 || s.db != "default.db" || sources["port"] != SourceDefault {
+		t.Errorf("got %+v, port from %s", s, sources["port"])
+	}
+}
+
+func TestLoadConfigFileFromEnv(t *testing.T) {
+	setEnv(t, testPrefix+"CONFIG", writeConfig(t, "port = 3"))
+	var s testSettings
+	sources, err := Load(newTestFlags(&s), nil, testPrefix, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.port != 3 || sources["config"] != SourceEnv || sources["port"] != SourceFile {
+		t.Errorf("got %+v, config from %s", s, sources["config"])
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	tests := map[string]struct {
+		toml string
+		env  map[string]string
+		args []string
+	}{
+		"unknown setting in file":  {toml: "colour = \"blue\""},
+		"config set in the file":   {toml: "config = \"other.toml\""},
+		"bad value in file":        {toml: "port = \"lots\""},
+		"bad toml":                 {toml: "port ="},
+		"bad value in environment": {env: map[string]string{testPrefix + "PORT": "-1"}},
+		"unknown flag":             {args: []string{"-colour", "blue"}},
+		"extra argument":           {args: []string{"serve"}},
+		"missing config file":      {args: []string{"-config", "/nonexistent/config.toml"}},
+	}
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			args := test.args
+			if test.toml != "" {
+				args = append([]string{"-config", writeConfig(t, test.toml)}, args...)
+			}
+			for env, value := range test.env {
+				setEnv(t, env, value)
+			}
+			var s testSettings
+			if _, err := Load(newTestFlags(&s), args, testPrefix, "config"); err == nil {
+				t.Errorf("got %+v", s)
+			}
+		})
+	}
+}
+
+func TestWriteReadsBack(t *testing.T) {
+	var s testSettings
+	flags := newTestFlags(&s)
+	sources, err := Load(flags, []string{"-db", `C:\my "bookmarks".db`, "-port", "9000", "-oidc-client-secret", "hunter2"}, testPrefix, "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out bytes.Buffer
+	err = Write(&out, flags, sources, func(name string) bool { return name == "oidc-client-secret" })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out.String(), "hunter2") {
+		t.Errorf("secret was written:\n%s", out.String())
+	}
+	values, err := parseToml(out.String())
+	if err != nil {
+		t.Fatalf("can't read back\n%s: %s", out.String(), err)
+	}
+	if values["db"] != `C:\my "bookmarks".db` || values["port"] != "9000" || values["oidc-client-secret"] != "<redacted>" {
+		t.Errorf("read back %v", values)
+	}
+}
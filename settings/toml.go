@@ -0,0 +1,195 @@
+package settings
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Parses the parts of TOML that settings need: tables, and keys set to strings, integers, booleans or arrays of those.
+// Keys inside a table are joined to the table's name with hyphens, so
+//
+//	[oidc]
+//	client-id = "bookmarks"
+//
+// is the same as `oidc-client-id = "bookmarks"`. Arrays come back as comma-separated lists.
+func parseToml(data string) (map[string]string, error) {
+	values := make(map[string]string)
+	table := ""
+	for i, line := range strings.Split(data, "\n") {
+		lineNumber := i + 1
+		line = strings.TrimSpace(stripComment(line))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") {
+			if !strings.HasSuffix(line, "]") || strings.HasPrefix(line, "[[") {
+				return nil, fmt.Errorf("line %d: bad table header %s", lineNumber, line)
+			}
+			name, err := parseKey(strings.TrimSpace(line[1 : len(line)-1]))
+			if err != nil {
+				return nil, fmt.Errorf("line %d: bad table name: %w", lineNumber, err)
+			}
+			table = name
+			continue
+		}
+
+		// the key can be a quoted string with an = in it
+		equals := indexUnquoted(line, '=')
+		if equals < 0 {
+			return nil, fmt.Errorf("line %d: expected key = value", lineNumber)
+		}
+		key, err := parseKey(strings.TrimSpace(line[:equals]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if table != "" {
+			key = table + "-" + key
+		}
+		value, err := parseValue(strings.TrimSpace(line[equals+1:]))
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s: %w", lineNumber, key, err)
+		}
+		if _, exists := values[key]; exists {
+			return nil, fmt.Errorf("line %d: %s is set twice", lineNumber, key)
+		}
+		values[key] = value
+	}
+	return values, nil
+}
+
+// Removes a # comment, unless the # is inside a string
+func stripComment(line string) string {
+	if i := indexUnquoted(line, '#'); i >= 0 {
+		return line[:i]
+	}
+	return line
+}
+
+// The index of the first c in line that isn't inside a string, or -1 if there isn't one
+func indexUnquoted(line string, target rune) int {
+	var quote rune
+	escaped := false
+	for i, c := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case quote == '"' && c == '\\':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == target:
+			return i
+		}
+	}
+	return -1
+}
+
+// Keys are normalised to look like flag names: dotted keys and underscores become hyphens
+func parseKey(key string) (string, error) {
+	if key == "" {
+		return "", fmt.Errorf("missing key")
+	}
+	if strings.HasPrefix(key, `"`) || strings.HasPrefix(key, "'") {
+		unquoted, err := parseString(key)
+		if err != nil {
+			return "", err
+		}
+		key = unquoted
+	}
+	for _, c := range key {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return "", fmt.Errorf("bad key %q", key)
+		}
+	}
+	key = strings.ReplaceAll(key, ".", "-")
+	return strings.ReplaceAll(key, "_", "-"), nil
+}
+
+func parseValue(value string) (string, error) {
+	switch {
+	case value == "":
+		return "", fmt.Errorf("missing value")
+	case strings.HasPrefix(value, `"""`) || strings.HasPrefix(value, "'''"):
+		return "", fmt.Errorf("multi-line strings aren't supported")
+	case strings.HasPrefix(value, `"`) || strings.HasPrefix(value, "'"):
+		return parseString(value)
+	case strings.HasPrefix(value, "["):
+		return parseArray(value)
+	case value == "true" || value == "false":
+		return value, nil
+	}
+	n, err := strconv.ParseInt(strings.ReplaceAll(value, "_", ""), 0, 64)
+	if err != nil {
+		return "", fmt.Errorf("unsupported value %s", value)
+	}
+	return strconv.FormatInt(n, 10), nil
+}
+
+func parseString(value string) (string, error) {
+	if len(value) < 2 || value[len(value)-1] != value[0] {
+		return "", fmt.Errorf("unterminated string %s", value)
+	}
+	if value[0] == '\'' {
+		literal := value[1 : len(value)-1]
+		if strings.Contains(literal, "'") {
+			return "", fmt.Errorf("bad string %s", value)
+		}
+		return literal, nil
+	}
+	unquoted, err := strconv.Unquote(value)
+	if err != nil {
+		return "", fmt.Errorf("bad string %s", value)
+	}
+	return unquoted, nil
+}
+
+func parseArray(value string) (string, error) {
+	if !strings.HasSuffix(value, "]") {
+		return "", fmt.Errorf("arrays have to be on one line")
+	}
+	inner := strings.TrimSpace(value[1 : len(value)-1])
+	items := make([]string, 0)
+	for inner != "" {
+		end := len(inner)
+		if inner[0] == '"' || inner[0] == '\'' {
+			// find the closing quote, skipping escaped ones in basic strings
+			end = -1
+			for i := 1; i < len(inner); i++ {
+				if inner[0] == '"' && inner[i] == '\\' {
+					i++
+					continue
+				}
+				if inner[i] == inner[0] {
+					end = i + 1
+					break
+				}
+			}
+			if end < 0 {
+				return "", fmt.Errorf("unterminated string in %s", value)
+			}
+		} else if comma := strings.Index(inner, ","); comma >= 0 {
+			end = comma
+		}
+		item, err := parseValue(strings.TrimSpace(inner[:end]))
+		if err != nil {
+			return "", err
+		}
+		if strings.HasPrefix(strings.TrimSpace(inner[:end]), "[") {
+			return "", fmt.Errorf("nested arrays aren't supported")
+		}
+		items = append(items, item)
+		inner = strings.TrimSpace(inner[end:])
+		if inner != "" {
+			if inner[0] != ',' {
+				return "", fmt.Errorf("expected a comma in %s", value)
+			}
+			inner = strings.TrimSpace(inner[1:])
+		}
+	}
+	return strings.Join(items, ","), nil
+}
@@ -0,0 +1,82 @@
+package settings
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseToml(t *testing.T) {
+	tests := []struct {
+		name string
+		toml string
+		want map[string]string
+	}{
+		{"empty", "", map[string]string{}},
+		{"comments and blank lines", "# a comment\n\n   # another\n", map[string]string{}},
+		{"basic string", `db = "/var/lib/bookmarks.db"`, map[string]string{"db": "/var/lib/bookmarks.db"}},
+		{"literal string", `db = 'C:\bookmarks.db'`, map[string]string{"db": `C:\bookmarks.db`}},
+		{"escapes", `password = "a\"b\\c\td\u00e9"`, map[string]string{"password": "a\"b\\c\td\u00e9"}},
+		{"= in a value", `secret = "a=b=c"`, map[string]string{"secret": "a=b=c"}},
+		{"# in a value", `secret = "a#b" # and a comment`, map[string]string{"secret": "a#b"}},
+		{"# in a literal string", `secret = 'a#b'`, map[string]string{"secret": "a#b"}},
+		{"quote of the other kind in a string", `secret = "it's # fine" # comment 'with quotes'`, map[string]string{"secret": "it's # fine"}},
+		{"escaped quote before #", `secret = "a\"#b"`, map[string]string{"secret": `a"#b`}},
+		{"no spaces", `port=8080`, map[string]string{"port": "8080"}},
+		{"integers", "a = 8_080\nb = -1\nc = 0x10\nd = +3", map[string]string{"a": "8080", "b": "-1", "c": "16", "d": "3"}},
+		{"booleans", "a = true\nb = false", map[string]string{"a": "true", "b": "false"}},
+		{"array", `proxies = ["10.0.0.0/8", '192.168.0.1', "a,b"]`, map[string]string{"proxies": "10.0.0.0/8,192.168.0.1,a,b"}},
+		{"array with a trailing comma", `ports = [1, 2, ]`, map[string]string{"ports": "1,2"}},
+		{"empty array", `proxies = []`, map[string]string{"proxies": ""}},
+		{"quoted key", `"db" = "a.db"`, map[string]string{"db": "a.db"}},
+		{"quoted key with #", `'log-level' = "debug" # "x" = 1`, map[string]string{"log-level": "debug"}},
+		{"underscores and dots in keys", "session_age = 1\noidc.client-id = \"x\"", map[string]string{"session-age": "1", "oidc-client-id": "x"}},
+		{"tables", "port = 1\n[oidc]\nclient-id = \"x\"\n[proxy.auth]\nheader = \"X-User\"\n",
+			map[string]string{"port": "1", "oidc-client-id": "x", "proxy-auth-header": "X-User"}},
+		{"table with a comment and spaces", "[ oidc ] # single sign-on\nissuer = 'x'", map[string]string{"oidc-issuer": "x"}},
+		{"quoted table name", "[\"oidc\"]\nissuer = 'x'", map[string]string{"oidc-issuer": "x"}},
+		{"crlf line endings", "port = 1\r\ndb = \"a.db\"\r\n", map[string]string{"port": "1", "db": "a.db"}},
+	}
+	for _, test := range tests {
+		got, err := parseToml(test.toml)
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestParseTomlErrors(t *testing.T) {
+	tests := map[string]string{
+		"no =":                     `port 8080`,
+		"no key":                   `= 8080`,
+		"no value":                 `port =`,
+		"= in a quoted key":        `"a=b" = 1`,
+		"space in a key":           `log level = "debug"`,
+		"unterminated string":      `db = "a.db`,
+		"unterminated literal":     `db = 'a.db`,
+		"quote inside a literal":   `db = 'a'b'`,
+		"text after a string":      `db = "a.db" x`,
+		"bad escape":               `db = "\q"`,
+		"multi-line string":        `db = """a.db"""`,
+		"float":                    `port = 1.5`,
+		"bare word":                `log-level = debug`,
+		"inline table":             `oidc = { issuer = "x" }`,
+		"multi-line array":         `proxies = [`,
+		"nested array":             `proxies = [[1]]`,
+		"missing comma":            `proxies = ["a" "b"]`,
+		"unterminated array item":  `proxies = ["a]`,
+		"array of tables":          "[[oidc]]\nissuer = 'x'",
+		"unterminated table":       "[oidc\nissuer = 'x'",
+		"empty table name":         "[]\nissuer = 'x'",
+		"set twice":                "port = 1\nport = 2",
+		"set twice through tables": "oidc-issuer = 'x'\n[oidc]\nissuer = 'y'",
+	}
+	for name, toml := range tests {
+		if got, err := parseToml(toml); err == nil {
+			t.Errorf("%s: got %v", name, got)
+		}
+	}
+}
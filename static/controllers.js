@@ -3,6 +3,11 @@ import * as Stimulus from "./stimulus.js";
 (() => {
     const application = Stimulus.Application.start()
 
+    // the app can be served under a base path, which base.html passes along
+    function appPath(path) {
+        return document.querySelector('meta[name="base-path"]').content + path
+    }
+
     application.register("are-you-sure", class extends Stimulus.Controller {
         static get targets() {
             return ["initial", "primary"]
@@ -75,6 +80,115 @@ import * as Stimulus from "./stimulus.js";
         }
     });
 
+    application.register("markdown-preview", class extends Stimulus.Controller {
+        static get targets() {
+            return ["source", "output"]
+        }
+
+        async preview() {
+            // the form holds the csrf token, so send it along with the description
+            let body = new URLSearchParams(new FormData(this.element.closest("form")))
+            body.set("description", this.sourceTarget.value)
+            let response = await fetch(appPath("/bookmarks/preview"), { method: "POST", body: body })
+            if (response.ok) {
+                // the server sanitizes the rendered markdown
+                this.outputTarget.innerHTML = await response.text()
+            } else {
+                this.outputTarget.innerText = "Couldn't render preview"
+            }
+        }
+    })
+
+    // webauthn deals in ArrayBuffers, which we send to and from the server as unpadded base64url
+    function fromBase64Url(text) {
+        let base64 = text.replace(/-/g, "+").replace(/_/g, "/")
+        return Uint8Array.from(atob(base64), c => c.charCodeAt(0)).buffer
+    }
+
+    function toBase64Url(buffer) {
+        let binary = String.fromCharCode(...new Uint8Array(buffer))
+        return btoa(binary).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "")
+    }
+
+    application.register("passkey-register", class extends Stimulus.Controller {
+        static get targets() {
+            return ["form", "clientData", "attestation"]
+        }
+
+        connect() {
+            if (window.PublicKeyCredential) {
+                this.element.style.display = ""
+            }
+        }
+
+        async register(event) {
+            if (this.attestationTarget.value != "") {
+                return
+            }
+            event.preventDefault()
+            let body = new URLSearchParams(new FormData(this.formTarget))
+            let response = await fetch(appPath("/account/passkeys/options"), { method: "POST", body: body })
+            if (!response.ok) {
+                return
+            }
+            let options = await response.json()
+            options.challenge = fromBase64Url(options.challenge)
+            options.user.id = fromBase64Url(options.user.id)
+            for (let credential of options.excludeCredentials) {
+                credential.id = fromBase64Url(credential.id)
+            }
+            let credential
+            try {
+                credential = await navigator.credentials.create({ publicKey: options })
+            } catch (error) {
+                // the user cancelled, or already has a passkey on this authenticator
+                return
+            }
+            this.clientDataTarget.value = toBase64Url(credential.response.clientDataJSON)
+            this.attestationTarget.value = toBase64Url(credential.response.attestationObject)
+            this.formTarget.requestSubmit()
+        }
+    })
+
+    application.register("passkey-login", class extends Stimulus.Controller {
+        static get targets() {
+            return ["credentialId", "clientData", "authenticatorData", "signature", "userHandle"]
+        }
+
+        connect() {
+            if (window.PublicKeyCredential) {
+                this.element.style.display = ""
+            }
+        }
+
+        async login(event) {
+            if (this.signatureTarget.value != "") {
+                return
+            }
+            event.preventDefault()
+            let response = await fetch(appPath("/login/passkey/options"))
+            if (!response.ok) {
+                return
+            }
+            let options = await response.json()
+            options.challenge = fromBase64Url(options.challenge)
+            let credential
+            try {
+                credential = await navigator.credentials.get({ publicKey: options })
+            } catch (error) {
+                return
+            }
+            this.credentialIdTarget.value = toBase64Url(credential.rawId)
+            this.clientDataTarget.value = toBase64Url(credential.response.clientDataJSON)
+            this.authenticatorDataTarget.value = toBase64Url(credential.response.authenticatorData)
+            this.signatureTarget.value = toBase64Url(credential.response.signature)
+            if (credential.response.userHandle) {
+                this.userHandleTarget.value = toBase64Url(credential.response.userHandle)
+            }
+            this.element.requestSubmit()
+        }
+    })
+
     application.register("tag", class extends Stimulus.Controller {
         static get targets() {
             return ["self"]
@@ -114,6 +228,8 @@ import * as Stimulus from "./stimulus.js";
 javascript:(() => {
 let auth = "${this.keyTarget.value}";
 let params = "?auth=" + encodeURIComponent(auth);
+let highlight = window.getSelection().toString();
+if (highlight != "") { params += "&highlight=" + encodeURIComponent(highlight); }
 let name = window.prompt("Name", document.title);
 if (name == null) { return; }
 params += "&name=" + encodeURIComponent(name);
@@ -127,7 +243,7 @@ while (true) {
 let tag = window.prompt("Add tag?", "");
 if (tag == null || tag == "") { break; }
 params += "&tag=" + encodeURIComponent(tag);}
-let newTabUrl = "https://${window.location.hostname}${port}/_bookmarklet" + params;
+let newTabUrl = "https://${window.location.hostname}${port}${appPath("/_bookmarklet")}" + params;
 let newTab = window.open(newTabUrl, "_blank");
 newTab.focus();})()`
             textElement.select()
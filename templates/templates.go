@@ -5,23 +5,34 @@ import (
 	"html/template"
 	"io/fs"
 	"local/bookmarks/datastore"
+	"local/bookmarks/markdown"
 	"local/bookmarks/urlparams"
 )
 
 const CsrfTokenName = "csrf-token"
 
 type Templates struct {
-	Login        *template.Template
-	ApiKeys      *template.Template
-	Export       *template.Template
-	Tags         *template.Template
-	Index        *template.Template
-	EditBookmark *template.Template
-	ViewBookmark *template.Template
+	Login         *template.Template
+	ApiKeys       *template.Template
+	Export        *template.Template
+	Tags          *template.Template
+	Index         *template.Template
+	EditBookmark  *template.Template
+	ViewBookmark  *template.Template
+	Dashboard     *template.Template
+	Rediscover    *template.Template
+	Account       *template.Template
+	LoginTotp     *template.Template
+	Sessions      *template.Template
+	Password      *template.Template
+	AdminUsers    *template.Template
+	Register      *template.Template
+	ResetPassword *template.Template
 }
 
-// Initializes a new template with all the functions we make available to templates
-func functions() *template.Template {
+// Initializes a new template with all the functions we make available to templates.
+// Links go through path, which puts them under the base path the app is served from.
+func functions(basePath string) *template.Template {
 	return template.New("").
 		Funcs(template.FuncMap{
 			"bookmarkAndParams": bookmarkAndParams,
@@ -33,36 +44,61 @@ func functions() *template.Template {
 			"paramAddTag":       urlparams.AddTag,
 			"paramQueryString":  urlparams.SearchParams.QueryString,
 			"csrfField":         csrfField,
+			"markdown":          markdown.Render,
+			"path": func(path string) string {
+				return basePath + path
+			},
 		})
 }
 
-func CreateTemplates(templateFS fs.FS) Templates {
-	login := template.Must(functions().ParseFS(templateFS, "pages/base.html", "pages/login.html"))
-	apiKeys := template.Must(functions().ParseFS(templateFS, "pages/base.html", "pages/keys.html"))
-	export := template.Must(functions().ParseFS(templateFS, "pages/base.html", "pages/export.html"))
-	index := template.Must(functions().ParseFS(templateFS, "pages/base.html", "pages/index.html"))
-	tags := template.Must(functions().ParseFS(templateFS, "pages/base.html", "pages/tags.html"))
-	edit := template.Must(functions().ParseFS(templateFS, "pages/base.html", "pages/edit.html"))
-	view := template.Must(functions().ParseFS(templateFS, "pages/base.html", "pages/view.html"))
+// basePath is a path like /bookmarks-app that the app is served under, or "" if it's served from the root
+func CreateTemplates(templateFS fs.FS, basePath string) Templates {
+	login := template.Must(functions(basePath).ParseFS(templateFS, "pages/base.html", "pages/login.html"))
+	apiKeys := template.Must(functions(basePath).ParseFS(templateFS, "pages/base.html", "pages/keys.html"))
+	export := template.Must(functions(basePath).ParseFS(templateFS, "pages/base.html", "pages/export.html"))
+	index := template.Must(functions(basePath).ParseFS(templateFS, "pages/base.html", "pages/index.html"))
+	tags := template.Must(functions(basePath).ParseFS(templateFS, "pages/base.html", "pages/tags.html"))
+	edit := template.Must(functions(basePath).ParseFS(templateFS, "pages/base.html", "pages/edit.html"))
+	view := template.Must(functions(basePath).ParseFS(templateFS, "pages/base.html", "pages/view.html"))
+	dashboard := template.Must(functions(basePath).ParseFS(templateFS, "pages/base.html", "pages/dashboard.html"))
+	rediscover := template.Must(functions(basePath).ParseFS(templateFS, "pages/base.html", "pages/rediscover.html"))
+	account := template.Must(functions(basePath).ParseFS(templateFS, "pages/base.html", "pages/account.html"))
+	loginTotp := template.Must(functions(basePath).ParseFS(templateFS, "pages/base.html", "pages/login_2fa.html"))
+	sessions := template.Must(functions(basePath).ParseFS(templateFS, "pages/base.html", "pages/sessions.html"))
+	password := template.Must(functions(basePath).ParseFS(templateFS, "pages/base.html", "pages/password.html"))
+	adminUsers := template.Must(functions(basePath).ParseFS(templateFS, "pages/base.html", "pages/admin_users.html"))
+	register := template.Must(functions(basePath).ParseFS(templateFS, "pages/base.html", "pages/register.html"))
+	resetPassword := template.Must(functions(basePath).ParseFS(templateFS, "pages/base.html", "pages/reset.html"))
 	return Templates{
-		Login:        login,
-		ApiKeys:      apiKeys,
-		Export:       export,
-		Index:        index,
-		Tags:         tags,
-		EditBookmark: edit,
-		ViewBookmark: view,
+		Login:         login,
+		ApiKeys:       apiKeys,
+		Export:        export,
+		Index:         index,
+		Tags:          tags,
+		EditBookmark:  edit,
+		ViewBookmark:  view,
+		Dashboard:     dashboard,
+		Rediscover:    rediscover,
+		Account:       account,
+		LoginTotp:     loginTotp,
+		Sessions:      sessions,
+		Password:      password,
+		AdminUsers:    adminUsers,
+		Register:      register,
+		ResetPassword: resetPassword,
 	}
 }
 
 type bookmarkAndParamsData struct {
 	Bookmark     datastore.Bookmark
 	SearchParams urlparams.SearchParams
+	CsrfToken    string
+	Expanded     bool
 }
 
-// Bundles a bookmark together with search parameters, as an argument to use in a template
-func bookmarkAndParams(bookmark datastore.Bookmark, params urlparams.SearchParams) bookmarkAndParamsData {
-	return bookmarkAndParamsData{bookmark, params}
+// Bundles a bookmark together with search parameters and the csrf token, as an argument to use in a template
+func bookmarkAndParams(bookmark datastore.Bookmark, params urlparams.SearchParams, csrfToken string) bookmarkAndParamsData {
+	return bookmarkAndParamsData{bookmark, params, csrfToken, false}
 }
 
 func emptyBookmark() datastore.Bookmark {
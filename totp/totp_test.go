@@ -0,0 +1,87 @@
+package totp
+
+import (
+	"testing"
+	"time"
+)
+
+// The SHA1 test vectors from RFC 6238 Appendix B. They're 8 digits long, and a 6 digit code is their last 6 digits.
+var rfcVectors = []struct {
+	unix int64
+	code string
+}{
+	{59, "94287082"},
+	{1111111109, "07081804"},
+	{1111111111, "14050471"},
+	{1234567890, "89005924"},
+	{2000000000, "69279037"},
+	{20000000000, "65353130"},
+}
+
+var rfcKey = []byte("12345678901234567890")
+
+func TestGenerate(t *testing.T) {
+	for _, v := range rfcVectors {
+		got := generate(rfcKey, Step(time.Unix(v.unix, 0)))
+		if want := v.code[2:]; got != want {
+			t.Errorf("at %d: got %s, want %s", v.unix, got, want)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret := encoding.EncodeToString(rfcKey)
+	for _, v := range rfcVectors {
+		at := time.Unix(v.unix, 0)
+		step, valid, err := Validate(secret, v.code[2:], at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !valid || step != Step(at) {
+			t.Errorf("at %d: got valid %v, step %d; want step %d", v.unix, valid, step, Step(at))
+		}
+	}
+}
+
+func TestValidateAllowsOneStepOfDrift(t *testing.T) {
+	secret := encoding.EncodeToString(rfcKey)
+	at := time.Unix(1111111111, 0)
+	code := generate(rfcKey, Step(at))
+	for _, drift := range []time.Duration{-step, step} {
+		if _, valid, _ := Validate(secret, code, at.Add(drift)); !valid {
+			t.Errorf("code wasn't accepted %s away", drift)
+		}
+	}
+	for _, drift := range []time.Duration{-2 * step, 2 * step} {
+		if _, valid, _ := Validate(secret, code, at.Add(drift)); valid {
+			t.Errorf("code was accepted %s away", drift)
+		}
+	}
+}
+
+func TestValidateRejects(t *testing.T) {
+	secret := encoding.EncodeToString(rfcKey)
+	at := time.Unix(59, 0)
+	for _, code := range []string{"", "28708", "2870820", "94287082", "287083", "abcdef"} {
+		if _, valid, _ := Validate(secret, code, at); valid {
+			t.Errorf("%q was accepted", code)
+		}
+	}
+	if _, _, err := Validate("not base32!", "287082", at); err == nil {
+		t.Error("a bad secret wasn't an error")
+	}
+}
+
+func TestValidateIgnoresCaseAndSpace(t *testing.T) {
+	secret := "gezdgnbvgy3tqojqgezdgnbvgy3tqojq"
+	if _, valid, err := Validate(secret, " 287082 ", time.Unix(59, 0)); err != nil || !valid {
+		t.Errorf("got valid %v, err %v", valid, err)
+	}
+}
+
+func TestCode(t *testing.T) {
+	code, err := Code(encoding.EncodeToString(rfcKey), time.Unix(1234567890, 0))
+	if err != nil || code != "005924" {
+		t.Errorf("got %q, %v", code, err)
+	}
+}
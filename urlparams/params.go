@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"html/template"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 )
@@ -93,28 +94,57 @@ func DefaultUrlParams() SearchParams {
 
 // Read query parameters out of request URL
 func GetQueryParams(req *http.Request) (SearchParams, error) {
-	params := DefaultUrlParams()
-
 	err := req.ParseForm()
 	if err != nil {
 		return SearchParams{}, fmt.Errorf("parsing request params: %w", err)
 	}
-	pageString := req.Form.Get("page")
+	return fromValues(req.Form)
+}
+
+// Read search parameters out of a query string produced by Encode
+func ParseQuery(query string) (SearchParams, error) {
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return SearchParams{}, fmt.Errorf("parsing query: %w", err)
+	}
+	return fromValues(values)
+}
+
+// Encode the search, order and tags (but not the page) as a url-encoded query string
+func (p SearchParams) Encode() string {
+	values := url.Values{}
+	if p.Order != NormalOrder {
+		values.Set("order", p.Order)
+	}
+	if p.Search != "" {
+		values.Set("search", p.Search)
+	}
+	for _, tag := range p.SearchTags {
+		values.Add("searchTag", tag)
+	}
+	return values.Encode()
+}
+
+func fromValues(form url.Values) (SearchParams, error) {
+	params := DefaultUrlParams()
+
+	var err error
+	pageString := form.Get("page")
 	if pageString != "" {
 		params.Page, err = strconv.Atoi(pageString)
 		if err != nil || params.Page < 1 {
 			return SearchParams{}, fmt.Errorf("parsing page: %w", err)
 		}
 	}
-	order := req.Form.Get("order")
+	order := form.Get("order")
 	if order != "" {
 		if order != NormalOrder && order != ReverseOrder {
 			return SearchParams{}, fmt.Errorf("invalid order %s", order)
 		}
 		params.Order = order
 	}
-	params.Search = req.Form.Get("search")
-	params.SearchTags = make([]string, 0, len(req.Form["searchTag"]))
-	params.SearchTags = append(params.SearchTags, req.Form["searchTag"]...)
+	params.Search = form.Get("search")
+	params.SearchTags = make([]string, 0, len(form["searchTag"]))
+	params.SearchTags = append(params.SearchTags, form["searchTag"]...)
 	return params, nil
 }
@@ -0,0 +1,40 @@
+package urlparams
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestEncodeRoundTrip(t *testing.T) {
+	tests := []SearchParams{
+		DefaultUrlParams(),
+		{Page: 1, Order: ReverseOrder, Search: "a&b=c", SearchTags: []string{"go", "two words"}},
+		{Page: 1, Order: NormalOrder, Search: "", SearchTags: []string{"ünïcode"}},
+	}
+	for _, params := range tests {
+		parsed, err := ParseQuery(params.Encode())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(parsed, params) {
+			t.Errorf("%q came back as %+v, want %+v", params.Encode(), parsed, params)
+		}
+	}
+}
+
+func TestEncodeLeavesOutThePage(t *testing.T) {
+	params := DefaultUrlParams()
+	params.Page = 3
+	params.Search = "go"
+	if got := params.Encode(); got != "search=go" {
+		t.Errorf("got %q", got)
+	}
+}
+
+func TestParseQueryRejects(t *testing.T) {
+	for _, query := range []string{"order=sideways", "page=0", "page=two", "search=%zz"} {
+		if _, err := ParseQuery(query); err == nil {
+			t.Errorf("%q was accepted", query)
+		}
+	}
+}
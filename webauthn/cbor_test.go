@@ -0,0 +1,99 @@
+package webauthn
+
+import (
+	"bytes"
+	"encoding/hex"
+	"reflect"
+	"testing"
+)
+
+func TestDecodeCbor(t *testing.T) {
+	// examples from RFC 8949 Appendix A
+	tests := []struct {
+		hex  string
+		want interface{}
+	}{
+		{"00", int64(0)},
+		{"17", int64(23)},
+		{"1818", int64(24)},
+		{"1903e8", int64(1000)},
+		{"1a000f4240", int64(1000000)},
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"20", int64(-1)},
+		{"3903e7", int64(-1000)},
+		{"f4", false},
+		{"f5", true},
+		{"f6", nil},
+		{"fa47c35000", float64(100000)},
+		{"fb3ff199999999999a", 1.1},
+		{"40", []byte(nil)},
+		{"4401020304", []byte{1, 2, 3, 4}},
+		{"60", ""},
+		{"6449455446", "IETF"},
+		{"62c3bc", "ü"},
+		{"80", []interface{}{}},
+		{"83010203", []interface{}{int64(1), int64(2), int64(3)}},
+		{"8301820203820405", []interface{}{int64(1), []interface{}{int64(2), int64(3)}, []interface{}{int64(4), int64(5)}}},
+		{"a0", map[interface{}]interface{}{}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"a26161016162820203", map[interface{}]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		// tags are skipped
+		{"c11a514b67b0", int64(1363896240)},
+	}
+	for _, test := range tests {
+		data, _ := hex.DecodeString(test.hex)
+		got, rest, err := decodeCbor(data)
+		if err != nil {
+			t.Errorf("%s: %s", test.hex, err)
+			continue
+		}
+		if len(rest) != 0 {
+			t.Errorf("%s: %d bytes left over", test.hex, len(rest))
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %#v, want %#v", test.hex, got, test.want)
+		}
+	}
+}
+
+func TestDecodeCborReturnsTheRest(t *testing.T) {
+	got, rest, err := decodeCbor([]byte{0x01, 0x02, 0x03})
+	if err != nil || got != int64(1) || !bytes.Equal(rest, []byte{0x02, 0x03}) {
+		t.Errorf("got %v, %x, %v", got, rest, err)
+	}
+}
+
+func TestDecodeCborErrors(t *testing.T) {
+	tests := map[string]string{
+		"empty":                     "",
+		"truncated argument":        "19 03",
+		"truncated byte string":     "44 0102",
+		"truncated text string":     "64 4945",
+		"truncated array":           "83 0102",
+		"truncated map":             "a2 0102 03",
+		"array longer than data":    "9b ffffffffffffffff",
+		"integer too large":         "1b ffffffffffffffff",
+		"negative too large":        "3b ffffffffffffffff",
+		"indefinite length":         "5f 41 01 ff",
+		"byte string map key":       "a1 4101 01",
+		"array map key":             "a1 80 01",
+		"unsupported simple value":  "f0",
+		"truncated float":           "fa 4700",
+		"nested too deeply":         "818181818181818181818181818181818181 00",
+		"map value is truncated":    "a1 01",
+		"truncated 8 byte argument": "1b 0000",
+	}
+	for name, h := range tests {
+		data, err := hex.DecodeString(removeSpaces(h))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if _, _, err := decodeCbor(data); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func removeSpaces(s string) string {
+	return string(bytes.ReplaceAll([]byte(s), []byte(" "), nil))
+}
@@ -0,0 +1,83 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// COSE (RFC 8152) key parameters
+const (
+	coseKeyType    = 1
+	coseAlgorithm  = 3
+	coseEc2Curve   = -1
+	coseEc2X       = -2
+	coseEc2Y       = -3
+	coseRsaN       = -1
+	coseRsaE       = -2
+	coseKeyTypeEc2 = 2
+	coseKeyTypeRsa = 3
+	coseCurveP256  = 1
+)
+
+// The algorithms we ask authenticators for, in order of preference
+const (
+	AlgorithmES256 = -7
+	AlgorithmRS256 = -257
+)
+
+// Checks a signature made with a COSE-encoded public key
+func verifySignature(coseKey, signed, signature []byte) error {
+	decoded, _, err := decodeCbor(coseKey)
+	if err != nil {
+		return fmt.Errorf("decoding public key: %w", err)
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return errors.New("public key is not a map")
+	}
+	hash := sha256.Sum256(signed)
+
+	switch coseInt(key, coseAlgorithm) {
+	case AlgorithmES256:
+		if coseInt(key, coseKeyType) != coseKeyTypeEc2 || coseInt(key, coseEc2Curve) != coseCurveP256 {
+			return errors.New("unsupported elliptic curve key")
+		}
+		x, xOk := key[int64(coseEc2X)].([]byte)
+		y, yOk := key[int64(coseEc2Y)].([]byte)
+		if !xOk || !yOk {
+			return errors.New("malformed elliptic curve key")
+		}
+		publicKey := ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return errors.New("public key is not on the curve")
+		}
+		if !ecdsa.VerifyASN1(&publicKey, hash[:], signature) {
+			return errors.New("bad signature")
+		}
+		return nil
+	case AlgorithmRS256:
+		if coseInt(key, coseKeyType) != coseKeyTypeRsa {
+			return errors.New("unsupported rsa key")
+		}
+		n, nOk := key[int64(coseRsaN)].([]byte)
+		e, eOk := key[int64(coseRsaE)].([]byte)
+		if !nOk || !eOk || len(e) > 4 {
+			return errors.New("malformed rsa key")
+		}
+		publicKey := rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		return rsa.VerifyPKCS1v15(&publicKey, crypto.SHA256, hash[:], signature)
+	}
+	return errors.New("unsupported algorithm")
+}
+
+// Reads an integer out of a COSE key, or 0 if it isn't there
+func coseInt(key map[interface{}]interface{}, label int64) int64 {
+	value, _ := key[label].(int64)
+	return value
+}
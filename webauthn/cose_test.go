@@ -0,0 +1,83 @@
+package webauthn
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"local/bookmarks/webauthn/webauthntest"
+	"testing"
+)
+
+func TestVerifySignatureEs256(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := []byte("signed data")
+	hash := sha256.Sum256(signed)
+	signature, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	coseKey := webauthntest.CoseEc2Key(&key.PublicKey)
+	if err := verifySignature(coseKey, signed, signature); err != nil {
+		t.Errorf("good signature: %s", err)
+	}
+	if err := verifySignature(coseKey, []byte("other data"), signature); err == nil {
+		t.Error("signature over other data was accepted")
+	}
+	other, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err := verifySignature(webauthntest.CoseEc2Key(&other.PublicKey), signed, signature); err == nil {
+		t.Error("signature was accepted with another key")
+	}
+}
+
+func TestVerifySignatureRs256(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := []byte("signed data")
+	hash := sha256.Sum256(signed)
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hash[:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	coseKey := webauthntest.CoseRsaKey(&key.PublicKey)
+	if err := verifySignature(coseKey, signed, signature); err != nil {
+		t.Errorf("good signature: %s", err)
+	}
+	signature[0] ^= 0xff
+	if err := verifySignature(coseKey, signed, signature); err == nil {
+		t.Error("bad signature was accepted")
+	}
+}
+
+func TestVerifySignatureRejectsBadKeys(t *testing.T) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	x := key.X.FillBytes(make([]byte, 32))
+	y := key.Y.FillBytes(make([]byte, 32))
+	offCurve := append([]byte(nil), y...)
+	offCurve[31] ^= 1
+	tests := map[string]interface{}{
+		"not a map":         []interface{}{1, 2},
+		"no algorithm":      map[interface{}]interface{}{1: 2, -1: 1, -2: x, -3: y},
+		"unknown algorithm": map[interface{}]interface{}{1: 2, 3: -8, -1: 1, -2: x, -3: y},
+		"wrong key type":    map[interface{}]interface{}{1: 3, 3: -7, -1: 1, -2: x, -3: y},
+		"wrong curve":       map[interface{}]interface{}{1: 2, 3: -7, -1: 2, -2: x, -3: y},
+		"missing y":         map[interface{}]interface{}{1: 2, 3: -7, -1: 1, -2: x},
+		"not on the curve":  map[interface{}]interface{}{1: 2, 3: -7, -1: 1, -2: x, -3: offCurve},
+		"huge rsa exponent": map[interface{}]interface{}{1: 3, 3: -257, -1: x, -2: []byte{1, 0, 0, 0, 1}},
+	}
+	for name, coseKey := range tests {
+		if err := verifySignature(webauthntest.EncodeCbor(coseKey), []byte("data"), []byte("signature")); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+	if err := verifySignature([]byte{0xa1}, []byte("data"), []byte("signature")); err == nil {
+		t.Error("truncated key: no error")
+	}
+}
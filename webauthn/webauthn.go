@@ -0,0 +1,225 @@
+// The server side of WebAuthn (https://www.w3.org/TR/webauthn-2/) registration and authentication ceremonies,
+// for logging in with passkeys and security keys. Attestation statements aren't checked, since we don't care
+// which make of authenticator someone uses, only that they keep using the same one.
+package webauthn
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const challengeSize = 32
+
+// Authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+// Browsers send binary values as unpadded base64url
+var Encoding = base64.RawURLEncoding
+
+// Describes the site that credentials are scoped to.
+// Id is the domain name, and Origin is the scheme, host and port that the browser must report.
+type RelyingParty struct {
+	Id     string
+	Origin string
+}
+
+// A newly registered credential
+type Credential struct {
+	Id []byte
+	// The COSE-encoded public key, which is passed back to VerifyAssertion
+	PublicKey    []byte
+	SignCount    uint32
+	UserVerified bool
+}
+
+// The result of a successful login
+type Assertion struct {
+	SignCount    uint32
+	UserVerified bool
+}
+
+type clientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type authenticatorData struct {
+	rpIdHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialId []byte
+	publicKey    []byte
+}
+
+// Generates a random challenge, encoded the way it comes back in the client data
+func NewChallenge() (string, error) {
+	challenge := make([]byte, challengeSize)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return "", fmt.Errorf("generating challenge: %w", err)
+	}
+	return Encoding.EncodeToString(challenge), nil
+}
+
+// Reads the challenge out of the client data, so that the caller can look it up
+// before verifying the rest of the response
+func Challenge(clientDataJson []byte) (string, error) {
+	var data clientData
+	err := json.Unmarshal(clientDataJson, &data)
+	if err != nil {
+		return "", fmt.Errorf("parsing client data: %w", err)
+	}
+	return data.Challenge, nil
+}
+
+func (rp RelyingParty) checkClientData(clientDataJson []byte, ceremony, challenge string) error {
+	var data clientData
+	err := json.Unmarshal(clientDataJson, &data)
+	if err != nil {
+		return fmt.Errorf("parsing client data: %w", err)
+	}
+	if data.Type != ceremony {
+		return fmt.Errorf("wrong ceremony type %q", data.Type)
+	}
+	if data.Challenge != challenge {
+		return errors.New("wrong challenge")
+	}
+	if data.Origin != rp.Origin {
+		return fmt.Errorf("wrong origin %q", data.Origin)
+	}
+	return nil
+}
+
+func (rp RelyingParty) checkAuthenticatorData(data authenticatorData) error {
+	rpIdHash := sha256.Sum256([]byte(rp.Id))
+	if !bytes.Equal(data.rpIdHash, rpIdHash[:]) {
+		return errors.New("wrong relying party id")
+	}
+	if data.flags&flagUserPresent == 0 {
+		return errors.New("user wasn't present")
+	}
+	return nil
+}
+
+// Checks the response to navigator.credentials.create() and returns the new credential
+func (rp RelyingParty) VerifyRegistration(clientDataJson, attestationObject []byte, challenge string) (Credential, error) {
+	err := rp.checkClientData(clientDataJson, "webauthn.create", challenge)
+	if err != nil {
+		return Credential{}, err
+	}
+
+	decoded, _, err := decodeCbor(attestationObject)
+	if err != nil {
+		return Credential{}, fmt.Errorf("decoding attestation object: %w", err)
+	}
+	attestation, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return Credential{}, errors.New("attestation object is not a map")
+	}
+	rawAuthData, ok := attestation["authData"].([]byte)
+	if !ok {
+		return Credential{}, errors.New("attestation object has no authenticator data")
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return Credential{}, err
+	}
+	err = rp.checkAuthenticatorData(authData)
+	if err != nil {
+		return Credential{}, err
+	}
+	if authData.credentialId == nil {
+		return Credential{}, errors.New("no credential in authenticator data")
+	}
+
+	// make sure we'll be able to check signatures from this key later
+	decoded, _, err = decodeCbor(authData.publicKey)
+	if err != nil {
+		return Credential{}, fmt.Errorf("decoding public key: %w", err)
+	}
+	key, ok := decoded.(map[interface{}]interface{})
+	if !ok {
+		return Credential{}, errors.New("public key is not a map")
+	}
+	if alg := coseInt(key, coseAlgorithm); alg != AlgorithmES256 && alg != AlgorithmRS256 {
+		return Credential{}, fmt.Errorf("unsupported algorithm %d", alg)
+	}
+
+	return Credential{
+		Id:           authData.credentialId,
+		PublicKey:    authData.publicKey,
+		SignCount:    authData.signCount,
+		UserVerified: authData.flags&flagUserVerified != 0,
+	}, nil
+}
+
+// Checks the response to navigator.credentials.get() against the public key that was registered
+func (rp RelyingParty) VerifyAssertion(clientDataJson, rawAuthData, signature []byte, challenge string, publicKey []byte) (Assertion, error) {
+	err := rp.checkClientData(clientDataJson, "webauthn.get", challenge)
+	if err != nil {
+		return Assertion{}, err
+	}
+	authData, err := parseAuthenticatorData(rawAuthData)
+	if err != nil {
+		return Assertion{}, err
+	}
+	err = rp.checkAuthenticatorData(authData)
+	if err != nil {
+		return Assertion{}, err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJson)
+	signed := append(append([]byte(nil), rawAuthData...), clientDataHash[:]...)
+	err = verifySignature(publicKey, signed, signature)
+	if err != nil {
+		return Assertion{}, fmt.Errorf("checking signature: %w", err)
+	}
+	return Assertion{
+		SignCount:    authData.signCount,
+		UserVerified: authData.flags&flagUserVerified != 0,
+	}, nil
+}
+
+func parseAuthenticatorData(data []byte) (authenticatorData, error) {
+	if len(data) < 37 {
+		return authenticatorData{}, errors.New("authenticator data is too short")
+	}
+	parsed := authenticatorData{
+		rpIdHash:  data[:32],
+		flags:     data[32],
+		signCount: binary.BigEndian.Uint32(data[33:37]),
+	}
+	if parsed.flags&flagAttestedData == 0 {
+		return parsed, nil
+	}
+
+	// the aaguid, then the length of the credential id, the id, and the public key
+	rest := data[37:]
+	if len(rest) < 18 {
+		return authenticatorData{}, errors.New("attested credential data is too short")
+	}
+	idLength := int(binary.BigEndian.Uint16(rest[16:18]))
+	rest = rest[18:]
+	if len(rest) < idLength {
+		return authenticatorData{}, errors.New("credential id is truncated")
+	}
+	parsed.credentialId = rest[:idLength]
+	rest = rest[idLength:]
+	_, after, err := decodeCbor(rest)
+	if err != nil {
+		return authenticatorData{}, fmt.Errorf("decoding public key: %w", err)
+	}
+	parsed.publicKey = rest[:len(rest)-len(after)]
+	return parsed, nil
+}
@@ -0,0 +1,113 @@
+package webauthn
+
+import (
+	"local/bookmarks/webauthn/webauthntest"
+	"strings"
+	"testing"
+)
+
+var testRp = RelyingParty{Id: "bookmarks.example.com", Origin: "https://bookmarks.example.com"}
+
+func newTestAuthenticator(t *testing.T) *webauthntest.Authenticator {
+	t.Helper()
+	a, err := webauthntest.New(testRp.Id, testRp.Origin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+// Registers a new authenticator with testRp, and returns it with its credential
+func register(t *testing.T) (*webauthntest.Authenticator, Credential) {
+	t.Helper()
+	a := newTestAuthenticator(t)
+	clientData, attestation := a.Create("registration-challenge")
+	credential, err := testRp.VerifyRegistration(clientData, attestation, "registration-challenge")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a, credential
+}
+
+func TestRegisterAndLogIn(t *testing.T) {
+	a, credential := register(t)
+	if string(credential.Id) != string(a.CredentialId) || credential.SignCount != 1 || !credential.UserVerified {
+		t.Errorf("got credential %+v", credential)
+	}
+
+	clientData, authData, signature := a.Get("login-challenge")
+	assertion, err := testRp.VerifyAssertion(clientData, authData, signature, "login-challenge", credential.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if assertion.SignCount != 2 || !assertion.UserVerified {
+		t.Errorf("got assertion %+v", assertion)
+	}
+
+	challenge, err := Challenge(clientData)
+	if err != nil || challenge != "login-challenge" {
+		t.Errorf("got challenge %q, %v", challenge, err)
+	}
+}
+
+func TestVerifyRegistrationRejects(t *testing.T) {
+	tests := map[string]func(a *webauthntest.Authenticator) (clientData, attestation []byte, challenge string){
+		"wrong challenge": func(a *webauthntest.Authenticator) ([]byte, []byte, string) {
+			clientData, attestation := a.Create("challenge")
+			return clientData, attestation, "another challenge"
+		},
+		"wrong origin": func(a *webauthntest.Authenticator) ([]byte, []byte, string) {
+			a.Origin = "https://evil.example.com"
+			clientData, attestation := a.Create("challenge")
+			return clientData, attestation, "challenge"
+		},
+		"wrong relying party": func(a *webauthntest.Authenticator) ([]byte, []byte, string) {
+			a.RpId = "evil.example.com"
+			clientData, attestation := a.Create("challenge")
+			return clientData, attestation, "challenge"
+		},
+		"login response": func(a *webauthntest.Authenticator) ([]byte, []byte, string) {
+			clientData, _, _ := a.Get("challenge")
+			_, attestation := a.Create("challenge")
+			return clientData, attestation, "challenge"
+		},
+		"truncated attestation": func(a *webauthntest.Authenticator) ([]byte, []byte, string) {
+			clientData, attestation := a.Create("challenge")
+			return clientData, attestation[:len(attestation)-10], "challenge"
+		},
+	}
+	for name, test := range tests {
+		clientData, attestation, challenge := test(newTestAuthenticator(t))
+		if _, err := testRp.VerifyRegistration(clientData, attestation, challenge); err == nil {
+			t.Errorf("%s: no error", name)
+		}
+	}
+}
+
+func TestVerifyAssertionRejects(t *testing.T) {
+	a, credential := register(t)
+	_, otherCredential := register(t)
+
+	clientData, authData, signature := a.Get("challenge")
+	if _, err := testRp.VerifyAssertion(clientData, authData, signature, "another challenge", credential.PublicKey); err == nil {
+		t.Error("wrong challenge: no error")
+	}
+	if _, err := testRp.VerifyAssertion(clientData, authData, signature, "challenge", otherCredential.PublicKey); err == nil {
+		t.Error("someone else's key: no error")
+	}
+	tampered := append([]byte(nil), authData...)
+	tampered[len(tampered)-1] += 1
+	if _, err := testRp.VerifyAssertion(clientData, tampered, signature, "challenge", credential.PublicKey); err == nil {
+		t.Error("tampered sign count: no error")
+	}
+	if _, err := testRp.VerifyAssertion(clientData, authData[:36], signature, "challenge", credential.PublicKey); err == nil {
+		t.Error("short authenticator data: no error")
+	}
+
+	a.Origin = "https://evil.example.com"
+	clientData, authData, signature = a.Get("challenge")
+	_, err := testRp.VerifyAssertion(clientData, authData, signature, "challenge", credential.PublicKey)
+	if err == nil || !strings.Contains(err.Error(), "origin") {
+		t.Errorf("wrong origin: got %v", err)
+	}
+}
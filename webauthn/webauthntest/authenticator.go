@@ -0,0 +1,180 @@
+// A software authenticator that makes the responses a browser would send for
+// navigator.credentials.create() and get(), for testing the server side of passkeys.
+package webauthntest
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"sort"
+)
+
+// Authenticator data flags
+const (
+	flagUserPresent  = 0x01
+	flagUserVerified = 0x04
+	flagAttestedData = 0x40
+)
+
+// Holds one ES256 passkey
+type Authenticator struct {
+	// The origin the browser reports in the client data
+	Origin string
+	// Sent as the relying party id hash, so it can be changed to pretend to be another site
+	RpId         string
+	CredentialId []byte
+	// Counts up with every signature, unless it's set back to 0 for authenticators that don't count
+	SignCount    uint32
+	UserVerified bool
+	key          *ecdsa.PrivateKey
+}
+
+func New(rpId, origin string) (*Authenticator, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, fmt.Errorf("generating key: %w", err)
+	}
+	id := make([]byte, 16)
+	_, err = rand.Read(id)
+	if err != nil {
+		return nil, fmt.Errorf("generating credential id: %w", err)
+	}
+	return &Authenticator{Origin: origin, RpId: rpId, CredentialId: id, SignCount: 1, UserVerified: true, key: key}, nil
+}
+
+// Registers the passkey, returning the client data and attestation object
+func (a *Authenticator) Create(challenge string) ([]byte, []byte) {
+	publicKey := CoseEc2Key(&a.key.PublicKey)
+	attested := make([]byte, 16, 18+len(a.CredentialId)+len(publicKey))
+	attested = append(attested, byte(len(a.CredentialId)>>8), byte(len(a.CredentialId)))
+	attested = append(attested, a.CredentialId...)
+	attested = append(attested, publicKey...)
+	authData := a.authenticatorData(flagAttestedData, attested)
+	attestation := EncodeCbor(map[interface{}]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[interface{}]interface{}{},
+		"authData": authData,
+	})
+	return a.clientData("webauthn.create", challenge), attestation
+}
+
+// Logs in with the passkey, returning the client data, authenticator data and signature
+func (a *Authenticator) Get(challenge string) ([]byte, []byte, []byte) {
+	if a.SignCount != 0 {
+		a.SignCount += 1
+	}
+	clientData := a.clientData("webauthn.get", challenge)
+	authData := a.authenticatorData(0, nil)
+	clientDataHash := sha256.Sum256(clientData)
+	hash := sha256.Sum256(append(append([]byte(nil), authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, hash[:])
+	if err != nil {
+		panic(err)
+	}
+	return clientData, authData, signature
+}
+
+func (a *Authenticator) clientData(ceremony, challenge string) []byte {
+	data, _ := json.Marshal(map[string]string{"type": ceremony, "challenge": challenge, "origin": a.Origin})
+	return data
+}
+
+func (a *Authenticator) authenticatorData(flags byte, attested []byte) []byte {
+	flags |= flagUserPresent
+	if a.UserVerified {
+		flags |= flagUserVerified
+	}
+	rpIdHash := sha256.Sum256([]byte(a.RpId))
+	data := append(rpIdHash[:], flags, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(data[33:], a.SignCount)
+	return append(data, attested...)
+}
+
+// The user handle, credential id and so on, encoded the way the browser sends them
+func Encode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// The COSE encoding of an ES256 public key
+func CoseEc2Key(key *ecdsa.PublicKey) []byte {
+	return EncodeCbor(map[interface{}]interface{}{
+		1:  2,
+		3:  -7,
+		-1: 1,
+		-2: key.X.FillBytes(make([]byte, 32)),
+		-3: key.Y.FillBytes(make([]byte, 32)),
+	})
+}
+
+// The COSE encoding of an RS256 public key
+func CoseRsaKey(key *rsa.PublicKey) []byte {
+	return EncodeCbor(map[interface{}]interface{}{
+		1:  3,
+		3:  -257,
+		-1: key.N.Bytes(),
+		-2: big.NewInt(int64(key.E)).Bytes(),
+	})
+}
+
+// Encodes ints, strings, byte strings, bools, slices and maps as CBOR. Map keys are sorted, so the output is always the same.
+func EncodeCbor(value interface{}) []byte {
+	switch v := value.(type) {
+	case int:
+		if v < 0 {
+			return cborHead(1, uint64(-1-v))
+		}
+		return cborHead(0, uint64(v))
+	case []byte:
+		return append(cborHead(2, uint64(len(v))), v...)
+	case string:
+		return append(cborHead(3, uint64(len(v))), v...)
+	case bool:
+		if v {
+			return []byte{0xf5}
+		}
+		return []byte{0xf4}
+	case []interface{}:
+		data := cborHead(4, uint64(len(v)))
+		for _, item := range v {
+			data = append(data, EncodeCbor(item)...)
+		}
+		return data
+	case map[interface{}]interface{}:
+		entries := make([][2][]byte, 0, len(v))
+		for key, item := range v {
+			entries = append(entries, [2][]byte{EncodeCbor(key), EncodeCbor(item)})
+		}
+		sort.Slice(entries, func(i, j int) bool { return string(entries[i][0]) < string(entries[j][0]) })
+		data := cborHead(5, uint64(len(v)))
+		for _, entry := range entries {
+			data = append(append(data, entry[0]...), entry[1]...)
+		}
+		return data
+	}
+	panic(fmt.Sprintf("can't encode %T as cbor", value))
+}
+
+func cborHead(major byte, arg uint64) []byte {
+	switch {
+	case arg < 24:
+		return []byte{major<<5 | byte(arg)}
+	case arg <= 0xff:
+		return []byte{major<<5 | 24, byte(arg)}
+	case arg <= 0xffff:
+		return []byte{major<<5 | 25, byte(arg >> 8), byte(arg)}
+	case arg <= 0xffffffff:
+		data := []byte{major<<5 | 26, 0, 0, 0, 0}
+		binary.BigEndian.PutUint32(data[1:], uint32(arg))
+		return data
+	}
+	data := []byte{major<<5 | 27, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint64(data[1:], arg)
+	return data
+}